@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/discourse/discourse_docker/launcher_go/v2/config"
+	"github.com/discourse/discourse_docker/launcher_go/v2/docker"
+	"github.com/discourse/discourse_docker/launcher_go/v2/utils"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+/*
+ * blue-green rebuilds
+ */
+
+// Starts the rebuilt image next to the running container on a temporary name and port,
+// then points the proxy's upstream at it and retires the old container once the new one is healthy.
+func (r *RebuildCmd) blueGreenSwap(cli *Cli, ctx *context.Context, config *config.Config, extraEnv []string) error {
+	next := r.Config + "_next"
+	// clear out a container left behind by an earlier failed rebuild
+	destroyNext := DestroyCmd{Config: next}
+	if err := destroyNext.Run(cli, ctx); err != nil {
+		return err
+	}
+
+	port, err := freePort()
+	if err != nil {
+		return err
+	}
+	health := r.HealthFlags
+	health.Wait = true
+	start := StartCmd{
+		Config:      r.Config,
+		HealthFlags: health,
+		extraEnv:    extraEnv,
+		name:        next,
+		// the proxy forwards plain http, so it talks to the container's http port whatever the config publishes
+		publish: []string{"127.0.0.1:" + strconv.Itoa(port) + ":80"},
+	}
+	if err := start.Run(cli, ctx); err != nil {
+		// the old container is still serving, so only the new one needs cleaning up
+		fmt.Fprintln(utils.Out, "new container failed to start, leaving "+r.Config+" running")
+		destroyNext.Run(cli, ctx)
+		return err
+	}
+
+	destroy := DestroyCmd{Config: r.Config}
+	upstream := "# generated by launcher2 rebuild --strategy=blue-green\n" +
+		"upstream discourse_" + r.Config + " {\n" +
+		"  server 127.0.0.1:" + strconv.Itoa(port) + ";\n" +
+		"}\n"
+	if err := os.WriteFile(r.UpstreamFile, []byte(upstream), 0644); err != nil {
+		return err
+	}
+	fmt.Fprintln(utils.Out, "pointed "+r.UpstreamFile+" at "+next+" on port "+strconv.Itoa(port))
+	if r.ReloadProxy != "" {
+		cmd := exec.CommandContext(*ctx, "sh", "-c", r.ReloadProxy)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		fmt.Fprintln(utils.Out, cmd)
+		if err := utils.CmdRunner(cmd).Run(); err != nil {
+			return err
+		}
+	}
+	if err := destroy.Run(cli, ctx); err != nil {
+		return err
+	}
+	return docker.RenameContainer(*ctx, next, r.Config)
+}
+
+// The swapped-in container is only published for the proxy, on a local port in place of the http port 80.
+// Other published ports stay bound by the old container while the new one starts, and would be lost after the swap.
+func blueGreenPorts(config *config.Config) error {
+	published := []string{}
+	for _, e := range config.Expose {
+		if _, _, containerPort := splitPublishedPort(e); strings.Contains(e, ":") && containerPort != "80" {
+			published = append(published, e)
+		}
+	}
+	if len(published) > 0 {
+		return errors.New("blue-green rebuilds only publish the http port 80 the proxy forwards to, but " + config.Name + " also publishes " + strings.Join(published, ", ") + ". Remove them from its expose entries, or rebuild with --strategy=restart")
+	}
+	return nil
+}
+
+// Finds a free local port for the new container to listen on while it starts.
+func freePort() (int, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer listener.Close()
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
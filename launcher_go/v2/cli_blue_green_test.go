@@ -0,0 +1,202 @@
+package main_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"bytes"
+	"context"
+	"encoding/json"
+	ddocker "github.com/discourse/discourse_docker/launcher_go/v2"
+	"github.com/discourse/discourse_docker/launcher_go/v2/docker"
+	. "github.com/discourse/discourse_docker/launcher_go/v2/test_utils"
+	"github.com/discourse/discourse_docker/launcher_go/v2/utils"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+var _ = Describe("Blue-green rebuild", func() {
+	var testDir string
+	var cli *ddocker.Cli
+	var ctx context.Context
+	var api *FakeDockerApi
+	var containers map[string]bool
+	var appStatus int
+	var servers []*httptest.Server
+	var nextPort string
+
+	var calls = func() []string {
+		return api.Calls()
+	}
+	var indexOf = func(call string) int {
+		return slices.Index(calls(), call)
+	}
+	var lastIndexOf = func(call string) int {
+		all := calls()
+		for i := len(all) - 1; i >= 0; i-- {
+			if all[i] == call {
+				return i
+			}
+		}
+		return -1
+	}
+
+	BeforeEach(func() {
+		utils.Out = &bytes.Buffer{}
+		utils.CommitWait = 0
+		utils.HealthPollInterval = time.Millisecond
+		ctx = context.Background()
+		testDir, _ = os.MkdirTemp("", "ddocker-test")
+		cli = &ddocker.Cli{ConfDir: "./test/containers", TemplatesDirs: []string{"./test"}, BuildDir: testDir}
+		// behind the proxy, web_only only publishes its http port
+		proxied := testDir + "/proxied.yml"
+		os.WriteFile(proxied, []byte("expose: !replace\n  - \"127.0.0.1:8080:80\"\n  - \"90\"\n"), 0644)
+		cli.Overlays = []string{proxied}
+		api = NewFakeDockerApi()
+		client, _ := docker.NewClient(api.Host())
+		docker.ActiveRuntime = &docker.ApiRuntime{Client: client}
+		appStatus = http.StatusOK
+		servers = []*httptest.Server{}
+		nextPort = ""
+		containers = map[string]bool{"web_only": true}
+
+		// a stateful engine: containers are named by their id, and the new container answers health checks on its published port
+		api.Handle("POST", "/containers/create", func(w http.ResponseWriter, r *http.Request) {
+			name := r.URL.Query().Get("name")
+			if strings.HasPrefix(name, "web_only") {
+				containers[name] = true
+			}
+			config := docker.ContainerConfig{}
+			json.Unmarshal(api.LastRequest("POST", "/containers/create").Body, &config)
+			if name == "web_only_next" {
+				// the new container publishes its http port for the proxy on a local port
+				nextPort = config.HostConfig.PortBindings["80/tcp"][0].HostPort
+				listener, err := net.Listen("tcp", "127.0.0.1:"+nextPort)
+				Expect(err).To(BeNil())
+				server := &httptest.Server{Listener: listener, Config: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(appStatus)
+				})}}
+				server.Start()
+				servers = append(servers, server)
+			}
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"Id":"` + name + `"}`))
+		})
+		api.Handle("GET", "/containers/json", func(w http.ResponseWriter, r *http.Request) {
+			filters := map[string][]string{}
+			json.Unmarshal([]byte(r.URL.Query().Get("filters")), &filters)
+			name := strings.TrimSuffix(strings.TrimPrefix(filters["name"][0], "^/?"), "$")
+			if containers[name] {
+				w.Write([]byte(`[{"Id":"` + name + `"}]`))
+				return
+			}
+			w.Write([]byte(`[]`))
+		})
+		for _, name := range []string{"web_only", "web_only_next"} {
+			name := name
+			api.Handle("GET", "/containers/"+name+"/json", func(w http.ResponseWriter, r *http.Request) {
+				if !containers[name] {
+					w.WriteHeader(http.StatusNotFound)
+					w.Write([]byte(`{"message":"No such container"}`))
+					return
+				}
+				w.Write([]byte(`{"Id":"` + name + `","State":{"Status":"running"}}`))
+			})
+			api.Handle("DELETE", "/containers/"+name, func(w http.ResponseWriter, r *http.Request) {
+				delete(containers, name)
+				w.WriteHeader(http.StatusNoContent)
+			})
+		}
+		api.Handle("POST", "/containers/web_only_next/rename", func(w http.ResponseWriter, r *http.Request) {
+			delete(containers, "web_only_next")
+			containers[r.URL.Query().Get("name")] = true
+			w.WriteHeader(http.StatusNoContent)
+		})
+	})
+	AfterEach(func() {
+		for _, s := range servers {
+			s.Close()
+		}
+		docker.ActiveRuntime = docker.NewDockerRuntime()
+		utils.HealthPollInterval = 2 * time.Second
+		api.Close()
+		os.RemoveAll(testDir)
+	})
+
+	It("swaps an upstream file to the new container, then retires the old one", func() {
+		upstream := testDir + "/upstream.conf"
+		runner := ddocker.RebuildCmd{
+			Config:           "web_only",
+			SkipVersionCheck: true,
+			Strategy:         "blue-green",
+			SkipLint:         true,
+			UpstreamFile:     upstream,
+			HealthFlags:      ddocker.HealthFlags{HealthTimeout: time.Second, HealthPath: "/srv/status"},
+		}
+		Expect(runner.Run(cli, &ctx)).To(Succeed())
+
+		Expect(nextPort).ToNot(BeEmpty())
+		content, _ := os.ReadFile(upstream)
+		Expect(string(content)).To(ContainSubstring("upstream discourse_web_only {\n  server 127.0.0.1:" + nextPort + ";\n}"))
+		Expect(containers).To(Equal(map[string]bool{"web_only": true}))
+
+		// the old container is only removed after the new one is healthy, and then replaced by it
+		Expect(indexOf("GET /containers/web_only_next/json")).To(BeNumerically("<", indexOf("DELETE /containers/web_only")))
+		Expect(indexOf("DELETE /containers/web_only")).To(BeNumerically("<", indexOf("POST /containers/web_only_next/rename")))
+		// post deployment migrations run after the swap
+		Expect(lastIndexOf("POST /containers/create")).To(BeNumerically(">", indexOf("POST /containers/web_only_next/rename")))
+	})
+
+	It("needs an upstream file", func() {
+		runner := ddocker.RebuildCmd{
+			Config:           "web_only",
+			SkipVersionCheck: true,
+			Strategy:         "blue-green",
+			SkipLint:         true,
+		}
+		Expect(runner.Run(cli, &ctx)).To(MatchError("blue-green rebuilds need --upstream-file, to move traffic through a reverse proxy in front of web_only"))
+		Expect(calls()).To(BeEmpty())
+	})
+
+	It("refuses configs publishing ports besides the proxied one", func() {
+		cli.Overlays = nil
+		runner := ddocker.RebuildCmd{
+			Config:           "web_only",
+			SkipVersionCheck: true,
+			Strategy:         "blue-green",
+			SkipLint:         true,
+			UpstreamFile:     testDir + "/upstream.conf",
+		}
+		Expect(runner.Run(cli, &ctx)).To(MatchError(HavePrefix("blue-green rebuilds only publish the http port 80 the proxy forwards to, but web_only also publishes 443:443.")))
+		Expect(calls()).To(BeEmpty())
+	})
+
+	It("leaves the old container running when the new one is unhealthy", func() {
+		appStatus = http.StatusServiceUnavailable
+		runner := ddocker.RebuildCmd{
+			Config:           "web_only",
+			SkipVersionCheck: true,
+			Strategy:         "blue-green",
+			SkipLint:         true,
+			UpstreamFile:     testDir + "/upstream.conf",
+			HealthFlags:      ddocker.HealthFlags{HealthTimeout: 20 * time.Millisecond, HealthPath: "/srv/status"},
+		}
+		err := runner.Run(cli, &ctx)
+		Expect(err).To(MatchError(ContainSubstring("web_only_next did not become healthy")))
+		Expect(containers).To(Equal(map[string]bool{"web_only": true}))
+		Expect(testDir + "/upstream.conf").ToNot(BeAnExistingFile())
+		// no post deployment migrations
+		Expect(api.LastRequest("POST", "/containers/create").Query.Get("name")).To(Equal("web_only_next"))
+	})
+
+	It("needs an external database", func() {
+		runner := ddocker.RebuildCmd{Config: "standalone", SkipVersionCheck: true, Strategy: "blue-green"}
+		Expect(runner.Run(cli, &ctx)).To(MatchError(ContainSubstring("blue-green rebuilds need a config with an external database")))
+		Expect(calls()).To(BeEmpty())
+	})
+})
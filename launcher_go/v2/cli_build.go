@@ -3,11 +3,13 @@ package main
 import (
 	"context"
 	"errors"
+	"fmt"
 	"github.com/discourse/discourse_docker/launcher_go/v2/config"
 	"github.com/discourse/discourse_docker/launcher_go/v2/docker"
 	"github.com/discourse/discourse_docker/launcher_go/v2/utils"
 	"github.com/google/uuid"
 	"os"
+	"slices"
 	"strings"
 )
 
@@ -15,20 +17,63 @@ import (
  * build
  * migrate
  * configure
+ * promote
  * bootstrap
  */
+type BuildCacheFlags struct {
+	Cache    string `help:"Build cache mode: none rebuilds every layer, local reuses the local layer cache, and registry also reads and writes the cache at --cache-ref. Defaults to the config's build_cache, or none."`
+	CacheRef string `name:"cache-ref" help:"Registry repository to keep the build cache in, eg. ghcr.io/example/discourse-cache. Defaults to the config's build_cache_ref."`
+	NoPull   bool   `name:"no-pull" help:"Build from the local base image instead of pulling it first. Also set by the config's no_build_pull."`
+}
+
+// Sets the builder's cache mode and pull setting from the flags, falling back to the config's settings.
+func (f BuildCacheFlags) apply(conf *config.Config, builder *docker.DockerBuilder) error {
+	builder.Cache = firstNonEmpty(f.Cache, conf.Build_Cache, "none")
+	builder.CacheRef = firstNonEmpty(f.CacheRef, conf.Build_Cache_Ref)
+	builder.NoPull = !f.pull(conf)
+	if !slices.Contains(config.BuildCacheModes, builder.Cache) {
+		return errors.New("unknown build cache mode " + builder.Cache + ", must be one of " + strings.Join(config.BuildCacheModes, ", "))
+	}
+	if builder.Cache == "registry" && builder.CacheRef == "" {
+		return errors.New("registry build cache needs a repository to keep the cache in, set --cache-ref or build_cache_ref")
+	}
+	return nil
+}
+
+func (f BuildCacheFlags) pull(conf *config.Config) bool {
+	return !f.NoPull && !conf.No_Build_Pull
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
 type DockerBuildCmd struct {
-	BakeEnv bool   `short:"e" help:"Bake in the configured environment to image after build."`
-	Tag     string `default:"latest" help:"Resulting image tag."`
+	BakeEnv         bool     `short:"e" help:"Bake in the configured environment to image after build."`
+	Tag             string   `default:"latest" help:"Resulting image tag."`
+	SkipLint        bool     `name:"skip-lint" help:"Build even when lint finds errors in the config."`
+	DisableLint     []string `name:"disable" help:"Lint rule to skip when linting before the build, eg. missing-link. May be repeated."`
+	Platform        []string `help:"Platforms to build for, eg. linux/amd64,linux/arm64. Multiple platforms build a multi-arch image with buildx, or podman. Defaults to the host's platform."`
+	BuildCacheFlags `embed:""`
 
 	Config string `arg:"" name:"config" help:"configuration" predictor:"config"`
 }
 
 func (r *DockerBuildCmd) Run(cli *Cli, ctx *context.Context) error {
-	config, err := config.LoadConfig(cli.ConfDir, r.Config, true, cli.TemplatesDir)
+	config, err := cli.loadConfig(r.Config)
 	if err != nil {
 		return errors.New("YAML syntax error. Please check your containers/*.yml config files.")
 	}
+	if !r.SkipLint {
+		if err := cli.lintConfig(r.Config, config, r.DisableLint...); err != nil {
+			return err
+		}
+	}
 
 	dir := cli.BuildDir + "/" + r.Config
 	if cli.ForceMkdir {
@@ -45,12 +90,23 @@ func (r *DockerBuildCmd) Run(cli *Cli, ctx *context.Context) error {
 	}
 
 	pupsArgs := "--skip-tags=precompile,migrate,db"
+	dockerfile := config.Dockerfile(pupsArgs, r.BakeEnv, docker.ActiveRuntime.BuildSecrets())
+	if len(r.Platform) > 0 {
+		dockerfile, err = config.PlatformDockerfile(pupsArgs, r.BakeEnv, docker.ActiveRuntime.BuildSecrets(), r.Platform)
+		if err != nil {
+			return err
+		}
+	}
 	builder := docker.DockerBuilder{
-		Config:   config,
-		Ctx:      ctx,
-		Stdin:    strings.NewReader(config.Dockerfile(pupsArgs, r.BakeEnv)),
-		Dir:      dir,
-		ImageTag: r.Tag,
+		Config:    config,
+		Ctx:       ctx,
+		Stdin:     strings.NewReader(dockerfile),
+		Dir:       dir,
+		ImageTag:  r.Tag,
+		Platforms: r.Platform,
+	}
+	if err := r.BuildCacheFlags.apply(config, &builder); err != nil {
+		return err
 	}
 	if err := builder.Run(); err != nil {
 		return err
@@ -62,12 +118,16 @@ func (r *DockerBuildCmd) Run(cli *Cli, ctx *context.Context) error {
 }
 
 type DockerConfigureCmd struct {
-	Tag    string `default:"latest" help:"Resulting image tag."`
-	Config string `arg:"" name:"config" help:"config" predictor:"config"`
+	Tag       string `default:"latest" help:"Resulting image tag."`
+	FromImage string `name:"from-image" help:"Configure this image, eg. one built for another config, instead of the config's own image."`
+	Config    string `arg:"" name:"config" help:"config" predictor:"config"`
+
+	// extra labels for the configured image, eg. the fingerprint rebuild compares against
+	labels map[string]string
 }
 
 func (r *DockerConfigureCmd) Run(cli *Cli, ctx *context.Context) error {
-	config, err := config.LoadConfig(cli.ConfDir, r.Config, true, cli.TemplatesDir)
+	config, err := cli.loadConfig(r.Config)
 	if err != nil {
 		return errors.New("YAML syntax error. Please check your containers/*.yml config files.")
 	}
@@ -76,21 +136,45 @@ func (r *DockerConfigureCmd) Run(cli *Cli, ctx *context.Context) error {
 	pups := docker.DockerPupsRunner{
 		Config:         config,
 		PupsArgs:       "--tags=db,precompile",
+		Image:          r.FromImage,
 		SavedImageName: utils.BaseImageName + r.Config + ":" + r.Tag,
 		ExtraEnv:       []string{"SKIP_EMBER_CLI_COMPILE=1"},
+		Labels:         r.labels,
 		Ctx:            ctx,
 		ContainerId:    containerId,
 	}
 	return pups.Run()
 }
 
+type PromoteCmd struct {
+	Tag   string `default:"latest" help:"Tag of the image built for the source config."`
+	ToTag string `name:"to-tag" default:"latest" help:"Resulting image tag for the target config."`
+	From  string `arg:"" name:"from" help:"config the image was built for" predictor:"config"`
+	To    string `arg:"" name:"to" help:"config to configure the image for" predictor:"config"`
+}
+
+// Configures the image built for one config with another config's settings, so one build serves several sites.
+func (r *PromoteCmd) Run(cli *Cli, ctx *context.Context) error {
+	image := utils.BaseImageName + r.From + ":" + r.Tag
+	found, err := docker.InspectImage(*ctx, image)
+	if err != nil {
+		return err
+	}
+	if found == nil {
+		return errors.New("image " + image + " was not found, run 'launcher2 build " + r.From + "' to build it")
+	}
+	fmt.Fprintln(utils.Out, "promoting "+image+" to "+utils.BaseImageName+r.To+":"+r.ToTag)
+	configure := DockerConfigureCmd{Config: r.To, Tag: r.ToTag, FromImage: image}
+	return configure.Run(cli, ctx)
+}
+
 type DockerMigrateCmd struct {
 	Config                       string `arg:"" name:"config" help:"config" predictor:"config"`
 	SkipPostDeploymentMigrations bool   `env:"SKIP_POST_DEPLOYMENT_MIGRATIONS" help:"Skip post-deployment migrations. Runs safe migrations only. Defers breaking-change migrations. Make sure you run post-deployment migrations after a full deploy is complete if you use this option."`
 }
 
 func (r *DockerMigrateCmd) Run(cli *Cli, ctx *context.Context) error {
-	config, err := config.LoadConfig(cli.ConfDir, r.Config, true, cli.TemplatesDir)
+	config, err := cli.loadConfig(r.Config)
 	if err != nil {
 		return errors.New("YAML syntax error. Please check your containers/*.yml config files.")
 	}
@@ -110,11 +194,14 @@ func (r *DockerMigrateCmd) Run(cli *Cli, ctx *context.Context) error {
 }
 
 type DockerBootstrapCmd struct {
-	Config string `arg:"" name:"config" help:"config" predictor:"config"`
+	Config          string   `arg:"" name:"config" help:"config" predictor:"config"`
+	SkipLint        bool     `name:"skip-lint" help:"Build even when lint finds errors in the config."`
+	DisableLint     []string `name:"disable" help:"Lint rule to skip when linting before the build, eg. missing-link. May be repeated."`
+	BuildCacheFlags `embed:""`
 }
 
 func (r *DockerBootstrapCmd) Run(cli *Cli, ctx *context.Context) error {
-	buildStep := DockerBuildCmd{Config: r.Config, BakeEnv: false}
+	buildStep := DockerBuildCmd{Config: r.Config, BakeEnv: false, SkipLint: r.SkipLint, DisableLint: r.DisableLint, BuildCacheFlags: r.BuildCacheFlags}
 	migrateStep := DockerMigrateCmd{Config: r.Config}
 	configureStep := DockerConfigureCmd{Config: r.Config}
 	if err := buildStep.Run(cli, ctx); err != nil {
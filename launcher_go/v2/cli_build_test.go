@@ -6,10 +6,13 @@ import (
 
 	"bytes"
 	"context"
+	"encoding/json"
 	ddocker "github.com/discourse/discourse_docker/launcher_go/v2"
+	"github.com/discourse/discourse_docker/launcher_go/v2/docker"
 	. "github.com/discourse/discourse_docker/launcher_go/v2/test_utils"
 	"github.com/discourse/discourse_docker/launcher_go/v2/utils"
 	"io"
+	"net/http"
 	"os"
 	"os/exec"
 	"strings"
@@ -30,9 +33,9 @@ var _ = Describe("Build", func() {
 		ctx = context.Background()
 
 		cli = &ddocker.Cli{
-			ConfDir:      "./test/containers",
-			TemplatesDir: "./test",
-			BuildDir:     testDir,
+			ConfDir:       "./test/containers",
+			TemplatesDirs: []string{"./test"},
+			BuildDir:      testDir,
 		}
 		utils.CmdRunner = CreateNewFakeCmdRunner()
 	})
@@ -43,16 +46,22 @@ var _ = Describe("Build", func() {
 	Context("When running build commands", func() {
 		var checkBuildCmd = func(cmd exec.Cmd) {
 			Expect(cmd.String()).To(ContainSubstring("docker build"))
-			Expect(cmd.String()).To(ContainSubstring("--build-arg DISCOURSE_DEVELOPER_EMAILS"))
+			Expect(cmd.String()).To(ContainSubstring("--build-arg LANG"))
 			Expect(cmd.Dir).To(Equal(testDir + "/test"))
 
-			//db password is ignored
-			Expect(cmd.Env).ToNot(ContainElement("DISCOURSE_DB_PASSWORD=SOME_SECRET"))
+			// secrets are passed as build secrets read from the env, never as build args
+			Expect(cmd.String()).ToNot(ContainSubstring("--build-arg DISCOURSE_DB_PASSWORD"))
+			Expect(cmd.String()).To(ContainSubstring("--secret id=DISCOURSE_DB_PASSWORD,env=DISCOURSE_DB_PASSWORD"))
+			Expect(cmd.String()).To(ContainSubstring("--secret id=DISCOURSE_DEVELOPER_EMAILS,env=DISCOURSE_DEVELOPER_EMAILS"))
+			Expect(cmd.Env).To(ContainElement("DISCOURSE_DB_PASSWORD=SOME_SECRET"))
+			Expect(cmd.Env).To(ContainElement("DOCKER_BUILDKIT=1"))
 			Expect(cmd.Env).ToNot(ContainElement("DISCOURSEDB_SOCKET="))
 			buf := new(strings.Builder)
 			io.Copy(buf, cmd.Stdin)
 			// docker build's stdin is a dockerfile
 			Expect(buf.String()).To(ContainSubstring("COPY config.yaml /temp-config.yaml"))
+			Expect(buf.String()).To(ContainSubstring("--mount=type=secret,id=DISCOURSE_DB_PASSWORD \\\n"))
+			Expect(buf.String()).ToNot(ContainSubstring("SOME_SECRET"))
 			Expect(buf.String()).To(ContainSubstring("--skip-tags=precompile,migrate,db"))
 			Expect(buf.String()).ToNot(ContainSubstring("SKIP_EMBER_CLI_COMPILE=1"))
 		}
@@ -101,12 +110,41 @@ var _ = Describe("Build", func() {
 		}
 
 		It("Should run docker build with correct arguments", func() {
-			runner := ddocker.DockerBuildCmd{Config: "test"}
+			runner := ddocker.DockerBuildCmd{Config: "test", SkipLint: true}
 			runner.Run(cli, &ctx)
 			Expect(len(RanCmds)).To(Equal(1))
 			checkBuildCmd(RanCmds[0])
 		})
 
+		It("Should build with cache and pull flags", func() {
+			runner := ddocker.DockerBuildCmd{Config: "test", SkipLint: true, BuildCacheFlags: ddocker.BuildCacheFlags{Cache: "local", NoPull: true}}
+			Expect(runner.Run(cli, &ctx)).To(Succeed())
+			Expect(len(RanCmds)).To(Equal(1))
+			Expect(RanCmds[0].String()).ToNot(ContainSubstring("--no-cache"))
+			Expect(RanCmds[0].String()).ToNot(ContainSubstring("--pull"))
+		})
+
+		It("Should build multi-arch images", func() {
+			CmdOutputResponse = []byte(`[["driver-type","io.containerd.snapshotter.v1"]]`)
+			runner := ddocker.DockerBuildCmd{Config: "test", SkipLint: true, Platform: []string{"linux/amd64", "linux/arm64"}}
+			Expect(runner.Run(cli, &ctx)).To(Succeed())
+			Expect(len(RanCmds)).To(Equal(2))
+			Expect(RanCmds[1].String()).To(ContainSubstring("docker buildx build"))
+			Expect(RanCmds[1].String()).To(ContainSubstring("--platform linux/amd64,linux/arm64"))
+			buf := new(strings.Builder)
+			io.Copy(buf, RanCmds[1].Stdin)
+			Expect(buf.String()).To(ContainSubstring("FROM base-${TARGETARCH}\n"))
+		})
+
+		It("Should need a cache ref for registry build caches", func() {
+			runner := ddocker.DockerBuildCmd{Config: "test", SkipLint: true, BuildCacheFlags: ddocker.BuildCacheFlags{Cache: "registry"}}
+			Expect(runner.Run(cli, &ctx)).To(MatchError(ContainSubstring("set --cache-ref or build_cache_ref")))
+			Expect(RanCmds).To(BeEmpty())
+
+			runner = ddocker.DockerBuildCmd{Config: "test", SkipLint: true, BuildCacheFlags: ddocker.BuildCacheFlags{Cache: "remote"}}
+			Expect(runner.Run(cli, &ctx)).To(MatchError(ContainSubstring("must be one of none, local, registry")))
+		})
+
 		It("Should run docker migrate with correct arguments", func() {
 			runner := ddocker.DockerMigrateCmd{Config: "test"}
 			runner.Run(cli, &ctx)
@@ -141,8 +179,21 @@ var _ = Describe("Build", func() {
 			checkConfigureClean(RanCmds[2])
 		})
 
+		It("Should configure an image built for another config", func() {
+			runner := ddocker.DockerConfigureCmd{Config: "test", FromImage: "local_discourse/web_only:v1"}
+			runner.Run(cli, &ctx)
+			Expect(len(RanCmds)).To(Equal(3))
+			Expect(RanCmds[0].String()).To(ContainSubstring(" local_discourse/web_only:v1 /bin/bash -c /usr/local/bin/pups --stdin --tags=db,precompile"))
+			buf := new(strings.Builder)
+			io.Copy(buf, RanCmds[0].Stdin)
+			// pups runs with the test config
+			Expect(buf.String()).To(ContainSubstring("path: /etc/service/nginx/run"))
+			checkConfigureCommit(RanCmds[1])
+			Expect(RanCmds[1].String()).To(ContainSubstring("--change LABEL org.discourse.launcher.config=test"))
+		})
+
 		It("Should run all docker commands for full bootstrap", func() {
-			runner := ddocker.DockerBootstrapCmd{Config: "test"}
+			runner := ddocker.DockerBootstrapCmd{Config: "test", SkipLint: true}
 			runner.Run(cli, &ctx)
 			Expect(len(RanCmds)).To(Equal(5))
 			checkBuildCmd(RanCmds[0])
@@ -153,3 +204,55 @@ var _ = Describe("Build", func() {
 		})
 	})
 })
+
+var _ = Describe("Promote", func() {
+	var testDir string
+	var out *bytes.Buffer
+	var cli *ddocker.Cli
+	var ctx context.Context
+	var api *FakeDockerApi
+
+	BeforeEach(func() {
+		out = &bytes.Buffer{}
+		utils.Out = out
+		utils.CommitWait = 0
+		ctx = context.Background()
+		testDir, _ = os.MkdirTemp("", "ddocker-test")
+		cli = &ddocker.Cli{ConfDir: "./test/containers", TemplatesDirs: []string{"./test"}, BuildDir: testDir}
+		api = NewFakeDockerApi()
+		client, _ := docker.NewClient(api.Host())
+		docker.ActiveRuntime = &docker.ApiRuntime{Client: client}
+		api.Handle("GET", "/images/local_discourse/web_only:v1/json", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"Id":"sha256:web"}`))
+		})
+	})
+	AfterEach(func() {
+		docker.ActiveRuntime = docker.NewDockerRuntime()
+		api.Close()
+		os.RemoveAll(testDir)
+	})
+
+	It("configures another config's image, tagged for the target config", func() {
+		runner := ddocker.PromoteCmd{From: "web_only", To: "test", Tag: "v1", ToTag: "latest"}
+		Expect(runner.Run(cli, &ctx)).To(Succeed())
+		create := api.LastRequest("POST", "/containers/create")
+		config := docker.ContainerConfig{}
+		json.Unmarshal(create.Body, &config)
+		Expect(config.Image).To(Equal("local_discourse/web_only:v1"))
+		Expect(string(api.Stdin)).To(ContainSubstring("path: /etc/service/nginx/run"))
+		commit := api.LastRequest("POST", "/commit")
+		Expect(commit.Query.Get("repo")).To(Equal("local_discourse/test"))
+		Expect(commit.Query.Get("tag")).To(Equal("latest"))
+		Expect(commit.Query["changes"]).To(ContainElement("LABEL org.discourse.launcher.config=test"))
+	})
+
+	It("needs the source config's image", func() {
+		api.Handle("GET", "/images/local_discourse/web_only:latest/json", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message":"No such image"}`))
+		})
+		runner := ddocker.PromoteCmd{From: "web_only", To: "test", Tag: "latest", ToTag: "latest"}
+		Expect(runner.Run(cli, &ctx)).To(MatchError("image local_discourse/web_only:latest was not found, run 'launcher2 build web_only' to build it"))
+		Expect(api.Calls()).ToNot(ContainElement("POST /containers/create"))
+	})
+})
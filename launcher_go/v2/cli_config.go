@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"github.com/discourse/discourse_docker/launcher_go/v2/config"
+	"github.com/discourse/discourse_docker/launcher_go/v2/utils"
+)
+
+/*
+ * get
+ * set
+ * unset
+ * add-template
+ * remove-template
+ */
+
+type CliConfig struct {
+	Get            ConfigGetCmd            `cmd:"" name:"get" help:"Print a config value, eg. env.DISCOURSE_HOSTNAME, or hooks.after_code.0.exec.cmd."`
+	Set            ConfigSetCmd            `cmd:"" name:"set" help:"Set a config value, parsed as yaml. Use + as a list index to append to a list."`
+	Unset          ConfigUnsetCmd          `cmd:"" name:"unset" help:"Remove a config value."`
+	AddTemplate    ConfigAddTemplateCmd    `cmd:"" name:"add-template" help:"Add a template to the end of the config's templates."`
+	RemoveTemplate ConfigRemoveTemplateCmd `cmd:"" name:"remove-template" help:"Remove a template from the config's templates."`
+}
+
+type ConfigGetCmd struct {
+	Config string `arg:"" name:"config" help:"config" predictor:"config"`
+	Path   string `arg:"" name:"path" help:"Dotted path to the value."`
+}
+
+func (r *ConfigGetCmd) Run(cli *Cli) error {
+	file, err := config.OpenConfigFile(cli.ConfDir, r.Config)
+	if err != nil {
+		return err
+	}
+	value, err := file.Get(r.Path)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(utils.Out, value)
+	return nil
+}
+
+type ConfigSetCmd struct {
+	Config string `arg:"" name:"config" help:"config" predictor:"config"`
+	Path   string `arg:"" name:"path" help:"Dotted path to the value."`
+	Value  string `arg:"" name:"value" help:"The value, parsed as yaml."`
+}
+
+func (r *ConfigSetCmd) Run(cli *Cli) error {
+	file, err := config.OpenConfigFile(cli.ConfDir, r.Config)
+	if err != nil {
+		return err
+	}
+	if err := file.Set(r.Path, r.Value); err != nil {
+		return err
+	}
+	return cli.saveConfigFile(file)
+}
+
+type ConfigUnsetCmd struct {
+	Config string `arg:"" name:"config" help:"config" predictor:"config"`
+	Path   string `arg:"" name:"path" help:"Dotted path to the value."`
+}
+
+func (r *ConfigUnsetCmd) Run(cli *Cli) error {
+	file, err := config.OpenConfigFile(cli.ConfDir, r.Config)
+	if err != nil {
+		return err
+	}
+	if err := file.Unset(r.Path); err != nil {
+		return err
+	}
+	return cli.saveConfigFile(file)
+}
+
+type ConfigAddTemplateCmd struct {
+	Config   string `arg:"" name:"config" help:"config" predictor:"config"`
+	Template string `arg:"" name:"template" help:"Template path, eg. templates/redis.template.yml."`
+}
+
+func (r *ConfigAddTemplateCmd) Run(cli *Cli) error {
+	file, err := config.OpenConfigFile(cli.ConfDir, r.Config)
+	if err != nil {
+		return err
+	}
+	added, err := file.AddTemplate(r.Template)
+	if err != nil {
+		return err
+	}
+	if !added {
+		fmt.Fprintln(utils.Out, r.Template+" is already a template of "+r.Config)
+		return nil
+	}
+	return cli.saveConfigFile(file)
+}
+
+type ConfigRemoveTemplateCmd struct {
+	Config   string `arg:"" name:"config" help:"config" predictor:"config"`
+	Template string `arg:"" name:"template" help:"Template path, eg. templates/redis.template.yml."`
+}
+
+func (r *ConfigRemoveTemplateCmd) Run(cli *Cli) error {
+	file, err := config.OpenConfigFile(cli.ConfDir, r.Config)
+	if err != nil {
+		return err
+	}
+	removed, err := file.RemoveTemplate(r.Template)
+	if err != nil {
+		return err
+	}
+	if !removed {
+		return fmt.Errorf("%s is not a template of %s", r.Template, r.Config)
+	}
+	return cli.saveConfigFile(file)
+}
+
+// Validates an edited config, and only writes it when it is valid.
+func (cli *Cli) saveConfigFile(file *config.ConfigFile) error {
+	diagnostics := config.ValidateConfigContent(file.Filename, file.Content(), cli.TemplatesDirs...)
+	for _, d := range diagnostics {
+		fmt.Fprintln(utils.Out, d)
+	}
+	if len(diagnostics) > 0 {
+		return fmt.Errorf("%d problem(s) found, %s was not changed", len(diagnostics), file.Filename)
+	}
+	return file.Save()
+}
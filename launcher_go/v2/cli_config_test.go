@@ -0,0 +1,65 @@
+package main_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"bytes"
+	ddocker "github.com/discourse/discourse_docker/launcher_go/v2"
+	"github.com/discourse/discourse_docker/launcher_go/v2/utils"
+	"os"
+)
+
+var _ = Describe("Config", func() {
+	var testDir string
+	var out *bytes.Buffer
+	var cli *ddocker.Cli
+	const app = "templates:\n  - templates/web.template.yml\n\n# the hostname\nenv:\n  DISCOURSE_HOSTNAME: discourse.example.com\n"
+
+	BeforeEach(func() {
+		out = &bytes.Buffer{}
+		utils.Out = out
+		testDir, _ = os.MkdirTemp("", "ddocker-test")
+		os.WriteFile(testDir+"/app.yml", []byte(app), 0660)
+		cli = &ddocker.Cli{
+			ConfDir:       testDir,
+			TemplatesDirs: []string{"./test"},
+		}
+	})
+	AfterEach(func() {
+		os.RemoveAll(testDir)
+	})
+
+	It("gets config values", func() {
+		runner := ddocker.ConfigGetCmd{Config: "app", Path: "env.DISCOURSE_HOSTNAME"}
+		Expect(runner.Run(cli)).To(Succeed())
+		Expect(out.String()).To(Equal("discourse.example.com\n"))
+	})
+
+	It("sets config values in place", func() {
+		runner := ddocker.ConfigSetCmd{Config: "app", Path: "env.DISCOURSE_HOSTNAME", Value: "forum.example.com"}
+		Expect(runner.Run(cli)).To(Succeed())
+		content, _ := os.ReadFile(testDir + "/app.yml")
+		Expect(string(content)).To(Equal("templates:\n  - templates/web.template.yml\n\n# the hostname\nenv:\n  DISCOURSE_HOSTNAME: forum.example.com\n"))
+	})
+
+	It("does not write invalid configs", func() {
+		runner := ddocker.ConfigAddTemplateCmd{Config: "app", Template: "templates/nope.template.yml"}
+		Expect(runner.Run(cli)).To(MatchError("1 problem(s) found, " + testDir + "/app.yml was not changed"))
+		Expect(out.String()).To(ContainSubstring("template templates/nope.template.yml could not be found in ./test"))
+
+		set := ddocker.ConfigSetCmd{Config: "app", Path: "update_pups", Value: "sometimes"}
+		Expect(set.Run(cli)).ToNot(Succeed())
+		Expect(out.String()).To(ContainSubstring("update_pups must be true or false"))
+		content, _ := os.ReadFile(testDir + "/app.yml")
+		Expect(string(content)).To(Equal(app))
+	})
+
+	It("removes templates", func() {
+		runner := ddocker.ConfigRemoveTemplateCmd{Config: "app", Template: "templates/web.template.yml"}
+		Expect(runner.Run(cli)).To(Succeed())
+		content, _ := os.ReadFile(testDir + "/app.yml")
+		Expect(string(content)).To(HavePrefix("templates: []\n\n# the hostname\n"))
+		Expect(runner.Run(cli)).To(MatchError("templates/web.template.yml is not a template of app"))
+	})
+})
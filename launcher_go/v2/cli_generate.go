@@ -7,46 +7,109 @@ import (
 	"github.com/discourse/discourse_docker/launcher_go/v2/config"
 	"github.com/discourse/discourse_docker/launcher_go/v2/utils"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
 )
 
 /*
  * raw-yaml
  * compose
+ * kubernetes
  * args (args, run-image, boot-command, hostname)
+ * explain
  */
 
 type CliGenerate struct {
-	DockerCompose DockerComposeCmd `cmd:"" name:"compose" help:"Create docker compose setup in the output {output-directory}/{config}/. The builder generates a docker-compose.yaml, Dockerfile, config.yaml, and an env file for you to source .envrc. Run with 'source .envrc; docker compose up'."`
+	DockerCompose DockerComposeCmd `cmd:"" name:"compose" help:"Create a docker compose project for one or more configs in {output-directory}/{project}/. The builder generates a docker-compose.yaml, a Dockerfile and config.yaml for each config, and an env file for you to source .envrc. Run with 'source .envrc; docker compose up'."`
+	Kubernetes    KubernetesCmd    `cmd:"" name:"kubernetes" help:"Create kubernetes manifests in {output-directory}/{config}/: a deployment, services for exposed ports, env config map and secret, volumes, and migrate and configure jobs. The directory is a kustomize base. Apply with 'kubectl apply -k'."`
 	DockerArgs    DockerArgsCmd    `cmd:"" name:"docker-args" help:"Print docker run args."`
 	RawYaml       RawYamlCmd       `cmd:"" name:"raw-yaml" help:"Print raw config, concatenated in pups format."`
 	ConcourseJob  ConcourseJobCmd  `cmd:"" name:"concourse-job" help:"Print concourse job config"`
+	Explain       ExplainCmd       `cmd:"" name:"explain" help:"Print where each setting came from: every template, config, and overlay line that set or overrode it, in merge order."`
 }
 
 type RawYamlCmd struct {
-	Config string `arg:"" name:"config" help:"config" predictor:"config"`
+	IncludeSecrets bool   `name:"include-secrets" help:"Include secret env values."`
+	Config         string `arg:"" name:"config" help:"config" predictor:"config"`
 }
 
 func (r *RawYamlCmd) Run(cli *Cli) error {
-	config, err := config.LoadConfig(cli.ConfDir, r.Config, true, cli.TemplatesDir)
+	config, err := cli.loadConfig(r.Config)
 	if err != nil {
 		return errors.New("YAML syntax error. Please check your containers/*.yml config files.")
 	}
-	fmt.Fprint(utils.Out, config.Yaml())
+	fmt.Fprint(utils.Out, config.Yaml(r.IncludeSecrets))
 	return nil
 }
 
 type DockerComposeCmd struct {
-	OutputDir string `name:"output dir" default:"./compose" short:"o" help:"Output dir for docker compose files." predictor:"dir"`
-	BakeEnv   bool   `short:"e" help:"Bake in the configured environment to image after build."`
+	OutputDir      string `name:"output dir" default:"./compose" short:"o" help:"Output dir for docker compose files." predictor:"dir"`
+	Project        string `help:"Compose project name, and the output subdir. Defaults to the config names joined with '-'."`
+	BakeEnv        bool   `short:"e" help:"Bake in the configured environment to image after build."`
+	IncludeSecrets bool   `name:"include-secrets" help:"Write secret env values to .envrc. Otherwise they must be exported before sourcing it."`
 
-	Config string `arg:"" name:"config" help:"config" predictor:"config"`
+	Configs []string `arg:"" name:"config" help:"configs to run as services of the project" predictor:"config"`
 }
 
 func (r *DockerComposeCmd) Run(cli *Cli, ctx *context.Context) error {
-	config, err := config.LoadConfig(cli.ConfDir, r.Config, true, cli.TemplatesDir)
+	configs := []*config.Config{}
+	for _, name := range r.Configs {
+		loadedConfig, err := cli.loadConfig(name)
+		if err != nil {
+			return errors.New("YAML syntax error. Please check your containers/*.yml config files.")
+		}
+		configs = append(configs, loadedConfig)
+	}
+	project := r.Project
+	if project == "" {
+		project = strings.Join(r.Configs, "-")
+	}
+	dir := r.OutputDir + "/" + project
+	if cli.ForceMkdir {
+		if err := os.MkdirAll(dir, 0755); err != nil && !os.IsExist(err) {
+			return err
+		}
+	} else {
+		if err := os.Mkdir(dir, 0755); err != nil && !os.IsExist(err) {
+			return err
+		}
+	}
+	if err := config.WriteDockerComposeProject(dir, project, configs, r.BakeEnv, r.IncludeSecrets); err != nil {
+		return err
+	}
+	for _, c := range configs {
+		for _, l := range c.Links {
+			if !slices.Contains(r.Configs, l.Link.Name) {
+				fmt.Fprintln(utils.Out, "Config "+c.Name+" links to "+l.Link.Name+", which is not in the project. Add it to the project, or attach its container to the "+project+"_"+config.ComposeNetworkName+" network.")
+			}
+		}
+	}
+	return nil
+}
+
+type KubernetesCmd struct {
+	OutputDir      string `name:"output-dir" default:"./kubernetes" short:"o" help:"Output dir for kubernetes manifests." predictor:"dir"`
+	Image          string `help:"Image to run. Defaults to the config's registry image when it has a registry, otherwise its run image."`
+	Volumes        string `default:"pvc" enum:"pvc,host-path" help:"Mount volumes from persistent volume claims, or from the host's volume paths."`
+	VolumeSize     string `name:"volume-size" default:"10Gi" help:"Storage requested by each persistent volume claim."`
+	IncludeSecrets bool   `name:"include-secrets" help:"Write secret env values to the secret manifest. Otherwise they are left empty to fill in."`
+
+	Config string `arg:"" name:"config" help:"config" predictor:"config"`
+}
+
+func (r *KubernetesCmd) Run(cli *Cli) error {
+	loadedConfig, err := cli.loadConfig(r.Config)
 	if err != nil {
 		return errors.New("YAML syntax error. Please check your containers/*.yml config files.")
 	}
+	image := r.Image
+	if image == "" {
+		image = loadedConfig.RunImage()
+		if loadedConfig.Registry != "" {
+			image, _ = loadedConfig.RegistryImage("latest")
+		}
+	}
 	dir := r.OutputDir + "/" + r.Config
 	if cli.ForceMkdir {
 		if err := os.MkdirAll(dir, 0755); err != nil && !os.IsExist(err) {
@@ -57,26 +120,36 @@ func (r *DockerComposeCmd) Run(cli *Cli, ctx *context.Context) error {
 			return err
 		}
 	}
-	if err := config.WriteDockerCompose(dir, r.BakeEnv); err != nil {
+	options := config.KubernetesOptions{
+		Image:          image,
+		HostPath:       r.Volumes == "host-path",
+		VolumeSize:     r.VolumeSize,
+		IncludeSecrets: r.IncludeSecrets,
+	}
+	if err := loadedConfig.WriteKubernetes(dir, options); err != nil {
 		return err
 	}
+	if !r.IncludeSecrets && len(loadedConfig.SecretKeys()) > 0 {
+		fmt.Fprintln(utils.Out, "Secret values were left out, fill them in "+dir+"/secret.yaml or pass --include-secrets")
+	}
 	return nil
 }
 
 type DockerArgsCmd struct {
-	Config       string `arg:"" name:"config" help:"config" predictor:"config"`
-	Type         string `default:"args" enum:"args,run-image,boot-command,hostname" help:"The type of run arg - args, run-image, boot-command, hostname."`
-	IncludePorts bool   `default:"true" name:"include-ports" negatable:"" help:"Include ports in run args."`
+	Config         string `arg:"" name:"config" help:"config" predictor:"config"`
+	Type           string `default:"args" enum:"args,run-image,boot-command,hostname" help:"The type of run arg - args, run-image, boot-command, hostname."`
+	IncludePorts   bool   `default:"true" name:"include-ports" negatable:"" help:"Include ports in run args."`
+	IncludeSecrets bool   `name:"include-secrets" help:"Include secret env values in run args. Otherwise they are passed by name, read from the environment."`
 }
 
 func (r *DockerArgsCmd) Run(cli *Cli) error {
-	config, err := config.LoadConfig(cli.ConfDir, r.Config, true, cli.TemplatesDir)
+	config, err := cli.loadConfig(r.Config)
 	if err != nil {
 		return errors.New("YAML syntax error. Please check your containers/*.yml config files.")
 	}
 	switch r.Type {
 	case "args":
-		fmt.Fprint(utils.Out, config.DockerArgsCli(r.IncludePorts))
+		fmt.Fprint(utils.Out, config.DockerArgsCli(r.IncludePorts, r.IncludeSecrets))
 	case "run-image":
 		fmt.Fprint(utils.Out, config.RunImage())
 	case "boot-command":
@@ -90,20 +163,64 @@ func (r *DockerArgsCmd) Run(cli *Cli) error {
 }
 
 type ConcourseJobCmd struct {
-	Output string `help:"write concourse job to output file"`
-	Config string `arg:"" name:"config" help:"config" predictor:"config"`
+	Output         string `help:"write concourse job to output file"`
+	IncludeSecrets bool   `name:"include-secrets" help:"Include secret env values. Otherwise they are read from concourse's credential manager."`
+	Config         string `arg:"" name:"config" help:"config" predictor:"config"`
 }
 
 func (r *ConcourseJobCmd) Run(cli *Cli) error {
 	fmt.Fprintln(utils.Out, "## WARNING: concourse job generation is experimental, use at your own risk!")
-	loadedConfig, err := config.LoadConfig(cli.ConfDir, r.Config, true, cli.TemplatesDir)
+	loadedConfig, err := cli.loadConfig(r.Config)
 	if err != nil {
 		return errors.New("YAML syntax error. Please check your containers/*.yml config files.")
 	}
 	if r.Output == "" {
-		fmt.Fprint(utils.Out, config.GenConcourseConfig(*loadedConfig))
+		fmt.Fprint(utils.Out, config.GenConcourseConfig(*loadedConfig, r.IncludeSecrets))
 	} else {
-		config.WriteConcourseConfig(*loadedConfig, r.Output)
+		config.WriteConcourseConfig(*loadedConfig, r.Output, r.IncludeSecrets)
+	}
+	return nil
+}
+
+type ExplainCmd struct {
+	Key    string `help:"Only explain this setting, eg. ENV.LANG, or a whole section, eg. env."`
+	Config string `arg:"" name:"config" help:"config" predictor:"config"`
+}
+
+func (r *ExplainCmd) Run(cli *Cli) error {
+	config, err := cli.loadConfig(r.Config)
+	if err != nil {
+		return errors.New("YAML syntax error. Please check your containers/*.yml config files.")
+	}
+	keys := config.SourceKeys()
+	if r.Key != "" {
+		keys = config.MatchSourceKeys(r.Key)
+		if len(keys) == 0 {
+			return errors.New("no setting " + r.Key + " in config " + r.Config)
+		}
+	}
+	for _, key := range keys {
+		value, ok := config.Value(key)
+		section, name, _ := strings.Cut(key, ".")
+		switch {
+		case !ok && (section == "env" || section == "params" || section == "labels"):
+			value = "(unset)"
+		case !ok:
+			value = "(removed)"
+		case section == "env" && config.IsSecret(name):
+			value = "(secret)"
+		case strings.Contains(value, "\n"):
+			value = strconv.Quote(value)
+		}
+		if ok && slices.Contains([]string{"templates", "expose", "volumes", "links", "secrets"}, section) {
+			// list entries are their own value
+			fmt.Fprintln(utils.Out, key)
+		} else {
+			fmt.Fprintf(utils.Out, "%s: %s\n", key, value)
+		}
+		for _, source := range config.Sources(key) {
+			fmt.Fprintf(utils.Out, "  %s\n", source)
+		}
 	}
 	return nil
 }
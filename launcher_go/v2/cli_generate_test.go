@@ -26,9 +26,9 @@ var _ = Describe("Generate", func() {
 		ctx = context.Background()
 
 		cli = &ddocker.Cli{
-			ConfDir:      "./test/containers",
-			TemplatesDir: "./test",
-			BuildDir:     testDir,
+			ConfDir:       "./test/containers",
+			TemplatesDirs: []string{"./test"},
+			BuildDir:      testDir,
 		}
 	})
 	AfterEach(func() {
@@ -38,23 +38,106 @@ var _ = Describe("Generate", func() {
 	It("should allow concatenated templates", func() {
 		runner := ddocker.RawYamlCmd{Config: "test"}
 		runner.Run(cli)
-		Expect(out.String()).To(ContainSubstring("DISCOURSE_DEVELOPER_EMAILS: 'me@example.com,you@example.com'"))
+		Expect(out.String()).To(ContainSubstring("LANG: en_US.UTF-8"))
 		Expect(out.String()).To(ContainSubstring("_FILE_SEPERATOR_"))
 		Expect(out.String()).To(ContainSubstring("version: tests-passed"))
+		Expect(out.String()).ToNot(ContainSubstring("DISCOURSE_DEVELOPER_EMAILS"))
+	})
+
+	It("should include overlays in raw yaml", func() {
+		cli.EnvName = "staging"
+		runner := ddocker.RawYamlCmd{Config: "test"}
+		runner.Run(cli)
+		Expect(out.String()).To(HaveSuffix("_FILE_SEPERATOR_## Overrides for running the test config in staging, merged with --env-name staging\nenv:\n  UNICORN_WORKERS: 2\n"))
+	})
+
+	It("should print secrets in raw yaml when asked", func() {
+		runner := ddocker.RawYamlCmd{Config: "test", IncludeSecrets: true}
+		runner.Run(cli)
+		Expect(out.String()).To(ContainSubstring("DISCOURSE_DEVELOPER_EMAILS: 'me@example.com,you@example.com'"))
+	})
+
+	It("should explain where a setting came from", func() {
+		cli.EnvName = "staging"
+		runner := ddocker.ExplainCmd{Config: "test", Key: "ENV.UNICORN_WORKERS"}
+		Expect(runner.Run(cli)).To(Succeed())
+		Expect(out.String()).To(Equal("env.UNICORN_WORKERS: 2\n" +
+			"  set       ./test/templates/web.template.yml:4\n" +
+			"  override  ./test/containers/test.staging.yml:4\n"))
+	})
+
+	It("should redact secrets when explaining", func() {
+		runner := ddocker.ExplainCmd{Config: "test", Key: "env"}
+		Expect(runner.Run(cli)).To(Succeed())
+		Expect(out.String()).To(ContainSubstring("env.DISCOURSE_DB_PASSWORD: (secret)\n"))
+		Expect(out.String()).To(ContainSubstring("env.LANG: en_US.UTF-8\n"))
+		Expect(out.String()).ToNot(ContainSubstring("params."))
+	})
+
+	It("should redact multiline secrets when explaining", func() {
+		overlay := testDir + "/secrets.yml"
+		os.WriteFile(overlay, []byte("secrets:\n  - MULTI\n"), 0644)
+		cli.Overlays = []string{overlay}
+		runner := ddocker.ExplainCmd{Config: "test", Key: "env.MULTI"}
+		Expect(runner.Run(cli)).To(Succeed())
+		Expect(out.String()).To(HavePrefix("env.MULTI: (secret)\n"))
+		Expect(out.String()).ToNot(ContainSubstring("multiline"))
+	})
+
+	It("should fail to explain unknown settings", func() {
+		runner := ddocker.ExplainCmd{Config: "test", Key: "env.NOPE"}
+		Expect(runner.Run(cli)).To(MatchError("no setting env.NOPE in config test"))
 	})
 
 	It("should output docker compose cmd to config name's subdir", func() {
-		runner := ddocker.DockerComposeCmd{Config: "test",
+		runner := ddocker.DockerComposeCmd{Configs: []string{"test"},
 			OutputDir: testDir}
 		err := runner.Run(cli, &ctx)
 		Expect(err).To(BeNil())
 		out, err := os.ReadFile(testDir + "/test/config.yaml")
 		Expect(err).To(BeNil())
-		Expect(string(out[:])).To(ContainSubstring("DISCOURSE_DEVELOPER_EMAILS: 'me@example.com,you@example.com'"))
+		Expect(string(out[:])).To(ContainSubstring("LANG: en_US.UTF-8"))
+	})
+
+	It("should output a compose project for several configs", func() {
+		runner := ddocker.DockerComposeCmd{Configs: []string{"test", "web_only"}, Project: "site", OutputDir: testDir}
+		Expect(runner.Run(cli, &ctx)).To(Succeed())
+		Expect(testDir + "/site/docker-compose.yaml").To(BeAnExistingFile())
+		Expect(testDir + "/site/.envrc").To(BeAnExistingFile())
+		Expect(testDir + "/site/test/config.yaml").To(BeAnExistingFile())
+		Expect(testDir + "/site/web_only/Dockerfile").To(BeAnExistingFile())
+		Expect(out.String()).To(ContainSubstring("Config web_only links to data, which is not in the project."))
+	})
+
+	It("should output kubernetes manifests to config name's subdir", func() {
+		runner := ddocker.KubernetesCmd{Config: "test", OutputDir: testDir, Volumes: "pvc", VolumeSize: "10Gi"}
+		Expect(runner.Run(cli)).To(Succeed())
+		for _, file := range []string{"kustomization.yaml", "deployment.yaml", "services.yaml", "configmap.yaml", "secret.yaml", "volumes.yaml", "jobs.yaml"} {
+			Expect(testDir + "/test/" + file).To(BeAnExistingFile())
+		}
+		deployment, _ := os.ReadFile(testDir + "/test/deployment.yaml")
+		Expect(string(deployment)).To(ContainSubstring("image: local_discourse/test\n"))
+		secret, _ := os.ReadFile(testDir + "/test/secret.yaml")
+		Expect(string(secret)).To(ContainSubstring("DISCOURSE_DB_PASSWORD: \"\""))
+		Expect(string(secret)).ToNot(ContainSubstring("SOME_SECRET"))
+		Expect(out.String()).To(ContainSubstring("Secret values were left out"))
+	})
+
+	It("should run the registry image in kubernetes when the config has a registry", func() {
+		overlay := testDir + "/registry.yml"
+		os.WriteFile(overlay, []byte("registry: ghcr.io/example\n"), 0644)
+		cli.Overlays = []string{overlay}
+		runner := ddocker.KubernetesCmd{Config: "test", OutputDir: testDir, Volumes: "host-path", IncludeSecrets: true}
+		Expect(runner.Run(cli)).To(Succeed())
+		deployment, _ := os.ReadFile(testDir + "/test/deployment.yaml")
+		Expect(string(deployment)).To(ContainSubstring("image: ghcr.io/example/test:latest\n"))
+		Expect(testDir + "/test/volumes.yaml").ToNot(BeAnExistingFile())
+		secret, _ := os.ReadFile(testDir + "/test/secret.yaml")
+		Expect(string(secret)).To(ContainSubstring("DISCOURSE_DB_PASSWORD: SOME_SECRET"))
 	})
 
 	It("does not create output parent folders when not asked", func() {
-		runner := ddocker.DockerComposeCmd{Config: "test",
+		runner := ddocker.DockerComposeCmd{Configs: []string{"test"},
 			OutputDir: testDir + "/subfolder/sub-subfolder"}
 		err := runner.Run(cli, &ctx)
 		Expect(err).ToNot(BeNil())
@@ -63,13 +146,13 @@ var _ = Describe("Generate", func() {
 	})
 
 	It("should force create output parent folders when asked", func() {
-		runner := ddocker.DockerComposeCmd{Config: "test",
+		runner := ddocker.DockerComposeCmd{Configs: []string{"test"},
 			OutputDir: testDir + "/subfolder/sub-subfolder"}
 		cli.ForceMkdir = true
 		err := runner.Run(cli, &ctx)
 		Expect(err).To(BeNil())
 		out, err := os.ReadFile(testDir + "/subfolder/sub-subfolder/test/config.yaml")
 		Expect(err).To(BeNil())
-		Expect(string(out[:])).To(ContainSubstring("DISCOURSE_DEVELOPER_EMAILS: 'me@example.com,you@example.com'"))
+		Expect(string(out[:])).To(ContainSubstring("LANG: en_US.UTF-8"))
 	})
 })
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/discourse/discourse_docker/launcher_go/v2/config"
+	"github.com/discourse/discourse_docker/launcher_go/v2/docker"
+	"github.com/discourse/discourse_docker/launcher_go/v2/utils"
+	"strings"
+	"time"
+)
+
+/*
+ * health checks for started containers
+ */
+
+type HealthFlags struct {
+	Wait          bool          `negatable:"" default:"true" help:"Wait for the started container to become healthy."`
+	HealthTimeout time.Duration `name:"health-timeout" default:"10m" help:"How long to wait for the started container to become healthy."`
+	HealthPath    string        `name:"health-path" default:"/srv/status" help:"Path polled through the container's published web port to check it is healthy."`
+}
+
+func (f HealthFlags) waitHealthy(ctx context.Context, config *config.Config, container string) error {
+	if !f.Wait {
+		return nil
+	}
+	check := docker.HealthCheck{
+		Container: container,
+		Url:       healthUrl(config.Expose, f.HealthPath),
+		Host:      config.Env["DISCOURSE_HOSTNAME"],
+		Timeout:   f.HealthTimeout,
+	}
+	if check.Url == "" {
+		fmt.Fprintln(utils.Out, "waiting for "+container+" to stay up")
+	} else {
+		fmt.Fprintln(utils.Out, "waiting for "+container+" to respond on "+check.Url)
+	}
+	if err := docker.WaitHealthy(ctx, check); err != nil {
+		return err
+	}
+	fmt.Fprintln(utils.Out, container+" is healthy")
+	return nil
+}
+
+// Finds the url that reaches path on a container through its published https or http port.
+// Empty when neither port is published.
+func healthUrl(expose []string, path string) string {
+	for _, scheme := range []string{"https", "http"} {
+		containerPort := "443"
+		if scheme == "http" {
+			containerPort = "80"
+		}
+		for _, e := range expose {
+			hostIp, hostPort, port := splitPublishedPort(e)
+			if port != containerPort || hostPort == "" {
+				continue
+			}
+			if hostIp == "" || hostIp == "0.0.0.0" {
+				hostIp = "127.0.0.1"
+			} else if hostIp == "::" {
+				hostIp = "::1"
+			}
+			if strings.Contains(hostIp, ":") {
+				hostIp = "[" + hostIp + "]"
+			}
+			return scheme + "://" + hostIp + ":" + hostPort + path
+		}
+	}
+	return ""
+}
+
+// Splits a tcp expose entry, [ip:][hostPort:]containerPort[/tcp], into its parts.
+func splitPublishedPort(expose string) (string, string, string) {
+	expose, protocol, _ := strings.Cut(expose, "/")
+	if protocol != "" && protocol != "tcp" {
+		return "", "", ""
+	}
+	i := strings.LastIndex(expose, ":")
+	if i < 0 {
+		return "", "", expose
+	}
+	hostIp, hostPort := "", expose[:i]
+	if j := strings.LastIndex(hostPort, ":"); j >= 0 {
+		hostIp, hostPort = strings.Trim(hostPort[:j], "[]"), hostPort[j+1:]
+	}
+	return hostIp, hostPort, expose[i+1:]
+}
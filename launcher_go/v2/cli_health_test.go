@@ -0,0 +1,83 @@
+package main_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"bytes"
+	"context"
+	"errors"
+	ddocker "github.com/discourse/discourse_docker/launcher_go/v2"
+	"github.com/discourse/discourse_docker/launcher_go/v2/docker"
+	. "github.com/discourse/discourse_docker/launcher_go/v2/test_utils"
+	"github.com/discourse/discourse_docker/launcher_go/v2/utils"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"time"
+)
+
+var _ = Describe("Health", func() {
+	var testDir string
+	var out *bytes.Buffer
+	var cli *ddocker.Cli
+	var ctx context.Context
+	var api *FakeDockerApi
+	var app *httptest.Server
+	var appStatus int
+	var health ddocker.HealthFlags
+
+	BeforeEach(func() {
+		out = &bytes.Buffer{}
+		utils.Out = out
+		utils.HealthPollInterval = time.Millisecond
+		ctx = context.Background()
+		testDir, _ = os.MkdirTemp("", "ddocker-test")
+		cli = &ddocker.Cli{ConfDir: testDir, TemplatesDirs: []string{"./test"}, BuildDir: testDir}
+		api = NewFakeDockerApi()
+		client, _ := docker.NewClient(api.Host())
+		docker.ActiveRuntime = &docker.ApiRuntime{Client: client}
+		api.Handle("GET", "/containers/app/json", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"Id":"abc","State":{"Status":"running"}}`))
+		})
+		appStatus = http.StatusOK
+		app = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(appStatus)
+		}))
+		port := app.Listener.Addr().String()[strings.LastIndex(app.Listener.Addr().String(), ":")+1:]
+		os.WriteFile(testDir+"/app.yml", []byte("expose:\n  - \"127.0.0.1:"+port+":80\"\nenv:\n  DISCOURSE_HOSTNAME: discourse.example.com\n"), 0660)
+		health = ddocker.HealthFlags{Wait: true, HealthTimeout: 50 * time.Millisecond, HealthPath: "/srv/status"}
+	})
+	AfterEach(func() {
+		docker.ActiveRuntime = docker.NewDockerRuntime()
+		utils.HealthPollInterval = 2 * time.Second
+		api.Close()
+		app.Close()
+		os.RemoveAll(testDir)
+	})
+
+	It("waits for a started container to respond through its published port", func() {
+		runner := ddocker.StartCmd{Config: "app", HealthFlags: health}
+		Expect(runner.Run(cli, &ctx)).To(Succeed())
+		Expect(out.String()).To(ContainSubstring("waiting for app to respond on " + app.URL + "/srv/status"))
+		Expect(out.String()).To(ContainSubstring("app is healthy"))
+	})
+
+	It("fails start when the container never becomes healthy", func() {
+		appStatus = http.StatusServiceUnavailable
+		runner := ddocker.StartCmd{Config: "app", HealthFlags: health}
+		err := runner.Run(cli, &ctx)
+		var unhealthy *docker.UnhealthyError
+		Expect(errors.As(err, &unhealthy)).To(BeTrue())
+		Expect(unhealthy.Container).To(Equal("app"))
+	})
+
+	It("skips waiting with --no-wait", func() {
+		appStatus = http.StatusServiceUnavailable
+		health.Wait = false
+		runner := ddocker.StartCmd{Config: "app", HealthFlags: health}
+		Expect(runner.Run(cli, &ctx)).To(Succeed())
+		Expect(api.Calls()).ToNot(ContainElement("GET /containers/app/json"))
+	})
+})
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"github.com/discourse/discourse_docker/launcher_go/v2/config"
+	"github.com/discourse/discourse_docker/launcher_go/v2/utils"
+)
+
+/*
+ * lint
+ */
+
+type LintCmd struct {
+	Config  string   `arg:"" name:"config" help:"config" predictor:"config"`
+	Disable []string `name:"disable" help:"Lint rule to skip, eg. missing-volume-host. May be repeated."`
+	Strict  bool     `help:"Fail on warnings as well as errors."`
+}
+
+func (r *LintCmd) Run(cli *Cli) error {
+	config, err := cli.loadConfig(r.Config)
+	if err != nil {
+		return fmt.Errorf("could not load config %s: %w", r.Config, err)
+	}
+	lints := config.Lint(cli.ConfDir, r.Disable...)
+	printLints(lints)
+	if r.Strict && len(lints) > 0 {
+		return fmt.Errorf("%d problem(s) found in config %s", len(lints), r.Config)
+	}
+	if err := lintError(r.Config, lints); err != nil {
+		return err
+	}
+	fmt.Fprintln(utils.Out, r.Config+" passed lint")
+	return nil
+}
+
+// Lints a config before building it, skipping the disabled rules and failing on errors. Warnings are printed and building continues.
+func (cli *Cli) lintConfig(name string, config *config.Config, disabled ...string) error {
+	lints := config.Lint(cli.ConfDir, disabled...)
+	printLints(lints)
+	if err := lintError(name, lints); err != nil {
+		return fmt.Errorf("%w, fix them, --disable their rules, or pass --skip-lint to build anyway", err)
+	}
+	return nil
+}
+
+func printLints(lints []config.Lint) {
+	for _, l := range lints {
+		fmt.Fprintln(utils.Out, l)
+	}
+}
+
+func lintError(name string, lints []config.Lint) error {
+	if n := config.LintErrors(lints); n > 0 {
+		return fmt.Errorf("%d lint error(s) found in config %s", n, name)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package main_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"bytes"
+	"context"
+	ddocker "github.com/discourse/discourse_docker/launcher_go/v2"
+	. "github.com/discourse/discourse_docker/launcher_go/v2/test_utils"
+	"github.com/discourse/discourse_docker/launcher_go/v2/utils"
+	"os"
+)
+
+var _ = Describe("Lint", func() {
+	var testDir string
+	var out *bytes.Buffer
+	var cli *ddocker.Cli
+
+	BeforeEach(func() {
+		utils.DockerPath = "docker"
+		out = &bytes.Buffer{}
+		utils.Out = out
+		testDir, _ = os.MkdirTemp("", "ddocker-test")
+		cli = &ddocker.Cli{
+			ConfDir:       "./test/containers",
+			TemplatesDirs: []string{"./test"},
+			BuildDir:      testDir,
+		}
+		utils.CmdRunner = CreateNewFakeCmdRunner()
+	})
+	AfterEach(func() {
+		os.RemoveAll(testDir)
+	})
+
+	It("prints lints and fails on errors", func() {
+		runner := ddocker.LintCmd{Config: "standalone"}
+		Expect(runner.Run(cli)).To(MatchError("2 lint error(s) found in config standalone"))
+		Expect(out.String()).To(ContainSubstring("test/containers/standalone.yml:53: error: env.DISCOURSE_HOSTNAME: domain is not configured"))
+		Expect(out.String()).To(ContainSubstring("(missing-volume-host)"))
+	})
+
+	It("passes with warnings unless strict", func() {
+		runner := ddocker.LintCmd{Config: "standalone", Disable: []string{"placeholder-hostname", "placeholder-smtp"}}
+		Expect(runner.Run(cli)).To(Succeed())
+		Expect(out.String()).To(ContainSubstring("standalone passed lint"))
+		runner.Strict = true
+		Expect(runner.Run(cli)).To(MatchError("2 problem(s) found in config standalone"))
+	})
+
+	It("stops builds on lint errors", func() {
+		runner := ddocker.DockerBuildCmd{Config: "test"}
+		ctx := context.Background()
+		Expect(runner.Run(cli, &ctx)).To(MatchError("2 lint error(s) found in config test, fix them, --disable their rules, or pass --skip-lint to build anyway"))
+		Expect(RanCmds).To(BeEmpty())
+		// links to containers launcher doesn't manage only warn
+		Expect(out.String()).To(ContainSubstring("warning: links.data:data"))
+	})
+
+	It("skips disabled rules when linting builds", func() {
+		runner := ddocker.DockerBuildCmd{Config: "test", DisableLint: []string{"placeholder-hostname"}}
+		ctx := context.Background()
+		Expect(runner.Run(cli, &ctx)).To(MatchError(HavePrefix("1 lint error(s) found in config test")))
+		Expect(out.String()).ToNot(ContainSubstring("(placeholder-hostname)"))
+	})
+})
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/discourse/discourse_docker/launcher_go/v2/docker"
+	"github.com/discourse/discourse_docker/launcher_go/v2/utils"
+	"strings"
+)
+
+/*
+ * push
+ * pull
+ */
+
+type PushCmd struct {
+	Tag    string `default:"latest" help:"Tag of the built image to push. It keeps the same tag in the registry. Images with secrets in their env, such as configured ones, are refused."`
+	Config string `arg:"" name:"config" help:"config" predictor:"config"`
+}
+
+func (r *PushCmd) Run(cli *Cli, ctx *context.Context) error {
+	config, err := cli.loadConfig(r.Config)
+	if err != nil {
+		return errors.New("YAML syntax error. Please check your containers/*.yml config files.")
+	}
+	remote, err := config.RegistryImage(r.Tag)
+	if err != nil {
+		return err
+	}
+	local := utils.BaseImageName + r.Config + ":" + r.Tag
+	image, err := docker.InspectImage(*ctx, local)
+	if err != nil {
+		return err
+	}
+	if image == nil {
+		return errors.New("image " + local + " was not found, run 'launcher2 build " + r.Config + "' to build it")
+	}
+	// configured images, and images built with --bake-env, carry the config's env
+	secrets := []string{}
+	for _, e := range image.Env {
+		k, _, _ := strings.Cut(e, "=")
+		if config.IsSecret(k) {
+			secrets = append(secrets, k)
+		}
+	}
+	if len(secrets) > 0 {
+		return errors.New("image " + local + " has secrets in its env (" + strings.Join(secrets, ", ") + "), pushing it would publish them. " +
+			"Push an image built without --bake-env before it is configured, eg. right after 'launcher2 build " + r.Config + "'")
+	}
+	if err := docker.TagImage(*ctx, local, remote); err != nil {
+		return err
+	}
+	if err := docker.PushImage(*ctx, remote); err != nil {
+		return err
+	}
+	fmt.Fprintln(utils.Out, "pushed "+local+" to "+remote)
+	return nil
+}
+
+type PullCmd struct {
+	Tag    string `default:"latest" help:"Tag of the image to pull from the registry."`
+	Config string `arg:"" name:"config" help:"config" predictor:"config"`
+}
+
+// Pulls the config's image from its registry, and tags it as the config's latest image, so it is the image the container starts from.
+func (r *PullCmd) Run(cli *Cli, ctx *context.Context) error {
+	config, err := cli.loadConfig(r.Config)
+	if err != nil {
+		return errors.New("YAML syntax error. Please check your containers/*.yml config files.")
+	}
+	remote, err := config.RegistryImage(r.Tag)
+	if err != nil {
+		return err
+	}
+	if err := docker.PullImage(*ctx, remote); err != nil {
+		return err
+	}
+	return docker.TagImage(*ctx, remote, utils.BaseImageName+r.Config+":latest")
+}
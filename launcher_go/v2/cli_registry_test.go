@@ -0,0 +1,117 @@
+package main_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"bytes"
+	"context"
+	ddocker "github.com/discourse/discourse_docker/launcher_go/v2"
+	"github.com/discourse/discourse_docker/launcher_go/v2/docker"
+	. "github.com/discourse/discourse_docker/launcher_go/v2/test_utils"
+	"github.com/discourse/discourse_docker/launcher_go/v2/utils"
+	"net/http"
+	"os"
+	"slices"
+)
+
+var _ = Describe("Registry", func() {
+	var testDir string
+	var out *bytes.Buffer
+	var cli *ddocker.Cli
+	var ctx context.Context
+	var api *FakeDockerApi
+
+	BeforeEach(func() {
+		out = &bytes.Buffer{}
+		utils.Out = out
+		utils.CommitWait = 0
+		ctx = context.Background()
+		testDir, _ = os.MkdirTemp("", "ddocker-test")
+		overlay := testDir + "/registry.yml"
+		os.WriteFile(overlay, []byte("registry: localhost:5000/\nimage_name: discourse/app\n"), 0644)
+		cli = &ddocker.Cli{ConfDir: "./test/containers", TemplatesDirs: []string{"./test"}, BuildDir: testDir, Overlays: []string{overlay}}
+		api = NewFakeDockerApi()
+		client, _ := docker.NewClient(api.Host())
+		docker.ActiveRuntime = &docker.ApiRuntime{Client: client}
+		api.Handle("GET", "/images/local_discourse/test:v1/json", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"Id":"sha256:app"}`))
+		})
+	})
+	AfterEach(func() {
+		docker.ActiveRuntime = docker.NewDockerRuntime()
+		api.Close()
+		os.RemoveAll(testDir)
+	})
+
+	It("pushes a built image to the config's registry", func() {
+		runner := ddocker.PushCmd{Config: "test", Tag: "v1"}
+		Expect(runner.Run(cli, &ctx)).To(Succeed())
+		tag := api.LastRequest("POST", "/images/local_discourse/test:v1/tag")
+		Expect(tag).ToNot(BeNil())
+		Expect(tag.Query.Get("repo")).To(Equal("localhost:5000/discourse/app"))
+		Expect(tag.Query.Get("tag")).To(Equal("v1"))
+		push := api.LastRequest("POST", "/images/localhost:5000/discourse/app/push")
+		Expect(push).ToNot(BeNil())
+		Expect(push.Query.Get("tag")).To(Equal("v1"))
+		Expect(push.Header.Get("X-Registry-Auth")).ToNot(BeEmpty())
+		Expect(out.String()).To(ContainSubstring("pushed local_discourse/test:v1 to localhost:5000/discourse/app:v1"))
+	})
+
+	It("refuses to push images with secrets in their env", func() {
+		api.Handle("GET", "/images/local_discourse/test:latest/json", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"Id":"sha256:app","Config":{"Env":["PATH=/usr/bin","DISCOURSE_DB_PASSWORD=s3cr3t","DISCOURSE_SMTP_USER_NAME=discourse"]}}`))
+		})
+		runner := ddocker.PushCmd{Config: "test", Tag: "latest"}
+		Expect(runner.Run(cli, &ctx)).To(MatchError(ContainSubstring("image local_discourse/test:latest has secrets in its env (DISCOURSE_DB_PASSWORD, DISCOURSE_SMTP_USER_NAME), pushing it would publish them")))
+		Expect(api.Calls()).ToNot(ContainElement("POST /images/local_discourse/test:latest/tag"))
+		Expect(api.Calls()).ToNot(ContainElement("POST /images/localhost:5000/discourse/app/push"))
+	})
+
+	It("needs a built image to push", func() {
+		api.Handle("GET", "/images/local_discourse/test:latest/json", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message":"No such image"}`))
+		})
+		runner := ddocker.PushCmd{Config: "test", Tag: "latest"}
+		Expect(runner.Run(cli, &ctx)).To(MatchError("image local_discourse/test:latest was not found, run 'launcher2 build test' to build it"))
+		Expect(api.Calls()).ToNot(ContainElement("POST /images/localhost:5000/discourse/app/push"))
+	})
+
+	It("needs a registry", func() {
+		cli.Overlays = []string{}
+		runner := ddocker.PushCmd{Config: "test", Tag: "latest"}
+		Expect(runner.Run(cli, &ctx)).To(MatchError("config test has no registry, set registry to push and pull its images"))
+		Expect(api.Calls()).To(BeEmpty())
+	})
+
+	It("pulls the config's image, and tags it as the image the container starts from", func() {
+		runner := ddocker.PullCmd{Config: "test", Tag: "v1"}
+		Expect(runner.Run(cli, &ctx)).To(Succeed())
+		pull := api.LastRequest("POST", "/images/create")
+		Expect(pull.Query.Get("fromImage")).To(Equal("localhost:5000/discourse/app"))
+		Expect(pull.Query.Get("tag")).To(Equal("v1"))
+		tag := api.LastRequest("POST", "/images/localhost:5000/discourse/app:v1/tag")
+		Expect(tag).ToNot(BeNil())
+		Expect(tag.Query.Get("repo")).To(Equal("local_discourse/test"))
+		Expect(tag.Query.Get("tag")).To(Equal("latest"))
+	})
+
+	It("starts from the registry's image", func() {
+		runner := ddocker.StartCmd{Config: "test", FromRegistry: true}
+		Expect(runner.Run(cli, &ctx)).To(Succeed())
+		calls := api.Calls()
+		Expect(slices.Index(calls, "POST /images/create")).To(BeNumerically("<", slices.Index(calls, "POST /containers/create")))
+	})
+
+	It("rebuilds from the registry's image without building", func() {
+		runner := ddocker.RebuildCmd{Config: "test", SkipVersionCheck: true, FromRegistry: true}
+		Expect(runner.Run(cli, &ctx)).To(Succeed())
+		calls := api.Calls()
+		Expect(calls).To(ContainElement("POST /images/localhost:5000/discourse/app:latest/tag"))
+		Expect(calls).ToNot(ContainElement("POST /build"))
+		// registry images aren't configured yet, so migrate and configure still run
+		Expect(calls).To(ContainElement("POST /commit"))
+		Expect(api.LastRequest("POST", "/images/create").Query.Get("fromImage")).To(Equal("localhost:5000/discourse/app"))
+	})
+})
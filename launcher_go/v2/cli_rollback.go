@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/discourse/discourse_docker/launcher_go/v2/docker"
+	"github.com/discourse/discourse_docker/launcher_go/v2/utils"
+	"slices"
+	"time"
+)
+
+/*
+ * rollback
+ */
+
+type RollbackCmd struct {
+	Config      string `arg:"" name:"config" help:"config" predictor:"config"`
+	To          string `name:"to" help:"Image tag to roll back to. Defaults to the image built before the one the container runs."`
+	HealthFlags `embed:""`
+}
+
+func (r *RollbackCmd) Run(cli *Cli, ctx *context.Context) error {
+	tag := r.To
+	if tag == "" {
+		var err error
+		if tag, err = previousBuildTag(*ctx, r.Config); err != nil {
+			return err
+		}
+	}
+	image := utils.BaseImageName + r.Config + ":" + tag
+	found, err := docker.InspectImage(*ctx, image)
+	if err != nil {
+		return err
+	}
+	if found == nil {
+		return errors.New("image " + image + " was not found")
+	}
+
+	fmt.Fprintln(utils.Out, "rolling back "+r.Config+" to "+image)
+	// latest is what later starts run and what rebuilds compare fingerprints against, so it must not stay on the bad build
+	if err := docker.TagImage(*ctx, image, utils.BaseImageName+r.Config+":latest"); err != nil {
+		return err
+	}
+	destroy := DestroyCmd{Config: r.Config}
+	if err := destroy.Run(cli, ctx); err != nil {
+		return err
+	}
+	start := StartCmd{Config: r.Config, RunImage: image, HealthFlags: r.HealthFlags}
+	return start.Run(cli, ctx)
+}
+
+// Tags the config's latest image with the current time, then removes all but the newest keep build tags.
+// Pruning is best-effort: an old tag may be the only tag of the image a rolled-back container runs.
+func tagBuild(ctx context.Context, config string, keep int, now time.Time) error {
+	repo := utils.BaseImageName + config
+	if err := docker.TagImage(ctx, repo+":latest", repo+":"+now.Format(utils.BuildTagFormat)); err != nil {
+		return err
+	}
+	tags, err := buildTags(ctx, config)
+	if err != nil {
+		return err
+	}
+	for len(tags) > keep {
+		if err := docker.RemoveImage(ctx, repo+":"+tags[0]); err != nil {
+			fmt.Fprintln(utils.Out, "Could not remove old build "+repo+":"+tags[0]+": "+err.Error())
+		}
+		tags = tags[1:]
+	}
+	return nil
+}
+
+// Returns the config's build tags, oldest first.
+func buildTags(ctx context.Context, config string) ([]string, error) {
+	tags, err := docker.ImageTags(ctx, utils.BaseImageName+config)
+	if err != nil {
+		return nil, err
+	}
+	result := []string{}
+	for _, tag := range tags {
+		if _, err := time.Parse(utils.BuildTagFormat, tag); err == nil {
+			result = append(result, tag)
+		}
+	}
+	slices.Sort(result)
+	return result, nil
+}
+
+// Finds the build tag before the image the config's container runs.
+// Without a container, eg. when a rebuild failed after destroying it, the latest image is taken as current.
+func previousBuildTag(ctx context.Context, config string) (string, error) {
+	currentId := ""
+	container, err := docker.InspectContainer(ctx, config)
+	if err != nil {
+		return "", err
+	}
+	if container != nil {
+		currentId = container.Image
+	} else {
+		latest, err := docker.InspectImage(ctx, utils.BaseImageName+config+":latest")
+		if err != nil {
+			return "", err
+		}
+		if latest != nil {
+			currentId = latest.Id
+		}
+	}
+	tags, err := buildTags(ctx, config)
+	if err != nil {
+		return "", err
+	}
+	// walk back from the current image's build, which may not be the newest after an earlier rollback
+	ids := map[string]string{}
+	for _, tag := range tags {
+		image, err := docker.InspectImage(ctx, utils.BaseImageName+config+":"+tag)
+		if err != nil {
+			return "", err
+		}
+		if image != nil {
+			ids[tag] = image.Id
+		}
+	}
+	current := slices.IndexFunc(tags, func(tag string) bool { return ids[tag] == currentId })
+	if current < 0 {
+		current = len(tags)
+	}
+	for i := current - 1; i >= 0; i-- {
+		if ids[tags[i]] != currentId {
+			return tags[i], nil
+		}
+	}
+	return "", errors.New("no previous image of " + config + " to roll back to")
+}
@@ -0,0 +1,167 @@
+package main_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"bytes"
+	"context"
+	"encoding/json"
+	ddocker "github.com/discourse/discourse_docker/launcher_go/v2"
+	"github.com/discourse/discourse_docker/launcher_go/v2/docker"
+	. "github.com/discourse/discourse_docker/launcher_go/v2/test_utils"
+	"github.com/discourse/discourse_docker/launcher_go/v2/utils"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var _ = Describe("Rollback", func() {
+	var testDir string
+	var cli *ddocker.Cli
+	var ctx context.Context
+	var api *FakeDockerApi
+	var images map[string]string
+	var containerImage string
+
+	BeforeEach(func() {
+		utils.Out = &bytes.Buffer{}
+		utils.CommitWait = 0
+		ctx = context.Background()
+		testDir, _ = os.MkdirTemp("", "ddocker-test")
+		cli = &ddocker.Cli{ConfDir: "./test/containers", TemplatesDirs: []string{"./test"}, BuildDir: testDir}
+		api = NewFakeDockerApi()
+		client, _ := docker.NewClient(api.Host())
+		docker.ActiveRuntime = &docker.ApiRuntime{Client: client}
+
+		images = map[string]string{
+			"local_discourse/test:latest":          "sha256:ccc",
+			"local_discourse/test:20240101-000000": "sha256:aaa",
+			"local_discourse/test:20240201-000000": "sha256:bbb",
+			"local_discourse/test:20240301-000000": "sha256:ccc",
+		}
+		containerImage = "sha256:ccc"
+		removed := false
+		api.Handle("GET", "/containers/json", func(w http.ResponseWriter, r *http.Request) {
+			if removed || r.URL.Query().Get("all") != "1" {
+				w.Write([]byte("[]"))
+				return
+			}
+			w.Write([]byte(`[{"Id":"abc","Names":["/test"]}]`))
+		})
+		api.Handle("DELETE", "/containers/test", func(w http.ResponseWriter, r *http.Request) {
+			removed = true
+			w.WriteHeader(http.StatusNoContent)
+		})
+		api.Handle("GET", "/containers/test/json", func(w http.ResponseWriter, r *http.Request) {
+			if containerImage == "" {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"message":"No such container: test"}`))
+				return
+			}
+			w.Write([]byte(`{"Id":"abc","Name":"/test","Image":"` + containerImage + `","State":{"Status":"running"}}`))
+		})
+		for image, id := range images {
+			id := id
+			api.Handle("GET", "/images/"+image+"/json", func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(`{"Id":"` + id + `"}`))
+			})
+		}
+		api.Handle("GET", "/images/json", func(w http.ResponseWriter, r *http.Request) {
+			tags := []string{}
+			for image := range images {
+				tags = append(tags, image)
+			}
+			json.NewEncoder(w).Encode([]map[string]any{{"Id": "sha256:ccc", "RepoTags": tags}})
+		})
+	})
+	AfterEach(func() {
+		docker.ActiveRuntime = docker.NewDockerRuntime()
+		api.Close()
+		os.RemoveAll(testDir)
+	})
+
+	var startedImage = func() string {
+		create := api.LastRequest("POST", "/containers/create")
+		Expect(create).ToNot(BeNil())
+		Expect(create.Query.Get("name")).To(Equal("test"))
+		config := docker.ContainerConfig{}
+		json.Unmarshal(create.Body, &config)
+		return config.Image
+	}
+
+	It("destroys the container and starts the previous build", func() {
+		runner := ddocker.RollbackCmd{Config: "test"}
+		Expect(runner.Run(cli, &ctx)).To(Succeed())
+		Expect(api.Calls()).To(ContainElements("POST /containers/test/stop", "DELETE /containers/test"))
+		Expect(startedImage()).To(Equal("local_discourse/test:20240201-000000"))
+		tag := api.LastRequest("POST", "/images/local_discourse/test:20240201-000000/tag")
+		Expect(tag).ToNot(BeNil())
+		Expect(tag.Query.Get("repo")).To(Equal("local_discourse/test"))
+		Expect(tag.Query.Get("tag")).To(Equal("latest"))
+	})
+
+	It("keeps rolling back from an earlier rollback", func() {
+		containerImage = "sha256:bbb"
+		runner := ddocker.RollbackCmd{Config: "test"}
+		Expect(runner.Run(cli, &ctx)).To(Succeed())
+		Expect(startedImage()).To(Equal("local_discourse/test:20240101-000000"))
+	})
+
+	It("rolls back from the latest image when there is no container", func() {
+		containerImage = ""
+		runner := ddocker.RollbackCmd{Config: "test"}
+		Expect(runner.Run(cli, &ctx)).To(Succeed())
+		Expect(startedImage()).To(Equal("local_discourse/test:20240201-000000"))
+	})
+
+	It("rolls back to a given tag", func() {
+		runner := ddocker.RollbackCmd{Config: "test", To: "20240101-000000"}
+		Expect(runner.Run(cli, &ctx)).To(Succeed())
+		Expect(startedImage()).To(Equal("local_discourse/test:20240101-000000"))
+	})
+
+	It("fails without a previous image", func() {
+		containerImage = "sha256:aaa"
+		runner := ddocker.RollbackCmd{Config: "test"}
+		Expect(runner.Run(cli, &ctx)).To(MatchError("no previous image of test to roll back to"))
+		Expect(api.Calls()).ToNot(ContainElement("DELETE /containers/test"))
+	})
+
+	It("fails on missing tags", func() {
+		api.Handle("GET", "/images/local_discourse/test:nope/json", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message":"No such image"}`))
+		})
+		runner := ddocker.RollbackCmd{Config: "test", To: "nope"}
+		Expect(runner.Run(cli, &ctx)).To(MatchError("image local_discourse/test:nope was not found"))
+	})
+
+	It("tags rebuilds and keeps only the newest builds", func() {
+		runner := ddocker.RebuildCmd{Config: "test", SkipVersionCheck: true, KeepImages: 2, SkipLint: true}
+		Expect(runner.Run(cli, &ctx)).To(Succeed())
+		var tagged string
+		for _, call := range api.Calls() {
+			if strings.HasSuffix(call, "/tag") {
+				tagged = call
+			}
+		}
+		Expect(tagged).To(Equal("POST /images/local_discourse/test:latest/tag"))
+		tag := api.LastRequest("POST", "/images/local_discourse/test:latest/tag")
+		Expect(tag.Query.Get("repo")).To(Equal("local_discourse/test"))
+		Expect(tag.Query.Get("tag")).To(MatchRegexp(`^\d{8}-\d{6}$`))
+		// the fake doesn't record the new tag, so of the three existing builds the oldest goes
+		Expect(api.Calls()).To(ContainElement("DELETE /images/local_discourse/test:20240101-000000"))
+		Expect(api.Calls()).ToNot(ContainElement("DELETE /images/local_discourse/test:20240201-000000"))
+	})
+
+	It("keeps rebuilding when an old build can't be removed", func() {
+		api.Handle("DELETE", "/images/local_discourse/test:20240101-000000", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(`{"message":"image is being used by running container"}`))
+		})
+		runner := ddocker.RebuildCmd{Config: "test", SkipVersionCheck: true, KeepImages: 2, SkipLint: true}
+		Expect(runner.Run(cli, &ctx)).To(Succeed())
+		Expect(utils.Out.(*bytes.Buffer).String()).To(ContainSubstring("Could not remove old build local_discourse/test:20240101-000000"))
+	})
+})
@@ -8,12 +8,8 @@ import (
 	"github.com/discourse/discourse_docker/launcher_go/v2/config"
 	"github.com/discourse/discourse_docker/launcher_go/v2/docker"
 	"github.com/discourse/discourse_docker/launcher_go/v2/utils"
-	"golang.org/x/sys/unix"
 	"os"
-	"os/exec"
-	"runtime"
 	"strings"
-	"syscall"
 	"time"
 )
 
@@ -30,53 +26,56 @@ import (
  */
 
 type StartCmd struct {
-	Config     string `arg:"" name:"config" help:"config" predictor:"config"`
-	DryRun     bool   `name:"dry-run" short:"n" help:"Do not start, print docker start command and exit."`
-	DockerArgs string `name:"docker-args" help:"Extra arguments to pass when running docker."`
-	RunImage   string `name:"run-image" help:"Start with a custom image."`
-	Supervised bool   `name:"supervised" env:"SUPERVISED" help:"Attach the running container on start."`
+	Config       string `arg:"" name:"config" help:"config" predictor:"config"`
+	DryRun       bool   `name:"dry-run" short:"n" help:"Do not start, print docker start command and exit."`
+	DockerArgs   string `name:"docker-args" help:"Extra arguments to pass when running docker."`
+	RunImage     string `name:"run-image" help:"Start with a custom image."`
+	Supervised   bool   `name:"supervised" env:"SUPERVISED" help:"Attach the running container on start."`
+	FromRegistry bool   `name:"from-registry" help:"Pull the config's latest image from its registry before starting. An existing container keeps its image, rebuild --from-registry replaces it."`
+	HealthFlags  `embed:""`
 
 	extraEnv []string
+	// Container name, when it isn't the config name
+	name string
+	// Ports published in place of the config's expose entries
+	publish []string
 }
 
 func (r *StartCmd) Run(cli *Cli, ctx *context.Context) error {
+	name := r.Config
+	if r.name != "" {
+		name = r.name
+	}
+	if r.FromRegistry && !r.DryRun {
+		pull := PullCmd{Config: r.Config, Tag: "latest"}
+		if err := pull.Run(cli, ctx); err != nil {
+			return err
+		}
+	}
 	//start stopped container first if exists
-	running, _ := docker.ContainerRunning(r.Config)
+	running, _ := docker.ContainerRunning(name)
 	if running && !r.DryRun {
 		fmt.Fprintln(utils.Out, "Nothing to do, your container has already started!")
 		return nil
 	}
-	exists, _ := docker.ContainerExists(r.Config)
+	exists, _ := docker.ContainerExists(name)
 	if exists && !r.DryRun {
 		fmt.Fprintln(utils.Out, "starting up existing container")
-		cmd := exec.CommandContext(*ctx, utils.DockerPath, "start", r.Config)
-		if r.Supervised {
-			cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
-			cmd.Cancel = func() error {
-				if runtime.GOOS == "darwin" {
-					runCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-					stopCmd := exec.CommandContext(runCtx, utils.DockerPath, "stop", r.Config)
-					utils.CmdRunner(stopCmd).Run()
-					cancel()
-				}
-				return unix.Kill(-cmd.Process.Pid, unix.SIGINT)
-			}
-			cmd.Args = append(cmd.Args, "--attach")
-			cmd.Stdin = os.Stdin
-			cmd.Stdout = os.Stdout
-			cmd.Stderr = os.Stderr
-		}
-		fmt.Fprintln(utils.Out, cmd)
-		if err := utils.CmdRunner(cmd).Run(); err != nil {
+		if err := docker.StartContainer(*ctx, name, r.Supervised); err != nil || r.Supervised || !r.Wait {
 			return err
 		}
-		return nil
 	}
 
-	config, err := config.LoadConfig(cli.ConfDir, r.Config, true, cli.TemplatesDir)
+	config, err := cli.loadConfig(r.Config)
 	if err != nil {
 		return errors.New("YAML syntax error. Please check your containers/*.yml config files.")
 	}
+	if r.publish != nil {
+		config.Expose = r.publish
+	}
+	if exists && !r.DryRun {
+		return r.waitHealthy(*ctx, config, name)
+	}
 	defaultHostname, _ := os.Hostname()
 	defaultHostname = defaultHostname + "-" + r.Config
 	hostname := config.DockerHostname(defaultHostname)
@@ -93,7 +92,7 @@ func (r *StartCmd) Run(cli *Cli, ctx *context.Context) error {
 	runner := docker.DockerRunner{
 		Config:      config,
 		Ctx:         ctx,
-		ContainerId: r.Config,
+		ContainerId: name,
 		DryRun:      r.DryRun,
 		CustomImage: r.RunImage,
 		Restart:     restart,
@@ -104,7 +103,10 @@ func (r *StartCmd) Run(cli *Cli, ctx *context.Context) error {
 		Cmd:         []string{bootCmd},
 	}
 	fmt.Fprintln(utils.Out, "starting new container...")
-	return runner.Run()
+	if err := runner.Run(); err != nil || r.Supervised || r.DryRun {
+		return err
+	}
+	return r.waitHealthy(*ctx, config, name)
 }
 
 type RunCmd struct {
@@ -115,7 +117,7 @@ type RunCmd struct {
 }
 
 func (r *RunCmd) Run(cli *Cli, ctx *context.Context) error {
-	config, err := config.LoadConfig(cli.ConfDir, r.Config, true, cli.TemplatesDir)
+	config, err := cli.loadConfig(r.Config)
 	if err != nil {
 		return errors.New("YAML syntax error. Please check your containers/*.yml config files.")
 	}
@@ -130,7 +132,6 @@ func (r *RunCmd) Run(cli *Cli, ctx *context.Context) error {
 		ExtraFlags:  extraFlags,
 	}
 	return runner.Run()
-	return nil
 }
 
 type StopCmd struct {
@@ -143,22 +144,18 @@ func (r *StopCmd) Run(cli *Cli, ctx *context.Context) error {
 		fmt.Fprintln(utils.Out, r.Config+" was not found")
 		return nil
 	}
-	cmd := exec.CommandContext(*ctx, "docker", "stop", "-t", "600", r.Config)
-	fmt.Fprintln(utils.Out, cmd)
-	if err := utils.CmdRunner(cmd).Run(); err != nil {
-		return err
-	}
-	return nil
+	return docker.StopContainer(*ctx, r.Config)
 }
 
 type RestartCmd struct {
-	Config     string `arg:"" name:"config" help:"config" predictor:"config"`
-	DockerArgs string `name:"docker-args" help:"Extra arguments to pass when running docker."`
-	RunImage   string `name:"run-image" help:"Override the image used for running the container."`
+	Config      string `arg:"" name:"config" help:"config" predictor:"config"`
+	DockerArgs  string `name:"docker-args" help:"Extra arguments to pass when running docker."`
+	RunImage    string `name:"run-image" help:"Override the image used for running the container."`
+	HealthFlags `embed:""`
 }
 
 func (r *RestartCmd) Run(cli *Cli, ctx *context.Context) error {
-	start := StartCmd{Config: r.Config, DockerArgs: r.DockerArgs, RunImage: r.RunImage}
+	start := StartCmd{Config: r.Config, DockerArgs: r.DockerArgs, RunImage: r.RunImage, HealthFlags: r.HealthFlags}
 	stop := StopCmd{Config: r.Config}
 	if err := stop.Run(cli, ctx); err != nil {
 		return err
@@ -180,17 +177,10 @@ func (r *DestroyCmd) Run(cli *Cli, ctx *context.Context) error {
 		return nil
 	}
 
-	cmd := exec.CommandContext(*ctx, utils.DockerPath, "stop", "-t", "600", r.Config)
-	fmt.Fprintln(utils.Out, cmd)
-	if err := utils.CmdRunner(cmd).Run(); err != nil {
-		return err
-	}
-	cmd = exec.CommandContext(*ctx, utils.DockerPath, "rm", r.Config)
-	fmt.Fprintln(utils.Out, cmd)
-	if err := utils.CmdRunner(cmd).Run(); err != nil {
+	if err := docker.StopContainer(*ctx, r.Config); err != nil {
 		return err
 	}
-	return nil
+	return docker.RemoveContainer(*ctx, r.Config)
 }
 
 type EnterCmd struct {
@@ -198,14 +188,7 @@ type EnterCmd struct {
 }
 
 func (r *EnterCmd) Run(cli *Cli, ctx *context.Context) error {
-	cmd := exec.CommandContext(*ctx, utils.DockerPath, "exec", "-it", r.Config, "/bin/bash", "--login")
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := utils.CmdRunner(cmd).Run(); err != nil {
-		return err
-	}
-	return nil
+	return docker.EnterContainer(*ctx, r.Config)
 }
 
 type LogsCmd struct {
@@ -213,8 +196,7 @@ type LogsCmd struct {
 }
 
 func (r *LogsCmd) Run(cli *Cli, ctx *context.Context) error {
-	cmd := exec.CommandContext(*ctx, utils.DockerPath, "logs", r.Config)
-	output, err := utils.CmdRunner(cmd).Output()
+	output, err := docker.ContainerLogs(*ctx, r.Config)
 	if err != nil {
 		return err
 	}
@@ -223,10 +205,21 @@ func (r *LogsCmd) Run(cli *Cli, ctx *context.Context) error {
 }
 
 type RebuildCmd struct {
-	Config           string `arg:"" name:"config" help:"config" predictor:"config"`
-	FullBuild        bool   `name:"full-build" help:"Run a full build image even when migrate on boot and precompile on boot are present in the config. Saves a fully built image with environment baked in. Without this flag, if MIGRATE_ON_BOOT is set in config it will defer migration until container start, and if PRECOMPILE_ON_BOOT is set in the config, it will defer configure step until container start."`
-	SkipVersionCheck bool   `env:"SKIP_VERSION_CHECK" help:"Skips launcher checking for a new version"`
-	Clean            bool   `help:"also runs clean"`
+	Config           string   `arg:"" name:"config" help:"config" predictor:"config"`
+	FullBuild        bool     `name:"full-build" help:"Run a full build image even when migrate on boot and precompile on boot are present in the config. Saves a fully built image with environment baked in. Without this flag, if MIGRATE_ON_BOOT is set in config it will defer migration until container start, and if PRECOMPILE_ON_BOOT is set in the config, it will defer configure step until container start."`
+	SkipVersionCheck bool     `env:"SKIP_VERSION_CHECK" help:"Skips launcher checking for a new version"`
+	Clean            bool     `help:"also runs clean"`
+	SkipLint         bool     `name:"skip-lint" help:"Build even when lint finds errors in the config."`
+	DisableLint      []string `name:"disable" help:"Lint rule to skip when linting before the build, eg. missing-link. May be repeated."`
+	Force            bool     `help:"Rebuild even when the image was built from the same config, templates, and base image."`
+	Check            bool     `help:"Only report whether the container is out of date with its config, templates, and base image, without rebuilding. Exits non-zero when it is."`
+	KeepImages       int      `name:"keep-images" default:"3" help:"Number of rebuilt images to keep per config, tagged with their build time, for rollback. 0 keeps none."`
+	Strategy         string   `default:"restart" enum:"restart,blue-green" help:"restart destroys the old container before starting the new one. blue-green starts the new container next to the old one, and only moves traffic once it is healthy. blue-green needs a config with an external database."`
+	UpstreamFile     string   `name:"upstream-file" help:"For blue-green rebuilds, required: move traffic by writing an nginx upstream pointing at the new container's http port to this file." predictor:"file"`
+	ReloadProxy      string   `name:"reload-proxy" help:"For blue-green rebuilds: shell command run after the upstream file is written, eg. 'nginx -s reload'."`
+	FromRegistry     bool     `name:"from-registry" help:"Deploy the config's latest image from its registry instead of building one. Migrations and configure still run, unless MIGRATE_ON_BOOT or PRECOMPILE_ON_BOOT is set."`
+	HealthFlags      `embed:""`
+	BuildCacheFlags  `embed:""`
 }
 
 func (r *RebuildCmd) Run(cli *Cli, ctx *context.Context) error {
@@ -235,7 +228,7 @@ func (r *RebuildCmd) Run(cli *Cli, ctx *context.Context) error {
 		CheckVersion()
 	}
 
-	config, err := config.LoadConfig(cli.ConfDir, r.Config, true, cli.TemplatesDir)
+	config, err := cli.loadConfig(r.Config)
 	if err != nil {
 		return errors.New("YAML syntax error. Please check your containers/*.yml config files.")
 	}
@@ -243,46 +236,112 @@ func (r *RebuildCmd) Run(cli *Cli, ctx *context.Context) error {
 	// if we're not in an all-in-one setup, we can run migrations while the app is running
 	externalDb := config.Env["DISCOURSE_DB_SOCKET"] == "" && config.Env["DISCOURSE_DB_HOST"] != ""
 
-	build := DockerBuildCmd{Config: r.Config}
+	if r.Strategy == "blue-green" && !externalDb {
+		return errors.New("blue-green rebuilds need a config with an external database, such as web_only. " + r.Config + " runs its own database")
+	}
+	// published ports can't move between running containers, so only a proxy in front can swap without downtime
+	if r.Strategy == "blue-green" && r.UpstreamFile == "" {
+		return errors.New("blue-green rebuilds need --upstream-file, to move traffic through a reverse proxy in front of " + r.Config)
+	}
+	if r.Strategy == "blue-green" {
+		if err := blueGreenPorts(config); err != nil {
+			return err
+		}
+	}
+
+	if r.Check {
+		return r.checkFingerprint(*ctx, config)
+	}
+
+	build := DockerBuildCmd{Config: r.Config, SkipLint: r.SkipLint, DisableLint: r.DisableLint, BuildCacheFlags: r.BuildCacheFlags}
 	configure := DockerConfigureCmd{Config: r.Config}
 	stop := StopCmd{Config: r.Config}
 	destroy := DestroyCmd{Config: r.Config}
 	clean := CleanupCmd{}
 	extraEnv := []string{}
 
-	if err := build.Run(cli, ctx); err != nil {
-		return err
+	upToDate := false
+	// images from the registry are deployed as they are, there is no fingerprint to compare
+	if !r.FromRegistry {
+		if fingerprint, err := configFingerprint(*ctx, config, r.pull(config)); err != nil {
+			// the fingerprint only saves work, so rebuild without one
+			fmt.Fprintln(utils.Out, "Could not fingerprint "+r.Config+", rebuilding: "+err.Error())
+		} else {
+			// stamped when configure commits, so a rebuild failing before then doesn't look up to date
+			configure.labels = map[string]string{utils.FingerprintLabel: fingerprint}
+			if !r.Force {
+				image, err := docker.InspectImage(*ctx, utils.BaseImageName+r.Config)
+				if err != nil {
+					return err
+				}
+				upToDate = image != nil && image.Labels[utils.FingerprintLabel] == fingerprint
+				if upToDate {
+					status, err := docker.InspectContainer(*ctx, r.Config)
+					if err != nil {
+						return err
+					}
+					if status != nil && status.State == "running" && status.Image == image.Id {
+						fmt.Fprintln(utils.Out, r.Config+" is up to date with its config, pass --force to rebuild anyway")
+						return nil
+					}
+					fmt.Fprintln(utils.Out, r.Config+" image is up to date with its config, skipping build")
+				}
+			}
+		}
 	}
-	if !externalDb {
-		if err := stop.Run(cli, ctx); err != nil {
+
+	if !upToDate {
+		if r.FromRegistry {
+			pull := PullCmd{Config: r.Config, Tag: "latest"}
+			if err := pull.Run(cli, ctx); err != nil {
+				return err
+			}
+		} else if err := build.Run(cli, ctx); err != nil {
 			return err
 		}
+		if !externalDb {
+			if err := stop.Run(cli, ctx); err != nil {
+				return err
+			}
+		}
+		_, migrateOnBoot := config.Env["MIGRATE_ON_BOOT"]
+		if !migrateOnBoot || r.FullBuild {
+			migrate := DockerMigrateCmd{Config: r.Config}
+			if externalDb {
+				// defer post deploy migrations until after reboot
+				migrate.SkipPostDeploymentMigrations = true
+			}
+			if err := migrate.Run(cli, ctx); err != nil {
+				return err
+			}
+			extraEnv = append(extraEnv, "MIGRATE_ON_BOOT=0")
+		}
+		_, precompileOnBoot := config.Env["PRECOMPILE_ON_BOOT"]
+		// registry images are pushed before they are configured, so they are configured here too
+		if !precompileOnBoot || r.FullBuild {
+			if err := configure.Run(cli, ctx); err != nil {
+				return err
+			}
+			extraEnv = append(extraEnv, "PRECOMPILE_ON_BOOT=0")
+		}
+		if r.KeepImages > 0 {
+			if err := tagBuild(*ctx, r.Config, r.KeepImages, time.Now()); err != nil {
+				return err
+			}
+		}
 	}
-	_, migrateOnBoot := config.Env["MIGRATE_ON_BOOT"]
-	if !migrateOnBoot || r.FullBuild {
-		migrate := DockerMigrateCmd{Config: r.Config}
-		if externalDb {
-			// defer post deploy migrations until after reboot
-			migrate.SkipPostDeploymentMigrations = true
+	if r.Strategy == "blue-green" {
+		if err := r.blueGreenSwap(cli, ctx, config, extraEnv); err != nil {
+			return err
 		}
-		if err := migrate.Run(cli, ctx); err != nil {
+	} else {
+		if err := destroy.Run(cli, ctx); err != nil {
 			return err
 		}
-		extraEnv = append(extraEnv, "MIGRATE_ON_BOOT=0")
-	}
-	_, precompileOnBoot := config.Env["PRECOMPILE_ON_BOOT"]
-	if !precompileOnBoot || r.FullBuild {
-		if err := configure.Run(cli, ctx); err != nil {
+		start := StartCmd{Config: r.Config, HealthFlags: r.HealthFlags, extraEnv: extraEnv}
+		if err := start.Run(cli, ctx); err != nil {
 			return err
 		}
-		extraEnv = append(extraEnv, "PRECOMPILE_ON_BOOT=0")
-	}
-	if err := destroy.Run(cli, ctx); err != nil {
-		return err
-	}
-	start := StartCmd{Config: r.Config, extraEnv: extraEnv}
-	if err := start.Run(cli, ctx); err != nil {
-		return err
 	}
 	// run post deploy migrations since we've rebooted
 	if externalDb {
@@ -299,15 +358,53 @@ func (r *RebuildCmd) Run(cli *Cli, ctx *context.Context) error {
 	return nil
 }
 
+// Reports whether the container runs an image built and configured from the config as it is now.
+// The base image is not pulled, so only base image updates already pulled are noticed.
+func (r *RebuildCmd) checkFingerprint(ctx context.Context, config *config.Config) error {
+	fingerprint, err := configFingerprint(ctx, config, false)
+	if err != nil {
+		return err
+	}
+	status, err := docker.InspectContainer(ctx, r.Config)
+	if err != nil {
+		return err
+	}
+	if status == nil {
+		return errors.New(r.Config + " has no container, run 'launcher2 rebuild " + r.Config + "' to build and start it")
+	}
+	image, err := docker.InspectImage(ctx, status.Image)
+	if err != nil {
+		return err
+	}
+	if image == nil || image.Labels[utils.FingerprintLabel] != fingerprint {
+		return errors.New(r.Config + " is out of date with its config, run 'launcher2 rebuild " + r.Config + "' to update it")
+	}
+	fmt.Fprintln(utils.Out, r.Config+" is up to date with its config")
+	return nil
+}
+
+// The fingerprint of a config and the base image it builds from. When pull is set,
+// the base image is pulled first, so an updated base image changes the fingerprint.
+func configFingerprint(ctx context.Context, config *config.Config, pull bool) (string, error) {
+	if pull {
+		if err := docker.PullImage(ctx, config.Base_Image); err != nil {
+			return "", err
+		}
+	}
+	base, err := docker.InspectImage(ctx, config.Base_Image)
+	if err != nil {
+		return "", err
+	}
+	if base == nil {
+		return "", errors.New("base image " + config.Base_Image + " does not exist")
+	}
+	return config.Fingerprint(base.Id), nil
+}
+
 type CleanupCmd struct{}
 
 func (r *CleanupCmd) Run(cli *Cli, ctx *context.Context) error {
-	cmd := exec.CommandContext(*ctx, utils.DockerPath, "container", "prune", "--filter", "until=1h")
-	if err := utils.CmdRunner(cmd).Run(); err != nil {
-		return err
-	}
-	cmd = exec.CommandContext(*ctx, utils.DockerPath, "image", "prune", "--all", "--filter", "until=1h")
-	if err := utils.CmdRunner(cmd).Run(); err != nil {
+	if err := docker.Prune(*ctx); err != nil {
 		return err
 	}
 	_, err := os.Stat("/var/discourse/shared/standalone/postgres_data_old")
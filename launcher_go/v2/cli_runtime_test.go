@@ -6,9 +6,13 @@ import (
 
 	"bytes"
 	"context"
+	"encoding/json"
 	ddocker "github.com/discourse/discourse_docker/launcher_go/v2"
+	"github.com/discourse/discourse_docker/launcher_go/v2/config"
+	"github.com/discourse/discourse_docker/launcher_go/v2/docker"
 	. "github.com/discourse/discourse_docker/launcher_go/v2/test_utils"
 	"github.com/discourse/discourse_docker/launcher_go/v2/utils"
+	"net/http"
 	"os"
 )
 
@@ -27,9 +31,9 @@ var _ = Describe("Runtime", func() {
 		ctx = context.Background()
 
 		cli = &ddocker.Cli{
-			ConfDir:      "./test/containers",
-			TemplatesDir: "./test",
-			BuildDir:     testDir,
+			ConfDir:       "./test/containers",
+			TemplatesDirs: []string{"./test"},
+			BuildDir:      testDir,
 		}
 		utils.CmdRunner = CreateNewFakeCmdRunner()
 	})
@@ -41,9 +45,9 @@ var _ = Describe("Runtime", func() {
 
 		var checkStartCmd = func() {
 			cmd := GetLastCommand()
-			Expect(cmd.String()).To(ContainSubstring("docker ps -q --filter name=test"))
+			Expect(cmd.String()).To(ContainSubstring("docker ps -q --filter name=^/?test$"))
 			cmd = GetLastCommand()
-			Expect(cmd.String()).To(ContainSubstring("docker ps -a -q --filter name=test"))
+			Expect(cmd.String()).To(ContainSubstring("docker ps -a -q --filter name=^/?test$"))
 			cmd = GetLastCommand()
 			Expect(cmd.String()).To(ContainSubstring("docker run"))
 			Expect(cmd.String()).To(ContainSubstring("-d"))
@@ -52,19 +56,19 @@ var _ = Describe("Runtime", func() {
 
 		var checkStartCmdWhenStarted = func() {
 			cmd := GetLastCommand()
-			Expect(cmd.String()).To(ContainSubstring("docker ps -q --filter name=test"))
+			Expect(cmd.String()).To(ContainSubstring("docker ps -q --filter name=^/?test$"))
 		}
 
 		var checkStopCmd = func() {
 			cmd := GetLastCommand()
-			Expect(cmd.String()).To(ContainSubstring("docker ps -a -q --filter name=test"))
+			Expect(cmd.String()).To(ContainSubstring("docker ps -a -q --filter name=^/?test$"))
 			cmd = GetLastCommand()
 			Expect(cmd.String()).To(ContainSubstring("docker stop -t 600 test"))
 		}
 
 		var checkStopCmdWhenMissing = func() {
 			cmd := GetLastCommand()
-			Expect(cmd.String()).To(ContainSubstring("docker ps -a -q --filter name=test"))
+			Expect(cmd.String()).To(ContainSubstring("docker ps -a -q --filter name=^/?test$"))
 		}
 
 		It("should run start commands", func() {
@@ -99,12 +103,18 @@ var _ = Describe("Runtime", func() {
 			})
 
 			It("should keep running during commits, and be post-deploy migration aware when using a web only container", func() {
-				runner := ddocker.RebuildCmd{Config: "web_only", SkipVersionCheck: true}
+				runner := ddocker.RebuildCmd{Config: "web_only", SkipVersionCheck: true, SkipLint: true}
 
 				runner.Run(cli, &ctx)
 
-				//initial build
+				// fingerprinting pulls and inspects the base image, the fake inspect output can't be read so it rebuilds
 				cmd := GetLastCommand()
+				Expect(cmd.String()).To(ContainSubstring("docker pull "))
+				cmd = GetLastCommand()
+				Expect(cmd.String()).To(ContainSubstring("docker image inspect "))
+
+				//initial build
+				cmd = GetLastCommand()
 				Expect(cmd.String()).To(ContainSubstring("docker build"))
 
 				//migrate, skipping post deployment migrations
@@ -124,7 +134,7 @@ var _ = Describe("Runtime", func() {
 
 				// destroying
 				cmd = GetLastCommand()
-				Expect(cmd.String()).To(ContainSubstring("docker ps -a -q --filter name=web_only"))
+				Expect(cmd.String()).To(ContainSubstring("docker ps -a -q --filter name=^/?web_only$"))
 				cmd = GetLastCommand()
 				Expect(cmd.String()).To(ContainSubstring("docker stop -t 600 web_only"))
 				cmd = GetLastCommand()
@@ -143,17 +153,23 @@ var _ = Describe("Runtime", func() {
 			})
 
 			It("should stop with standalone", func() {
-				runner := ddocker.RebuildCmd{Config: "standalone", SkipVersionCheck: true}
+				runner := ddocker.RebuildCmd{Config: "standalone", SkipVersionCheck: true, SkipLint: true}
 
 				runner.Run(cli, &ctx)
 
-				//initial build
+				// fingerprinting pulls and inspects the base image, the fake inspect output can't be read so it rebuilds
 				cmd := GetLastCommand()
+				Expect(cmd.String()).To(ContainSubstring("docker pull "))
+				cmd = GetLastCommand()
+				Expect(cmd.String()).To(ContainSubstring("docker image inspect "))
+
+				//initial build
+				cmd = GetLastCommand()
 				Expect(cmd.String()).To(ContainSubstring("docker build"))
 				cmd = GetLastCommand()
 
 				// stop
-				Expect(cmd.String()).To(ContainSubstring("docker ps -a -q --filter name=standalone"))
+				Expect(cmd.String()).To(ContainSubstring("docker ps -a -q --filter name=^/?standalone$"))
 				cmd = GetLastCommand()
 				Expect(cmd.String()).To(ContainSubstring("docker stop"))
 
@@ -189,3 +205,125 @@ var _ = Describe("Runtime", func() {
 
 	})
 })
+
+var _ = Describe("Rebuild fingerprint", func() {
+	var testDir string
+	var out *bytes.Buffer
+	var cli *ddocker.Cli
+	var ctx context.Context
+	var api *FakeDockerApi
+	var fingerprint string
+	var imageLabel string
+	var containerImage string
+
+	BeforeEach(func() {
+		out = &bytes.Buffer{}
+		utils.Out = out
+		utils.CommitWait = 0
+		ctx = context.Background()
+		testDir, _ = os.MkdirTemp("", "ddocker-test")
+		cli = &ddocker.Cli{ConfDir: "./test/containers", TemplatesDirs: []string{"./test"}, BuildDir: testDir}
+		api = NewFakeDockerApi()
+		client, _ := docker.NewClient(api.Host())
+		docker.ActiveRuntime = &docker.ApiRuntime{Client: client}
+
+		conf, err := config.LoadConfig("./test/containers", "standalone", true, "./test")
+		Expect(err).To(BeNil())
+		fingerprint = conf.Fingerprint("sha256:base")
+		imageLabel = fingerprint
+		containerImage = "sha256:app"
+
+		api.Handle("GET", "/images/"+config.DefaultBaseImage()+"/json", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"Id":"sha256:base"}`))
+		})
+		api.Handle("GET", "/images/local_discourse/standalone/json", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"Id":"sha256:app","Config":{"Labels":{"` + utils.FingerprintLabel + `":"` + imageLabel + `"}}}`))
+		})
+		api.Handle("GET", "/images/"+containerImage+"/json", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"Id":"sha256:app","Config":{"Labels":{"` + utils.FingerprintLabel + `":"` + imageLabel + `"}}}`))
+		})
+		api.Handle("GET", "/containers/standalone/json", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"Id":"standalone","Image":"` + containerImage + `","State":{"Status":"running"}}`))
+		})
+	})
+	AfterEach(func() {
+		docker.ActiveRuntime = docker.NewDockerRuntime()
+		api.Close()
+		os.RemoveAll(testDir)
+	})
+
+	It("skips rebuilding a container that is up to date", func() {
+		runner := ddocker.RebuildCmd{Config: "standalone", SkipVersionCheck: true, SkipLint: true}
+		Expect(runner.Run(cli, &ctx)).To(Succeed())
+		Expect(out.String()).To(ContainSubstring("standalone is up to date with its config, pass --force to rebuild anyway"))
+		Expect(api.Calls()).To(ContainElement("POST /images/create"))
+		Expect(api.Calls()).ToNot(ContainElement("POST /build"))
+		Expect(api.Calls()).ToNot(ContainElement("POST /containers/create"))
+	})
+
+	It("restarts a container running an older image without building", func() {
+		containerImage = "sha256:old"
+		runner := ddocker.RebuildCmd{Config: "standalone", SkipVersionCheck: true, SkipLint: true}
+		runner.Run(cli, &ctx)
+		Expect(out.String()).To(ContainSubstring("standalone image is up to date with its config, skipping build"))
+		Expect(api.Calls()).ToNot(ContainElement("POST /build"))
+		Expect(api.Calls()).To(ContainElement("POST /containers/create"))
+	})
+
+	It("labels the configured image with the fingerprint, not the build", func() {
+		runner := ddocker.RebuildCmd{Config: "standalone", SkipVersionCheck: true, SkipLint: true, Force: true}
+		runner.Run(cli, &ctx)
+		build := api.LastRequest("POST", "/build")
+		Expect(build).ToNot(BeNil())
+		Expect(build.Query.Get("labels")).ToNot(ContainSubstring(utils.FingerprintLabel))
+		commit := api.LastRequest("POST", "/commit")
+		Expect(commit).ToNot(BeNil())
+		Expect(commit.Query["changes"]).To(ContainElement("LABEL " + utils.FingerprintLabel + "=" + fingerprint))
+	})
+
+	It("rebuilds after a rebuild that failed to configure", func() {
+		imageLabel = "stale"
+		// the image keeps the labels of the last build or commit
+		api.Handle("POST", "/build", func(w http.ResponseWriter, r *http.Request) {
+			labels := map[string]string{}
+			json.Unmarshal([]byte(r.URL.Query().Get("labels")), &labels)
+			imageLabel = labels[utils.FingerprintLabel]
+			w.Write([]byte(`{"stream":"Successfully built fake-image-id\n"}`))
+		})
+		api.Handle("POST", "/commit", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		})
+		runner := ddocker.RebuildCmd{Config: "standalone", SkipVersionCheck: true, SkipLint: true}
+		Expect(runner.Run(cli, &ctx)).ToNot(Succeed())
+		Expect(imageLabel).ToNot(Equal(fingerprint))
+
+		runner.Run(cli, &ctx)
+		Expect(out.String()).ToNot(ContainSubstring("up to date"))
+		builds := 0
+		for _, call := range api.Calls() {
+			if call == "POST /build" {
+				builds++
+			}
+		}
+		Expect(builds).To(Equal(2))
+	})
+
+	It("rebuilds when the config changed", func() {
+		imageLabel = "stale"
+		runner := ddocker.RebuildCmd{Config: "standalone", SkipVersionCheck: true, SkipLint: true}
+		runner.Run(cli, &ctx)
+		Expect(api.Calls()).To(ContainElement("POST /build"))
+	})
+
+	It("checks whether the container is out of date", func() {
+		runner := ddocker.RebuildCmd{Config: "standalone", SkipVersionCheck: true, Check: true}
+		Expect(runner.Run(cli, &ctx)).To(Succeed())
+		Expect(out.String()).To(ContainSubstring("standalone is up to date with its config"))
+
+		imageLabel = "stale"
+		Expect(runner.Run(cli, &ctx)).To(MatchError("standalone is out of date with its config, run 'launcher2 rebuild standalone' to update it"))
+		// checks never pull or build
+		Expect(api.Calls()).ToNot(ContainElement("POST /images/create"))
+		Expect(api.Calls()).ToNot(ContainElement("POST /build"))
+	})
+})
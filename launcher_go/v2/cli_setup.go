@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"github.com/discourse/discourse_docker/launcher_go/v2/config"
+	"github.com/discourse/discourse_docker/launcher_go/v2/utils"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ * setup
+ */
+
+type SetupCmd struct {
+	Config           string `arg:"" optional:"" default:"app" name:"config" help:"Name of the config to create."`
+	Sample           string `help:"Sample config to start from. Defaults to samples/standalone.yml in the templates dir." predictor:"file"`
+	NonInteractive   bool   `short:"y" name:"non-interactive" help:"Don't prompt, take every answer from flags."`
+	Force            bool   `help:"Overwrite the config if it already exists, and only warn about ports in use."`
+	Hostname         string `help:"Domain name Discourse responds to, eg. discourse.example.com."`
+	DeveloperEmails  string `name:"developer-emails" help:"Comma separated emails made admin and developer on signup."`
+	SmtpAddress      string `name:"smtp-address" help:"SMTP server used to send email."`
+	SmtpPort         int    `name:"smtp-port" default:"587" help:"SMTP server port."`
+	SmtpUserName     string `name:"smtp-user-name" help:"SMTP user name."`
+	SmtpPassword     string `name:"smtp-password" env:"DISCOURSE_SMTP_PASSWORD" help:"SMTP password."`
+	LetsencryptEmail string `name:"letsencrypt-email" help:"Email for Let's Encrypt notices. Serves https with a free Let's Encrypt certificate when set."`
+	HttpPort         int    `name:"http-port" default:"80" help:"Host port to serve http on."`
+	HttpsPort        int    `name:"https-port" default:"443" help:"Host port to serve https on."`
+	MemoryGb         int    `name:"memory-gb" help:"Memory in GB to size unicorn workers and postgres buffers for. Detected when not set."`
+	Cpus             int    `help:"CPU cores to size unicorn workers for. Detected when not set."`
+}
+
+func (r *SetupCmd) Run(cli *Cli) error {
+	filename := strings.TrimRight(cli.ConfDir, "/") + "/" + r.Config + ".yml"
+	if _, err := os.Stat(filename); err == nil && !r.Force {
+		return errors.New(filename + " already exists, pass --force to overwrite it")
+	}
+	sample := r.Sample
+	if sample == "" {
+		var err error
+		if sample, err = config.FindTemplate(cli.TemplatesDirs, "samples/standalone.yml"); err != nil {
+			return errors.New("could not find samples/standalone.yml in the templates dir, pass --sample")
+		}
+	}
+	content, err := os.ReadFile(sample)
+	if err != nil {
+		return err
+	}
+	if r.Cpus == 0 {
+		r.Cpus = runtime.NumCPU()
+	}
+	if r.MemoryGb == 0 {
+		r.MemoryGb = detectMemoryGb()
+	}
+
+	scanner := bufio.NewScanner(utils.In)
+	if !r.NonInteractive {
+		r.prompt(scanner)
+	}
+	if err := r.check(); err != nil {
+		return err
+	}
+	workers, sharedBuffers := scaleForHost(r.MemoryGb, r.Cpus)
+	fmt.Fprintf(utils.Out, "Sizing for %d GB of memory and %d CPU cores: %d unicorn workers, %dMB postgres shared buffers\n", r.MemoryGb, r.Cpus, workers, sharedBuffers)
+	if !r.NonInteractive {
+		fmt.Fprintf(utils.Out, "Write %s? (Y/n) ", filename)
+		if scanner.Scan() && strings.HasPrefix(strings.ToLower(strings.TrimSpace(scanner.Text())), "n") {
+			return errors.New("Cancelled")
+		}
+	}
+
+	file := config.NewConfigFile(filename, content)
+	if err := r.edit(file, workers, sharedBuffers); err != nil {
+		return err
+	}
+	if err := cli.saveConfigFile(file); err != nil {
+		return err
+	}
+	if _, err := cli.loadConfig(r.Config); err != nil {
+		return err
+	}
+	fmt.Fprintln(utils.Out, "Wrote "+filename+", run 'launcher2 rebuild "+r.Config+"' to build and start Discourse")
+	return nil
+}
+
+// Asks for each setting, defaulting to the flag's value.
+func (r *SetupCmd) prompt(scanner *bufio.Scanner) {
+	ask := func(question string, value *string, shown string) {
+		fmt.Fprintf(utils.Out, "%s [%s]: ", question, shown)
+		if scanner.Scan() {
+			if answer := strings.TrimSpace(scanner.Text()); answer != "" {
+				*value = answer
+			}
+		}
+	}
+	askInt := func(question string, value *int) {
+		answer := strconv.Itoa(*value)
+		ask(question, &answer, answer)
+		if n, err := strconv.Atoi(answer); err == nil {
+			*value = n
+		}
+	}
+	ask("Hostname for your Discourse?", &r.Hostname, r.Hostname)
+	ask("Email address for admin account(s)?", &r.DeveloperEmails, r.DeveloperEmails)
+	ask("SMTP server address?", &r.SmtpAddress, r.SmtpAddress)
+	askInt("SMTP port?", &r.SmtpPort)
+	ask("SMTP user name?", &r.SmtpUserName, r.SmtpUserName)
+	shown := ""
+	if r.SmtpPassword != "" {
+		shown = "unchanged"
+	}
+	ask("SMTP password?", &r.SmtpPassword, shown)
+	ask("Optional email address for Let's Encrypt warnings?", &r.LetsencryptEmail, r.LetsencryptEmail)
+	askInt("Port to serve http on?", &r.HttpPort)
+	askInt("Port to serve https on?", &r.HttpsPort)
+}
+
+func (r *SetupCmd) check() error {
+	problems := []error{}
+	switch {
+	case r.Hostname == "" || r.Hostname == "discourse.example.com":
+		problems = append(problems, errors.New("a hostname is required, pass --hostname"))
+	case net.ParseIP(r.Hostname) != nil || !strings.Contains(r.Hostname, "."):
+		problems = append(problems, fmt.Errorf("hostname %s must be a domain name, Discourse will not work with a bare IP number", r.Hostname))
+	}
+	if r.DeveloperEmails == "" {
+		problems = append(problems, errors.New("an admin email is required, pass --developer-emails"))
+	}
+	for _, email := range strings.Split(r.DeveloperEmails, ",") {
+		if email != "" && !strings.Contains(email, "@") {
+			problems = append(problems, fmt.Errorf("admin email %s is not an email address", email))
+		}
+	}
+	if r.SmtpAddress == "" || r.SmtpUserName == "" || r.SmtpPassword == "" {
+		problems = append(problems, errors.New("SMTP settings are required to send account emails, pass --smtp-address, --smtp-user-name, and --smtp-password"))
+	}
+	if r.LetsencryptEmail != "" && !strings.Contains(r.LetsencryptEmail, "@") {
+		problems = append(problems, fmt.Errorf("Let's Encrypt email %s is not an email address", r.LetsencryptEmail))
+	}
+	for _, port := range []int{r.HttpPort, r.HttpsPort} {
+		if port < 1 || port > 65535 {
+			problems = append(problems, fmt.Errorf("port %d is not a valid port", port))
+		} else if portInUse(port) && r.Force {
+			// most likely the running container of the config being overwritten
+			fmt.Fprintf(utils.Out, "port %d is already in use, make sure it is %s's own container\n", port, r.Config)
+		} else if portInUse(port) {
+			problems = append(problems, fmt.Errorf("port %d is already in use, stop what is listening on it or choose another port", port))
+		}
+	}
+	if r.MemoryGb < 1 || r.Cpus < 1 {
+		problems = append(problems, errors.New("could not detect memory and CPU cores, pass --memory-gb and --cpus"))
+	}
+	return errors.Join(problems...)
+}
+
+func (r *SetupCmd) edit(file *config.ConfigFile, workers int, sharedBuffers int) error {
+	env := [][2]string{
+		{"DISCOURSE_HOSTNAME", r.Hostname},
+		{"DISCOURSE_DEVELOPER_EMAILS", r.DeveloperEmails},
+		{"DISCOURSE_SMTP_ADDRESS", r.SmtpAddress},
+		{"DISCOURSE_SMTP_USER_NAME", r.SmtpUserName},
+		{"DISCOURSE_SMTP_PASSWORD", r.SmtpPassword},
+	}
+	if r.LetsencryptEmail != "" {
+		env = append(env, [2]string{"LETSENCRYPT_ACCOUNT_EMAIL", r.LetsencryptEmail})
+	}
+	for _, kv := range env {
+		if err := file.SetString("env."+kv[0], kv[1]); err != nil {
+			return err
+		}
+	}
+	if err := file.Set("env.DISCOURSE_SMTP_PORT", strconv.Itoa(r.SmtpPort)); err != nil {
+		return err
+	}
+	if err := file.Set("env.UNICORN_WORKERS", strconv.Itoa(workers)); err != nil {
+		return err
+	}
+	if err := file.SetString("params.db_shared_buffers", strconv.Itoa(sharedBuffers)+"MB"); err != nil {
+		return err
+	}
+	if r.LetsencryptEmail != "" {
+		for _, t := range []string{"templates/web.ssl.template.yml", "templates/web.letsencrypt.ssl.template.yml"} {
+			if _, err := file.AddTemplate(t); err != nil {
+				return err
+			}
+		}
+	}
+	// publish the chosen host ports
+	for i := 0; ; i++ {
+		expose, err := file.Get("expose." + strconv.Itoa(i))
+		if err != nil {
+			break
+		}
+		for port, container := range map[int]string{r.HttpPort: ":80", r.HttpsPort: ":443"} {
+			if strings.HasSuffix(expose, container) {
+				if err := file.SetString("expose."+strconv.Itoa(i), strconv.Itoa(port)+container); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Sized like discourse-setup: 2 unicorn workers per GB up to 2GB, then 2 per CPU core, at most 8.
+// Postgres gets 128MB of shared buffers with 1GB, 256MB with 2GB, then 256MB per GB, at most 4GB.
+func scaleForHost(memoryGb int, cpus int) (int, int) {
+	workers := 2 * cpus
+	if memoryGb <= 2 {
+		workers = 2 * memoryGb
+	}
+	sharedBuffers := 256 * memoryGb
+	if memoryGb <= 1 {
+		sharedBuffers = 128
+	} else if memoryGb <= 2 {
+		sharedBuffers = 256
+	}
+	return min(workers, 8), min(sharedBuffers, 4096)
+}
+
+// Total memory in GB, rounded, or 0 when it can't be read.
+func detectMemoryGb() int {
+	content, err := os.ReadFile("/proc/meminfo")
+	if err != nil {
+		return 0
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "MemTotal:" {
+			kb, _ := strconv.Atoi(fields[1])
+			return max((kb+500_000)/1_000_000, 1)
+		}
+	}
+	return 0
+}
+
+// Whether something is already listening on a host port.
+func portInUse(port int) bool {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), time.Second)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
@@ -0,0 +1,134 @@
+package main_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"bytes"
+	ddocker "github.com/discourse/discourse_docker/launcher_go/v2"
+	"github.com/discourse/discourse_docker/launcher_go/v2/utils"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var _ = Describe("Setup", func() {
+	var testDir string
+	var out *bytes.Buffer
+	var cli *ddocker.Cli
+	var runner ddocker.SetupCmd
+
+	BeforeEach(func() {
+		out = &bytes.Buffer{}
+		utils.Out = out
+		testDir, _ = os.MkdirTemp("", "ddocker-test")
+		cli = &ddocker.Cli{
+			ConfDir:       testDir,
+			TemplatesDirs: []string{"./test"},
+		}
+		runner = ddocker.SetupCmd{
+			Config:          "app",
+			Sample:          "./test/containers/standalone.yml",
+			NonInteractive:  true,
+			Hostname:        "forum.example.com",
+			DeveloperEmails: "admin@example.com",
+			SmtpAddress:     "smtp.example.com",
+			SmtpPort:        2525,
+			SmtpUserName:    "discourse",
+			SmtpPassword:    "s3cr#t",
+			HttpPort:        48080,
+			HttpsPort:       48443,
+			MemoryGb:        4,
+			Cpus:            2,
+		}
+	})
+	AfterEach(func() {
+		utils.In = os.Stdin
+		os.RemoveAll(testDir)
+	})
+
+	It("writes a config from flags", func() {
+		Expect(runner.Run(cli)).To(Succeed())
+		content, _ := os.ReadFile(testDir + "/app.yml")
+		Expect(string(content)).To(ContainSubstring("  DISCOURSE_HOSTNAME: 'forum.example.com'\n"))
+		Expect(string(content)).To(ContainSubstring("DISCOURSE_DEVELOPER_EMAILS: 'admin@example.com'\n"))
+		Expect(string(content)).To(ContainSubstring("DISCOURSE_SMTP_PASSWORD: s3cr#t\n"))
+		Expect(string(content)).To(ContainSubstring("DISCOURSE_SMTP_PORT: 2525\n"))
+		Expect(string(content)).To(ContainSubstring("UNICORN_WORKERS: 4\n"))
+		Expect(string(content)).To(ContainSubstring("db_shared_buffers: 1024MB\n"))
+		Expect(string(content)).To(ContainSubstring("  - \"48080:80\" # http\n"))
+		Expect(string(content)).To(ContainSubstring("## BE *VERY* CAREFUL WHEN EDITING!\n"))
+		Expect(out.String()).To(ContainSubstring("Sizing for 4 GB of memory and 2 CPU cores: 4 unicorn workers, 1024MB postgres shared buffers\n"))
+	})
+
+	It("asks for settings interactively", func() {
+		runner.NonInteractive = false
+		runner.Hostname = ""
+		utils.In = strings.NewReader("discourse.example.org\n\n\n\n\n\n\n\n\ny\n")
+		Expect(runner.Run(cli)).To(Succeed())
+		Expect(out.String()).To(ContainSubstring("Hostname for your Discourse? []: "))
+		Expect(out.String()).To(ContainSubstring("SMTP password? [unchanged]: "))
+		content, _ := os.ReadFile(testDir + "/app.yml")
+		Expect(string(content)).To(ContainSubstring("DISCOURSE_HOSTNAME: 'discourse.example.org'\n"))
+		Expect(string(content)).To(ContainSubstring("DISCOURSE_SMTP_PASSWORD: s3cr#t\n"))
+	})
+
+	It("does not write when cancelled", func() {
+		runner.NonInteractive = false
+		utils.In = strings.NewReader("\n\n\n\n\n\n\n\n\nn\n")
+		Expect(runner.Run(cli)).To(MatchError("Cancelled"))
+		_, err := os.Stat(testDir + "/app.yml")
+		Expect(os.IsNotExist(err)).To(BeTrue())
+	})
+
+	It("requires hostname, emails, and smtp settings", func() {
+		runner.Hostname = ""
+		runner.DeveloperEmails = "admin"
+		runner.SmtpPassword = ""
+		err := runner.Run(cli)
+		Expect(err).To(MatchError(ContainSubstring("a hostname is required")))
+		Expect(err).To(MatchError(ContainSubstring("admin email admin is not an email address")))
+		Expect(err).To(MatchError(ContainSubstring("SMTP settings are required")))
+	})
+
+	It("rejects ports that are in use", func() {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).To(BeNil())
+		defer listener.Close()
+		port := listener.Addr().(*net.TCPAddr).Port
+		runner.HttpPort = port
+		Expect(runner.Run(cli)).To(MatchError("port " + strconv.Itoa(port) + " is already in use, stop what is listening on it or choose another port"))
+	})
+
+	It("only warns about ports in use with --force", func() {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).To(BeNil())
+		defer listener.Close()
+		port := listener.Addr().(*net.TCPAddr).Port
+		runner.HttpPort = port
+		runner.Force = true
+		Expect(runner.Run(cli)).To(Succeed())
+		Expect(out.String()).To(ContainSubstring("port " + strconv.Itoa(port) + " is already in use, make sure it is app's own container"))
+	})
+
+	It("does not overwrite configs without --force", func() {
+		os.WriteFile(testDir+"/app.yml", []byte("env: {}\n"), 0660)
+		Expect(runner.Run(cli)).To(MatchError(testDir + "/app.yml already exists, pass --force to overwrite it"))
+		runner.Force = true
+		Expect(runner.Run(cli)).To(Succeed())
+	})
+
+	It("adds the Let's Encrypt templates", func() {
+		templatesDir := testDir + "/templates_dir"
+		os.MkdirAll(templatesDir+"/templates", 0755)
+		os.WriteFile(templatesDir+"/templates/web.ssl.template.yml", []byte("env: {}\n"), 0644)
+		os.WriteFile(templatesDir+"/templates/web.letsencrypt.ssl.template.yml", []byte("env: {}\n"), 0644)
+		cli.TemplatesDirs = append(cli.TemplatesDirs, templatesDir)
+		runner.LetsencryptEmail = "admin@example.com"
+		Expect(runner.Run(cli)).To(Succeed())
+		content, _ := os.ReadFile(testDir + "/app.yml")
+		Expect(string(content)).To(ContainSubstring("  - \"templates/web.letsencrypt.ssl.template.yml\"\n"))
+		Expect(string(content)).To(ContainSubstring("LETSENCRYPT_ACCOUNT_EMAIL: admin@example.com\n"))
+	})
+})
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/discourse/discourse_docker/launcher_go/v2/docker"
+	"github.com/discourse/discourse_docker/launcher_go/v2/utils"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+/*
+ * status
+ */
+
+type StatusCmd struct {
+	Configs []string `arg:"" optional:"" name:"config" help:"Configs to show. Defaults to every config in the conf dir." predictor:"config"`
+	Format  string   `default:"table" enum:"table,json" help:"Output format: table or json."`
+}
+
+type ContainerStatus struct {
+	Config       string     `json:"config"`
+	State        string     `json:"state"`
+	Uptime       string     `json:"uptime,omitempty"`
+	Image        string     `json:"image,omitempty"`
+	ImageId      string     `json:"image_id,omitempty"`
+	Created      *time.Time `json:"created,omitempty"`
+	StartedAt    *time.Time `json:"started_at,omitempty"`
+	RestartCount int        `json:"restart_count"`
+	// The latest built local_discourse/<config> image, when it is newer than the one the container runs
+	NewerImageId string `json:"newer_image_id,omitempty"`
+	Outdated     bool   `json:"outdated"`
+}
+
+func (r *StatusCmd) Run(cli *Cli, ctx *context.Context) error {
+	configs := r.Configs
+	if len(configs) == 0 {
+		configs = utils.FindConfigNamesIn(cli.ConfDir)
+	}
+	statuses := []ContainerStatus{}
+	for _, c := range configs {
+		status, err := configStatus(*ctx, c, time.Now())
+		if err != nil {
+			return err
+		}
+		statuses = append(statuses, status)
+	}
+
+	if r.Format == "json" {
+		encoder := json.NewEncoder(utils.Out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(statuses)
+	}
+	w := tabwriter.NewWriter(utils.Out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "CONFIG\tSTATE\tUPTIME\tIMAGE\tIMAGE ID\tCREATED\tRESTARTS")
+	for _, s := range statuses {
+		created := ""
+		if s.Created != nil {
+			created = s.Created.Local().Format("2006-01-02 15:04:05")
+		}
+		image := s.Image
+		if s.Outdated {
+			image = image + " (outdated)"
+		}
+		fmt.Fprintln(w, strings.Join([]string{
+			s.Config, s.State, s.Uptime, image, shortId(s.ImageId), created, strconv.Itoa(s.RestartCount),
+		}, "\t"))
+	}
+	return w.Flush()
+}
+
+func configStatus(ctx context.Context, config string, now time.Time) (ContainerStatus, error) {
+	status := ContainerStatus{Config: config, State: "not created"}
+	container, err := docker.InspectContainer(ctx, config)
+	if err != nil || container == nil {
+		return status, err
+	}
+	status.State = container.State
+	status.Image = container.ImageName
+	status.ImageId = container.Image
+	status.Created = &container.Created
+	status.RestartCount = container.RestartCount
+	if container.State == "running" {
+		status.StartedAt = &container.StartedAt
+		status.Uptime = now.Sub(container.StartedAt).Round(time.Second).String()
+	}
+
+	latest, err := docker.InspectImage(ctx, utils.BaseImageName+config)
+	if err != nil || latest == nil || shortId(latest.Id) == shortId(container.Image) {
+		return status, err
+	}
+	current, err := docker.InspectImage(ctx, container.Image)
+	if err != nil {
+		return status, err
+	}
+	// an image that's gone has been replaced by a newer build
+	if current == nil || latest.Created.After(current.Created) {
+		status.Outdated = true
+		status.NewerImageId = latest.Id
+	}
+	return status, nil
+}
+
+// Image ids are shown the way docker does, as the first 12 characters of the digest.
+func shortId(id string) string {
+	id = strings.TrimPrefix(id, "sha256:")
+	if len(id) > 12 {
+		return id[:12]
+	}
+	return id
+}
@@ -0,0 +1,99 @@
+package main_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"bytes"
+	"context"
+	"encoding/json"
+	ddocker "github.com/discourse/discourse_docker/launcher_go/v2"
+	"github.com/discourse/discourse_docker/launcher_go/v2/docker"
+	. "github.com/discourse/discourse_docker/launcher_go/v2/test_utils"
+	"github.com/discourse/discourse_docker/launcher_go/v2/utils"
+	"net/http"
+	"os/exec"
+	"strings"
+)
+
+var _ = Describe("Status", func() {
+	var out *bytes.Buffer
+	var cli *ddocker.Cli
+	var ctx context.Context
+	var api *FakeDockerApi
+
+	var respond = func(path string, status int, body string) {
+		api.Handle("GET", path, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+			w.Write([]byte(body))
+		})
+	}
+
+	BeforeEach(func() {
+		out = &bytes.Buffer{}
+		utils.Out = out
+		ctx = context.Background()
+		cli = &ddocker.Cli{ConfDir: "./test/containers", TemplatesDirs: []string{"./test"}}
+		api = NewFakeDockerApi()
+		client, _ := docker.NewClient(api.Host())
+		docker.ActiveRuntime = &docker.ApiRuntime{Client: client}
+
+		notFound := `{"message":"No such object"}`
+		for _, c := range []string{"standalone", "test2"} {
+			respond("/containers/"+c+"/json", http.StatusNotFound, notFound)
+		}
+		respond("/containers/test/json", http.StatusOK, `{
+			"Id": "abc", "Name": "/test", "Created": "2024-01-01T10:00:00Z", "Image": "sha256:1111111111111111", "RestartCount": 2,
+			"State": {"Status": "running", "Running": true, "StartedAt": "2024-01-02T10:00:00Z"},
+			"Config": {"Image": "local_discourse/test"}}`)
+		respond("/containers/web_only/json", http.StatusOK, `{
+			"Id": "def", "Name": "/web_only", "Created": "2024-01-01T10:00:00Z", "Image": "sha256:3333333333333333",
+			"State": {"Status": "exited"}, "Config": {"Image": "local_discourse/web_only"}}`)
+		respond("/images/local_discourse/test/json", http.StatusOK, `{"Id": "sha256:2222222222222222", "Created": "2024-02-01T00:00:00Z"}`)
+		respond("/images/sha256:1111111111111111/json", http.StatusOK, `{"Id": "sha256:1111111111111111", "Created": "2024-01-01T00:00:00Z"}`)
+		respond("/images/local_discourse/web_only/json", http.StatusOK, `{"Id": "sha256:3333333333333333", "Created": "2024-01-01T00:00:00Z"}`)
+	})
+	AfterEach(func() {
+		docker.ActiveRuntime = docker.NewDockerRuntime()
+		api.Close()
+	})
+
+	It("lists every config in the conf dir as a table", func() {
+		runner := ddocker.StatusCmd{Format: "table"}
+		Expect(runner.Run(cli, &ctx)).To(Succeed())
+		lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+		Expect(lines).To(HaveLen(5))
+		Expect(lines[0]).To(MatchRegexp(`^CONFIG\s+STATE\s+UPTIME\s+IMAGE\s+IMAGE ID\s+CREATED\s+RESTARTS$`))
+		Expect(lines[1]).To(MatchRegexp(`^standalone\s+not created\s+0$`))
+		Expect(lines[2]).To(MatchRegexp(`^test\s+running\s+\S+\s+local_discourse/test \(outdated\)\s+111111111111\s+.*\s+2$`))
+		Expect(lines[4]).To(MatchRegexp(`^web_only\s+exited\s+local_discourse/web_only\s+333333333333\s+.*\s+0$`))
+	})
+
+	It("prints json for the given configs", func() {
+		runner := ddocker.StatusCmd{Configs: []string{"test", "web_only"}, Format: "json"}
+		Expect(runner.Run(cli, &ctx)).To(Succeed())
+		statuses := []ddocker.ContainerStatus{}
+		Expect(json.Unmarshal(out.Bytes(), &statuses)).To(Succeed())
+		Expect(statuses).To(HaveLen(2))
+		Expect(statuses[0].Config).To(Equal("test"))
+		Expect(statuses[0].State).To(Equal("running"))
+		Expect(statuses[0].RestartCount).To(Equal(2))
+		Expect(statuses[0].Outdated).To(BeTrue())
+		Expect(statuses[0].NewerImageId).To(Equal("sha256:2222222222222222"))
+		Expect(statuses[0].StartedAt.UTC().Format("2006-01-02")).To(Equal("2024-01-02"))
+		Expect(statuses[1].Outdated).To(BeFalse())
+		Expect(statuses[1].Uptime).To(BeEmpty())
+	})
+
+	It("reads container state from the cli", func() {
+		docker.ActiveRuntime = docker.NewDockerRuntime()
+		utils.DockerPath = "docker"
+		utils.CmdRunner = CreateNewFakeCmdRunner()
+		CmdOutputError = &exec.ExitError{Stderr: []byte("Error: No such container: test2")}
+		runner := ddocker.StatusCmd{Configs: []string{"test2"}, Format: "table"}
+		Expect(runner.Run(cli, &ctx)).To(Succeed())
+		cmd := GetLastCommand()
+		Expect(cmd.String()).To(ContainSubstring("docker container inspect test2"))
+		Expect(out.String()).To(MatchRegexp(`test2\s+not created`))
+	})
+})
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"fmt"
+	"github.com/discourse/discourse_docker/launcher_go/v2/config"
+	"github.com/discourse/discourse_docker/launcher_go/v2/utils"
+)
+
+/*
+ * validate
+ */
+
+type ValidateCmd struct {
+	Config string `arg:"" name:"config" help:"config" predictor:"config"`
+}
+
+func (r *ValidateCmd) Run(cli *Cli) error {
+	diagnostics := config.ValidateConfig(cli.ConfDir, r.Config, cli.TemplatesDirs...)
+	for _, d := range diagnostics {
+		fmt.Fprintln(utils.Out, d)
+	}
+	if len(diagnostics) > 0 {
+		return fmt.Errorf("%d problem(s) found in config %s", len(diagnostics), r.Config)
+	}
+	fmt.Fprintln(utils.Out, r.Config+" is valid")
+	return nil
+}
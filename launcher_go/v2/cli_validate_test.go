@@ -0,0 +1,46 @@
+package main_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"bytes"
+	ddocker "github.com/discourse/discourse_docker/launcher_go/v2"
+	"github.com/discourse/discourse_docker/launcher_go/v2/utils"
+	"os"
+)
+
+var _ = Describe("Validate", func() {
+	var testDir string
+	var out *bytes.Buffer
+	var cli *ddocker.Cli
+
+	BeforeEach(func() {
+		out = &bytes.Buffer{}
+		utils.Out = out
+		testDir, _ = os.MkdirTemp("", "ddocker-test")
+		cli = &ddocker.Cli{
+			ConfDir:       "./test/containers",
+			TemplatesDirs: []string{"./test"},
+			BuildDir:      testDir,
+		}
+	})
+	AfterEach(func() {
+		os.RemoveAll(testDir)
+	})
+
+	It("succeeds on a valid config", func() {
+		runner := ddocker.ValidateCmd{Config: "test"}
+		Expect(runner.Run(cli)).To(Succeed())
+		Expect(out.String()).To(ContainSubstring("test is valid"))
+	})
+
+	It("fails and prints diagnostics on an invalid config", func() {
+		os.WriteFile(testDir+"/app.yml", []byte("templates:\n  - templates/nope.template.yml\n"), 0660)
+		cli.ConfDir = testDir
+		runner := ddocker.ValidateCmd{Config: "app"}
+		err := runner.Run(cli)
+		Expect(err).To(MatchError("1 problem(s) found in config app"))
+		Expect(out.String()).To(ContainSubstring(testDir + "/app.yml:2:5: template templates/nope.template.yml could not be found in ./test"))
+	})
+})
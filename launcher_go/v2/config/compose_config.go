@@ -0,0 +1,343 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"github.com/discourse/discourse_docker/launcher_go/v2/utils"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Network every service of a compose project joins, in place of links.
+const ComposeNetworkName = "discourse"
+
+type DockerComposeYaml struct {
+	Name     string `yaml:",omitempty"`
+	Services map[string]ComposeService
+	Networks map[string]*interface{}
+	Volumes  map[string]*interface{}
+	Secrets  map[string]ComposeSecret `yaml:",omitempty"`
+}
+type ComposeService struct {
+	Image       string
+	Build       *ComposeBuild `yaml:",omitempty"`
+	Command     []string      `yaml:",omitempty"`
+	Volumes     []string
+	Networks    map[string]*ComposeNetwork
+	Environment map[string]string
+	Ports       []string                     `yaml:",omitempty"`
+	Depends_On  map[string]ComposeDependency `yaml:",omitempty"`
+	Healthcheck *ComposeHealthcheck          `yaml:",omitempty"`
+}
+type ComposeBuild struct {
+	Context    string
+	Dockerfile string
+	Labels     map[string]string
+	Shm_Size   string
+	Args       map[string]string
+	Secrets    []ComposeBuildSecret `yaml:",omitempty"`
+	No_Cache   bool
+}
+type ComposeBuildSecret struct {
+	Source string
+	Target string
+}
+type ComposeNetwork struct {
+	Aliases []string `yaml:",omitempty"`
+}
+type ComposeDependency struct {
+	Condition string
+}
+type ComposeHealthcheck struct {
+	Test         []string
+	Interval     string
+	Timeout      string
+	Retries      int
+	Start_Period string
+}
+type ComposeSecret struct {
+	Environment string
+}
+
+// Writes a compose project for the config alone, with its build context in dir.
+func (config *Config) WriteDockerCompose(dir string, bakeEnv bool, includeSecrets bool) error {
+	return WriteDockerComposeProject(dir, config.Name, []*Config{config}, bakeEnv, includeSecrets)
+}
+
+// Writes a compose project running a service for each config, joined on one network.
+// A single config builds from dir, several configs each build from dir/{config}.
+// Web configs also get {config}-migrate and {config}-configure services, which run to completion before the web service starts.
+func WriteDockerComposeProject(dir string, project string, configs []*Config, bakeEnv bool, includeSecrets bool) error {
+	dir = strings.TrimRight(dir, "/")
+	secretVars, err := writeComposeEnv(dir, configs, includeSecrets)
+	if err != nil {
+		return err
+	}
+
+	// links become network aliases on the linked service, and dependencies of the linking one
+	aliases := map[string][]string{}
+	inProject := map[string]*Config{}
+	for _, config := range configs {
+		inProject[config.Name] = config
+	}
+	for _, config := range configs {
+		for _, l := range config.Links {
+			if l.Link.Alias != l.Link.Name && !slices.Contains(aliases[l.Link.Name], l.Link.Alias) {
+				aliases[l.Link.Name] = append(aliases[l.Link.Name], l.Link.Alias)
+			}
+		}
+	}
+
+	compose := &DockerComposeYaml{
+		Name:     project,
+		Services: map[string]ComposeService{},
+		Networks: map[string]*interface{}{ComposeNetworkName: nil},
+		Volumes:  map[string]*interface{}{},
+		Secrets:  map[string]ComposeSecret{},
+	}
+	for _, config := range configs {
+		context := "."
+		contextDir := dir
+		if len(configs) > 1 {
+			context = "./" + config.Name
+			contextDir = dir + "/" + config.Name
+			if err := os.MkdirAll(contextDir, 0755); err != nil {
+				return err
+			}
+		}
+		pupsArgs := "--skip-tags=precompile,migrate,db"
+		if err := config.WriteDockerfile(contextDir, pupsArgs, bakeEnv); err != nil {
+			return err
+		}
+
+		labels := map[string]string{}
+		for k, v := range config.Labels {
+			labels[k] = composeEscape(v)
+		}
+		// each service carries its own values, only secrets are read from the environment
+		env := map[string]string{}
+		args := map[string]string{}
+		for k, v := range config.Env {
+			if config.IsSecret(k) {
+				// interpolated by compose from the environment exported by .envrc
+				env[k] = "${" + secretVars[config.Name][k] + "}"
+				continue
+			}
+			env[k] = composeEscape(v)
+			args[k] = composeEscape(v)
+		}
+		volumes := []string{}
+		for _, v := range config.Volumes {
+			volumes = append(volumes, v.Volume.Host+":"+v.Volume.Guest)
+			// if this is a docker volume (vs a bind mount), add to global volume list
+			matched, _ := regexp.MatchString(`^[A-Za-z]`, v.Volume.Host)
+			if matched {
+				compose.Volumes[v.Volume.Host] = nil
+			}
+		}
+		slices.Sort(volumes)
+		ports := slices.Clone(config.Expose)
+		slices.Sort(ports)
+		// build secrets are read from the environment exported by .envrc, and mounted under their env key
+		secrets := []ComposeBuildSecret{}
+		for _, k := range config.SecretKeys() {
+			name := secretVars[config.Name][k]
+			compose.Secrets[name] = ComposeSecret{Environment: name}
+			secrets = append(secrets, ComposeBuildSecret{Source: name, Target: k})
+		}
+		dependsOn := map[string]ComposeDependency{}
+		for _, l := range config.Links {
+			linked, ok := inProject[l.Link.Name]
+			if !ok {
+				continue
+			}
+			condition := "service_started"
+			if composeHealthcheck(linked) != nil {
+				condition = "service_healthy"
+			}
+			dependsOn[l.Link.Name] = ComposeDependency{Condition: condition}
+		}
+		network := map[string]*ComposeNetwork{ComposeNetworkName: nil}
+		if len(aliases[config.Name]) > 0 {
+			network[ComposeNetworkName] = &ComposeNetwork{Aliases: aliases[config.Name]}
+		}
+
+		service := ComposeService{
+			Image: utils.BaseImageName + config.Name,
+			Build: &ComposeBuild{
+				Context:    context,
+				Dockerfile: "./Dockerfile",
+				Labels:     labels,
+				Shm_Size:   "512m",
+				Args:       args,
+				Secrets:    secrets,
+				No_Cache:   true,
+			},
+			Volumes:     volumes,
+			Networks:    network,
+			Environment: env,
+			Ports:       ports,
+			Depends_On:  dependsOn,
+			Healthcheck: composeHealthcheck(config),
+		}
+		if !config.hasTemplate("web.template.yml") {
+			compose.Services[config.Name] = service
+			continue
+		}
+
+		// the image is built without its db, migrate, and precompile phases, so one-shot services run them
+		// before the web service starts. Precompiled assets are kept in a volume shared with the web service.
+		assets := config.Name + "_assets:/var/www/discourse/public/assets"
+		compose.Volumes[config.Name+"_assets"] = nil
+		service.Volumes = append(slices.Clone(volumes), assets)
+		service.Depends_On = map[string]ComposeDependency{}
+		for k, v := range dependsOn {
+			service.Depends_On[k] = v
+		}
+		completed := ComposeDependency{Condition: "service_completed_successfully"}
+		service.Depends_On[config.Name+"-migrate"] = completed
+		service.Depends_On[config.Name+"-configure"] = completed
+		compose.Services[config.Name] = service
+		pupsEnv := map[string]string{"SKIP_EMBER_CLI_COMPILE": "1"}
+		for k, v := range env {
+			pupsEnv[k] = v
+		}
+		for _, job := range []struct{ name, pupsArgs string }{
+			{"migrate", "--tags=db,migrate"},
+			{"configure", "--tags=db,precompile"},
+		} {
+			jobVolumes := append(slices.Clone(volumes), context+"/config.yaml:/pups/config.yaml:ro")
+			jobDependsOn := dependsOn
+			if job.name == "configure" {
+				jobVolumes = append(jobVolumes, assets)
+				// precompiles after migrations, like rebuild does
+				jobDependsOn = map[string]ComposeDependency{config.Name + "-migrate": completed}
+				for k, v := range dependsOn {
+					jobDependsOn[k] = v
+				}
+			}
+			compose.Services[config.Name+"-"+job.name] = ComposeService{
+				Image:       utils.BaseImageName + config.Name,
+				Command:     []string{"/bin/bash", "-c", "/usr/local/bin/pups --stdin " + job.pupsArgs + " < /pups/config.yaml"},
+				Volumes:     jobVolumes,
+				Networks:    map[string]*ComposeNetwork{ComposeNetworkName: nil},
+				Environment: pupsEnv,
+				Depends_On:  jobDependsOn,
+			}
+		}
+	}
+
+	var b bytes.Buffer
+	encoder := yaml.NewEncoder(&b)
+	encoder.SetIndent(2)
+	err = encoder.Encode(&compose)
+	yaml := b.Bytes()
+	if err != nil {
+		return errors.New("error marshalling compose file to write docker-compose.yaml")
+	}
+	if err := os.WriteFile(dir+"/"+"docker-compose.yaml", yaml, 0660); err != nil {
+		return errors.New("error writing compose file docker-compose.yaml")
+	}
+	return nil
+}
+
+// Writes one .envrc for the project, and returns the variable each config's secrets are read from.
+// Secrets configs set differently are exported once per config, as {CONFIG}_{KEY}.
+// Other env configs set differently is left out, the services carry their own values.
+func writeComposeEnv(dir string, configs []*Config, includeSecrets bool) (map[string]map[string]string, error) {
+	// export lines by key, then by config
+	lines := map[string]map[string]string{}
+	for _, config := range configs {
+		for _, line := range strings.Split(config.ExportEnv(includeSecrets), "\n") {
+			if line == "" {
+				continue
+			}
+			key, _, _ := strings.Cut(strings.TrimPrefix(line, "export "), "=")
+			if lines[key] == nil {
+				lines[key] = map[string]string{}
+			}
+			lines[key][config.Name] = line
+		}
+	}
+	secretVars := map[string]map[string]string{}
+	builder := []string{}
+	for key, byConfig := range lines {
+		values := []string{}
+		for _, line := range byConfig {
+			values = append(values, line)
+		}
+		slices.Sort(values)
+		values = slices.Compact(values)
+		if len(values) == 1 {
+			builder = append(builder, values[0])
+		}
+		for _, config := range configs {
+			line, ok := byConfig[config.Name]
+			if !ok || !config.IsSecret(key) {
+				continue
+			}
+			name := key
+			if len(values) > 1 {
+				name = composeVarPrefix(config.Name) + "_" + key
+				builder = append(builder, "export "+name+strings.TrimPrefix(line, "export "+key))
+			}
+			if secretVars[config.Name] == nil {
+				secretVars[config.Name] = map[string]string{}
+			}
+			secretVars[config.Name][key] = name
+		}
+	}
+	slices.Sort(builder)
+	file := dir + "/.envrc"
+	if err := os.WriteFile(file, []byte(strings.Join(builder, "\n")), 0660); err != nil {
+		return nil, errors.New("error writing export env " + file)
+	}
+	return secretVars, nil
+}
+
+// The config name as an env variable prefix, eg. WEB_ONLY for web_only.
+func composeVarPrefix(name string) string {
+	return strings.ToUpper(regexp.MustCompile(`[^A-Za-z0-9]`).ReplaceAllString(name, "_"))
+}
+
+// Escapes a value so compose doesn't interpolate it.
+func composeEscape(value string) string {
+	return strings.ReplaceAll(value, "$", "$$")
+}
+
+// Checks the service's readiness with the tools of the templates it runs: the web status endpoint, postgres, and redis.
+func composeHealthcheck(config *Config) *ComposeHealthcheck {
+	checks := []string{}
+	if config.hasTemplate("web.template.yml") {
+		checks = append(checks, "curl -fsS http://localhost/srv/status")
+	}
+	if config.hasTemplate("postgres.template.yml") {
+		checks = append(checks, "pg_isready -q")
+	}
+	if config.hasTemplate("redis.template.yml") {
+		checks = append(checks, "redis-cli ping")
+	}
+	if len(checks) == 0 {
+		return nil
+	}
+	return &ComposeHealthcheck{
+		Test:         []string{"CMD-SHELL", strings.Join(checks, " && ")},
+		Interval:     "10s",
+		Timeout:      "5s",
+		Retries:      5,
+		Start_Period: "60s",
+	}
+}
+
+func (config *Config) hasTemplate(name string) bool {
+	for _, t := range config.Templates {
+		if path.Base(t) == name {
+			return true
+		}
+	}
+	return false
+}
@@ -36,13 +36,22 @@ type ConcourseConfig struct {
 	Config        string
 }
 
-func getConcourseTask(config Config) string {
+func getConcourseTask(config Config, includeSecrets bool) string {
 	content := []*yaml.Node{}
 	for k, v := range config.Env {
+		// oci-build-task mounts BUILDKIT_SECRETTEXT_ params as build secrets
+		param := "BUILD_ARG_" + k
+		if config.IsSecret(k) {
+			param = "BUILDKIT_SECRETTEXT_" + k
+			if !includeSecrets {
+				// filled in from concourse's credential manager
+				v = "((" + k + "))"
+			}
+		}
 		key := yaml.Node{
 			Kind:  yaml.ScalarNode,
 			Tag:   "!!str",
-			Value: "BUILD_ARG_" + k,
+			Value: param,
 		}
 		val := yaml.Node{
 			Kind:  yaml.ScalarNode,
@@ -80,12 +89,12 @@ func getConcourseTask(config Config) string {
 // dockerfile, concoursetask, config
 // which may be used in a static concourse resource
 // to generate build jobs
-func GenConcourseConfig(config Config) string {
+func GenConcourseConfig(config Config, includeSecrets bool) string {
 
 	concourseConfig := &ConcourseConfig{
-		Dockerfile:    config.Dockerfile("--skip-tags=precompile,migrate,db", false),
-		ConcourseTask: getConcourseTask(config),
-		Config:        config.Yaml(),
+		Dockerfile:    config.Dockerfile("--skip-tags=precompile,migrate,db", false, true),
+		ConcourseTask: getConcourseTask(config, includeSecrets),
+		Config:        config.Yaml(includeSecrets),
 	}
 
 	var b bytes.Buffer
@@ -96,8 +105,8 @@ func GenConcourseConfig(config Config) string {
 	return string(yaml)
 }
 
-func WriteConcourseConfig(config Config, file string) error {
-	if err := os.WriteFile(file, []byte(GenConcourseConfig(config)), 0660); err != nil {
+func WriteConcourseConfig(config Config, file string, includeSecrets bool) error {
+	if err := os.WriteFile(file, []byte(GenConcourseConfig(config, includeSecrets)), 0660); err != nil {
 		return errors.New("error writing concourse job config " + file)
 	}
 	return nil
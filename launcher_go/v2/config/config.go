@@ -1,13 +1,12 @@
 package config
 
 import (
-	"bytes"
-	"dario.cat/mergo"
 	"errors"
 	"fmt"
 	"github.com/Wing924/shellwords"
 	"github.com/discourse/discourse_docker/launcher_go/v2/utils"
 	"os"
+	"path"
 	"regexp"
 	"runtime"
 	"slices"
@@ -18,90 +17,187 @@ import (
 
 var DefaultBootCommand = "/sbin/boot"
 
+// Base images for each architecture discourse publishes one for.
+var DefaultBaseImages = map[string]string{
+	"amd64": "discourse/base:2.0.20231121-0024",
+	"arm64": "discourse/base:aarch64",
+}
+
 func DefaultBaseImage() string {
 	if runtime.GOARCH == "arm64" {
-		return "discourse/base:aarch64"
+		return DefaultBaseImages["arm64"]
 	}
-	return "discourse/base:2.0.20231121-0024"
+	return DefaultBaseImages["amd64"]
 }
 
-type DockerComposeYaml struct {
-	Services ComposeAppService
-	Volumes  map[string]*interface{}
-}
-type ComposeAppService struct {
-	App ComposeService
-}
-type ComposeService struct {
-	Image       string
-	Build       ComposeBuild
-	Volumes     []string
-	Links       []string
-	Environment map[string]string
-	Ports       []string
-}
-type ComposeBuild struct {
-	Dockerfile string
-	Labels     map[string]string
-	Shm_Size   string
-	Args       []string
-	No_Cache   bool
+// The base image to build a platform, eg. linux/arm64, from.
+// Configs that set their own base image use it for every platform, so it must be a multi-arch image.
+func (config *Config) PlatformBaseImage(platform string) (string, error) {
+	parts := strings.Split(platform, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return "", errors.New("invalid platform " + platform + ", expected os/arch[/variant], eg. linux/arm64")
+	}
+	if config.Base_Image != DefaultBaseImage() {
+		return config.Base_Image, nil
+	}
+	if parts[0] != "linux" || DefaultBaseImages[parts[1]] == "" {
+		return "", errors.New("there is no default base image for " + platform + ", set base_image to a multi-arch image to build it")
+	}
+	return DefaultBaseImages[parts[1]], nil
 }
 
 type Config struct {
-	Name            string `yaml:-`
+	Name            string `yaml:"-"`
 	rawYaml         []string
-	Base_Image      string            `yaml:,omitempty`
-	Update_Pups     bool              `yaml:,omitempty`
-	Run_Image       string            `yaml:,omitempty`
-	Boot_Command    string            `yaml:,omitempty`
-	No_Boot_Command bool              `yaml:,omitempty`
-	Docker_Args     string            `yaml:,omitempty`
-	Templates       []string          `yaml:templates,omitempty`
-	Expose          []string          `yaml:expose,omitempty`
-	Params          map[string]string `yaml:params,omitempty`
-	Env             map[string]string `yaml:env,omitempty`
-	Labels          map[string]string `yaml:labels,omitempty`
+	sources         map[string][]Source
+	lookupEnv       func(string) (string, bool)
+	secretRefs      []string
+	Base_Image      string            `yaml:",omitempty"`
+	Update_Pups     bool              `yaml:",omitempty"`
+	Run_Image       string            `yaml:",omitempty"`
+	Boot_Command    string            `yaml:",omitempty"`
+	No_Boot_Command bool              `yaml:",omitempty"`
+	Docker_Args     string            `yaml:",omitempty"`
+	Build_Cache     string            `yaml:",omitempty"`
+	Build_Cache_Ref string            `yaml:",omitempty"`
+	No_Build_Pull   bool              `yaml:",omitempty"`
+	Registry        string            `yaml:",omitempty"`
+	Image_Name      string            `yaml:",omitempty"`
+	Templates       []string          `yaml:"templates,omitempty"`
+	Expose          []string          `yaml:"expose,omitempty"`
+	Params          map[string]string `yaml:"params,omitempty"`
+	Env             map[string]string `yaml:"env,omitempty"`
+	Labels          map[string]string `yaml:"labels,omitempty"`
+	Secrets         []string          `yaml:"secrets,omitempty"`
 	Volumes         []struct {
 		Volume struct {
-			Host  string `yaml:host`
-			Guest string `yaml:guest`
-		} `yaml:volume`
-	} `yaml:volumes,omitempty`
+			Host  string `yaml:"host"`
+			Guest string `yaml:"guest"`
+		} `yaml:"volume"`
+	} `yaml:"volumes,omitempty"`
 	Links []struct {
 		Link struct {
-			Name  string `yaml:name`
-			Alias string `yaml:alias`
-		} `yaml:link`
-	} `yaml:links,omitempty`
+			Name  string `yaml:"name"`
+			Alias string `yaml:"alias"`
+		} `yaml:"link"`
+	} `yaml:"links,omitempty"`
 }
 
-func (config *Config) loadTemplate(templateDir string, template string) error {
-	template_filename := strings.TrimRight(templateDir, "/") + "/" + string(template)
+// The templates a config or template includes. Only these are read before merging,
+// the rest of the file may hold values that need resolving first, like secret references.
+type includes struct {
+	Templates []string `yaml:"templates"`
+}
+
+// Finds a template in the first of templatesDirs containing it.
+func FindTemplate(templatesDirs []string, template string) (string, error) {
+	for _, dir := range templatesDirs {
+		filename := strings.TrimRight(dir, "/") + "/" + template
+		if _, err := os.Stat(filename); err == nil {
+			return filename, nil
+		}
+	}
+	return "", fmt.Errorf("template %s could not be found in %s: %w", template, strings.Join(templatesDirs, ", "), os.ErrNotExist)
+}
+
+// Loads a template after the templates it includes, skipping templates already loaded.
+// included holds the chain of templates including this one, to catch cycles.
+func (config *Config) loadTemplate(templatesDirs []string, template string, included []string, loaded map[string]bool) error {
+	if slices.Contains(included, template) {
+		err := errors.New("template cycle: " + strings.Join(append(slices.Clone(included), template), " -> "))
+		fmt.Println(err.Error())
+		return err
+	}
+	if loaded[template] {
+		return nil
+	}
+	template_filename, err := FindTemplate(templatesDirs, template)
+	if err != nil {
+		fmt.Println(err.Error())
+		return err
+	}
 	content, err := os.ReadFile(template_filename)
 	if err != nil {
-		if os.IsNotExist(err) {
-			fmt.Println("template file does not exist: " + template_filename)
-		}
 		return err
 	}
-	templateConfig := &Config{}
+	templateConfig := &includes{}
 	if err := yaml.Unmarshal(content, templateConfig); err != nil {
 		return err
 	}
-	if err := mergo.Merge(config, templateConfig, mergo.WithOverride); err != nil {
-		return err
+	for _, t := range templateConfig.Templates {
+		if err := config.loadTemplate(templatesDirs, t, append(slices.Clone(included), template), loaded); err != nil {
+			return err
+		}
 	}
-	config.rawYaml = append(config.rawYaml, string(content[:]))
-	return nil
+	loaded[template] = true
+	return config.merge(content, template_filename)
+}
+
+func readOverlay(filename string) ([]byte, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			fmt.Println("overlay file does not exist: " + filename)
+		}
+		return nil, err
+	}
+	return content, nil
+}
+
+// Applies a config or overlay's templates list, with its merge directive, to the templates listed before it.
+func includedTemplates(templates []string, content []byte) ([]string, error) {
+	doc := &yaml.Node{}
+	if err := yaml.Unmarshal(content, doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		return templates, nil
+	}
+	node := mappingValue(doc.Content[0], "templates")
+	if node == nil {
+		return templates, nil
+	}
+	result, err := mergeList(templates, node, func(string, int, string) {}, entryName)
+	if err != nil {
+		return nil, fmt.Errorf("templates: %w", err)
+	}
+	return result, nil
+}
+
+type LoadOptions struct {
+	IncludeTemplates bool
+	// Searched in order for each template, the first directory containing it wins
+	TemplatesDirs []string
+	// Files merged over the container config in order, after its templates
+	Overlays []string
+	// Merges {dir}/{config}.{EnvName}.yml over the container config, before any other overlays. It must exist
+	EnvName string
+	// Variables for ${VAR} interpolation, after the process environment
+	EnvFile string
+}
+
+func LoadConfig(dir string, configName string, includeTemplates bool, templatesDirs ...string) (*Config, error) {
+	return Load(dir, configName, LoadOptions{IncludeTemplates: includeTemplates, TemplatesDirs: templatesDirs})
 }
 
-func LoadConfig(dir string, configName string, includeTemplates bool, templatesDir string) (*Config, error) {
+// Loads a container config from dir, merged with its templates and overlays.
+func Load(dir string, configName string, options LoadOptions) (*Config, error) {
 	config := &Config{
 		Name:         configName,
 		Boot_Command: DefaultBootCommand,
 		Base_Image:   DefaultBaseImage(),
 	}
+	envFile := map[string]string{}
+	if options.EnvFile != "" {
+		var err error
+		if envFile, err = ReadEnvFile(options.EnvFile); err != nil {
+			if os.IsNotExist(err) {
+				fmt.Println("env file does not exist: " + options.EnvFile)
+			}
+			return nil, err
+		}
+	}
+	config.lookupEnv = envLookup(envFile)
 	matched, _ := regexp.MatchString("[[:upper:]/ !@#$%^&*()+~`=]", configName)
 	if matched {
 		msg := "ERROR: Config name '" + configName + "' must not contain upper case characters, spaces or special characters. Correct config name and rerun."
@@ -117,27 +213,51 @@ func LoadConfig(dir string, configName string, includeTemplates bool, templatesD
 		}
 		return nil, err
 	}
-	baseConfig := &Config{}
-
-	if err := yaml.Unmarshal(content, baseConfig); err != nil {
-		return nil, err
+	overlays := options.Overlays
+	if options.EnvName != "" {
+		envFilename := strings.TrimRight(dir, "/") + "/" + config.Name + "." + options.EnvName + ".yml"
+		if _, err := os.Stat(envFilename); err != nil {
+			msg := "no overlay for env " + options.EnvName + ", " + envFilename + " does not exist"
+			fmt.Println(msg)
+			return nil, errors.New(msg)
+		}
+		overlays = append([]string{envFilename}, overlays...)
+	}
+	overlayContents := [][]byte{}
+	for _, o := range overlays {
+		overlayContent, err := readOverlay(o)
+		if err != nil {
+			return nil, err
+		}
+		overlayContents = append(overlayContents, overlayContent)
 	}
 
-	if includeTemplates {
-		for _, t := range baseConfig.Templates {
-			if err := config.loadTemplate(templatesDir, t); err != nil {
+	if options.IncludeTemplates {
+		// the config and its overlays settle which templates are included, directives and all, before any are loaded
+		templates, err := includedTemplates([]string{}, content)
+		if err != nil {
+			return nil, err
+		}
+		for _, overlayContent := range overlayContents {
+			if templates, err = includedTemplates(templates, overlayContent); err != nil {
+				return nil, err
+			}
+		}
+		loaded := map[string]bool{}
+		for _, t := range templates {
+			if err := config.loadTemplate(options.TemplatesDirs, t, []string{}, loaded); err != nil {
 				return nil, err
 			}
 		}
 	}
-	if err := mergo.Merge(config, baseConfig, mergo.WithOverride); err != nil {
+	if err := config.merge(content, config_filename); err != nil {
 		return nil, err
 	}
-	config.rawYaml = append(config.rawYaml, string(content[:]))
-	if err != nil {
-		return nil, err
+	for i, o := range overlays {
+		if err := config.merge(overlayContents[i], o); err != nil {
+			return nil, err
+		}
 	}
-
 	for k, v := range config.Labels {
 		val := strings.ReplaceAll(v, "{{config}}", config.Name)
 		config.Labels[k] = val
@@ -151,88 +271,23 @@ func LoadConfig(dir string, configName string, includeTemplates bool, templatesD
 	return config, nil
 }
 
-func (config *Config) Yaml() string {
-	return strings.Join(config.rawYaml, "_FILE_SEPERATOR_")
-}
-
-func (config *Config) WriteDockerCompose(dir string, bakeEnv bool) error {
-	if err := config.WriteEnvConfig(dir); err != nil {
-		return err
-	}
-	pupsArgs := "--skip-tags=precompile,migrate,db"
-	if err := config.WriteDockerfile(dir, pupsArgs, bakeEnv); err != nil {
-		return err
-	}
-	labels := map[string]string{}
-	for k, v := range config.Labels {
-		labels[k] = v
-	}
-	env := map[string]string{}
-	for k, v := range config.Env {
-		env[k] = v
-	}
-	env["CREATE_DB_ON_BOOT"] = "1"
-	env["MIGRATE_ON_BOOT"] = "1"
-
-	links := []string{}
-	for _, v := range config.Links {
-		links = append(links, v.Link.Name+":"+v.Link.Alias)
-	}
-	slices.Sort(links)
-	volumes := []string{}
-	composeVolumes := map[string]*interface{}{}
-	for _, v := range config.Volumes {
-		volumes = append(volumes, v.Volume.Host+":"+v.Volume.Guest)
-		// if this is a docker volume (vs a bind mount), add to global volume list
-		matched, _ := regexp.MatchString(`^[A-Za-z]`, v.Volume.Host)
-		if matched {
-			composeVolumes[v.Volume.Host] = nil
-		}
+// The raw config and templates, concatenated in pups format.
+// Without includeSecrets, secret env is removed from each file's env section.
+func (config *Config) Yaml(includeSecrets bool) string {
+	if includeSecrets {
+		return strings.Join(config.rawYaml, "_FILE_SEPERATOR_")
 	}
-	slices.Sort(volumes)
-	ports := []string{}
-	for _, v := range config.Expose {
-		ports = append(ports, v)
+	docs := []string{}
+	for _, doc := range config.rawYaml {
+		docs = append(docs, config.withoutSecrets(doc))
 	}
-	slices.Sort(ports)
+	return strings.Join(docs, "_FILE_SEPERATOR_")
+}
 
-	args := []string{}
-	for k, _ := range config.Env {
-		args = append(args, k)
-	}
-	slices.Sort(args)
-	compose := &DockerComposeYaml{
-		Services: ComposeAppService{
-			App: ComposeService{
-				Image: utils.BaseImageName + config.Name,
-				Build: ComposeBuild{
-					Dockerfile: "./Dockerfile",
-					Labels:     labels,
-					Shm_Size:   "512m",
-					Args:       args,
-					No_Cache:   true,
-				},
-				Environment: env,
-				Links:       links,
-				Volumes:     volumes,
-				Ports:       ports,
-			},
-		},
-		Volumes: composeVolumes,
-	}
-
-	var b bytes.Buffer
-	encoder := yaml.NewEncoder(&b)
-	encoder.SetIndent(2)
-	err := encoder.Encode(&compose)
-	yaml := b.Bytes()
-	if err != nil {
-		return errors.New("error marshalling compose file to write docker-compose.yaml")
-	}
-	if err := os.WriteFile(strings.TrimRight(dir, "/")+"/"+"docker-compose.yaml", yaml, 0660); err != nil {
-		return errors.New("error writing compose file docker-compose.yaml")
-	}
-	return nil
+func (config *Config) withoutSecrets(content string) string {
+	return editYaml(content, func(root *yaml.Node) bool {
+		return removeKeys(root, "env", config.IsSecret)
+	})
 }
 
 func (config *Config) WriteDockerfile(dir string, pupsArgs string, bakeEnv bool) error {
@@ -241,40 +296,85 @@ func (config *Config) WriteDockerfile(dir string, pupsArgs string, bakeEnv bool)
 	}
 
 	file := strings.TrimRight(dir, "/") + "/" + "Dockerfile"
-	if err := os.WriteFile(file, []byte(config.Dockerfile(pupsArgs, bakeEnv)), 0660); err != nil {
+	if err := os.WriteFile(file, []byte(config.Dockerfile(pupsArgs, bakeEnv, true)), 0660); err != nil {
 		return errors.New("error writing dockerfile Dockerfile " + file)
 	}
 	return nil
 }
 
-func (config *Config) Dockerfile(pupsArgs string, bakeEnv bool) string {
+// Generates the dockerfile that builds the config's image.
+// When mountSecrets is set, secret env is mounted into the pups step with BuildKit secrets,
+// otherwise it is left out of the build entirely. Either way it never ends up in the image.
+// Only the config and its env feed into the pups step, so a cached build reuses it until they change.
+func (config *Config) Dockerfile(pupsArgs string, bakeEnv bool, mountSecrets bool) string {
+	from := "ARG dockerfile_from_image=" + config.Base_Image + "\n" +
+		"FROM ${dockerfile_from_image}\n"
+	return config.dockerfile(from, pupsArgs, bakeEnv, mountSecrets)
+}
+
+// Generates the dockerfile that builds the config's image for each of platforms.
+// With more than one platform, each builds from its own base image, picked by the builder's TARGETARCH.
+func (config *Config) PlatformDockerfile(pupsArgs string, bakeEnv bool, mountSecrets bool, platforms []string) (string, error) {
+	images := []string{}
+	for _, platform := range platforms {
+		image, err := config.PlatformBaseImage(platform)
+		if err != nil {
+			return "", err
+		}
+		images = append(images, image)
+	}
+	if !slices.ContainsFunc(images, func(image string) bool { return image != images[0] }) {
+		return config.dockerfile("FROM "+images[0]+"\n", pupsArgs, bakeEnv, mountSecrets), nil
+	}
+	from := strings.Builder{}
+	stages := []string{}
+	for i, platform := range platforms {
+		stage := "base-" + strings.Split(platform, "/")[1]
+		if slices.Contains(stages, stage) {
+			continue
+		}
+		stages = append(stages, stage)
+		from.WriteString("FROM " + images[i] + " AS " + stage + "\n")
+	}
+	from.WriteString("FROM base-${TARGETARCH}\n")
+	return config.dockerfile(from.String(), pupsArgs, bakeEnv, mountSecrets), nil
+}
+
+func (config *Config) dockerfile(from string, pupsArgs string, bakeEnv bool, mountSecrets bool) string {
 	builder := strings.Builder{}
-	builder.WriteString("ARG dockerfile_from_image=" + config.Base_Image + "\n")
-	builder.WriteString("FROM ${dockerfile_from_image}\n")
+	builder.WriteString(from)
 	builder.WriteString(config.DockerfileArgs() + "\n")
+	builder.WriteString("COPY config.yaml /temp-config.yaml\n")
+	builder.WriteString("RUN ")
+	if secrets := config.SecretKeys(); mountSecrets && len(secrets) > 0 {
+		for _, k := range secrets {
+			builder.WriteString("--mount=type=secret,id=" + k + " \\\n    ")
+		}
+		for _, k := range secrets {
+			builder.WriteString("export " + k + "=\"$(cat /run/secrets/" + k + ")\" && \\\n    ")
+		}
+	}
+	builder.WriteString("cat /temp-config.yaml | /usr/local/bin/pups " + pupsArgs + " --stdin " +
+		"&& rm /temp-config.yaml\n")
 	if bakeEnv {
 		builder.WriteString(config.DockerfileEnvs() + "\n")
 	}
 	builder.WriteString(config.DockerfileExpose() + "\n")
-	builder.WriteString("COPY config.yaml /temp-config.yaml\n")
-	builder.WriteString("RUN " +
-		"cat /temp-config.yaml | /usr/local/bin/pups " + pupsArgs + " --stdin " +
-		"&& rm /temp-config.yaml\n")
 	builder.WriteString("CMD [\"" + config.BootCommand() + "\"]")
 	return builder.String()
 }
 
 func (config *Config) WriteYamlConfig(dir string) error {
 	file := strings.TrimRight(dir, "/") + "/config.yaml"
-	if err := os.WriteFile(file, []byte(config.Yaml()), 0660); err != nil {
+	if err := os.WriteFile(file, []byte(config.Yaml(false)), 0660); err != nil {
 		return errors.New("error writing config file " + file)
 	}
 	return nil
 }
 
-func (config *Config) WriteEnvConfig(dir string) error {
+func (config *Config) WriteEnvConfig(dir string, includeSecrets bool) error {
 	file := strings.TrimRight(dir, "/") + "/.envrc"
-	if err := os.WriteFile(file, []byte(config.ExportEnv()), 0660); err != nil {
+	if err := os.WriteFile(file, []byte(config.ExportEnv(includeSecrets)), 0660); err != nil {
 		return errors.New("error writing export env " + file)
 	}
 	return nil
@@ -290,10 +390,38 @@ func (config *Config) BootCommand() string {
 	}
 }
 
-func (config *Config) EnvArray(includeKnownSecrets bool) []string {
+// Whether the env key holds a secret, which must stay out of built images and generated files.
+// Secrets are well-known discourse secrets, keys resolved from a secret provider, or keys matching a default or declared secrets pattern.
+func (config *Config) IsSecret(key string) bool {
+	if slices.Contains(utils.KnownSecrets, key) || slices.Contains(config.secretRefs, key) {
+		return true
+	}
+	for _, patterns := range [][]string{utils.SecretPatterns, config.Secrets} {
+		for _, pattern := range patterns {
+			if matched, _ := path.Match(pattern, key); matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Sorted env keys holding secrets.
+func (config *Config) SecretKeys() []string {
+	keys := []string{}
+	for k, _ := range config.Env {
+		if config.IsSecret(k) {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func (config *Config) EnvArray(includeSecrets bool) []string {
 	envs := []string{}
 	for k, v := range config.Env {
-		if !includeKnownSecrets && slices.Contains(utils.KnownSecrets, k) {
+		if !includeSecrets && config.IsSecret(k) {
 			continue
 		}
 		envs = append(envs, k+"="+v)
@@ -306,9 +434,14 @@ func (config *Config) DockerArgs() []string {
 	return strings.Fields(config.Docker_Args)
 }
 
-func (config *Config) ExportEnv() string {
+// Without includeSecrets, secrets are not written out. They must instead already be exported when sourcing.
+func (config *Config) ExportEnv(includeSecrets bool) string {
 	builder := []string{}
 	for k, v := range config.Env {
+		if !includeSecrets && config.IsSecret(k) {
+			builder = append(builder, "export "+k+"=\"${"+k+":?"+k+" is a secret, export it before sourcing}\"")
+			continue
+		}
 		val := strings.ReplaceAll(v, "\\", "\\\\")
 		val = strings.ReplaceAll(val, "\"", "\\\"")
 		builder = append(builder, "export "+k+"=\""+val+"\"")
@@ -320,6 +453,9 @@ func (config *Config) ExportEnv() string {
 func (config *Config) DockerfileEnvs() string {
 	builder := []string{}
 	for k, _ := range config.Env {
+		if config.IsSecret(k) {
+			continue
+		}
 		builder = append(builder, "ENV "+k+"=${"+k+"}")
 	}
 	slices.Sort(builder)
@@ -329,6 +465,9 @@ func (config *Config) DockerfileEnvs() string {
 func (config *Config) DockerfileArgs() string {
 	builder := []string{}
 	for k, _ := range config.Env {
+		if config.IsSecret(k) {
+			continue
+		}
 		builder = append(builder, "ARG "+k)
 	}
 	slices.Sort(builder)
@@ -348,9 +487,14 @@ func (config *Config) DockerfileExpose() string {
 	return strings.Join(builder, "\n")
 }
 
-func (config *Config) DockerArgsCli(includePorts bool) string {
+// Without includeSecrets, secrets are passed by name, so docker reads them from its environment.
+func (config *Config) DockerArgsCli(includePorts bool, includeSecrets bool) string {
 	args := []string{}
 	for k, v := range config.Env {
+		if !includeSecrets && config.IsSecret(k) {
+			args = append(args, "--env "+k)
+			continue
+		}
 		value := shellwords.Escape(v)
 		args = append(args, "--env "+k+"="+value)
 	}
@@ -384,6 +528,19 @@ func (config *Config) RunImage() string {
 	return utils.BaseImageName + config.Name
 }
 
+// The image the config's images are pushed to and pulled from in its registry, eg. ghcr.io/example/app:latest.
+// The image is named after the config, unless image_name is set.
+func (config *Config) RegistryImage(tag string) (string, error) {
+	if config.Registry == "" {
+		return "", errors.New("config " + config.Name + " has no registry, set registry to push and pull its images")
+	}
+	name := config.Image_Name
+	if name == "" {
+		name = config.Name
+	}
+	return strings.TrimRight(config.Registry, "/") + "/" + name + ":" + tag, nil
+}
+
 func (config *Config) DockerHostname(defaultHostname string) string {
 	_, exists := config.Env["DOCKER_USE_HOSTNAME"]
 	re := regexp.MustCompile(`[^a-zA-Z-]`)
@@ -5,8 +5,13 @@ import (
 	. "github.com/onsi/gomega"
 
 	"github.com/discourse/discourse_docker/launcher_go/v2/config"
+	. "github.com/discourse/discourse_docker/launcher_go/v2/test_utils"
+	"github.com/discourse/discourse_docker/launcher_go/v2/utils"
 	"os"
+	"path"
 	"strings"
+
+	"gopkg.in/yaml.v3"
 )
 
 var _ = Describe("Config", func() {
@@ -22,65 +27,698 @@ var _ = Describe("Config", func() {
 	It("should be able to load", func() {
 		conf, err := config.LoadConfig("../test/containers", "test", true, "../test")
 		Expect(err).To(BeNil())
-		result := conf.Yaml()
+		result := conf.Yaml(true)
 		Expect(string(result)).To(ContainSubstring("DISCOURSE_DEVELOPER_EMAILS: 'me@example.com,you@example.com'"))
 		Expect(string(result)).To(ContainSubstring("_FILE_SEPERATOR_"))
 		Expect(string(result)).To(ContainSubstring("version: tests-passed"))
 	})
 
+	Context("with overlays", func() {
+		It("merges the environment's overlay, then overlay files in order", func() {
+			overlay := testDir + "/overlay.yml"
+			os.WriteFile(overlay, []byte("env:\n  UNICORN_WORKERS: 4\n  LANG: C\n"), 0644)
+			conf, err := config.Load("../test/containers", "test", config.LoadOptions{
+				IncludeTemplates: true,
+				TemplatesDirs:    []string{"../test"},
+				Overlays:         []string{overlay},
+				EnvName:          "staging",
+			})
+			Expect(err).To(BeNil())
+			Expect(conf.Env["DISCOURSE_HOSTNAME"]).To(Equal("staging.example.com"))
+			Expect(conf.Env["UNICORN_WORKERS"]).To(Equal("4"))
+			Expect(conf.Env["LANG"]).To(Equal("C"))
+			Expect(conf.Env["LANGUAGE"]).To(Equal("en_US.UTF-8"))
+
+			// overlays come last in the raw yaml, so pups merges them last too
+			docs := strings.Split(conf.Yaml(true), "_FILE_SEPERATOR_")
+			Expect(docs).To(HaveLen(4))
+			Expect(docs[2]).To(ContainSubstring("staging.example.com"))
+			Expect(docs[3]).To(ContainSubstring("LANG: C"))
+		})
+
+		It("fails on a missing environment overlay", func() {
+			_, err := config.Load("../test/containers", "test", config.LoadOptions{EnvName: "prdo"})
+			Expect(err).To(MatchError("no overlay for env prdo, ../test/containers/test.prdo.yml does not exist"))
+		})
+
+		It("fails on a missing overlay file", func() {
+			_, err := config.Load("../test/containers", "test", config.LoadOptions{Overlays: []string{testDir + "/missing.yml"}})
+			Expect(err).ToNot(BeNil())
+		})
+	})
+
+	Context("with nested templates", func() {
+		var write = func(file string, content string) {
+			os.MkdirAll(path.Dir(testDir+"/"+file), 0755)
+			os.WriteFile(testDir+"/"+file, []byte(content), 0644)
+		}
+
+		It("loads included templates first, once each", func() {
+			write("templates/base.template.yml", "env:\n  A: base\n  B: base\n")
+			write("templates/web.template.yml", "templates:\n  - templates/base.template.yml\nenv:\n  B: web\n")
+			write("templates/redis.template.yml", "templates:\n  - templates/base.template.yml\nenv:\n  C: redis\n")
+			write("containers/app.yml", "templates:\n  - templates/web.template.yml\n  - templates/redis.template.yml\n")
+			conf, err := config.LoadConfig(testDir+"/containers", "app", true, testDir)
+			Expect(err).To(BeNil())
+			Expect(conf.Env).To(Equal(map[string]string{"A": "base", "B": "web", "C": "redis"}))
+			Expect(conf.Templates).To(Equal([]string{"templates/base.template.yml", "templates/web.template.yml", "templates/redis.template.yml"}))
+			Expect(strings.Split(conf.Yaml(true), "_FILE_SEPERATOR_")).To(HaveLen(4))
+		})
+
+		It("applies merge directives to the templates list before loading them", func() {
+			write("templates/a.template.yml", "env:\n  A: a\n")
+			write("templates/b.template.yml", "env:\n  B: b\n")
+			write("containers/app.yml", "templates: !remove\n  - templates/a.template.yml\n")
+			conf, err := config.LoadConfig(testDir+"/containers", "app", true, testDir)
+			Expect(err).To(BeNil())
+			Expect(conf.Templates).To(BeEmpty())
+			Expect(conf.Env).ToNot(HaveKey("A"))
+		})
+
+		It("loads templates added by overlays", func() {
+			write("templates/a.template.yml", "env:\n  A: a\n")
+			write("templates/b.template.yml", "env:\n  B: b\n")
+			write("containers/app.yml", "templates:\n  - templates/a.template.yml\n")
+			write("containers/app.prod.yml", "templates:\n  - templates/b.template.yml\n")
+			write("containers/app.solo.yml", "templates: !replace\n  - templates/b.template.yml\n")
+			conf, err := config.Load(testDir+"/containers", "app", config.LoadOptions{IncludeTemplates: true, TemplatesDirs: []string{testDir}, EnvName: "prod"})
+			Expect(err).To(BeNil())
+			Expect(conf.Templates).To(Equal([]string{"templates/a.template.yml", "templates/b.template.yml"}))
+			Expect(conf.Env).To(Equal(map[string]string{"A": "a", "B": "b"}))
+
+			conf, err = config.Load(testDir+"/containers", "app", config.LoadOptions{IncludeTemplates: true, TemplatesDirs: []string{testDir}, EnvName: "solo"})
+			Expect(err).To(BeNil())
+			Expect(conf.Templates).To(Equal([]string{"templates/b.template.yml"}))
+			Expect(conf.Env).To(Equal(map[string]string{"B": "b"}))
+		})
+
+		It("fails on template cycles", func() {
+			write("templates/a.template.yml", "templates:\n  - templates/b.template.yml\n")
+			write("templates/b.template.yml", "templates:\n  - templates/a.template.yml\n")
+			write("containers/app.yml", "templates:\n  - templates/a.template.yml\n")
+			_, err := config.LoadConfig(testDir+"/containers", "app", true, testDir)
+			Expect(err).To(MatchError("template cycle: templates/a.template.yml -> templates/b.template.yml -> templates/a.template.yml"))
+		})
+
+		It("takes templates from the first templates dir containing them", func() {
+			write("team/templates/web.template.yml", "env:\n  A: team\n")
+			write("upstream/templates/web.template.yml", "env:\n  A: upstream\n")
+			write("upstream/templates/redis.template.yml", "env:\n  B: upstream\n")
+			write("containers/app.yml", "templates:\n  - templates/web.template.yml\n  - templates/redis.template.yml\n")
+			conf, err := config.LoadConfig(testDir+"/containers", "app", true, testDir+"/team", testDir+"/upstream")
+			Expect(err).To(BeNil())
+			Expect(conf.Env).To(Equal(map[string]string{"A": "team", "B": "upstream"}))
+		})
+
+		It("fails on templates missing from every templates dir", func() {
+			write("containers/app.yml", "templates:\n  - templates/missing.template.yml\n")
+			_, err := config.LoadConfig(testDir+"/containers", "app", true, testDir+"/team", testDir+"/upstream")
+			Expect(err).To(MatchError(ContainSubstring("template templates/missing.template.yml could not be found in " + testDir + "/team, " + testDir + "/upstream")))
+		})
+	})
+
+	Context("with interpolation", func() {
+		var load = func(app string, envFile string) (*config.Config, error) {
+			os.WriteFile(testDir+"/app.yml", []byte(app), 0644)
+			os.WriteFile(testDir+"/.env", []byte(envFile), 0644)
+			return config.Load(testDir, "app", config.LoadOptions{EnvFile: testDir + "/.env"})
+		}
+		BeforeEach(func() {
+			os.Setenv("LAUNCHER_TEST_HOST", "db.example.com")
+			os.Setenv("LAUNCHER_TEST_EMPTY", "")
+		})
+		AfterEach(func() {
+			os.Unsetenv("LAUNCHER_TEST_HOST")
+			os.Unsetenv("LAUNCHER_TEST_EMPTY")
+		})
+
+		It("interpolates the process environment, then the env file", func() {
+			conf, err := load(
+				"env:\n  HOST: ${LAUNCHER_TEST_HOST}\n  PORT: ${LAUNCHER_TEST_PORT:-5432}\n  NAME: ${LAUNCHER_TEST_NAME}\n  EMPTY: ${LAUNCHER_TEST_EMPTY:-default}\n  LITERAL: $${LAUNCHER_TEST_HOST}\n"+
+					"params:\n  version: ${LAUNCHER_TEST_VERSION:-stable}\n"+
+					"labels:\n  host: ${LAUNCHER_TEST_HOST}\n"+
+					"volumes:\n  - volume:\n      host: ${LAUNCHER_TEST_SHARED}/shared\n      guest: /shared\n"+
+					"docker_args: --add-host db:${LAUNCHER_TEST_IP}\n"+
+					"run_image: ${LAUNCHER_TEST_REGISTRY}/web\n",
+				"# test env\nLAUNCHER_TEST_HOST=from-env-file\nexport LAUNCHER_TEST_NAME=\"discourse\"\nLAUNCHER_TEST_SHARED='/var/discourse'\nLAUNCHER_TEST_IP=10.0.0.2\nLAUNCHER_TEST_REGISTRY=registry.example.com\n")
+			Expect(err).To(BeNil())
+			Expect(conf.Env).To(Equal(map[string]string{
+				"HOST":    "db.example.com",
+				"PORT":    "5432",
+				"NAME":    "discourse",
+				"EMPTY":   "default",
+				"LITERAL": "${LAUNCHER_TEST_HOST}",
+			}))
+			Expect(conf.Params["version"]).To(Equal("stable"))
+			Expect(conf.Labels["host"]).To(Equal("db.example.com"))
+			Expect(conf.Volumes[0].Volume.Host).To(Equal("/var/discourse/shared"))
+			Expect(conf.Docker_Args).To(Equal("--add-host db:10.0.0.2"))
+			Expect(conf.Run_Image).To(Equal("registry.example.com/web"))
+			// pups gets the interpolated values too
+			Expect(conf.Yaml(true)).To(ContainSubstring("HOST: db.example.com"))
+			Expect(conf.Yaml(true)).To(ContainSubstring("version: stable"))
+		})
+
+		It("fails on missing required values, naming the file and key", func() {
+			_, err := load("env:\n  LANG: C\n  DISCOURSE_DB_PASSWORD: ${LAUNCHER_TEST_PASSWORD:?export it in CI}\n", "")
+			Expect(err).To(MatchError(testDir + "/app.yml:3: env.DISCOURSE_DB_PASSWORD: required variable LAUNCHER_TEST_PASSWORD is missing a value: export it in CI"))
+			_, err = load("docker_args: ${LAUNCHER_TEST_EMPTY:?}\n", "")
+			Expect(err).To(MatchError(testDir + "/app.yml:1: docker_args: required variable LAUNCHER_TEST_EMPTY is missing a value"))
+		})
+
+		It("fails on malformed env files", func() {
+			_, err := load("env:\n  LANG: C\n", "LANG=C\nnot a variable\n")
+			Expect(err).To(MatchError(testDir + "/.env:2: expected KEY=VALUE"))
+		})
+	})
+
+	Context("with secret providers", func() {
+		var load = func(app string) (*config.Config, error) {
+			os.WriteFile(testDir+"/app.yml", []byte(app), 0644)
+			return config.LoadConfig(testDir, "app", false)
+		}
+		BeforeEach(func() {
+			utils.CmdRunner = CreateNewFakeCmdRunner()
+		})
+		AfterEach(func() {
+			utils.CmdRunner = utils.NewExecCmdRunner
+		})
+
+		It("resolves secrets from files and commands, and keeps them out of generated files", func() {
+			os.WriteFile(testDir+"/db_pass", []byte("file-secret\n"), 0600)
+			CmdOutputResponse = []byte("exec-secret\n")
+			conf, err := load("env:\n  LANG: C\n  DB_PASS: {secret: \"file:" + testDir + "/db_pass\"}\n  API_TOKEN:\n    secret: exec:pass show discourse/api\n")
+			Expect(err).To(BeNil())
+			Expect(conf.Env["DB_PASS"]).To(Equal("file-secret"))
+			Expect(conf.Env["API_TOKEN"]).To(Equal("exec-secret"))
+			cmd := GetLastCommand()
+			Expect(cmd.Args).To(Equal([]string{"sh", "-c", "pass show discourse/api"}))
+
+			Expect(conf.IsSecret("DB_PASS")).To(BeTrue())
+			Expect(conf.IsSecret("API_TOKEN")).To(BeTrue())
+			Expect(conf.Yaml(false)).To(Equal("env:\n  LANG: C\n"))
+			Expect(conf.Yaml(true)).To(ContainSubstring("DB_PASS: file-secret"))
+			Expect(conf.ExportEnv(false)).ToNot(ContainSubstring("-secret"))
+			Expect(config.GenConcourseConfig(*conf, false)).ToNot(ContainSubstring("-secret"))
+		})
+
+		It("decrypts sops and age files", func() {
+			os.Setenv("AGE_IDENTITY", testDir+"/key.txt")
+			defer os.Unsetenv("AGE_IDENTITY")
+			CmdOutputResponse = []byte("decrypted")
+			conf, err := load("env:\n  A: {secret: \"sops:secrets.enc.yml#DB_PASS\"}\n  B: {secret: \"age:db_pass.age\"}\n")
+			Expect(err).To(BeNil())
+			Expect(conf.Env).To(Equal(map[string]string{"A": "decrypted", "B": "decrypted"}))
+			sops := GetLastCommand()
+			Expect(sops.Args).To(Equal([]string{"sops", "--decrypt", "--extract", `["DB_PASS"]`, "secrets.enc.yml"}))
+			age := GetLastCommand()
+			Expect(age.Args).To(Equal([]string{"age", "--decrypt", "--identity", testDir + "/key.txt", "db_pass.age"}))
+		})
+
+		It("fails on unknown providers and unresolvable secrets, naming the file and key", func() {
+			_, err := load("env:\n  A: {secret: \"vault:db\"}\n")
+			Expect(err).To(MatchError(testDir + "/app.yml:2: env.A: unknown secret provider 'vault'"))
+			_, err = load("env:\n  A: {secret: \"file:" + testDir + "/missing\"}\n")
+			Expect(err).To(MatchError(ContainSubstring(testDir + "/app.yml:2: env.A: resolving file secret: open " + testDir + "/missing")))
+		})
+	})
+
 	It("can write raw yaml config", func() {
 		err := conf.WriteYamlConfig(testDir)
 		Expect(err).To(BeNil())
 		out, err := os.ReadFile(testDir + "/config.yaml")
 		Expect(err).To(BeNil())
 		Expect(strings.Contains(string(out[:]), ""))
-		Expect(string(out[:])).To(ContainSubstring("DISCOURSE_DEVELOPER_EMAILS: 'me@example.com,you@example.com'"))
+		Expect(string(out[:])).To(ContainSubstring("LANG: en_US.UTF-8"))
+		// secrets are removed from the env section
+		Expect(string(out[:])).ToNot(ContainSubstring("DISCOURSE_DEVELOPER_EMAILS"))
+		Expect(string(out[:])).ToNot(ContainSubstring("DISCOURSE_DB_PASSWORD: SOME_SECRET"))
+		Expect(string(out[:])).ToNot(ContainSubstring("s3-secret"))
+		Expect(string(out[:])).ToNot(ContainSubstring("1234567890123456"))
+		// files without secrets are untouched
+		Expect(string(out[:])).To(ContainSubstring("version: tests-passed"))
 	})
 
 	It("can write env file", func() {
-		conf.WriteEnvConfig(testDir)
+		conf.WriteEnvConfig(testDir, true)
 		out, err := os.ReadFile(testDir + "/.envrc")
 		Expect(err).To(BeNil())
 		Expect(string(out[:])).To(ContainSubstring("export DISCOURSE_HOSTNAME"))
+		Expect(string(out[:])).To(ContainSubstring("export DISCOURSE_DB_PASSWORD=\"SOME_SECRET\""))
+	})
+
+	It("leaves secret values out of the env file", func() {
+		conf.WriteEnvConfig(testDir, false)
+		out, err := os.ReadFile(testDir + "/.envrc")
+		Expect(err).To(BeNil())
+		Expect(string(out[:])).To(ContainSubstring("export LANG=\"en_US.UTF-8\""))
+		Expect(string(out[:])).To(ContainSubstring(`export DISCOURSE_DB_PASSWORD="${DISCOURSE_DB_PASSWORD:?DISCOURSE_DB_PASSWORD is a secret, export it before sourcing}"`))
+		Expect(string(out[:])).ToNot(ContainSubstring("SOME_SECRET"))
+		Expect(string(out[:])).ToNot(ContainSubstring("s3-secret"))
+	})
+
+	It("recognizes secrets by name, default patterns, and declared patterns", func() {
+		Expect(conf.IsSecret("DISCOURSE_DB_PASSWORD")).To(BeTrue())
+		Expect(conf.IsSecret("DISCOURSE_S3_SECRET_ACCESS_KEY")).To(BeTrue())
+		Expect(conf.IsSecret("DISCOURSE_MAXMIND_LICENSE_KEY")).To(BeTrue())
+		Expect(conf.IsSecret("LANG")).To(BeFalse())
+		Expect(conf.EnvArray(false)).ToNot(ContainElement("DISCOURSE_S3_SECRET_ACCESS_KEY=s3-secret"))
+		Expect(conf.EnvArray(true)).To(ContainElement("DISCOURSE_S3_SECRET_ACCESS_KEY=s3-secret"))
+	})
+
+	It("merges secrets declared by templates with the config's", func() {
+		os.MkdirAll(testDir+"/containers", 0755)
+		os.WriteFile(testDir+"/secrets.template.yml", []byte("secrets:\n  - OAUTH_*\n"), 0644)
+		os.WriteFile(testDir+"/containers/app.yml", []byte("templates:\n  - secrets.template.yml\nsecrets:\n  - STRIPE_KEY\nenv:\n  OAUTH_CLIENT: a\n  STRIPE_KEY: b\n  LANG: c\n"), 0644)
+		conf, err := config.LoadConfig(testDir+"/containers", "app", true, testDir)
+		Expect(err).To(BeNil())
+		Expect(conf.Secrets).To(Equal([]string{"OAUTH_*", "STRIPE_KEY"}))
+		Expect(conf.SecretKeys()).To(Equal([]string{"OAUTH_CLIENT", "STRIPE_KEY"}))
 	})
 
 	It("can write a dockerfile", func() {
 		conf.WriteDockerfile(testDir, "", false)
 		out, err := os.ReadFile(testDir + "/config.yaml")
 		Expect(err).To(BeNil())
-		Expect(string(out[:])).To(ContainSubstring("DISCOURSE_DEVELOPER_EMAILS: 'me@example.com,you@example.com'"))
+		Expect(string(out[:])).To(ContainSubstring("LANG: en_US.UTF-8"))
 		out, err = os.ReadFile(testDir + "/Dockerfile")
 		Expect(err).To(BeNil())
-		Expect(string(out[:])).To(ContainSubstring("RUN cat /temp-config.yaml"))
+		Expect(string(out[:])).To(ContainSubstring("cat /temp-config.yaml | /usr/local/bin/pups"))
 		Expect(string(out[:])).To(ContainSubstring("EXPOSE 80"))
 	})
 
+	It("mounts secrets into the pups step instead of passing them as build args", func() {
+		dockerfile := conf.Dockerfile("", true, true)
+		Expect(dockerfile).To(ContainSubstring("ARG LANG\n"))
+		Expect(dockerfile).To(ContainSubstring("ENV LANG=${LANG}\n"))
+		Expect(dockerfile).ToNot(ContainSubstring("ARG DISCOURSE_DB_PASSWORD"))
+		Expect(dockerfile).ToNot(ContainSubstring("ENV DISCOURSE_DB_PASSWORD"))
+		Expect(dockerfile).To(ContainSubstring("RUN --mount=type=secret,id=DISCOURSE_DB_HOST \\\n    --mount=type=secret,id=DISCOURSE_DB_PASSWORD \\\n"))
+		Expect(dockerfile).To(ContainSubstring(`    export DISCOURSE_DB_PASSWORD="$(cat /run/secrets/DISCOURSE_DB_PASSWORD)" && \`))
+		Expect(dockerfile).To(ContainSubstring(" && \\\n    cat /temp-config.yaml | /usr/local/bin/pups  --stdin && rm /temp-config.yaml\n"))
+		Expect(dockerfile).ToNot(ContainSubstring("SOME_SECRET"))
+
+		// ports and baked env don't feed into pups, so they come after it and changing them keeps its layer cached
+		Expect(strings.Index(dockerfile, "EXPOSE 80")).To(BeNumerically(">", strings.Index(dockerfile, "/usr/local/bin/pups")))
+		Expect(strings.Index(dockerfile, "ENV LANG")).To(BeNumerically(">", strings.Index(dockerfile, "/usr/local/bin/pups")))
+
+		// builders without BuildKit leave secrets out entirely
+		dockerfile = conf.Dockerfile("", false, false)
+		Expect(dockerfile).To(ContainSubstring("RUN cat /temp-config.yaml"))
+		Expect(dockerfile).ToNot(ContainSubstring("DISCOURSE_DB_PASSWORD"))
+	})
+
+	It("builds each platform from its own base image", func() {
+		dockerfile, err := conf.PlatformDockerfile("", false, true, []string{"linux/amd64", "linux/arm64"})
+		Expect(err).To(BeNil())
+		Expect(dockerfile).To(HavePrefix("FROM discourse/base:2.0.20231121-0024 AS base-amd64\nFROM discourse/base:aarch64 AS base-arm64\nFROM base-${TARGETARCH}\nARG "))
+
+		dockerfile, err = conf.PlatformDockerfile("", false, true, []string{"linux/arm64"})
+		Expect(err).To(BeNil())
+		Expect(dockerfile).To(HavePrefix("FROM discourse/base:aarch64\nARG "))
+
+		_, err = conf.PlatformDockerfile("", false, true, []string{"linux/s390x"})
+		Expect(err).To(MatchError("there is no default base image for linux/s390x, set base_image to a multi-arch image to build it"))
+		_, err = conf.PlatformDockerfile("", false, true, []string{"arm64"})
+		Expect(err).To(MatchError(ContainSubstring("invalid platform arm64")))
+
+		// a config's own base image is used for every platform
+		conf.Base_Image = "example/multiarch:latest"
+		dockerfile, err = conf.PlatformDockerfile("", false, true, []string{"linux/s390x", "linux/arm64"})
+		Expect(err).To(BeNil())
+		Expect(dockerfile).To(HavePrefix("FROM example/multiarch:latest\nARG "))
+	})
+
+	It("generates kubernetes manifests", func() {
+		manifests, err := conf.KubernetesManifests(config.KubernetesOptions{Image: "ghcr.io/example/test:latest", VolumeSize: "20Gi"})
+		Expect(err).To(BeNil())
+		Expect(manifests["kustomization.yaml"]).To(Equal("apiVersion: kustomize.config.k8s.io/v1beta1\nkind: Kustomization\nresources:\n  - configmap.yaml\n  - deployment.yaml\n  - jobs.yaml\n  - secret.yaml\n  - services.yaml\n  - volumes.yaml\n"))
+
+		// a service for each expose entry, on its host port
+		services := manifests["services.yaml"]
+		Expect(strings.Count(services, "kind: Service\n")).To(Equal(3))
+		Expect(services).To(ContainSubstring("  name: test-443\n"))
+		Expect(services).To(ContainSubstring("    - name: tcp-90\n      port: 90\n      targetPort: 90\n      protocol: TCP\n"))
+
+		// secrets go in the secret, the rest of the env in the config map
+		Expect(manifests["configmap.yaml"]).To(ContainSubstring("  LANG: en_US.UTF-8\n"))
+		Expect(manifests["configmap.yaml"]).ToNot(ContainSubstring("DISCOURSE_DB_PASSWORD"))
+		Expect(manifests["secret.yaml"]).To(ContainSubstring("  DISCOURSE_DB_PASSWORD: \"\"\n"))
+		Expect(manifests["secret.yaml"]).ToNot(ContainSubstring("SOME_SECRET"))
+
+		Expect(manifests["volumes.yaml"]).To(ContainSubstring("  name: test-vol-var-log\n"))
+		Expect(manifests["volumes.yaml"]).To(ContainSubstring("storage: 20Gi\n"))
+		Expect(manifests["deployment.yaml"]).To(ContainSubstring("          image: ghcr.io/example/test:latest\n"))
+		Expect(manifests["deployment.yaml"]).To(ContainSubstring("            - name: vol-var-log\n              mountPath: /var/log\n"))
+
+		// jobs run the migrate and configure pups phases
+		Expect(manifests["jobs.yaml"]).To(ContainSubstring("/usr/local/bin/pups --stdin --tags=db,migrate < /pups/config.yaml\n"))
+		Expect(manifests["jobs.yaml"]).To(ContainSubstring("/usr/local/bin/pups --stdin --tags=db,precompile < /pups/config.yaml\n"))
+		Expect(manifests["configmap.yaml"]).To(ContainSubstring("_FILE_SEPERATOR_"))
+		// configure precompiles into an assets volume the deployment serves, near the deployment's pod, and the jobs leave the data volumes alone
+		Expect(manifests["volumes.yaml"]).To(ContainSubstring("  name: test-assets\n"))
+		Expect(manifests["deployment.yaml"]).To(ContainSubstring("            - name: assets\n              mountPath: /var/www/discourse/public/assets\n"))
+		Expect(strings.Count(manifests["jobs.yaml"], "mountPath: /var/www/discourse/public/assets\n")).To(Equal(1))
+		Expect(strings.Count(manifests["jobs.yaml"], "topologyKey: kubernetes.io/hostname\n")).To(Equal(1))
+		Expect(manifests["jobs.yaml"]).ToNot(ContainSubstring("mountPath: /var/log\n"))
+		Expect(manifests["jobs.yaml"]).ToNot(ContainSubstring("mountPath: /shared\n"))
+
+		manifests, err = conf.KubernetesManifests(config.KubernetesOptions{Image: "local_discourse/test", HostPath: true, IncludeSecrets: true})
+		Expect(err).To(BeNil())
+		Expect(manifests).ToNot(HaveKey("volumes.yaml"))
+		Expect(manifests["deployment.yaml"]).To(ContainSubstring("          hostPath:\n            path: /var/discourse/shared/web-only/log/var-log\n            type: DirectoryOrCreate\n"))
+		Expect(manifests["jobs.yaml"]).To(ContainSubstring("          hostPath:\n            path: /var/discourse/assets/test\n            type: DirectoryOrCreate\n"))
+		Expect(manifests["secret.yaml"]).To(ContainSubstring("  DISCOURSE_DB_PASSWORD: SOME_SECRET\n"))
+	})
+
+	It("names kubernetes volumes apart from each other and the built in ones", func() {
+		volume := conf.Volumes[0]
+		conf.Volumes = conf.Volumes[:0:0]
+		for _, guest := range []string{"/assets", "/shm", "/var/log", "/var_log"} {
+			v := volume
+			v.Volume.Host = "/var/discourse/shared" + guest
+			v.Volume.Guest = guest
+			conf.Volumes = append(conf.Volumes, v)
+		}
+		manifests, err := conf.KubernetesManifests(config.KubernetesOptions{Image: "local_discourse/test", VolumeSize: "20Gi"})
+		Expect(err).To(BeNil())
+		deployment := manifests["deployment.yaml"]
+		for _, name := range []string{"shm", "assets", "vol-assets", "vol-shm", "vol-var-log", "vol-var-log-2"} {
+			// mounted once, and declared once
+			Expect(strings.Count(deployment, "\n            - name: "+name+"\n")).To(Equal(1), name)
+			Expect(strings.Count(deployment, "\n        - name: "+name+"\n")).To(Equal(1), name)
+		}
+		Expect(deployment).To(ContainSubstring("            - name: vol-assets\n              mountPath: /assets\n"))
+		Expect(manifests["volumes.yaml"]).To(ContainSubstring("  name: test-vol-var-log-2\n"))
+		// configure still precompiles into the built in assets volume
+		Expect(manifests["jobs.yaml"]).To(ContainSubstring("claimName: test-assets\n"))
+		Expect(manifests["jobs.yaml"]).ToNot(ContainSubstring("claimName: test-vol-assets\n"))
+	})
+
+	It("passes secrets to concourse builds as secret params", func() {
+		out := config.GenConcourseConfig(*conf, false)
+		Expect(out).To(ContainSubstring("BUILD_ARG_LANG: en_US.UTF-8"))
+		Expect(out).To(ContainSubstring("BUILDKIT_SECRETTEXT_DISCOURSE_DB_PASSWORD: ((DISCOURSE_DB_PASSWORD))"))
+		Expect(out).To(ContainSubstring("BUILDKIT_SECRETTEXT_DISCOURSE_S3_SECRET_ACCESS_KEY: ((DISCOURSE_S3_SECRET_ACCESS_KEY))"))
+		Expect(out).ToNot(ContainSubstring("BUILD_ARG_DISCOURSE_DB_PASSWORD"))
+		Expect(out).ToNot(ContainSubstring("DISCOURSE_DB_PASSWORD: SOME_SECRET"))
+		Expect(out).ToNot(ContainSubstring("s3-secret"))
+
+		out = config.GenConcourseConfig(*conf, true)
+		Expect(out).To(ContainSubstring("BUILDKIT_SECRETTEXT_DISCOURSE_DB_PASSWORD: SOME_SECRET"))
+	})
+
 	It("can write a docker compose setup", func() {
-		conf.WriteDockerCompose(testDir, false)
+		conf.WriteDockerCompose(testDir, false, false)
 		out, err := os.ReadFile(testDir + "/.envrc")
 		Expect(err).To(BeNil())
 		Expect(string(out[:])).To(ContainSubstring("export DISCOURSE_HOSTNAME"))
+		Expect(string(out[:])).ToNot(ContainSubstring("SOME_SECRET"))
 		out, err = os.ReadFile(testDir + "/config.yaml")
 		Expect(err).To(BeNil())
-		Expect(string(out[:])).To(ContainSubstring("DISCOURSE_DEVELOPER_EMAILS: 'me@example.com,you@example.com'"))
+		Expect(string(out[:])).To(ContainSubstring("LANG: en_US.UTF-8"))
+		Expect(string(out[:])).ToNot(ContainSubstring("DISCOURSE_DB_PASSWORD: SOME_SECRET"))
 		out, err = os.ReadFile(testDir + "/Dockerfile")
 		Expect(err).To(BeNil())
-		Expect(string(out[:])).To(ContainSubstring("RUN cat /temp-config.yaml"))
+		Expect(string(out[:])).To(ContainSubstring("cat /temp-config.yaml | /usr/local/bin/pups"))
 
 		out, err = os.ReadFile(testDir + "/docker-compose.yaml")
 		Expect(err).To(BeNil())
 		Expect(string(out[:])).To(ContainSubstring("build:"))
 		Expect(string(out[:])).To(ContainSubstring("image: local_discourse/test"))
+		// secrets are build secrets sourced from the environment, not build args
+		compose := config.DockerComposeYaml{}
+		Expect(yaml.Unmarshal(out, &compose)).To(Succeed())
+		Expect(compose.Services["test"].Build.Args).To(HaveKeyWithValue("LANG", "en_US.UTF-8"))
+		Expect(compose.Services["test"].Build.Args).ToNot(HaveKey("DISCOURSE_DB_PASSWORD"))
+		Expect(compose.Services["test"].Build.Secrets).To(ContainElement(config.ComposeBuildSecret{Source: "DISCOURSE_DB_PASSWORD", Target: "DISCOURSE_DB_PASSWORD"}))
+		Expect(compose.Secrets).To(HaveKeyWithValue("DISCOURSE_DB_PASSWORD", config.ComposeSecret{Environment: "DISCOURSE_DB_PASSWORD"}))
+		// and the container reads them from the environment too
+		Expect(compose.Services["test"].Environment).To(HaveKeyWithValue("DISCOURSE_DB_PASSWORD", "${DISCOURSE_DB_PASSWORD}"))
+		Expect(compose.Services["test"].Environment).To(HaveKeyWithValue("LANG", "en_US.UTF-8"))
+	})
+
+	Context("with a multi-config compose project", func() {
+		var configs []*config.Config
+		BeforeEach(func() {
+			write := func(file string, content string) {
+				os.MkdirAll(path.Dir(testDir+"/"+file), 0755)
+				os.WriteFile(testDir+"/"+file, []byte(content), 0644)
+			}
+			write("templates/postgres.template.yml", "env:\n  LANG: en_US.UTF-8\n")
+			write("templates/redis.template.yml", "env: {}\n")
+			write("templates/web.template.yml", "env:\n  LANG: en_US.UTF-8\n")
+			write("containers/data.yml", "templates:\n  - templates/postgres.template.yml\n  - templates/redis.template.yml\nvolumes:\n  - volume:\n      host: data\n      guest: /shared\n")
+			write("containers/web_only.yml", "templates:\n  - templates/web.template.yml\nlinks:\n  - link:\n      name: data\n      alias: postgres\nexpose:\n  - \"80:80\"\nenv:\n  UNICORN_WORKERS: 3\n")
+			configs = []*config.Config{}
+			for _, name := range []string{"data", "web_only"} {
+				loaded, err := config.LoadConfig(testDir+"/containers", name, true, testDir)
+				Expect(err).To(BeNil())
+				configs = append(configs, loaded)
+			}
+		})
+
+		It("runs each config as a service on one network", func() {
+			Expect(config.WriteDockerComposeProject(testDir, "site", configs, false, false)).To(Succeed())
+			for _, file := range []string{"data/Dockerfile", "data/config.yaml", "web_only/Dockerfile", "web_only/config.yaml"} {
+				Expect(testDir + "/" + file).To(BeAnExistingFile())
+			}
+			out, err := os.ReadFile(testDir + "/docker-compose.yaml")
+			Expect(err).To(BeNil())
+			Expect(string(out)).ToNot(ContainSubstring("links:"))
+			compose := config.DockerComposeYaml{}
+			Expect(yaml.Unmarshal(out, &compose)).To(Succeed())
+			Expect(compose.Name).To(Equal("site"))
+			Expect(compose.Networks).To(HaveKey("discourse"))
+			Expect(compose.Volumes).To(HaveKey("data"))
+			Expect(compose.Volumes).To(HaveKey("web_only_assets"))
+
+			data := compose.Services["data"]
+			Expect(data.Build.Context).To(Equal("./data"))
+			Expect(data.Networks["discourse"].Aliases).To(Equal([]string{"postgres"}))
+			Expect(data.Healthcheck.Test).To(Equal([]string{"CMD-SHELL", "pg_isready -q && redis-cli ping"}))
+
+			web := compose.Services["web_only"]
+			Expect(web.Build.Context).To(Equal("./web_only"))
+			Expect(web.Environment).ToNot(HaveKey("MIGRATE_ON_BOOT"))
+			// a plain up migrates and precompiles before starting web
+			Expect(web.Depends_On).To(Equal(map[string]config.ComposeDependency{
+				"data":               {Condition: "service_healthy"},
+				"web_only-migrate":   {Condition: "service_completed_successfully"},
+				"web_only-configure": {Condition: "service_completed_successfully"},
+			}))
+			Expect(web.Healthcheck.Test).To(Equal([]string{"CMD-SHELL", "curl -fsS http://localhost/srv/status"}))
+			Expect(web.Volumes).To(ContainElement("web_only_assets:/var/www/discourse/public/assets"))
+		})
+
+		It("adds migrate and configure services to web configs", func() {
+			Expect(config.WriteDockerComposeProject(testDir, "site", configs, false, false)).To(Succeed())
+			out, _ := os.ReadFile(testDir + "/docker-compose.yaml")
+			compose := config.DockerComposeYaml{}
+			Expect(yaml.Unmarshal(out, &compose)).To(Succeed())
+			Expect(compose.Services).ToNot(HaveKey("data-migrate"))
+
+			migrate := compose.Services["web_only-migrate"]
+			Expect(migrate.Build).To(BeNil())
+			Expect(migrate.Image).To(Equal("local_discourse/web_only"))
+			Expect(migrate.Command).To(Equal([]string{"/bin/bash", "-c", "/usr/local/bin/pups --stdin --tags=db,migrate < /pups/config.yaml"}))
+			Expect(migrate.Volumes).To(ContainElement("./web_only/config.yaml:/pups/config.yaml:ro"))
+			Expect(migrate.Depends_On).To(HaveKeyWithValue("data", config.ComposeDependency{Condition: "service_healthy"}))
+
+			configure := compose.Services["web_only-configure"]
+			Expect(configure.Depends_On).To(Equal(map[string]config.ComposeDependency{
+				"data":             {Condition: "service_healthy"},
+				"web_only-migrate": {Condition: "service_completed_successfully"},
+			}))
+			Expect(configure.Command[2]).To(ContainSubstring("--tags=db,precompile"))
+			Expect(configure.Volumes).To(ContainElement("web_only_assets:/var/www/discourse/public/assets"))
+		})
+
+		It("keeps values configs set differently on their own services", func() {
+			configs[0].Env["LANG"] = "de_DE.UTF-8"
+			configs[0].Env["DISCOURSE_DB_PASSWORD"] = "data-pass"
+			configs[1].Env["DISCOURSE_DB_PASSWORD"] = "web-pass"
+			configs[1].Env["SITE_TAGLINE"] = "pa$word"
+			Expect(config.WriteDockerComposeProject(testDir, "site", configs, false, true)).To(Succeed())
+			out, _ := os.ReadFile(testDir + "/.envrc")
+			Expect(string(out)).ToNot(ContainSubstring("export LANG="))
+			Expect(string(out)).To(ContainSubstring("export UNICORN_WORKERS=\"3\""))
+			Expect(string(out)).To(ContainSubstring("export DATA_DISCOURSE_DB_PASSWORD=\"data-pass\""))
+			Expect(string(out)).To(ContainSubstring("export WEB_ONLY_DISCOURSE_DB_PASSWORD=\"web-pass\""))
+
+			out, _ = os.ReadFile(testDir + "/docker-compose.yaml")
+			compose := config.DockerComposeYaml{}
+			Expect(yaml.Unmarshal(out, &compose)).To(Succeed())
+			Expect(compose.Services["data"].Environment).To(HaveKeyWithValue("LANG", "de_DE.UTF-8"))
+			Expect(compose.Services["data"].Build.Args).To(HaveKeyWithValue("LANG", "de_DE.UTF-8"))
+			Expect(compose.Services["web_only"].Environment).To(HaveKeyWithValue("LANG", "en_US.UTF-8"))
+			// values are escaped from compose's interpolation
+			Expect(compose.Services["web_only"].Environment).To(HaveKeyWithValue("SITE_TAGLINE", "pa$$word"))
+			// secrets are read from each config's own variable, and mounted under their key
+			Expect(compose.Services["web_only"].Environment).To(HaveKeyWithValue("DISCOURSE_DB_PASSWORD", "${WEB_ONLY_DISCOURSE_DB_PASSWORD}"))
+			Expect(compose.Services["data"].Build.Secrets).To(ContainElement(config.ComposeBuildSecret{Source: "DATA_DISCOURSE_DB_PASSWORD", Target: "DISCOURSE_DB_PASSWORD"}))
+			Expect(compose.Secrets).To(HaveKeyWithValue("WEB_ONLY_DISCOURSE_DB_PASSWORD", config.ComposeSecret{Environment: "WEB_ONLY_DISCOURSE_DB_PASSWORD"}))
+		})
 	})
 
 	It("parses docker args", func() {
-		Expect(conf.DockerArgsCli(true)).To(ContainSubstring("--expose 90"))
-		Expect(conf.DockerArgsCli(true)).To(ContainSubstring("--env MULTI=test'\n'multiline\\ with\\ some\\ spaces'\n'var'\n'"))
-		Expect(conf.DockerArgsCli(true)).To(ContainSubstring("--env REPLACED=test/test/test"))
-		Expect(conf.DockerArgsCli(true)).To(ContainSubstring("--expose 100"))
+		Expect(conf.DockerArgsCli(true, false)).To(ContainSubstring("--expose 90"))
+		Expect(conf.DockerArgsCli(true, false)).To(ContainSubstring("--env MULTI=test'\n'multiline\\ with\\ some\\ spaces'\n'var'\n'"))
+		Expect(conf.DockerArgsCli(true, false)).To(ContainSubstring("--env REPLACED=test/test/test"))
+		Expect(conf.DockerArgsCli(true, false)).To(ContainSubstring("--expose 100"))
 
 		// ports can be omitted
-		Expect(conf.DockerArgsCli(false)).ToNot(ContainSubstring("--expose 90"))
+		Expect(conf.DockerArgsCli(false, false)).ToNot(ContainSubstring("--expose 90"))
+
+		// secrets are passed by name unless included
+		Expect(conf.DockerArgsCli(true, false)).To(ContainSubstring("--env DISCOURSE_DB_PASSWORD "))
+		Expect(conf.DockerArgsCli(true, false)).ToNot(ContainSubstring("SOME_SECRET"))
+		Expect(conf.DockerArgsCli(true, true)).To(ContainSubstring("--env DISCOURSE_DB_PASSWORD=SOME_SECRET"))
+	})
+
+	Context("merging templates", func() {
+		// loads app.yml, with a single template merged before it
+		var load = func(template string, app string) (*config.Config, error) {
+			os.MkdirAll(testDir+"/containers", 0755)
+			os.WriteFile(testDir+"/base.template.yml", []byte(template), 0644)
+			os.WriteFile(testDir+"/containers/app.yml", []byte("templates:\n  - base.template.yml\n"+app), 0644)
+			return config.LoadConfig(testDir+"/containers", "app", true, testDir)
+		}
+		type volume = struct {
+			Volume struct {
+				Host  string `yaml:"host"`
+				Guest string `yaml:"guest"`
+			} `yaml:"volume"`
+		}
+		var vol = func(host string, guest string) volume {
+			v := volume{}
+			v.Volume.Host = host
+			v.Volume.Guest = guest
+			return v
+		}
+
+		DescribeTable("merge semantics",
+			func(template string, app string, check func(*config.Config)) {
+				conf, err := load(template, app)
+				Expect(err).To(BeNil())
+				check(conf)
+			},
+			Entry("appends lists",
+				"expose:\n  - \"80:80\"\n",
+				"expose:\n  - \"443:443\"\n",
+				func(c *config.Config) { Expect(c.Expose).To(Equal([]string{"80:80", "443:443"})) }),
+			Entry("skips duplicate list entries",
+				"expose:\n  - \"80:80\"\n  - 90\n",
+				"expose:\n  - \"80:80\"\n  - 100\n",
+				func(c *config.Config) { Expect(c.Expose).To(Equal([]string{"80:80", "90", "100"})) }),
+			Entry("replaces lists",
+				"expose:\n  - \"80:80\"\n",
+				"expose: !replace\n  - \"8080:80\"\n",
+				func(c *config.Config) { Expect(c.Expose).To(Equal([]string{"8080:80"})) }),
+			Entry("prepends to lists",
+				"volumes:\n  - volume:\n      host: /a\n      guest: /a\n",
+				"volumes: !prepend\n  - volume:\n      host: /b\n      guest: /b\n",
+				func(c *config.Config) { Expect(c.Volumes).To(Equal([]volume{vol("/b", "/b"), vol("/a", "/a")})) }),
+			Entry("removes list entries",
+				"volumes:\n  - volume:\n      host: /a\n      guest: /a\n  - volume:\n      host: /b\n      guest: /b\n",
+				"volumes: !remove\n  - volume:\n      host: /a\n      guest: /a\n",
+				func(c *config.Config) { Expect(c.Volumes).To(Equal([]volume{vol("/b", "/b")})) }),
+			Entry("removes links",
+				"links:\n  - link:\n      name: data\n      alias: data\n",
+				"links: !remove\n  - link:\n      name: data\n      alias: data\n",
+				func(c *config.Config) { Expect(c.Links).To(BeEmpty()) }),
+			Entry("overrides and adds map keys",
+				"env:\n  A: 1\n  B: 2\n",
+				"env:\n  B: 3\n  C: 4\n",
+				func(c *config.Config) {
+					Expect(c.Env).To(Equal(map[string]string{"A": "1", "B": "3", "C": "4"}))
+				}),
+			Entry("unsets map keys",
+				"env:\n  A: 1\n  B: 2\nlabels:\n  team: web\n",
+				"env:\n  B: !unset\nlabels:\n  team: !unset\n",
+				func(c *config.Config) {
+					Expect(c.Env).To(Equal(map[string]string{"A": "1"}))
+					Expect(c.Labels).To(BeEmpty())
+				}),
+			Entry("replaces maps",
+				"params:\n  a: 1\n  b: 2\n",
+				"params: !replace\n  c: 3\n",
+				func(c *config.Config) { Expect(c.Params).To(Equal(map[string]string{"c": "3"})) }),
+			Entry("overrides settings",
+				"docker_args: --privileged\nupdate_pups: true\n",
+				"docker_args: --expose 100\nupdate_pups: false\n",
+				func(c *config.Config) {
+					Expect(c.Docker_Args).To(Equal("--expose 100"))
+					Expect(c.Update_Pups).To(BeFalse())
+				}),
+			Entry("keeps settings the config leaves out",
+				"run_image: discourse/custom\n",
+				"env:\n  A: 1\n",
+				func(c *config.Config) { Expect(c.Run_Image).To(Equal("discourse/custom")) }),
+		)
+
+		DescribeTable("unsupported directives",
+			func(app string, message string) {
+				_, err := load("env:\n  A: 1\n", app)
+				Expect(err).To(MatchError(message))
+			},
+			Entry("!unset on a list", "expose: !unset\n  - 80\n", "expose: !unset is not supported on lists"),
+			Entry("!prepend on a map", "env: !prepend\n  A: 2\n", "env: !prepend is not supported on maps"),
+			Entry("!replace on a map value", "env:\n  A: !replace 2\n", "env: !replace is not supported on A"),
+			Entry("directives on settings", "docker_args: !replace --expose 100\n", "docker_args: !replace is not supported on docker_args"),
+		)
+
+		It("hands pups the merged env and params, without directives", func() {
+			conf, err := load("env:\n  A: 1\n  B: 2\nparams:\n  a: 1\n", "env:\n  B: !unset\n  C: 3\nparams: !replace\n  c: 3\nexpose: !replace\n  - 80\n")
+			Expect(err).To(BeNil())
+			docs := strings.Split(conf.Yaml(true), "_FILE_SEPERATOR_")
+			Expect(docs).To(HaveLen(2))
+			Expect(docs[0]).To(Equal("env:\n  A: 1\n"))
+			Expect(docs[1]).To(Equal("templates:\n  - base.template.yml\nenv:\n  C: 3\nparams:\n  c: 3\nexpose:\n  - 80\n"))
+		})
+
+		It("tracks the file and line that set or overrode each setting, in merge order", func() {
+			conf, err := load("base_image: discourse/base\nenv:\n  A: 1\n  B: 2\nexpose:\n  - 80\n", "env:\n  A: 3\n  B: !unset\nexpose: !remove\n  - 80\n")
+			Expect(err).To(BeNil())
+			template := testDir + "/base.template.yml"
+			app := testDir + "/containers/app.yml"
+			Expect(conf.Sources("ENV.A")).To(Equal([]config.Source{{File: template, Line: 3, Action: config.ActionSet}, {File: app, Line: 4, Action: config.ActionOverride}}))
+			Expect(conf.Sources("env.B")).To(Equal([]config.Source{{File: template, Line: 4, Action: config.ActionSet}, {File: app, Line: 5, Action: config.ActionUnset}}))
+			Expect(conf.Sources("expose.80")).To(Equal([]config.Source{{File: template, Line: 6, Action: config.ActionAdd}, {File: app, Line: 7, Action: config.ActionRemove}}))
+			Expect(conf.Sources("base_image")).To(Equal([]config.Source{{File: template, Line: 1, Action: config.ActionSet}}))
+			Expect(conf.MatchSourceKeys("env")).To(Equal([]string{"env.A", "env.B"}))
+			Expect(conf.SourceKeys()).To(Equal([]string{"base_image", "templates.base.template.yml", "env.A", "env.B", "expose.80"}))
+
+			value, ok := conf.Value("env.A")
+			Expect(value).To(Equal("3"))
+			Expect(ok).To(BeTrue())
+			_, ok = conf.Value("env.B")
+			Expect(ok).To(BeFalse())
+			_, ok = conf.Value("expose.80")
+			Expect(ok).To(BeFalse())
+		})
+	})
+
+	It("names registry images after the config, unless image_name is set", func() {
+		_, err := conf.RegistryImage("latest")
+		Expect(err).To(MatchError("config test has no registry, set registry to push and pull its images"))
+		conf.Registry = "ghcr.io/example/"
+		Expect(conf.RegistryImage("latest")).To(Equal("ghcr.io/example/test:latest"))
+		conf.Image_Name = "discourse"
+		Expect(conf.RegistryImage("v1")).To(Equal("ghcr.io/example/discourse:v1"))
+	})
+
+	It("fingerprints the config, its templates, and the base image", func() {
+		fingerprint := conf.Fingerprint("sha256:base")
+		Expect(fingerprint).To(HaveLen(64))
+		Expect(conf.Fingerprint("sha256:base")).To(Equal(fingerprint))
+		Expect(conf.Fingerprint("sha256:newer")).ToNot(Equal(fingerprint))
+
+		overlay := testDir + "/overlay.yml"
+		os.WriteFile(overlay, []byte("env:\n  UNICORN_WORKERS: 4\n"), 0644)
+		changed, err := config.Load("../test/containers", "test", config.LoadOptions{IncludeTemplates: true, TemplatesDirs: []string{"../test"}, Overlays: []string{overlay}})
+		Expect(err).To(BeNil())
+		Expect(changed.Fingerprint("sha256:base")).ToNot(Equal(fingerprint))
 	})
 
 	Context("hostname tests", func() {
@@ -0,0 +1,531 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// A container config file, edited in place.
+//
+// Edits go through the file's yaml nodes, and only the lines of the entry being changed are re-rendered,
+// so comments, key order, and formatting elsewhere in the file are kept as they are.
+type ConfigFile struct {
+	Filename string
+	content  []byte
+}
+
+func OpenConfigFile(dir string, configName string) (*ConfigFile, error) {
+	filename := strings.TrimRight(dir, "/") + "/" + configName + ".yml"
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &ConfigFile{Filename: filename, content: content}, nil
+}
+
+// A config file to be written to filename, starting from content, eg. a sample config.
+func NewConfigFile(filename string, content []byte) *ConfigFile {
+	return &ConfigFile{Filename: filename, content: content}
+}
+
+// The edited file content.
+func (f *ConfigFile) Content() []byte {
+	return f.content
+}
+
+// Writes the edited content back to the file.
+func (f *ConfigFile) Save() error {
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(f.Filename); err == nil {
+		mode = info.Mode()
+	}
+	return os.WriteFile(f.Filename, f.content, mode)
+}
+
+// Splits a path like env.DISCOURSE_HOSTNAME or hooks.after_code.0.exec.cmd into its keys and list indexes.
+// Keys of env, labels, and params may contain dots themselves, so everything after the section is the key.
+func editPath(path string) ([]string, error) {
+	section, key, found := strings.Cut(path, ".")
+	if found && slices.Contains(pupsMapKeys, section) && key != "" {
+		return []string{section, key}, nil
+	}
+	segments := strings.Split(path, ".")
+	if slices.Contains(segments, "") {
+		return nil, fmt.Errorf("invalid path '%s'", path)
+	}
+	return segments, nil
+}
+
+// Parses a value given on the command line as yaml, eg. 4, "a string", or {secret: file:/etc/db_pass}.
+// Anything that isn't valid yaml is taken as a string.
+func parseValue(value string) *yaml.Node {
+	doc := &yaml.Node{}
+	if err := yaml.Unmarshal([]byte(value), doc); err != nil || len(doc.Content) == 0 {
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}
+	}
+	node := doc.Content[0]
+	node.HeadComment, node.LineComment, node.FootComment = "", "", ""
+	return node
+}
+
+// The value at path, as a string for scalars, and as yaml otherwise.
+func (f *ConfigFile) Get(path string) (string, error) {
+	segments, err := editPath(path)
+	if err != nil {
+		return "", err
+	}
+	ed, err := newEditor(f.content)
+	if err != nil {
+		return "", err
+	}
+	chain, err := find(ed.root, segments)
+	if err != nil {
+		return "", err
+	}
+	if len(chain) < len(segments) {
+		return "", fmt.Errorf("%s is not set", path)
+	}
+	node := chain[len(chain)-1].value()
+	if node.Kind == yaml.ScalarNode {
+		return node.Value, nil
+	}
+	node.HeadComment, node.LineComment, node.FootComment = "", "", ""
+	out, err := encodeYaml(node)
+	return strings.TrimSuffix(string(out), "\n"), err
+}
+
+// Sets the value at path, creating any mappings and lists leading to it.
+// A list index of + appends to the list.
+func (f *ConfigFile) Set(path string, value string) error {
+	segments, err := editPath(path)
+	if err != nil {
+		return err
+	}
+	return f.edit(func(ed *editor) error { return ed.set(segments, parseValue(value)) })
+}
+
+// Sets the value at path to a string, as is, eg. a password that may not be valid yaml.
+func (f *ConfigFile) SetString(path string, value string) error {
+	segments, err := editPath(path)
+	if err != nil {
+		return err
+	}
+	return f.edit(func(ed *editor) error {
+		return ed.set(segments, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value})
+	})
+}
+
+// Removes the value at path.
+func (f *ConfigFile) Unset(path string) error {
+	segments, err := editPath(path)
+	if err != nil {
+		return err
+	}
+	return f.edit(func(ed *editor) error { return ed.unset(segments) })
+}
+
+// Adds a template to the end of the templates list. Returns false when it is already listed.
+func (f *ConfigFile) AddTemplate(template string) (bool, error) {
+	added := false
+	err := f.edit(func(ed *editor) error {
+		node := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: template}
+		if templates := mappingValue(ed.root, "templates"); templates != nil && templates.Kind == yaml.SequenceNode {
+			for _, t := range templates.Content {
+				if t.Value == template {
+					return nil
+				}
+			}
+			if len(templates.Content) > 0 {
+				// quote like the templates already listed
+				node.Style = templates.Content[0].Style
+			}
+		}
+		added = true
+		return ed.set([]string{"templates", "+"}, node)
+	})
+	return added, err
+}
+
+// Removes a template from the templates list. Returns false when it isn't listed.
+func (f *ConfigFile) RemoveTemplate(template string) (bool, error) {
+	removed := false
+	err := f.edit(func(ed *editor) error {
+		templates := mappingValue(ed.root, "templates")
+		if templates == nil || templates.Kind != yaml.SequenceNode {
+			return nil
+		}
+		for i, t := range templates.Content {
+			if t.Value == template {
+				removed = true
+				return ed.unset([]string{"templates", strconv.Itoa(i)})
+			}
+		}
+		return nil
+	})
+	return removed, err
+}
+
+func (f *ConfigFile) edit(edit func(ed *editor) error) error {
+	ed, err := newEditor(f.content)
+	if err != nil {
+		return err
+	}
+	if err := edit(ed); err != nil {
+		return err
+	}
+	content, err := ed.result()
+	if err != nil {
+		return err
+	}
+	f.content = content
+	return nil
+}
+
+// An entry of a mapping or list: the container, and the index of the entry's value in its content.
+type entry struct {
+	container *yaml.Node
+	index     int
+}
+
+func (e entry) key() *yaml.Node {
+	if e.container.Kind == yaml.MappingNode {
+		return e.container.Content[e.index-1]
+	}
+	return nil
+}
+
+func (e entry) value() *yaml.Node {
+	return e.container.Content[e.index]
+}
+
+func isFlow(node *yaml.Node) bool {
+	return node.Style&yaml.FlowStyle != 0
+}
+
+// Follows segments from root, returning the entries found along the way.
+// Stops early at the first missing key or index.
+func find(root *yaml.Node, segments []string) ([]entry, error) {
+	chain := []entry{}
+	node := root
+	for i, segment := range segments {
+		found := -1
+		switch node.Kind {
+		case yaml.MappingNode:
+			for j := 0; j+1 < len(node.Content); j += 2 {
+				if node.Content[j].Value == segment {
+					found = j + 1
+					break
+				}
+			}
+		case yaml.SequenceNode:
+			index, err := strconv.Atoi(segment)
+			if err != nil && segment != "+" {
+				return nil, fmt.Errorf("%s is a list, '%s' is not a list index", strings.Join(segments[:i], "."), segment)
+			}
+			if err == nil && index >= 0 && index < len(node.Content) {
+				found = index
+			}
+		default:
+			if !isNull(node) {
+				return nil, fmt.Errorf("%s is not a mapping or list", strings.Join(segments[:i], "."))
+			}
+		}
+		if found < 0 {
+			return chain, nil
+		}
+		chain = append(chain, entry{container: node, index: found})
+		node = node.Content[found]
+	}
+	return chain, nil
+}
+
+// Edits a parsed config, and the lines of its file to match.
+type editor struct {
+	doc     *yaml.Node
+	root    *yaml.Node
+	content []byte
+	lines   []string
+	// lines replacing lines[start:end]
+	start, end int
+	replaced   []string
+	reformat   bool
+}
+
+func newEditor(content []byte) (*editor, error) {
+	doc := &yaml.Node{}
+	if err := yaml.Unmarshal(content, doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 {
+		doc = &yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	}
+	if doc.Content[0].Kind != yaml.MappingNode {
+		return nil, errors.New("config must be a mapping of keys to values")
+	}
+	lines := strings.Split(string(content), "\n")
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return &editor{doc: doc, root: doc.Content[0], content: content, lines: lines, start: -1}, nil
+}
+
+func (ed *editor) set(segments []string, value *yaml.Node) error {
+	chain, err := find(ed.root, segments)
+	if err != nil {
+		return err
+	}
+	if len(chain) == len(segments) {
+		e := chain[len(chain)-1]
+		old := e.value()
+		if old.Kind == yaml.ScalarNode && value.Kind == yaml.ScalarNode && value.Style == 0 {
+			// keep the value quoted like it was
+			value.Style = old.Style & (yaml.SingleQuotedStyle | yaml.DoubleQuotedStyle)
+		}
+		value.LineComment = old.LineComment
+		ed.rerender(chain, func() { e.container.Content[e.index] = value })
+		return nil
+	}
+
+	parent := ed.root
+	if len(chain) > 0 {
+		parent = chain[len(chain)-1].value()
+	}
+	rest := segments[len(chain):]
+	child := value
+	for i := len(rest) - 1; i > 0; i-- {
+		child = containerFor(rest[i], rest[i], child)
+	}
+	if isNull(parent) {
+		ed.rerender(chain, func() { *parent = *containerFor(rest[0], rest[0], child) })
+		return nil
+	}
+	if parent.Kind == yaml.SequenceNode && rest[0] != "+" && rest[0] != strconv.Itoa(len(parent.Content)) {
+		return fmt.Errorf("%s has no index %s", strings.Join(segments[:len(chain)], "."), rest[0])
+	}
+	ed.append(chain, parent, rest[0], child)
+	return nil
+}
+
+// A mapping holding child at key, or a list holding child when key is a list index.
+func containerFor(segment string, key string, child *yaml.Node) *yaml.Node {
+	if _, err := strconv.Atoi(segment); err == nil || segment == "+" {
+		return &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Content: []*yaml.Node{child}}
+	}
+	return &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map", Content: []*yaml.Node{{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, child}}
+}
+
+func (ed *editor) unset(segments []string) error {
+	chain, err := find(ed.root, segments)
+	if err != nil {
+		return err
+	}
+	if len(chain) < len(segments) {
+		return fmt.Errorf("%s is not set", strings.Join(segments, "."))
+	}
+	e := chain[len(chain)-1]
+	remove := func() {
+		if e.container.Kind == yaml.MappingNode {
+			e.container.Content = slices.Delete(e.container.Content, e.index-1, e.index+1)
+		} else {
+			e.container.Content = slices.Delete(e.container.Content, e.index, e.index+1)
+		}
+	}
+	if isFlow(e.container) {
+		ed.rerender(chain[:len(chain)-1], remove)
+		return nil
+	}
+	entries := len(e.container.Content)
+	if e.container.Kind == yaml.MappingNode {
+		entries /= 2
+	}
+	if entries == 1 && len(chain) > 1 {
+		// an empty block container has to become an empty flow one, eg. expose: []
+		ed.rerender(chain[:len(chain)-1], func() {
+			remove()
+			e.container.Style = yaml.FlowStyle
+		})
+		return nil
+	}
+	ed.replace(ed.entryStart(e), ed.entryEnd(chain), nil)
+	remove()
+	return nil
+}
+
+// Applies change to the nodes, then re-renders the innermost entry of chain in a block container.
+func (ed *editor) rerender(chain []entry, change func()) {
+	d := len(chain) - 1
+	for d >= 0 && isFlow(chain[d].container) {
+		d--
+	}
+	if d < 0 {
+		change()
+		ed.reformat = true
+		return
+	}
+	e := chain[d]
+	start, end, indent := ed.entryStart(e), ed.entryEnd(chain[:d+1]), ed.entryIndent(e)
+	change()
+	ed.replace(start, end, render(e.container, e.key(), e.value(), indent))
+}
+
+// Adds an entry to the end of a container, after the last line of its last entry.
+func (ed *editor) append(chain []entry, container *yaml.Node, key string, value *yaml.Node) {
+	keyNode := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}
+	add := func() {
+		if container.Kind == yaml.MappingNode {
+			container.Content = append(container.Content, keyNode, value)
+		} else {
+			container.Content = append(container.Content, value)
+		}
+	}
+	if isFlow(container) {
+		ed.rerender(chain, add)
+		return
+	}
+	if len(container.Content) == 0 {
+		// only the root of an empty file is an empty block container
+		add()
+		ed.replace(len(ed.lines), len(ed.lines), render(container, keyNode, value, 0))
+		return
+	}
+	last := entry{container: container, index: len(container.Content) - 1}
+	end := ed.entryEnd(append(slices.Clone(chain), last))
+	indent := ed.entryIndent(last)
+	add()
+	ed.replace(end, end, render(container, keyNode, value, indent))
+}
+
+func (ed *editor) replace(start int, end int, lines []string) {
+	ed.start, ed.end, ed.replaced = start, end, lines
+}
+
+// The first line of an entry, its key or its list item.
+func (ed *editor) entryStart(e entry) int {
+	if k := e.key(); k != nil {
+		return k.Line - 1
+	}
+	return e.value().Line - 1
+}
+
+// The column an entry starts at, the column of its key or of its list item's dash.
+func (ed *editor) entryIndent(e entry) int {
+	if k := e.key(); k != nil {
+		return k.Column - 1
+	}
+	v := e.value()
+	line := ed.lines[v.Line-1]
+	for i := min(v.Column-2, len(line)-1); i >= 0; i-- {
+		if line[i] == '-' {
+			return i
+		}
+	}
+	return 0
+}
+
+// The line after the last line of the innermost entry of chain.
+// Blank lines and comments trailing the entry are left outside of it.
+func (ed *editor) entryEnd(chain []entry) int {
+	e := chain[len(chain)-1]
+	end := len(ed.lines)
+	for d := len(chain) - 1; d >= 0; d-- {
+		c := chain[d]
+		// the next key or list item
+		next := c.index + 1
+		if next < len(c.container.Content) {
+			end = c.container.Content[next].Line - 1
+			break
+		}
+	}
+	start := ed.entryStart(e)
+	for end > start+1 && isBlankOrComment(ed.lines[end-1]) {
+		end--
+	}
+	return max(end, lastLine(e.value()), start+1)
+}
+
+func isBlankOrComment(line string) bool {
+	line = strings.TrimSpace(line)
+	return line == "" || strings.HasPrefix(line, "#")
+}
+
+// The last line a node's own text is on.
+func lastLine(node *yaml.Node) int {
+	if (node.Kind == yaml.MappingNode || node.Kind == yaml.SequenceNode) && len(node.Content) > 0 && !isFlow(node) {
+		return lastLine(node.Content[len(node.Content)-1])
+	}
+	if node.Style&(yaml.LiteralStyle|yaml.FoldedStyle) != 0 {
+		return node.Line + strings.Count(strings.TrimRight(node.Value, "\n"), "\n") + 1
+	}
+	return node.Line
+}
+
+// Renders a single entry of container as yaml lines, indented to indent.
+func render(container *yaml.Node, key *yaml.Node, value *yaml.Node, indent int) []string {
+	v := *value
+	v.HeadComment = ""
+	stripFootComments(&v)
+	node := &yaml.Node{Kind: yaml.SequenceNode, Content: []*yaml.Node{&v}}
+	if container.Kind == yaml.MappingNode {
+		k := *key
+		k.HeadComment, k.FootComment = "", ""
+		node = &yaml.Node{Kind: yaml.MappingNode, Content: []*yaml.Node{&k, &v}}
+	}
+	out, _ := encodeYaml(node)
+	lines := strings.Split(strings.TrimSuffix(string(out), "\n"), "\n")
+	for i, line := range lines {
+		if line != "" {
+			lines[i] = strings.Repeat(" ", indent) + line
+		}
+	}
+	return lines
+}
+
+// Trailing comments are outside an entry's lines, so they must not be rendered with it.
+func stripFootComments(node *yaml.Node) {
+	node.FootComment = ""
+	if len(node.Content) > 0 {
+		last := *node.Content[len(node.Content)-1]
+		node.Content = append(slices.Clone(node.Content[:len(node.Content)-1]), &last)
+		stripFootComments(&last)
+	}
+}
+
+func encodeYaml(node *yaml.Node) ([]byte, error) {
+	var b bytes.Buffer
+	encoder := yaml.NewEncoder(&b)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(node); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// The edited file. Falls back to re-encoding the whole file when splicing the edited lines in
+// doesn't give the edited config, which loses blank lines, but never changes values.
+func (ed *editor) result() ([]byte, error) {
+	if !ed.reformat && ed.start < 0 {
+		return ed.content, nil
+	}
+	encoded, err := encodeYaml(ed.doc)
+	if err != nil {
+		return nil, err
+	}
+	if ed.reformat {
+		return encoded, nil
+	}
+	lines := append(append(slices.Clone(ed.lines[:ed.start]), ed.replaced...), ed.lines[ed.end:]...)
+	content := []byte(strings.Join(lines, "\n") + "\n")
+	var want, got any
+	if ed.doc.Decode(&want) != nil || yaml.Unmarshal(content, &got) != nil || !reflect.DeepEqual(want, got) {
+		return encoded, nil
+	}
+	return content, nil
+}
@@ -0,0 +1,141 @@
+package config_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/discourse/discourse_docker/launcher_go/v2/config"
+	"os"
+)
+
+var _ = Describe("ConfigFile", func() {
+	var testDir string
+	var open = func(content string) *config.ConfigFile {
+		os.WriteFile(testDir+"/app.yml", []byte(content), 0600)
+		file, err := config.OpenConfigFile(testDir, "app")
+		Expect(err).To(BeNil())
+		return file
+	}
+	const app = `## the app
+templates:
+  - "templates/postgres.template.yml"
+  #- "templates/redis.template.yml"
+  - "templates/web.template.yml"
+
+expose:
+  - "80:80"   # http
+
+env:
+  LANG: en_US.UTF-8
+  MULTI: |
+    line one
+    line two
+  DISCOURSE_HOSTNAME: 'discourse.example.com'
+  ## uncomment for a CDN
+  #DISCOURSE_CDN_URL: https://discourse-cdn.example.com
+
+hooks:
+  after_code:
+    - exec:
+        cd: $home/plugins
+        cmd:
+          - git clone https://github.com/discourse/docker_manager.git
+
+## Any custom commands to run after building
+run:
+  - exec: echo "Beginning of custom commands"
+`
+
+	BeforeEach(func() {
+		testDir, _ = os.MkdirTemp("", "ddocker-test")
+	})
+	AfterEach(func() {
+		os.RemoveAll(testDir)
+	})
+
+	It("gets values", func() {
+		file := open(app)
+		Expect(file.Get("env.DISCOURSE_HOSTNAME")).To(Equal("discourse.example.com"))
+		Expect(file.Get("hooks.after_code.0.exec.cd")).To(Equal("$home/plugins"))
+		Expect(file.Get("expose")).To(Equal(`- "80:80" # http`))
+		_, err := file.Get("env.MISSING")
+		Expect(err).To(MatchError("env.MISSING is not set"))
+		_, err = file.Get("templates.first")
+		Expect(err).To(MatchError("templates is a list, 'first' is not a list index"))
+	})
+
+	It("edits values, keeping comments and formatting", func() {
+		file := open(app)
+		Expect(file.Set("env.DISCOURSE_HOSTNAME", "forum.example.com")).To(Succeed())
+		Expect(file.Set("env.UNICORN_WORKERS", "4")).To(Succeed())
+		Expect(file.Set("env.MULTI", "one line")).To(Succeed())
+		Expect(file.Unset("env.LANG")).To(Succeed())
+		Expect(file.Set("hooks.after_code.0.exec.cmd.+", "git clone https://github.com/discourse/discourse-solved.git")).To(Succeed())
+		Expect(file.Set("params.version", "stable")).To(Succeed())
+		Expect(string(file.Content())).To(Equal(`## the app
+templates:
+  - "templates/postgres.template.yml"
+  #- "templates/redis.template.yml"
+  - "templates/web.template.yml"
+
+expose:
+  - "80:80"   # http
+
+env:
+  MULTI: one line
+  DISCOURSE_HOSTNAME: 'forum.example.com'
+  UNICORN_WORKERS: 4
+  ## uncomment for a CDN
+  #DISCOURSE_CDN_URL: https://discourse-cdn.example.com
+
+hooks:
+  after_code:
+    - exec:
+        cd: $home/plugins
+        cmd:
+          - git clone https://github.com/discourse/docker_manager.git
+          - git clone https://github.com/discourse/discourse-solved.git
+
+## Any custom commands to run after building
+run:
+  - exec: echo "Beginning of custom commands"
+params:
+  version: stable
+`))
+	})
+
+	It("adds and removes templates", func() {
+		file := open(app)
+		Expect(file.AddTemplate("templates/redis.template.yml")).To(BeTrue())
+		Expect(file.AddTemplate("templates/web.template.yml")).To(BeFalse())
+		Expect(file.RemoveTemplate("templates/postgres.template.yml")).To(BeTrue())
+		Expect(file.RemoveTemplate("templates/postgres.template.yml")).To(BeFalse())
+		Expect(string(file.Content())).To(HavePrefix(`## the app
+templates:
+  #- "templates/redis.template.yml"
+  - "templates/web.template.yml"
+  - "templates/redis.template.yml"
+
+expose:
+`))
+	})
+
+	It("edits empty, null, and flow style values", func() {
+		file := open("hooks:\nexpose: [\"80:80\"]\nlabels:\n  team: web\n")
+		Expect(file.Set("hooks.after_code.+.exec.cd", "$home/plugins")).To(Succeed())
+		Expect(file.Set("expose.+", "443:443")).To(Succeed())
+		Expect(file.Unset("labels.team")).To(Succeed())
+		Expect(string(file.Content())).To(Equal("hooks:\n  after_code:\n    - exec:\n        cd: $home/plugins\nexpose: [\"80:80\", '443:443']\nlabels: {}\n"))
+
+		file = open("")
+		Expect(file.Set("env.LANG", "C")).To(Succeed())
+		Expect(string(file.Content())).To(Equal("env:\n  LANG: C\n"))
+	})
+
+	It("refuses paths through values that aren't mappings or lists", func() {
+		file := open(app)
+		Expect(file.Set("expose.5", "443")).To(MatchError("expose has no index 5"))
+		Expect(file.Set("hooks.after_code.0.exec.cd.dir", "x")).To(MatchError("hooks.after_code.0.exec.cd is not a mapping or list"))
+		Expect(file.Unset("volumes")).To(MatchError("volumes is not set"))
+	})
+})
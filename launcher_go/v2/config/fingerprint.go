@@ -0,0 +1,20 @@
+package config
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+
+	"github.com/discourse/discourse_docker/launcher_go/v2/utils"
+)
+
+// A hash of everything a build of the config depends on: the launcher version, the id of
+// the base image it builds from, and the raw config with its templates and overlays.
+// Secrets are hashed too, as changing them needs a new container.
+func (config *Config) Fingerprint(baseImageId string) string {
+	hash := sha256.New()
+	io.WriteString(hash, utils.Version+"\n")
+	io.WriteString(hash, baseImageId+"\n")
+	io.WriteString(hash, config.Yaml(true))
+	return hex.EncodeToString(hash.Sum(nil))
+}
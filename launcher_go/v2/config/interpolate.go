@@ -0,0 +1,135 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Keys whose values may reference the host environment as ${VAR}, ${VAR:-default}, or ${VAR:?error}.
+var interpolatedKeys = []string{"env", "labels", "params", "volumes", "docker_args", "run_image", "registry", "image_name"}
+
+// $${ escapes a literal ${
+var interpolationRegexp = regexp.MustCompile(`\$\$\{|\$\{([A-Za-z_][A-Za-z0-9_]*)(?:(:-|:\?)([^}]*))?\}`)
+
+// Replaces ${VAR} references in value with variables from lookup.
+// ${VAR:-default} falls back to default when VAR is unset or empty, ${VAR:?error} fails with error instead.
+func interpolate(value string, lookup func(string) (string, bool)) (string, error) {
+	var err error
+	result := interpolationRegexp.ReplaceAllStringFunc(value, func(match string) string {
+		if match == "$${" {
+			return "${"
+		}
+		m := interpolationRegexp.FindStringSubmatch(match)
+		name, operator, arg := m[1], m[2], m[3]
+		v, _ := lookup(name)
+		if v != "" {
+			return v
+		}
+		switch operator {
+		case ":-":
+			return arg
+		case ":?":
+			if err == nil {
+				err = fmt.Errorf("required variable %s is missing a value", name)
+				if arg != "" {
+					err = fmt.Errorf("%w: %s", err, arg)
+				}
+			}
+		}
+		return ""
+	})
+	return result, err
+}
+
+// Interpolates the scalar values under node in place, naming map keys of section in errors, eg. env.LANG.
+// Returns whether any value changed.
+func interpolateNode(node *yaml.Node, section string, name string, lookup func(string) (string, bool)) (bool, error) {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		if directiveOf(node) != "" {
+			return false, nil
+		}
+		value, err := interpolate(node.Value, lookup)
+		if err != nil {
+			return false, fmt.Errorf("%d: %s: %w", node.Line, name, err)
+		}
+		if value == node.Value {
+			return false, nil
+		}
+		node.Value = value
+		node.Tag = "!!str"
+		node.Style = 0
+		return true, nil
+	case yaml.MappingNode:
+		changed := false
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			childName := name
+			if slices.Contains(pupsMapKeys, section) && name == section {
+				childName = section + "." + node.Content[i].Value
+			}
+			c, err := interpolateNode(node.Content[i+1], section, childName, lookup)
+			if err != nil {
+				return false, err
+			}
+			changed = changed || c
+		}
+		return changed, nil
+	case yaml.SequenceNode:
+		changed := false
+		for _, child := range node.Content {
+			c, err := interpolateNode(child, section, name, lookup)
+			if err != nil {
+				return false, err
+			}
+			changed = changed || c
+		}
+		return changed, nil
+	}
+	return false, nil
+}
+
+// Looks up variables in the process environment, then in the variables read from an env file.
+func envLookup(envFile map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		if v, ok := os.LookupEnv(name); ok {
+			return v, true
+		}
+		v, ok := envFile[name]
+		return v, ok
+	}
+}
+
+// Reads KEY=VALUE lines from an env file. Blank lines and lines starting with # are skipped,
+// an "export " prefix is allowed, and values may be wrapped in single or double quotes.
+func ReadEnvFile(filename string) (map[string]string, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	env := map[string]string{}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		key, value, found := strings.Cut(strings.TrimPrefix(text, "export "), "=")
+		key = strings.TrimSpace(key)
+		if !found || key == "" {
+			return nil, fmt.Errorf("%s:%d: expected KEY=VALUE", filename, line)
+		}
+		value = strings.TrimSpace(value)
+		if len(value) >= 2 && (value[0] == '"' || value[0] == '\'') && value[len(value)-1] == value[0] {
+			value = value[1 : len(value)-1]
+		}
+		env[key] = value
+	}
+	return env, scanner.Err()
+}
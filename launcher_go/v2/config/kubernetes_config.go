@@ -0,0 +1,391 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+type KubernetesMeta struct {
+	Name        string            `yaml:"name"`
+	Labels      map[string]string `yaml:"labels,omitempty"`
+	Annotations map[string]string `yaml:"annotations,omitempty"`
+}
+type KubernetesObject struct {
+	ApiVersion string            `yaml:"apiVersion"`
+	Kind       string            `yaml:"kind"`
+	Metadata   KubernetesMeta    `yaml:"metadata"`
+	Type       string            `yaml:"type,omitempty"`
+	Data       map[string]string `yaml:"data,omitempty"`
+	StringData map[string]string `yaml:"stringData,omitempty"`
+	Spec       any               `yaml:"spec,omitempty"`
+}
+
+type KubernetesDeploymentSpec struct {
+	Replicas int                   `yaml:"replicas"`
+	Strategy map[string]string     `yaml:"strategy"`
+	Selector KubernetesSelector    `yaml:"selector"`
+	Template KubernetesPodTemplate `yaml:"template"`
+}
+type KubernetesJobSpec struct {
+	BackoffLimit int                   `yaml:"backoffLimit"`
+	Template     KubernetesPodTemplate `yaml:"template"`
+}
+type KubernetesSelector struct {
+	MatchLabels map[string]string `yaml:"matchLabels"`
+}
+type KubernetesPodTemplate struct {
+	Metadata KubernetesMeta    `yaml:"metadata"`
+	Spec     KubernetesPodSpec `yaml:"spec"`
+}
+type KubernetesPodSpec struct {
+	RestartPolicy string                `yaml:"restartPolicy,omitempty"`
+	Affinity      *KubernetesAffinity   `yaml:"affinity,omitempty"`
+	Containers    []KubernetesContainer `yaml:"containers"`
+	Volumes       []KubernetesVolume    `yaml:"volumes,omitempty"`
+}
+type KubernetesAffinity struct {
+	PodAffinity KubernetesPodAffinity `yaml:"podAffinity"`
+}
+type KubernetesPodAffinity struct {
+	Preferred []KubernetesWeightedAffinityTerm `yaml:"preferredDuringSchedulingIgnoredDuringExecution"`
+}
+type KubernetesWeightedAffinityTerm struct {
+	Weight          int                    `yaml:"weight"`
+	PodAffinityTerm KubernetesAffinityTerm `yaml:"podAffinityTerm"`
+}
+type KubernetesAffinityTerm struct {
+	LabelSelector KubernetesSelector `yaml:"labelSelector"`
+	TopologyKey   string             `yaml:"topologyKey"`
+}
+type KubernetesContainer struct {
+	Name         string                  `yaml:"name"`
+	Image        string                  `yaml:"image"`
+	Command      []string                `yaml:"command,omitempty"`
+	Env          []KubernetesEnv         `yaml:"env,omitempty"`
+	EnvFrom      []KubernetesEnvFrom     `yaml:"envFrom"`
+	Ports        []KubernetesPort        `yaml:"ports,omitempty"`
+	VolumeMounts []KubernetesVolumeMount `yaml:"volumeMounts"`
+}
+type KubernetesEnv struct {
+	Name  string `yaml:"name"`
+	Value string `yaml:"value"`
+}
+type KubernetesEnvFrom struct {
+	ConfigMapRef *KubernetesRef `yaml:"configMapRef,omitempty"`
+	SecretRef    *KubernetesRef `yaml:"secretRef,omitempty"`
+}
+type KubernetesRef struct {
+	Name string `yaml:"name"`
+}
+type KubernetesPort struct {
+	Name          string `yaml:"name,omitempty"`
+	ContainerPort int    `yaml:"containerPort,omitempty"`
+	Port          int    `yaml:"port,omitempty"`
+	TargetPort    int    `yaml:"targetPort,omitempty"`
+	Protocol      string `yaml:"protocol"`
+}
+type KubernetesVolumeMount struct {
+	Name      string `yaml:"name"`
+	MountPath string `yaml:"mountPath"`
+}
+type KubernetesVolume struct {
+	Name                  string            `yaml:"name"`
+	PersistentVolumeClaim *KubernetesClaim  `yaml:"persistentVolumeClaim,omitempty"`
+	HostPath              map[string]string `yaml:"hostPath,omitempty"`
+	EmptyDir              map[string]string `yaml:"emptyDir,omitempty"`
+	ConfigMap             *KubernetesRef    `yaml:"configMap,omitempty"`
+}
+type KubernetesClaim struct {
+	ClaimName string `yaml:"claimName"`
+}
+type KubernetesServiceSpec struct {
+	Selector map[string]string `yaml:"selector"`
+	Ports    []KubernetesPort  `yaml:"ports"`
+}
+type KubernetesClaimSpec struct {
+	AccessModes []string                     `yaml:"accessModes"`
+	Resources   map[string]map[string]string `yaml:"resources"`
+}
+type Kustomization struct {
+	ApiVersion string   `yaml:"apiVersion"`
+	Kind       string   `yaml:"kind"`
+	Resources  []string `yaml:"resources"`
+}
+
+type KubernetesOptions struct {
+	// Image the deployment and jobs run
+	Image string
+	// Volumes are persistent volume claims of VolumeSize, or hostPath volumes when HostPath is set
+	HostPath   bool
+	VolumeSize string
+	// Write secret values into the Secret, otherwise they are left empty to fill in
+	IncludeSecrets bool
+}
+
+// Generates kubernetes manifests for the config, keyed by file name, with a kustomization listing them.
+// Links have no kubernetes equivalent and are left out, linked containers need their own services.
+func (config *Config) KubernetesManifests(options KubernetesOptions) (map[string]string, error) {
+	name := kubernetesName(config.Name)
+	appLabels := map[string]string{"app.kubernetes.io/name": name}
+	envFrom := []KubernetesEnvFrom{
+		{ConfigMapRef: &KubernetesRef{Name: name + "-env"}},
+		{SecretRef: &KubernetesRef{Name: name + "-env"}},
+	}
+
+	env := map[string]string{}
+	secrets := map[string]string{}
+	for k, v := range config.Env {
+		if config.IsSecret(k) {
+			if !options.IncludeSecrets {
+				v = ""
+			}
+			secrets[k] = v
+		} else {
+			env[k] = v
+		}
+	}
+
+	// discourse needs a 512m shm for chrome during asset precompile
+	shmMount := KubernetesVolumeMount{Name: "shm", MountPath: "/dev/shm"}
+	shmVolume := KubernetesVolume{Name: "shm", EmptyDir: map[string]string{"medium": "Memory", "sizeLimit": "512Mi"}}
+	// the configure job precompiles assets into a volume the deployment serves them from
+	assetsMount := KubernetesVolumeMount{Name: "assets", MountPath: "/var/www/discourse/public/assets"}
+	mounts := []KubernetesVolumeMount{shmMount, assetsMount}
+	volumes := []KubernetesVolume{shmVolume}
+	claims := []KubernetesObject{}
+	addVolume := func(volumeName string, host string) {
+		if options.HostPath {
+			volumes = append(volumes, KubernetesVolume{Name: volumeName, HostPath: map[string]string{"path": host, "type": "DirectoryOrCreate"}})
+			return
+		}
+		claim := name + "-" + volumeName
+		volumes = append(volumes, KubernetesVolume{Name: volumeName, PersistentVolumeClaim: &KubernetesClaim{ClaimName: claim}})
+		claims = append(claims, KubernetesObject{
+			ApiVersion: "v1",
+			Kind:       "PersistentVolumeClaim",
+			Metadata:   KubernetesMeta{Name: claim, Labels: appLabels},
+			Spec: KubernetesClaimSpec{
+				AccessModes: []string{"ReadWriteOnce"},
+				Resources:   map[string]map[string]string{"requests": {"storage": options.VolumeSize}},
+			},
+		})
+	}
+	addVolume("assets", "/var/discourse/assets/"+config.Name)
+	assetsVolume := volumes[len(volumes)-1]
+	for _, v := range config.Volumes {
+		// prefixed so they can't clash with the shm, assets, and pups volumes, and numbered when guests differ only in punctuation
+		base := strings.TrimSuffix("vol-"+kubernetesName(v.Volume.Guest), "-")
+		volumeName := base
+		for i := 2; slices.ContainsFunc(volumes, func(v KubernetesVolume) bool { return v.Name == volumeName }); i++ {
+			volumeName = base + "-" + strconv.Itoa(i)
+		}
+		mounts = append(mounts, KubernetesVolumeMount{Name: volumeName, MountPath: v.Volume.Guest})
+		addVolume(volumeName, v.Volume.Host)
+	}
+
+	containerPorts := []KubernetesPort{}
+	services := []KubernetesObject{}
+	for _, expose := range config.Expose {
+		ports, err := kubernetesPorts(expose)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range ports {
+			containerPort := KubernetesPort{ContainerPort: p.TargetPort, Protocol: p.Protocol}
+			if !slices.Contains(containerPorts, containerPort) {
+				containerPorts = append(containerPorts, containerPort)
+			}
+		}
+		serviceName := name + "-" + strconv.Itoa(ports[0].Port)
+		if ports[0].Protocol != "TCP" {
+			serviceName += "-" + strings.ToLower(ports[0].Protocol)
+		}
+		services = append(services, KubernetesObject{
+			ApiVersion: "v1",
+			Kind:       "Service",
+			Metadata:   KubernetesMeta{Name: serviceName, Labels: appLabels},
+			Spec:       KubernetesServiceSpec{Selector: appLabels, Ports: ports},
+		})
+	}
+
+	var command []string
+	if boot := config.BootCommand(); boot != "" {
+		command = []string{boot}
+	}
+	deployment := KubernetesObject{
+		ApiVersion: "apps/v1",
+		Kind:       "Deployment",
+		Metadata:   KubernetesMeta{Name: name, Labels: appLabels},
+		Spec: KubernetesDeploymentSpec{
+			Replicas: 1,
+			// volumes are mounted by a single pod at a time
+			Strategy: map[string]string{"type": "Recreate"},
+			Selector: KubernetesSelector{MatchLabels: appLabels},
+			Template: KubernetesPodTemplate{
+				Metadata: KubernetesMeta{Name: name, Labels: appLabels, Annotations: config.Labels},
+				Spec: KubernetesPodSpec{
+					Containers: []KubernetesContainer{{
+						Name:         "discourse",
+						Image:        options.Image,
+						Command:      command,
+						EnvFrom:      envFrom,
+						Ports:        containerPorts,
+						VolumeMounts: mounts,
+					}},
+					Volumes: volumes,
+				},
+			},
+		},
+	}
+
+	// jobs run pups like migrate and configure do, reading the pups config from a config map instead of stdin.
+	// They leave the data volumes alone, so they don't wait on claims the deployment's node holds.
+	pupsMount := KubernetesVolumeMount{Name: "pups", MountPath: "/pups"}
+	pupsVolume := KubernetesVolume{Name: "pups", ConfigMap: &KubernetesRef{Name: name + "-pups"}}
+	// the assets claim is ReadWriteOnce too, so configure prefers the deployment's node
+	deploymentAffinity := &KubernetesAffinity{PodAffinity: KubernetesPodAffinity{Preferred: []KubernetesWeightedAffinityTerm{{
+		Weight:          100,
+		PodAffinityTerm: KubernetesAffinityTerm{LabelSelector: KubernetesSelector{MatchLabels: appLabels}, TopologyKey: "kubernetes.io/hostname"},
+	}}}}
+	jobs := []KubernetesObject{}
+	for _, job := range []struct {
+		name, pupsArgs string
+		mounts         []KubernetesVolumeMount
+		volumes        []KubernetesVolume
+		affinity       *KubernetesAffinity
+	}{
+		{"migrate", "--tags=db,migrate", []KubernetesVolumeMount{shmMount, pupsMount}, []KubernetesVolume{shmVolume, pupsVolume}, nil},
+		{"configure", "--tags=db,precompile", []KubernetesVolumeMount{shmMount, assetsMount, pupsMount}, []KubernetesVolume{shmVolume, assetsVolume, pupsVolume}, deploymentAffinity},
+	} {
+		jobs = append(jobs, KubernetesObject{
+			ApiVersion: "batch/v1",
+			Kind:       "Job",
+			Metadata:   KubernetesMeta{Name: name + "-" + job.name, Labels: appLabels},
+			Spec: KubernetesJobSpec{
+				BackoffLimit: 0,
+				Template: KubernetesPodTemplate{
+					Metadata: KubernetesMeta{Name: name + "-" + job.name},
+					Spec: KubernetesPodSpec{
+						RestartPolicy: "Never",
+						Affinity:      job.affinity,
+						Containers: []KubernetesContainer{{
+							Name:         job.name,
+							Image:        options.Image,
+							Command:      []string{"/bin/bash", "-c", "/usr/local/bin/pups --stdin " + job.pupsArgs + " < /pups/config.yaml"},
+							Env:          []KubernetesEnv{{Name: "SKIP_EMBER_CLI_COMPILE", Value: "1"}},
+							EnvFrom:      envFrom,
+							VolumeMounts: job.mounts,
+						}},
+						Volumes: job.volumes,
+					},
+				},
+			},
+		})
+	}
+
+	files := map[string][]KubernetesObject{
+		"configmap.yaml": {
+			{ApiVersion: "v1", Kind: "ConfigMap", Metadata: KubernetesMeta{Name: name + "-env", Labels: appLabels}, Data: env},
+			{ApiVersion: "v1", Kind: "ConfigMap", Metadata: KubernetesMeta{Name: name + "-pups", Labels: appLabels}, Data: map[string]string{"config.yaml": config.Yaml(false)}},
+		},
+		"secret.yaml":     {{ApiVersion: "v1", Kind: "Secret", Metadata: KubernetesMeta{Name: name + "-env", Labels: appLabels}, Type: "Opaque", StringData: secrets}},
+		"deployment.yaml": {deployment},
+		"jobs.yaml":       jobs,
+	}
+	if len(services) > 0 {
+		files["services.yaml"] = services
+	}
+	if len(claims) > 0 {
+		files["volumes.yaml"] = claims
+	}
+
+	manifests := map[string]string{}
+	kustomization := Kustomization{ApiVersion: "kustomize.config.k8s.io/v1beta1", Kind: "Kustomization"}
+	for file, objects := range files {
+		content, err := encodeKubernetes(objects...)
+		if err != nil {
+			return nil, errors.New("error marshalling kubernetes manifest " + file)
+		}
+		manifests[file] = content
+		kustomization.Resources = append(kustomization.Resources, file)
+	}
+	slices.Sort(kustomization.Resources)
+	content, err := encodeKubernetes(kustomization)
+	if err != nil {
+		return nil, errors.New("error marshalling kustomization.yaml")
+	}
+	manifests["kustomization.yaml"] = content
+	return manifests, nil
+}
+
+// Encodes objects as a multi-document yaml file.
+func encodeKubernetes[T any](objects ...T) (string, error) {
+	var b bytes.Buffer
+	encoder := yaml.NewEncoder(&b)
+	encoder.SetIndent(2)
+	for _, object := range objects {
+		if err := encoder.Encode(object); err != nil {
+			return "", err
+		}
+	}
+	return b.String(), nil
+}
+
+func (config *Config) WriteKubernetes(dir string, options KubernetesOptions) error {
+	manifests, err := config.KubernetesManifests(options)
+	if err != nil {
+		return err
+	}
+	for file, content := range manifests {
+		if err := os.WriteFile(strings.TrimRight(dir, "/")+"/"+file, []byte(content), 0660); err != nil {
+			return errors.New("error writing kubernetes manifest " + file)
+		}
+	}
+	return nil
+}
+
+// The service ports for an expose entry. Services listen on the host port, or the container port when none is published.
+func kubernetesPorts(expose string) ([]KubernetesPort, error) {
+	m := exposeRegexp.FindStringSubmatch(expose)
+	if m == nil {
+		return nil, errors.New("invalid expose entry '" + expose + "', expected [ip:][hostPort:]containerPort[/protocol]")
+	}
+	protocol := "TCP"
+	if _, p, found := strings.Cut(expose, "/"); found {
+		protocol = strings.ToUpper(p)
+	}
+	first, _ := strconv.Atoi(m[3])
+	last := first
+	if m[4] != "" {
+		last, _ = strconv.Atoi(m[4])
+	}
+	hostFirst := first
+	if m[1] != "" {
+		hostFirst, _ = strconv.Atoi(m[1])
+	}
+	ports := []KubernetesPort{}
+	for port := first; port <= min(last, 65535); port++ {
+		servicePort := hostFirst + port - first
+		ports = append(ports, KubernetesPort{
+			Name:       strings.ToLower(protocol) + "-" + strconv.Itoa(servicePort),
+			Port:       servicePort,
+			TargetPort: port,
+			Protocol:   protocol,
+		})
+	}
+	return ports, nil
+}
+
+var kubernetesNameRegexp = regexp.MustCompile(`[^a-z0-9-]+`)
+
+// Kubernetes names are lowercase alphanumerics and dashes.
+func kubernetesName(name string) string {
+	return strings.Trim(kubernetesNameRegexp.ReplaceAllString(strings.ToLower(name), "-"), "-")
+}
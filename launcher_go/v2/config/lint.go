@@ -0,0 +1,220 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/discourse/discourse_docker/launcher_go/v2/utils"
+)
+
+type LintLevel int
+
+const (
+	LintWarning LintLevel = iota
+	LintError
+)
+
+func (l LintLevel) String() string {
+	if l == LintError {
+		return "error"
+	}
+	return "warning"
+}
+
+// A problem a lint rule found with a setting of a loaded config, eg. Key "env.DISCOURSE_HOSTNAME".
+type Lint struct {
+	Rule    string
+	Level   LintLevel
+	Key     string
+	Message string
+	Source  *Source
+}
+
+func (l Lint) String() string {
+	if l.Source == nil {
+		return fmt.Sprintf("%s: %s: %s (%s)", l.Level, l.Key, l.Message, l.Rule)
+	}
+	return fmt.Sprintf("%s:%d: %s: %s: %s (%s)", l.Source.File, l.Source.Line, l.Level, l.Key, l.Message, l.Rule)
+}
+
+// A check of a loaded config for settings known to break Discourse.
+// Check returns lints with Key and Message set, confDir is the directory holding the config.
+type LintRule struct {
+	Name  string
+	Level LintLevel
+	Check func(config *Config, confDir string) []Lint
+}
+
+// Rules run by Lint, in order. Append to add rules.
+var LintRules = []LintRule{
+	{Name: "placeholder-hostname", Level: LintError, Check: lintPlaceholderHostname},
+	{Name: "placeholder-smtp", Level: LintError, Check: lintPlaceholderSmtp},
+	{Name: "cdn-protocol", Level: LintError, Check: lintCdnProtocol},
+	{Name: "developer-emails", Level: LintWarning, Check: lintDeveloperEmails},
+	{Name: "duplicate-host-port", Level: LintError, Check: lintDuplicateHostPort},
+	{Name: "missing-volume-host", Level: LintWarning, Check: lintMissingVolumeHost},
+	{Name: "migrate-without-create-db", Level: LintWarning, Check: lintMigrateWithoutCreateDb},
+	{Name: "missing-link", Level: LintWarning, Check: lintMissingLink},
+}
+
+// Runs LintRules over a loaded config, skipping the rules named in disabled.
+// Each lint points at the file and line that last set its setting, when known.
+func (config *Config) Lint(confDir string, disabled ...string) []Lint {
+	lints := []Lint{}
+	for _, rule := range LintRules {
+		if slices.Contains(disabled, rule.Name) {
+			continue
+		}
+		for _, l := range rule.Check(config, confDir) {
+			l.Rule = rule.Name
+			l.Level = rule.Level
+			if sources := config.Sources(l.Key); len(sources) > 0 {
+				l.Source = &sources[len(sources)-1]
+			}
+			lints = append(lints, l)
+		}
+	}
+	return lints
+}
+
+// The number of lints that are errors.
+func LintErrors(lints []Lint) int {
+	count := 0
+	for _, l := range lints {
+		if l.Level == LintError {
+			count++
+		}
+	}
+	return count
+}
+
+func lintPlaceholderHostname(config *Config, confDir string) []Lint {
+	if config.Env["DISCOURSE_HOSTNAME"] == "discourse.example.com" {
+		return []Lint{{Key: "env.DISCOURSE_HOSTNAME", Message: "domain is not configured, discourse.example.com is a placeholder"}}
+	}
+	return nil
+}
+
+func lintPlaceholderSmtp(config *Config, confDir string) []Lint {
+	if config.Env["DISCOURSE_SMTP_ADDRESS"] == "smtp.example.com" {
+		return []Lint{{Key: "env.DISCOURSE_SMTP_ADDRESS", Message: "mail is not configured, smtp.example.com is a placeholder"}}
+	}
+	return nil
+}
+
+func lintCdnProtocol(config *Config, confDir string) []Lint {
+	if strings.HasPrefix(config.Env["DISCOURSE_CDN_URL"], "//") {
+		return []Lint{{Key: "env.DISCOURSE_CDN_URL", Message: "CDN must have a protocol specified, eg. https:" + config.Env["DISCOURSE_CDN_URL"]}}
+	}
+	return nil
+}
+
+func lintDeveloperEmails(config *Config, confDir string) []Lint {
+	// web_only and other app configs set a hostname, data configs have nobody to sign up
+	if config.Env["DISCOURSE_HOSTNAME"] != "" && config.Env["DISCOURSE_DEVELOPER_EMAILS"] == "" {
+		return []Lint{{Key: "env.DISCOURSE_DEVELOPER_EMAILS", Message: "no admin emails are set, nobody will be made admin on signup"}}
+	}
+	return nil
+}
+
+type hostPort struct {
+	ip       string
+	port     int
+	protocol string
+}
+
+// The host ports an expose entry binds, none when docker picks the port.
+// ip is empty when every address is bound.
+func exposedHostPorts(expose string) []hostPort {
+	m := exposeRegexp.FindStringSubmatch(expose)
+	if m == nil || m[1] == "" {
+		return nil
+	}
+	protocol := "tcp"
+	if _, p, found := strings.Cut(expose, "/"); found {
+		protocol = p
+	}
+	ip := ""
+	if i := strings.LastIndex(expose, "]:"); i >= 0 {
+		ip = expose[:i+1]
+	} else if strings.Count(expose, ":") == 2 {
+		ip = expose[:strings.Index(expose, ":")]
+	}
+	if ip == "0.0.0.0" || ip == "[::]" {
+		ip = ""
+	}
+	first, _ := strconv.Atoi(m[1])
+	last := first
+	if m[2] != "" {
+		last, _ = strconv.Atoi(m[2])
+	}
+	ports := []hostPort{}
+	for port := first; port <= min(last, 65535); port++ {
+		ports = append(ports, hostPort{ip: ip, port: port, protocol: protocol})
+	}
+	return ports
+}
+
+func lintDuplicateHostPort(config *Config, confDir string) []Lint {
+	lints := []Lint{}
+	bound := []hostPort{}
+	boundBy := []string{}
+	for _, expose := range config.Expose {
+	ports:
+		for _, p := range exposedHostPorts(expose) {
+			for i, other := range bound {
+				if other.port == p.port && other.protocol == p.protocol && (other.ip == p.ip || other.ip == "" || p.ip == "") {
+					lints = append(lints, Lint{Key: "expose." + expose, Message: fmt.Sprintf("host port %d/%s is already bound by %s", p.port, p.protocol, boundBy[i])})
+					break ports
+				}
+			}
+			bound = append(bound, p)
+			boundBy = append(boundBy, expose)
+		}
+	}
+	return lints
+}
+
+func lintMissingVolumeHost(config *Config, confDir string) []Lint {
+	lints := []Lint{}
+	for _, v := range config.Volumes {
+		// anything else is a named volume docker manages
+		if !filepath.IsAbs(v.Volume.Host) {
+			continue
+		}
+		if _, err := os.Stat(v.Volume.Host); os.IsNotExist(err) {
+			lints = append(lints, Lint{Key: "volumes." + volumeName(v), Message: "host path " + v.Volume.Host + " does not exist, docker will create it owned by root"})
+		}
+	}
+	return lints
+}
+
+func lintMigrateWithoutCreateDb(config *Config, confDir string) []Lint {
+	if isTruthy(config.Env["MIGRATE_ON_BOOT"]) && !isTruthy(config.Env["CREATE_DB_ON_BOOT"]) {
+		return []Lint{{Key: "env.MIGRATE_ON_BOOT", Message: "MIGRATE_ON_BOOT is set without CREATE_DB_ON_BOOT, migrations fail on boot until the database exists"}}
+	}
+	return nil
+}
+
+func lintMissingLink(config *Config, confDir string) []Lint {
+	lints := []Lint{}
+	configs := utils.FindConfigNamesIn(confDir)
+	for _, l := range config.Links {
+		if !slices.Contains(configs, l.Link.Name) {
+			lints = append(lints, Lint{Key: "links." + linkName(l), Message: "links to " + l.Link.Name + ", which has no config in " + confDir + ", make sure it runs before this container starts"})
+		}
+	}
+	return lints
+}
+
+func isTruthy(value string) bool {
+	switch strings.ToLower(value) {
+	case "", "0", "false", "no", "off":
+		return false
+	}
+	return true
+}
@@ -0,0 +1,89 @@
+package config_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/discourse/discourse_docker/launcher_go/v2/config"
+	"os"
+)
+
+var _ = Describe("Lint", func() {
+	var testDir string
+	var lint = func(content string, disabled ...string) []string {
+		err := os.WriteFile(testDir+"/app.yml", []byte(content), 0660)
+		Expect(err).To(BeNil())
+		conf, err := config.LoadConfig(testDir, "app", false)
+		Expect(err).To(BeNil())
+		result := []string{}
+		for _, l := range conf.Lint(testDir, disabled...) {
+			result = append(result, l.String())
+		}
+		return result
+	}
+
+	BeforeEach(func() {
+		testDir, _ = os.MkdirTemp("", "ddocker-test")
+	})
+	AfterEach(func() {
+		os.RemoveAll(testDir)
+	})
+
+	It("reports the placeholders web.template.yml aborts on", func() {
+		Expect(lint("env:\n  DISCOURSE_HOSTNAME: discourse.example.com\n  DISCOURSE_DEVELOPER_EMAILS: a@example.com\n  DISCOURSE_SMTP_ADDRESS: smtp.example.com\n  DISCOURSE_CDN_URL: //cdn.example.com\n")).To(Equal([]string{
+			testDir + "/app.yml:2: error: env.DISCOURSE_HOSTNAME: domain is not configured, discourse.example.com is a placeholder (placeholder-hostname)",
+			testDir + "/app.yml:4: error: env.DISCOURSE_SMTP_ADDRESS: mail is not configured, smtp.example.com is a placeholder (placeholder-smtp)",
+			testDir + "/app.yml:5: error: env.DISCOURSE_CDN_URL: CDN must have a protocol specified, eg. https://cdn.example.com (cdn-protocol)",
+		}))
+	})
+
+	It("warns about missing admin emails", func() {
+		Expect(lint("env:\n  DISCOURSE_HOSTNAME: forum.example.com\n")).To(Equal([]string{
+			"warning: env.DISCOURSE_DEVELOPER_EMAILS: no admin emails are set, nobody will be made admin on signup (developer-emails)",
+		}))
+	})
+
+	It("reports host ports bound twice", func() {
+		Expect(lint("expose:\n  - \"80:80\"\n  - \"127.0.0.1:80:3000\"\n  - \"127.0.0.2:443:443\"\n  - \"127.0.0.3:443:443\"\n  - \"8000-8010:8000-8010\"\n  - \"8005:80/udp\"\n  - \"8010:80\"\n")).To(Equal([]string{
+			testDir + "/app.yml:3: error: expose.127.0.0.1:80:3000: host port 80/tcp is already bound by 80:80 (duplicate-host-port)",
+			testDir + "/app.yml:8: error: expose.8010:80: host port 8010/tcp is already bound by 8000-8010:8000-8010 (duplicate-host-port)",
+		}))
+	})
+
+	It("warns about volume host paths that do not exist", func() {
+		Expect(lint("volumes:\n  - volume:\n      host: " + testDir + "\n      guest: /shared\n  - volume:\n      host: " + testDir + "/nope\n      guest: /var/log\n  - volume:\n      host: named\n      guest: /named\n")).To(Equal([]string{
+			testDir + "/app.yml:5: warning: volumes." + testDir + "/nope:/var/log: host path " + testDir + "/nope does not exist, docker will create it owned by root (missing-volume-host)",
+		}))
+	})
+
+	It("warns about migrating on boot without creating the database", func() {
+		Expect(lint("env:\n  MIGRATE_ON_BOOT: 1\n")).To(Equal([]string{
+			testDir + "/app.yml:2: warning: env.MIGRATE_ON_BOOT: MIGRATE_ON_BOOT is set without CREATE_DB_ON_BOOT, migrations fail on boot until the database exists (migrate-without-create-db)",
+		}))
+		Expect(lint("env:\n  MIGRATE_ON_BOOT: 1\n  CREATE_DB_ON_BOOT: 1\n")).To(BeEmpty())
+	})
+
+	It("reports links to containers without a config", func() {
+		os.WriteFile(testDir+"/data.yml", []byte("env: {}\n"), 0660)
+		Expect(lint("links:\n  - link:\n      name: data\n      alias: data\n  - link:\n      name: redis\n      alias: redis\n")).To(Equal([]string{
+			testDir + "/app.yml:5: warning: links.redis:redis: links to redis, which has no config in " + testDir + ", make sure it runs before this container starts (missing-link)",
+		}))
+	})
+
+	It("skips disabled rules", func() {
+		Expect(lint("env:\n  DISCOURSE_HOSTNAME: discourse.example.com\n  DISCOURSE_DEVELOPER_EMAILS: a@example.com\n", "placeholder-hostname")).To(BeEmpty())
+	})
+
+	It("runs added rules", func() {
+		defer func(rules []config.LintRule) { config.LintRules = rules }(config.LintRules)
+		config.LintRules = append(config.LintRules, config.LintRule{Name: "no-cats", Level: config.LintWarning, Check: func(c *config.Config, confDir string) []config.Lint {
+			if c.Env["CATS"] != "" {
+				return []config.Lint{{Key: "env.CATS", Message: "no cats allowed"}}
+			}
+			return nil
+		}})
+		Expect(lint("env:\n  CATS: many\n")).To(Equal([]string{
+			testDir + "/app.yml:2: warning: env.CATS: no cats allowed (no-cats)",
+		}))
+	})
+})
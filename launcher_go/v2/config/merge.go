@@ -0,0 +1,330 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"slices"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Merge directives, set as yaml tags in templates, configs and overlays.
+//
+// Lists (templates, expose, volumes, links, secrets) append new entries to the ones merged before them,
+// skipping duplicates. Tag a list !replace to replace them instead, !prepend to add entries before them,
+// or !remove to remove the listed entries.
+//
+// Maps (env, labels, params) add and override keys. Tag a map !replace to drop the keys merged before it,
+// or tag a single value !unset to delete that key.
+const (
+	ReplaceDirective = "!replace"
+	PrependDirective = "!prepend"
+	RemoveDirective  = "!remove"
+	UnsetDirective   = "!unset"
+)
+
+// Keys pups reads itself. Their merge directives are applied to the raw yaml handed to pups as well.
+var pupsMapKeys = []string{"env", "params", "labels"}
+
+// Merges a template, config, or overlay file over the config loaded so far.
+func (config *Config) merge(content []byte, file string) error {
+	doc := &yaml.Node{}
+	if err := yaml.Unmarshal(content, doc); err != nil {
+		return err
+	}
+	if len(doc.Content) == 0 {
+		config.rawYaml = append(config.rawYaml, string(content[:]))
+		return nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return errors.New("config must be a mapping of keys to values")
+	}
+	edited := false
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key := root.Content[i].Value
+		value := root.Content[i+1]
+		directive := directiveOf(value)
+		record := config.recorder(file, key)
+		if slices.Contains(interpolatedKeys, key) {
+			interpolated, err := interpolateNode(value, key, key, config.lookupEnv)
+			if err != nil {
+				err = fmt.Errorf("%s:%w", file, err)
+				fmt.Println(err.Error())
+				return err
+			}
+			edited = interpolated || edited
+		}
+		if key == "env" {
+			resolved, err := config.resolveSecrets(value)
+			if err != nil {
+				err = fmt.Errorf("%s:%w", file, err)
+				fmt.Println(err.Error())
+				return err
+			}
+			edited = resolved || edited
+		}
+		var err error
+		switch key {
+		case "templates":
+			config.Templates, err = mergeList(config.Templates, value, record, entryName)
+		case "expose":
+			config.Expose, err = mergeList(config.Expose, value, record, entryName)
+		case "secrets":
+			config.Secrets, err = mergeList(config.Secrets, value, record, entryName)
+		case "volumes":
+			config.Volumes, err = mergeList(config.Volumes, value, record, volumeName)
+		case "links":
+			config.Links, err = mergeList(config.Links, value, record, linkName)
+		case "env":
+			config.Env, err = mergeMap(config.Env, value, record)
+		case "labels":
+			config.Labels, err = mergeMap(config.Labels, value, record)
+		case "params":
+			config.Params, err = mergeMap(config.Params, value, record)
+		default:
+			if directive != "" {
+				err = fmt.Errorf("%s is not supported on %s", directive, key)
+			} else if err = config.mergeField(key, value); err == nil && slices.Contains(settingKeys, key) {
+				config.recorder(file, "")(key, root.Content[i].Line, ActionSet)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", key, err)
+		}
+		if slices.Contains(pupsMapKeys, key) {
+			edited = config.applyToRawYaml(key, value) || edited
+		}
+		if directive != "" {
+			value.Tag = ""
+			edited = true
+		}
+	}
+	if edited {
+		// pups doesn't understand merge directives, hand it the merged result instead
+		var b bytes.Buffer
+		encoder := yaml.NewEncoder(&b)
+		encoder.SetIndent(2)
+		if err := encoder.Encode(doc); err != nil {
+			return err
+		}
+		content = b.Bytes()
+	}
+	config.rawYaml = append(config.rawYaml, string(content[:]))
+	return nil
+}
+
+// Scalar settings, which override the ones merged before them.
+var settingKeys = []string{"base_image", "update_pups", "run_image", "boot_command", "no_boot_command", "docker_args", "build_cache", "build_cache_ref", "no_build_pull", "registry", "image_name"}
+
+func (config *Config) mergeField(key string, value *yaml.Node) error {
+	switch key {
+	case "base_image":
+		return value.Decode(&config.Base_Image)
+	case "update_pups":
+		return value.Decode(&config.Update_Pups)
+	case "run_image":
+		return value.Decode(&config.Run_Image)
+	case "boot_command":
+		return value.Decode(&config.Boot_Command)
+	case "no_boot_command":
+		return value.Decode(&config.No_Boot_Command)
+	case "docker_args":
+		return value.Decode(&config.Docker_Args)
+	case "build_cache":
+		return value.Decode(&config.Build_Cache)
+	case "build_cache_ref":
+		return value.Decode(&config.Build_Cache_Ref)
+	case "no_build_pull":
+		return value.Decode(&config.No_Build_Pull)
+	case "registry":
+		return value.Decode(&config.Registry)
+	case "image_name":
+		return value.Decode(&config.Image_Name)
+	}
+	// anything else is for pups
+	return nil
+}
+
+func directiveOf(node *yaml.Node) string {
+	switch node.Tag {
+	case ReplaceDirective, PrependDirective, RemoveDirective, UnsetDirective:
+		return node.Tag
+	}
+	return ""
+}
+
+func mergeList[T comparable](existing []T, node *yaml.Node, record recordFunc, name func(T) string) ([]T, error) {
+	directive := directiveOf(node)
+	entries := []T{}
+	if !isNull(node) {
+		if err := node.Decode(&entries); err != nil {
+			return nil, err
+		}
+	}
+	result := []T{}
+	switch directive {
+	case "":
+		result = append(result, existing...)
+		for i, e := range entries {
+			if slices.Contains(result, e) {
+				record(name(e), node.Content[i].Line, ActionDuplicate)
+				continue
+			}
+			result = append(result, e)
+			record(name(e), node.Content[i].Line, ActionAdd)
+		}
+	case ReplaceDirective:
+		for _, e := range existing {
+			if !slices.Contains(entries, e) {
+				record(name(e), node.Line, ActionReplaced)
+			}
+		}
+		for i, e := range entries {
+			if !slices.Contains(result, e) {
+				result = append(result, e)
+				record(name(e), node.Content[i].Line, ActionAdd)
+			}
+		}
+	case PrependDirective:
+		for i, e := range entries {
+			if !slices.Contains(result, e) {
+				result = append(result, e)
+				record(name(e), node.Content[i].Line, ActionPrepend)
+			}
+		}
+		for _, e := range existing {
+			if !slices.Contains(result, e) {
+				result = append(result, e)
+			}
+		}
+	case RemoveDirective:
+		for _, e := range existing {
+			if !slices.Contains(entries, e) {
+				result = append(result, e)
+			}
+		}
+		for i, e := range entries {
+			record(name(e), node.Content[i].Line, ActionRemove)
+		}
+	default:
+		return nil, fmt.Errorf("%s is not supported on lists", directive)
+	}
+	return result, nil
+}
+
+func mergeMap(existing map[string]string, node *yaml.Node, record recordFunc) (map[string]string, error) {
+	directive := directiveOf(node)
+	if directive != "" && directive != ReplaceDirective {
+		return nil, fmt.Errorf("%s is not supported on maps", directive)
+	}
+	if !isNull(node) && node.Kind != yaml.MappingNode {
+		return nil, errors.New("must be a mapping")
+	}
+	result := map[string]string{}
+	for k, v := range existing {
+		if directive == "" || mappingValue(node, k) != nil {
+			result[k] = v
+		} else {
+			record(k, node.Line, ActionReplaced)
+		}
+	}
+	if isNull(node) {
+		return result, nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key := node.Content[i].Value
+		value := node.Content[i+1]
+		switch directiveOf(value) {
+		case "":
+			var v string
+			if err := value.Decode(&v); err != nil {
+				return nil, err
+			}
+			if _, ok := result[key]; ok {
+				record(key, node.Content[i].Line, ActionOverride)
+			} else {
+				record(key, node.Content[i].Line, ActionSet)
+			}
+			result[key] = v
+		case UnsetDirective:
+			delete(result, key)
+			record(key, node.Content[i].Line, ActionUnset)
+		default:
+			return nil, fmt.Errorf("%s is not supported on %s", value.Tag, key)
+		}
+	}
+	return result, nil
+}
+
+// Applies a map's !replace and !unset directives to the raw yaml merged before it,
+// and drops !unset keys from the map itself.
+// Returns whether the map was changed.
+func (config *Config) applyToRawYaml(key string, node *yaml.Node) bool {
+	replace := directiveOf(node) == ReplaceDirective
+	unset := []string{}
+	kept := []*yaml.Node{}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if directiveOf(node.Content[i+1]) == UnsetDirective {
+			unset = append(unset, node.Content[i].Value)
+		} else {
+			kept = append(kept, node.Content[i], node.Content[i+1])
+		}
+	}
+	if !replace && len(unset) == 0 {
+		return false
+	}
+	for i, doc := range config.rawYaml {
+		config.rawYaml[i] = editYaml(doc, func(root *yaml.Node) bool {
+			return removeKeys(root, key, func(k string) bool { return replace || slices.Contains(unset, k) })
+		})
+	}
+	node.Content = kept
+	return len(unset) > 0
+}
+
+// Removes keys of the section mapping for which remove returns true. Removes the whole section when they all are.
+func removeKeys(root *yaml.Node, section string, remove func(key string) bool) bool {
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value != section || root.Content[i+1].Kind != yaml.MappingNode {
+			continue
+		}
+		node := root.Content[i+1]
+		kept := []*yaml.Node{}
+		for j := 0; j+1 < len(node.Content); j += 2 {
+			if !remove(node.Content[j].Value) {
+				kept = append(kept, node.Content[j], node.Content[j+1])
+			}
+		}
+		if len(kept) == len(node.Content) {
+			return false
+		}
+		if len(kept) == 0 {
+			root.Content = append(root.Content[:i], root.Content[i+2:]...)
+		} else {
+			node.Content = kept
+		}
+		return true
+	}
+	return false
+}
+
+// Parses a raw yaml document and re-encodes it when edit changes it.
+// Documents edit leaves alone are returned untouched, keeping their formatting and comments.
+func editYaml(content string, edit func(root *yaml.Node) bool) string {
+	doc := &yaml.Node{}
+	if err := yaml.Unmarshal([]byte(content), doc); err != nil || len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return content
+	}
+	if !edit(doc.Content[0]) {
+		return content
+	}
+	var b bytes.Buffer
+	encoder := yaml.NewEncoder(&b)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(doc); err != nil {
+		return content
+	}
+	return b.String()
+}
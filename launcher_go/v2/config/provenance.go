@@ -0,0 +1,188 @@
+package config
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// What a file did to a setting while being merged.
+const (
+	ActionSet       = "set"
+	ActionOverride  = "override"
+	ActionUnset     = "unset"
+	ActionAdd       = "add"
+	ActionDuplicate = "duplicate"
+	ActionPrepend   = "prepend"
+	ActionRemove    = "remove"
+	ActionReplaced  = "replaced"
+)
+
+// A file and line that set, overrode, or removed a setting.
+type Source struct {
+	File   string
+	Line   int
+	Action string
+}
+
+func (s Source) String() string {
+	return fmt.Sprintf("%-9s %s:%d", s.Action, s.File, s.Line)
+}
+
+type recordFunc func(name string, line int, action string)
+
+// Records sources of a section's settings, eg. section "env" and name "LANG" for "env.LANG".
+// Settings outside of a section have an empty section.
+func (config *Config) recorder(file string, section string) recordFunc {
+	return func(name string, line int, action string) {
+		key := name
+		if section != "" {
+			key = section + "." + name
+		}
+		if config.sources == nil {
+			config.sources = map[string][]Source{}
+		}
+		config.sources[key] = append(config.sources[key], Source{File: file, Line: line, Action: action})
+	}
+}
+
+func entryName(e string) string {
+	return e
+}
+
+func volumeName(v struct {
+	Volume struct {
+		Host  string `yaml:"host"`
+		Guest string `yaml:"guest"`
+	} `yaml:"volume"`
+}) string {
+	return v.Volume.Host + ":" + v.Volume.Guest
+}
+
+func linkName(l struct {
+	Link struct {
+		Name  string `yaml:"name"`
+		Alias string `yaml:"alias"`
+	} `yaml:"link"`
+}) string {
+	return l.Link.Name + ":" + l.Link.Alias
+}
+
+// Sections are listed in this order, settings outside of a section first.
+var sourceSections = []string{"", "templates", "env", "params", "labels", "expose", "volumes", "links", "secrets"}
+
+func sectionOf(key string) string {
+	section, _, found := strings.Cut(key, ".")
+	if !found || !slices.Contains(sourceSections, section) {
+		return ""
+	}
+	return section
+}
+
+// Every setting with a known source, eg. "env.LANG" or "expose.80:80", sorted by section then name.
+func (config *Config) SourceKeys() []string {
+	keys := []string{}
+	for k := range config.sources {
+		keys = append(keys, k)
+	}
+	slices.SortFunc(keys, func(a, b string) int {
+		if sa, sb := slices.Index(sourceSections, sectionOf(a)), slices.Index(sourceSections, sectionOf(b)); sa != sb {
+			return sa - sb
+		}
+		return strings.Compare(a, b)
+	})
+	return keys
+}
+
+// The files and lines that set, overrode, or removed a setting, in merge order.
+// The section part of the key is case insensitive, eg. "ENV.LANG" finds "env.LANG".
+func (config *Config) Sources(key string) []Source {
+	return config.sources[normalizeSourceKey(key)]
+}
+
+// Keys matching a setting, eg. "ENV.LANG", or every key of a section, eg. "env".
+func (config *Config) MatchSourceKeys(key string) []string {
+	key = normalizeSourceKey(key)
+	keys := []string{}
+	for _, k := range config.SourceKeys() {
+		if k == key || sectionOf(k) == key {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+func normalizeSourceKey(key string) string {
+	section, name, found := strings.Cut(key, ".")
+	if found && slices.Contains(sourceSections, strings.ToLower(section)) {
+		return strings.ToLower(section) + "." + name
+	}
+	return strings.ToLower(key)
+}
+
+// The resolved value of a setting, and whether it is still set after merging.
+// List entries are their own value.
+func (config *Config) Value(key string) (string, bool) {
+	key = normalizeSourceKey(key)
+	section, name, _ := strings.Cut(key, ".")
+	switch sectionOf(key) {
+	case "env":
+		v, ok := config.Env[name]
+		return v, ok
+	case "params":
+		v, ok := config.Params[name]
+		return v, ok
+	case "labels":
+		v, ok := config.Labels[name]
+		return v, ok
+	case "templates":
+		return name, slices.Contains(config.Templates, name)
+	case "expose":
+		return name, slices.Contains(config.Expose, name)
+	case "secrets":
+		return name, slices.Contains(config.Secrets, name)
+	case "volumes":
+		return name, slices.ContainsFunc(config.Volumes, func(v struct {
+			Volume struct {
+				Host  string `yaml:"host"`
+				Guest string `yaml:"guest"`
+			} `yaml:"volume"`
+		}) bool {
+			return volumeName(v) == name
+		})
+	case "links":
+		return name, slices.ContainsFunc(config.Links, func(l struct {
+			Link struct {
+				Name  string `yaml:"name"`
+				Alias string `yaml:"alias"`
+			} `yaml:"link"`
+		}) bool {
+			return linkName(l) == name
+		})
+	}
+	switch section {
+	case "base_image":
+		return config.Base_Image, true
+	case "update_pups":
+		return fmt.Sprint(config.Update_Pups), true
+	case "run_image":
+		return config.Run_Image, true
+	case "boot_command":
+		return config.Boot_Command, true
+	case "no_boot_command":
+		return fmt.Sprint(config.No_Boot_Command), true
+	case "docker_args":
+		return config.Docker_Args, true
+	case "build_cache":
+		return config.Build_Cache, true
+	case "build_cache_ref":
+		return config.Build_Cache_Ref, true
+	case "no_build_pull":
+		return fmt.Sprint(config.No_Build_Pull), true
+	case "registry":
+		return config.Registry, true
+	case "image_name":
+		return config.Image_Name, true
+	}
+	return "", false
+}
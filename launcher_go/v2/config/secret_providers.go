@@ -0,0 +1,116 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/discourse/discourse_docker/launcher_go/v2/utils"
+	"gopkg.in/yaml.v3"
+)
+
+// Resolves secret references in env, written as `KEY: {secret: <provider>:<ref>}`.
+type SecretProvider interface {
+	Resolve(ref string) (string, error)
+}
+
+// Reads the secret from a file, eg. {secret: file:/etc/discourse/db_pass}
+type FileSecretProvider struct{}
+
+func (FileSecretProvider) Resolve(ref string) (string, error) {
+	content, err := os.ReadFile(ref)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
+
+// Runs a shell command and uses its output, eg. {secret: exec:pass show discourse/db}
+type ExecSecretProvider struct{}
+
+func (ExecSecretProvider) Resolve(ref string) (string, error) {
+	return runSecretCmd(exec.Command("sh", "-c", ref))
+}
+
+// Decrypts a sops encrypted file, eg. {secret: sops:secrets.enc.yml#DISCOURSE_DB_PASSWORD}
+// Without a #key, the whole decrypted file is the secret.
+type SopsSecretProvider struct{}
+
+func (SopsSecretProvider) Resolve(ref string) (string, error) {
+	file, key, found := strings.Cut(ref, "#")
+	args := []string{"--decrypt"}
+	if found {
+		args = append(args, "--extract", fmt.Sprintf("[%q]", key))
+	}
+	return runSecretCmd(exec.Command("sops", append(args, file)...))
+}
+
+// Decrypts an age encrypted file with the identity file in AGE_IDENTITY, eg. {secret: age:db_pass.age}
+type AgeSecretProvider struct{}
+
+func (AgeSecretProvider) Resolve(ref string) (string, error) {
+	identity := os.Getenv("AGE_IDENTITY")
+	if identity == "" {
+		return "", errors.New("AGE_IDENTITY must be set to an age identity file")
+	}
+	return runSecretCmd(exec.Command("age", "--decrypt", "--identity", identity, ref))
+}
+
+func runSecretCmd(cmd *exec.Cmd) (string, error) {
+	cmd.Stderr = os.Stderr
+	out, err := utils.CmdRunner(cmd).Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(out), "\r\n"), nil
+}
+
+// Providers for secret references, by the prefix before the first colon.
+var SecretProviders = map[string]SecretProvider{
+	"file": FileSecretProvider{},
+	"exec": ExecSecretProvider{},
+	"sops": SopsSecretProvider{},
+	"age":  AgeSecretProvider{},
+}
+
+// The provider and reference of a `{secret: <provider>:<ref>}` value, and whether node is one.
+func secretRef(node *yaml.Node) (string, string, bool) {
+	if node.Kind != yaml.MappingNode || len(node.Content) != 2 || node.Content[0].Value != "secret" || node.Content[1].Kind != yaml.ScalarNode {
+		return "", "", false
+	}
+	provider, ref, _ := strings.Cut(node.Content[1].Value, ":")
+	return provider, ref, true
+}
+
+// Replaces secret references in an env mapping with the secrets they resolve to, marking their keys as secret.
+// Returns whether any were resolved.
+func (config *Config) resolveSecrets(node *yaml.Node) (bool, error) {
+	if node.Kind != yaml.MappingNode {
+		return false, nil
+	}
+	resolved := false
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key := node.Content[i].Value
+		value := node.Content[i+1]
+		name, ref, ok := secretRef(value)
+		if !ok {
+			continue
+		}
+		provider, ok := SecretProviders[name]
+		if !ok {
+			return false, fmt.Errorf("%d: env.%s: unknown secret provider '%s'", value.Line, key, name)
+		}
+		secret, err := provider.Resolve(ref)
+		if err != nil {
+			return false, fmt.Errorf("%d: env.%s: resolving %s secret: %w", value.Line, key, name, err)
+		}
+		*value = yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: secret, Line: value.Line, Column: value.Column}
+		if !config.IsSecret(key) {
+			config.secretRefs = append(config.secretRefs, key)
+		}
+		resolved = true
+	}
+	return resolved, nil
+}
@@ -0,0 +1,387 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// A single problem found while validating a container config or one of its templates.
+// Line and Column are 1-based, and zero when the problem is not tied to a position in the file.
+type Diagnostic struct {
+	File    string
+	Line    int
+	Column  int
+	Message string
+}
+
+func (d Diagnostic) String() string {
+	if d.Line == 0 {
+		return d.File + ": " + d.Message
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", d.File, d.Line, d.Column, d.Message)
+}
+
+type schemaKind int
+
+const (
+	schemaString schemaKind = iota
+	schemaBool
+	schemaStringList
+	schemaStringMap
+	schemaExpose
+	schemaVolumes
+	schemaLinks
+	schemaMap
+	schemaList
+	schemaPatterns
+	schemaEnv
+	schemaBuildCache
+)
+
+// Build cache modes: none rebuilds every layer, local reuses the local layer cache,
+// and registry also reads and writes the cache at build_cache_ref.
+var BuildCacheModes = []string{"none", "local", "registry"}
+
+// Top level keys understood by launcher and pups, and the shape their values must take.
+var configSchema = map[string]schemaKind{
+	"base_image":      schemaString,
+	"update_pups":     schemaBool,
+	"run_image":       schemaString,
+	"boot_command":    schemaString,
+	"no_boot_command": schemaBool,
+	"docker_args":     schemaString,
+	"build_cache":     schemaBuildCache,
+	"build_cache_ref": schemaString,
+	"no_build_pull":   schemaBool,
+	"registry":        schemaString,
+	"image_name":      schemaString,
+	"templates":       schemaStringList,
+	"expose":          schemaExpose,
+	"params":          schemaStringMap,
+	"env":             schemaEnv,
+	"labels":          schemaStringMap,
+	"secrets":         schemaPatterns,
+	"volumes":         schemaVolumes,
+	"links":           schemaLinks,
+	"hooks":           schemaMap,
+	"run":             schemaList,
+}
+
+// [ip:][hostPort:]containerPort[/protocol], where ports may be ranges
+var exposeRegexp = regexp.MustCompile(`^(?:(?:\d{1,3}(?:\.\d{1,3}){3}|\[[0-9A-Fa-f:]+\]):)?(?:(\d+)(?:-(\d+))?:)?(\d+)(?:-(\d+))?(?:/(?:tcp|udp|sctp))?$`)
+
+type validator struct {
+	file        string
+	diagnostics []Diagnostic
+}
+
+func (v *validator) errorf(node *yaml.Node, format string, args ...any) {
+	d := Diagnostic{File: v.file, Message: fmt.Sprintf(format, args...)}
+	if node != nil {
+		d.Line = node.Line
+		d.Column = node.Column
+	}
+	v.diagnostics = append(v.diagnostics, d)
+}
+
+// Validates a container config and every template it includes against the config schema.
+// Templates are taken from the first of templatesDirs containing them.
+// Returns every problem found, an empty result means the config is valid.
+func ValidateConfig(dir string, configName string, templatesDirs ...string) []Diagnostic {
+	configFilename := strings.TrimRight(dir, "/") + "/" + configName + ".yml"
+	matched, _ := regexp.MatchString("[[:upper:]/ !@#$%^&*()+~`=]", configName)
+	if matched {
+		return []Diagnostic{{
+			File:    configFilename,
+			Message: "config name '" + configName + "' must not contain upper case characters, spaces or special characters",
+		}}
+	}
+
+	v := &validator{file: configFilename}
+	doc := v.parseFile(configFilename)
+	if doc == nil {
+		return v.diagnostics
+	}
+	return v.checkConfig(doc, templatesDirs)
+}
+
+// Validates the content of a container config before it is written to filename.
+func ValidateConfigContent(filename string, content []byte, templatesDirs ...string) []Diagnostic {
+	v := &validator{file: filename}
+	doc := v.parse(content)
+	if doc == nil {
+		return v.diagnostics
+	}
+	return v.checkConfig(doc, templatesDirs)
+}
+
+func (v *validator) checkConfig(doc *yaml.Node, templatesDirs []string) []Diagnostic {
+	v.checkDocument(doc)
+	v.checkTemplates(doc, templatesDirs, []string{}, map[string]bool{})
+	return v.diagnostics
+}
+
+// Validates the templates a config or template includes, and the templates they include in turn.
+// included holds the chain of templates that led here, to catch cycles.
+func (v *validator) checkTemplates(doc *yaml.Node, templatesDirs []string, included []string, checked map[string]bool) {
+	templates := mappingValue(doc, "templates")
+	if templates == nil || templates.Kind != yaml.SequenceNode {
+		return
+	}
+	for _, t := range templates.Content {
+		if t.Kind != yaml.ScalarNode {
+			continue
+		}
+		if slices.Contains(included, t.Value) {
+			v.errorf(t, "template cycle: %s", strings.Join(append(slices.Clone(included), t.Value), " -> "))
+			continue
+		}
+		if checked[t.Value] {
+			continue
+		}
+		checked[t.Value] = true
+		templateFilename, err := FindTemplate(templatesDirs, t.Value)
+		if err != nil {
+			v.errorf(t, "template %s could not be found in %s", t.Value, strings.Join(templatesDirs, ", "))
+			continue
+		}
+		tv := &validator{file: templateFilename}
+		if templateDoc := tv.parseFile(templateFilename); templateDoc != nil {
+			tv.checkDocument(templateDoc)
+			if templateDoc.Kind == yaml.MappingNode {
+				tv.checkTemplates(templateDoc, templatesDirs, append(slices.Clone(included), t.Value), checked)
+			}
+		}
+		v.diagnostics = append(v.diagnostics, tv.diagnostics...)
+	}
+}
+
+var yamlErrorLineRegexp = regexp.MustCompile(`line (\d+)`)
+
+func (v *validator) parseFile(filename string) *yaml.Node {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			v.errorf(nil, "file does not exist")
+		} else {
+			v.errorf(nil, "%s", err.Error())
+		}
+		return nil
+	}
+	return v.parse(content)
+}
+
+func (v *validator) parse(content []byte) *yaml.Node {
+	doc := &yaml.Node{}
+	if err := yaml.Unmarshal(content, doc); err != nil {
+		d := Diagnostic{File: v.file, Message: err.Error()}
+		if m := yamlErrorLineRegexp.FindStringSubmatch(err.Error()); m != nil {
+			d.Line, _ = strconv.Atoi(m[1])
+			d.Column = 1
+		}
+		v.diagnostics = append(v.diagnostics, d)
+		return nil
+	}
+	if len(doc.Content) == 0 {
+		// an empty file is a valid, if useless, config
+		return nil
+	}
+	return doc.Content[0]
+}
+
+func (v *validator) checkDocument(root *yaml.Node) {
+	if root.Kind != yaml.MappingNode {
+		v.errorf(root, "config must be a mapping of keys to values")
+		return
+	}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key := root.Content[i]
+		value := root.Content[i+1]
+		kind, ok := configSchema[key.Value]
+		if !ok {
+			v.errorf(key, "unknown key '%s'", key.Value)
+			continue
+		}
+		v.checkValue(key.Value, kind, value)
+	}
+}
+
+func (v *validator) checkValue(name string, kind schemaKind, node *yaml.Node) {
+	switch kind {
+	case schemaStringList, schemaExpose, schemaVolumes, schemaLinks, schemaPatterns:
+		v.checkDirective(name, node, ReplaceDirective, PrependDirective, RemoveDirective)
+	case schemaStringMap, schemaEnv:
+		v.checkDirective(name, node, ReplaceDirective)
+	default:
+		v.checkDirective(name, node)
+	}
+	// an empty value (eg. `params:` with everything commented out) is fine for any key
+	if isNull(node) {
+		return
+	}
+	switch kind {
+	case schemaString:
+		if node.Kind != yaml.ScalarNode {
+			v.errorf(node, "%s must be a string", name)
+		}
+	case schemaBuildCache:
+		if node.Kind != yaml.ScalarNode || !slices.Contains(BuildCacheModes, node.Value) {
+			v.errorf(node, "%s must be one of %s", name, strings.Join(BuildCacheModes, ", "))
+		}
+	case schemaBool:
+		if node.Kind != yaml.ScalarNode || node.ShortTag() != "!!bool" {
+			v.errorf(node, "%s must be true or false", name)
+		}
+	case schemaStringList:
+		if !v.expectKind(name, node, yaml.SequenceNode, "a list") {
+			return
+		}
+		for _, item := range node.Content {
+			if item.Kind != yaml.ScalarNode {
+				v.errorf(item, "%s entries must be strings", name)
+			}
+		}
+	case schemaStringMap, schemaEnv:
+		if !v.expectKind(name, node, yaml.MappingNode, "a mapping") {
+			return
+		}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i]
+			value := node.Content[i+1]
+			v.checkDirective(name+" value for '"+key.Value+"'", value, UnsetDirective)
+			if provider, _, ok := secretRef(value); ok && kind == schemaEnv {
+				if _, known := SecretProviders[provider]; !known {
+					v.errorf(value.Content[1], "unknown secret provider '%s' for %s value '%s'", provider, name, key.Value)
+				}
+			} else if value.Kind != yaml.ScalarNode {
+				v.errorf(value, "%s value for '%s' must be a string", name, key.Value)
+			}
+		}
+	case schemaPatterns:
+		if !v.expectKind(name, node, yaml.SequenceNode, "a list") {
+			return
+		}
+		for _, item := range node.Content {
+			if item.Kind != yaml.ScalarNode {
+				v.errorf(item, "%s entries must be strings", name)
+			} else if _, err := path.Match(item.Value, ""); err != nil {
+				v.errorf(item, "invalid %s pattern '%s'", name, item.Value)
+			}
+		}
+	case schemaExpose:
+		if !v.expectKind(name, node, yaml.SequenceNode, "a list") {
+			return
+		}
+		for _, item := range node.Content {
+			v.checkExpose(item)
+		}
+	case schemaVolumes:
+		v.checkNamedEntries(name, node, "volume", []string{"host", "guest"})
+	case schemaLinks:
+		v.checkNamedEntries(name, node, "link", []string{"name", "alias"})
+	case schemaMap:
+		v.expectKind(name, node, yaml.MappingNode, "a mapping")
+	case schemaList:
+		v.expectKind(name, node, yaml.SequenceNode, "a list")
+	}
+}
+
+// Local tags are merge directives, and only some apply to each kind of value.
+func (v *validator) checkDirective(name string, node *yaml.Node, allowed ...string) {
+	if !strings.HasPrefix(node.Tag, "!") || strings.HasPrefix(node.Tag, "!!") || slices.Contains(allowed, node.Tag) {
+		return
+	}
+	if directiveOf(node) == "" {
+		v.errorf(node, "unknown merge directive '%s'", node.Tag)
+	} else {
+		v.errorf(node, "%s is not supported on %s", node.Tag, name)
+	}
+}
+
+func (v *validator) expectKind(name string, node *yaml.Node, kind yaml.Kind, description string) bool {
+	if node.Kind != kind {
+		v.errorf(node, "%s must be %s", name, description)
+		return false
+	}
+	return true
+}
+
+func (v *validator) checkExpose(node *yaml.Node) {
+	if node.Kind != yaml.ScalarNode {
+		v.errorf(node, "expose entries must be a port or a port mapping such as \"80:80\"")
+		return
+	}
+	m := exposeRegexp.FindStringSubmatch(node.Value)
+	if m == nil {
+		v.errorf(node, "invalid expose entry '%s', expected [ip:][hostPort:]containerPort[/protocol]", node.Value)
+		return
+	}
+	for _, p := range m[1:] {
+		if p == "" {
+			continue
+		}
+		if port, _ := strconv.Atoi(p); port < 1 || port > 65535 {
+			v.errorf(node, "invalid expose entry '%s', port %s is out of range", node.Value, p)
+			return
+		}
+	}
+}
+
+// volumes and links are lists of single key mappings, eg:
+//
+//	volumes:
+//	  - volume:
+//	      host: /var/discourse/shared
+//	      guest: /shared
+func (v *validator) checkNamedEntries(name string, node *yaml.Node, entryName string, fields []string) {
+	if !v.expectKind(name, node, yaml.SequenceNode, "a list") {
+		return
+	}
+	for _, item := range node.Content {
+		if item.Kind != yaml.MappingNode || len(item.Content) != 2 || item.Content[0].Value != entryName {
+			v.errorf(item, "%s entries must be a mapping with a single '%s' key", name, entryName)
+			continue
+		}
+		entry := item.Content[1]
+		if entry.Kind != yaml.MappingNode {
+			v.errorf(entry, "%s must be a mapping with %s", entryName, strings.Join(fields, " and "))
+			continue
+		}
+		for i := 0; i+1 < len(entry.Content); i += 2 {
+			key := entry.Content[i]
+			if !slices.Contains(fields, key.Value) {
+				v.errorf(key, "unknown %s key '%s'", entryName, key.Value)
+			} else if entry.Content[i+1].Kind != yaml.ScalarNode || isNull(entry.Content[i+1]) {
+				v.errorf(entry.Content[i+1], "%s %s must be a string", entryName, key.Value)
+			}
+		}
+		for _, f := range fields {
+			if mappingValue(entry, f) == nil {
+				v.errorf(entry, "%s is missing '%s'", entryName, f)
+			}
+		}
+	}
+}
+
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func isNull(node *yaml.Node) bool {
+	return node.Kind == yaml.ScalarNode && node.ShortTag() == "!!null"
+}
@@ -0,0 +1,143 @@
+package config_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/discourse/discourse_docker/launcher_go/v2/config"
+	"os"
+)
+
+var _ = Describe("Validate", func() {
+	var testDir string
+	var messages = func(diagnostics []config.Diagnostic) []string {
+		result := []string{}
+		for _, d := range diagnostics {
+			result = append(result, d.String())
+		}
+		return result
+	}
+	var writeConfig = func(content string) {
+		err := os.WriteFile(testDir+"/app.yml", []byte(content), 0660)
+		Expect(err).To(BeNil())
+	}
+
+	BeforeEach(func() {
+		testDir, _ = os.MkdirTemp("", "ddocker-test")
+	})
+	AfterEach(func() {
+		os.RemoveAll(testDir)
+	})
+
+	It("passes the test configs", func() {
+		Expect(config.ValidateConfig("../test/containers", "test", "../test")).To(BeEmpty())
+		Expect(config.ValidateConfig("../test/containers", "standalone", "../test")).To(BeEmpty())
+		Expect(config.ValidateConfig("../test/containers", "web_only", "../test")).To(BeEmpty())
+	})
+
+	It("reports invalid config names", func() {
+		Expect(messages(config.ValidateConfig("../test/containers", "Test", "../test"))).To(ConsistOf(
+			ContainSubstring("must not contain upper case characters")))
+	})
+
+	It("reports missing config files", func() {
+		Expect(messages(config.ValidateConfig(testDir, "app", "../test"))).To(ConsistOf(
+			testDir + "/app.yml: file does not exist"))
+	})
+
+	It("reports yaml syntax errors with a line number", func() {
+		writeConfig("env:\n  A: b\n  B: c: d\n")
+		Expect(messages(config.ValidateConfig(testDir, "app", "../test"))).To(ConsistOf(
+			HavePrefix(testDir + "/app.yml:3:1: yaml:")))
+	})
+
+	It("reports invalid secrets patterns", func() {
+		writeConfig("secrets:\n  - DISCOURSE_S3_*\n  - \"[\"\n  - a: b\n")
+		Expect(messages(config.ValidateConfig(testDir, "app", "../test"))).To(ConsistOf(
+			testDir+"/app.yml:3:5: invalid secrets pattern '['",
+			testDir+"/app.yml:4:5: secrets entries must be strings",
+		))
+	})
+
+	It("reports misplaced and unknown merge directives", func() {
+		writeConfig("expose: !replace\n  - 80\nenv: !prepend\n  A: !unset\n  B: !repalce b\ndocker_args: !replace --expose 100\n")
+		Expect(messages(config.ValidateConfig(testDir, "app", "../test"))).To(ConsistOf(
+			testDir+"/app.yml:3:6: !prepend is not supported on env",
+			testDir+"/app.yml:5:6: unknown merge directive '!repalce'",
+			testDir+"/app.yml:6:14: !replace is not supported on docker_args",
+		))
+	})
+
+	It("reports unknown build cache modes", func() {
+		writeConfig("build_cache: remote\nbuild_cache_ref: ghcr.io/example/cache\nno_build_pull: true\n")
+		Expect(messages(config.ValidateConfig(testDir, "app", "../test"))).To(ConsistOf(
+			testDir + "/app.yml:1:14: build_cache must be one of none, local, registry",
+		))
+	})
+
+	It("reports schema errors with line and column", func() {
+		writeConfig(`templates:
+  - templates/web.template.yml
+  - templates/missing.template.yml
+unknown_key: true
+expose:
+  - "80:80"
+  - "443:443/tcp"
+  - "127.0.0.1:8080:80"
+  - "80:80:80:80"
+  - "99999:80"
+env:
+  GOOD: value
+  NUMBER: 3
+  NESTED:
+    bad: value
+volumes:
+  - volume:
+      host: /var/discourse/shared
+      guest: /shared
+  - volume:
+      host: /var/discourse/log
+  - host: /var/discourse/other
+links:
+  - link:
+      name: data
+      alias: data
+      extra: nope
+`)
+		Expect(messages(config.ValidateConfig(testDir, "app", "../test"))).To(ConsistOf(
+			testDir+"/app.yml:3:5: template templates/missing.template.yml could not be found in ../test",
+			testDir+"/app.yml:4:1: unknown key 'unknown_key'",
+			testDir+"/app.yml:9:5: invalid expose entry '80:80:80:80', expected [ip:][hostPort:]containerPort[/protocol]",
+			testDir+"/app.yml:10:5: invalid expose entry '99999:80', port 99999 is out of range",
+			testDir+"/app.yml:15:5: env value for 'NESTED' must be a string",
+			testDir+"/app.yml:21:7: volume is missing 'guest'",
+			testDir+"/app.yml:22:5: volumes entries must be a mapping with a single 'volume' key",
+			testDir+"/app.yml:27:7: unknown link key 'extra'",
+		))
+	})
+
+	It("validates listed templates", func() {
+		os.Mkdir(testDir+"/templates", 0755)
+		os.WriteFile(testDir+"/templates/bad.template.yml", []byte("params:\n  - not a map\n"), 0660)
+		writeConfig("templates:\n  - templates/bad.template.yml\n")
+		Expect(messages(config.ValidateConfig(testDir, "app", testDir))).To(ConsistOf(
+			testDir + "/templates/bad.template.yml:2:3: params must be a mapping"))
+	})
+
+	It("validates nested templates, and catches cycles", func() {
+		os.Mkdir(testDir+"/templates", 0755)
+		os.WriteFile(testDir+"/templates/a.template.yml", []byte("templates:\n  - templates/b.template.yml\n"), 0660)
+		os.WriteFile(testDir+"/templates/b.template.yml", []byte("templates:\n  - templates/a.template.yml\nparams:\n  - not a map\n"), 0660)
+		writeConfig("templates:\n  - templates/a.template.yml\n  - templates/b.template.yml\n")
+		Expect(messages(config.ValidateConfig(testDir, "app", testDir))).To(ConsistOf(
+			testDir+"/templates/b.template.yml:2:5: template cycle: templates/a.template.yml -> templates/b.template.yml -> templates/a.template.yml",
+			testDir+"/templates/b.template.yml:4:3: params must be a mapping"))
+	})
+
+	It("allows secret references in env, from known providers", func() {
+		writeConfig("env:\n  A: {secret: \"file:/etc/a\"}\n  B: {secret: \"vault:b\"}\nparams:\n  c: {secret: \"file:/etc/c\"}\n")
+		Expect(messages(config.ValidateConfig(testDir, "app", "../test"))).To(ConsistOf(
+			testDir+"/app.yml:3:15: unknown secret provider 'vault' for env value 'B'",
+			testDir+"/app.yml:5:6: params value for 'c' must be a string"))
+	})
+})
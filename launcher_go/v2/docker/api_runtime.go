@@ -0,0 +1,576 @@
+package docker
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/discourse/discourse_docker/launcher_go/v2/utils"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Runs containers through the engine api, for hosts without a docker cli.
+// Podman's docker compatible api is used when Podman is set.
+type ApiRuntime struct {
+	Client *Client
+	Podman bool
+}
+
+func (a *ApiRuntime) Name() string {
+	if a.Podman {
+		return "podman"
+	}
+	return "docker"
+}
+
+// The engine api's classic builder has no BuildKit session to mount secrets through.
+func (a *ApiRuntime) BuildSecrets() bool {
+	return false
+}
+
+// The engine api's builder builds a single platform, so it can't produce multi-arch manifests.
+func (a *ApiRuntime) Build(r *DockerBuilder) error {
+	if len(r.Platforms) > 1 {
+		return errors.New("the engine api can only build one platform at a time, use --engine=cli to build " + strings.Join(r.Platforms, ","))
+	}
+	dockerfile, err := io.ReadAll(r.Stdin)
+	if err != nil {
+		return err
+	}
+	buildContext, err := tarBuildContext(r.Dir, dockerfile)
+	if err != nil {
+		return err
+	}
+	// mirror the cli build: secrets are excluded from build args
+	buildArgs := map[string]string{}
+	for _, e := range r.Config.EnvArray(false) {
+		k, v, _ := strings.Cut(e, "=")
+		buildArgs[k] = v
+	}
+	buildArgsJson, err := json.Marshal(buildArgs)
+	if err != nil {
+		return err
+	}
+	query := url.Values{}
+	query.Set("t", r.imageName())
+	query.Set("dockerfile", "Dockerfile")
+	query.Set("buildargs", string(buildArgsJson))
+	switch r.Cache {
+	case "", "none":
+		query.Set("nocache", "1")
+	case "registry":
+		// the engine api can read cache from an image, but not export it
+		cacheFromJson, err := json.Marshal([]string{r.CacheRef})
+		if err != nil {
+			return err
+		}
+		query.Set("cachefrom", string(cacheFromJson))
+		fmt.Fprintln(utils.Out, "reading build cache from "+r.CacheRef+", the engine api cannot write it back")
+	}
+	if !r.NoPull {
+		query.Set("pull", "1")
+	}
+	if len(r.Platforms) == 1 {
+		query.Set("platform", r.Platforms[0])
+	}
+	query.Set("forcerm", "1")
+	query.Set("shmsize", strconv.FormatInt(shmSize, 10))
+	labels := map[string]string{}
+	for _, label := range r.labels() {
+		k, v, _ := strings.Cut(label, "=")
+		labels[k] = v
+	}
+	labelsJson, err := json.Marshal(labels)
+	if err != nil {
+		return err
+	}
+	query.Set("labels", string(labelsJson))
+	return a.Client.ImageBuild(*r.Ctx, buildContext, query, os.Stdout)
+}
+
+// Tars up the build dir, adding the generated dockerfile in place of any Dockerfile already there.
+func tarBuildContext(dir string, dockerfile []byte) (io.Reader, error) {
+	buf := &bytes.Buffer{}
+	tw := tar.NewWriter(buf)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(dir, path)
+		if err != nil || name == "." || name == "Dockerfile" {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(name)
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		_, err = io.Copy(tw, file)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	header := &tar.Header{Name: "Dockerfile", Mode: 0644, Size: int64(len(dockerfile)), ModTime: time.Now()}
+	if err := tw.WriteHeader(header); err != nil {
+		return nil, err
+	}
+	if _, err := tw.Write(dockerfile); err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (a *ApiRuntime) containerConfig(r *DockerRunner) (*ContainerConfig, error) {
+	hostConfig := &HostConfig{ShmSize: shmSize}
+	config := &ContainerConfig{
+		Hostname:     r.Hostname,
+		Cmd:          r.Cmd,
+		Image:        r.image(),
+		Labels:       map[string]string{},
+		ExposedPorts: map[string]struct{}{},
+		AttachStdout: !r.Detatch,
+		AttachStderr: !r.Detatch,
+		AttachStdin:  r.Stdin != nil,
+		OpenStdin:    r.Stdin != nil,
+		StdinOnce:    r.Stdin != nil,
+		HostConfig:   hostConfig,
+	}
+	// Order is important here, we add extra env after config's env to override anything set in env.
+	for _, e := range r.Config.EnvArray(true) {
+		config.Env = setEnv(config.Env, e)
+	}
+	for _, e := range r.ExtraEnv {
+		config.Env = setEnv(config.Env, e)
+	}
+	for k, v := range r.Config.Labels {
+		config.Labels[k] = v
+	}
+	if !r.SkipPorts {
+		for _, v := range r.Config.Expose {
+			if err := addPort(config, v, strings.Contains(v, ":")); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, v := range r.Config.Volumes {
+		hostConfig.Binds = append(hostConfig.Binds, v.Volume.Host+":"+v.Volume.Guest)
+	}
+	if a.Podman {
+		network, err := podmanNetwork(r)
+		if err != nil {
+			return nil, err
+		}
+		hostConfig.NetworkMode = network
+	} else {
+		for _, v := range r.Config.Links {
+			hostConfig.Links = append(hostConfig.Links, v.Link.Name+":"+v.Link.Alias)
+		}
+	}
+	if r.Restart {
+		hostConfig.RestartPolicy.Name = "always"
+	} else {
+		hostConfig.RestartPolicy.Name = "no"
+	}
+
+	// Docker args override settings above
+	if err := applyRunFlags(config, r.Config.DockerArgs()); err != nil {
+		return nil, err
+	}
+	if err := applyRunFlags(config, r.ExtraFlags); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func (a *ApiRuntime) Run(r *DockerRunner) error {
+	if r.DryRun {
+		// dry runs print the equivalent cli command
+		if a.Podman {
+			return NewPodmanRuntime().Run(r)
+		}
+		return NewDockerRuntime().Run(r)
+	}
+	ctx := *r.Ctx
+	config, err := a.containerConfig(r)
+	if err != nil {
+		return err
+	}
+	if a.Podman && config.HostConfig.NetworkMode == PodmanNetwork {
+		if err := a.ensureNetwork(ctx); err != nil {
+			return err
+		}
+	}
+	id, err := a.createContainer(ctx, r.ContainerId, config)
+	if err != nil {
+		return err
+	}
+	if r.Detatch {
+		return a.Client.ContainerStart(ctx, id)
+	}
+
+	// --rm is handled here rather than through auto remove, so the exit code can still be read once the container stops
+	if r.Rm {
+		defer func() {
+			runCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			a.Client.ContainerRemove(runCtx, id, true)
+			cancel()
+		}()
+	}
+	attachment, err := a.Client.ContainerAttach(ctx, id, r.Stdin)
+	if err != nil {
+		return err
+	}
+	defer attachment.Close()
+	return a.supervise(ctx, id, attachment, config.Tty)
+}
+
+func (a *ApiRuntime) ensureNetwork(ctx context.Context) error {
+	exists, err := a.Client.NetworkExists(ctx, PodmanNetwork)
+	if err != nil || exists {
+		return err
+	}
+	return a.Client.NetworkCreate(ctx, PodmanNetwork)
+}
+
+// Starts an attached container, streaming its output until it exits. Stops the container if ctx is cancelled.
+func (a *ApiRuntime) supervise(ctx context.Context, id string, attachment *Attachment, tty bool) error {
+	streamDone := make(chan error, 1)
+	go func() {
+		streamDone <- attachment.Stream(os.Stdout, os.Stderr, tty)
+	}()
+	if err := a.Client.ContainerStart(ctx, id); err != nil {
+		return err
+	}
+	select {
+	case <-streamDone:
+	case <-ctx.Done():
+		runCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		a.Client.ContainerStop(runCtx, id, 10)
+		cancel()
+	}
+	code, err := a.Client.ContainerWait(context.Background(), id, "not-running")
+	if err != nil {
+		return err
+	}
+	if code != 0 {
+		return &ExitError{Code: code}
+	}
+	return nil
+}
+
+// Creates a container, pulling its image first if it is not present, like docker run does.
+func (a *ApiRuntime) createContainer(ctx context.Context, name string, config *ContainerConfig) (string, error) {
+	id, err := a.Client.ContainerCreate(ctx, name, config)
+	if err == nil || !IsNotFound(err) {
+		return id, err
+	}
+	if err := a.Client.ImagePull(ctx, config.Image, os.Stdout); err != nil {
+		return "", err
+	}
+	return a.Client.ContainerCreate(ctx, name, config)
+}
+
+func (a *ApiRuntime) Commit(ctx context.Context, container string, image string, changes []string) error {
+	repo, tag := splitImageTag(image)
+	fmt.Fprintln(utils.Out, "committing "+container+" to "+image)
+	return a.Client.ContainerCommit(ctx, container, repo, tag, changes)
+}
+
+func (a *ApiRuntime) Start(ctx context.Context, container string, supervised bool) error {
+	if !supervised {
+		fmt.Fprintln(utils.Out, "starting "+container)
+		return a.Client.ContainerStart(ctx, container)
+	}
+	info, err := a.Client.ContainerInspect(ctx, container)
+	if err != nil {
+		return err
+	}
+	attachment, err := a.Client.ContainerAttach(ctx, container, nil)
+	if err != nil {
+		return err
+	}
+	defer attachment.Close()
+	return a.supervise(ctx, container, attachment, info.Config.Tty)
+}
+
+func (a *ApiRuntime) Stop(ctx context.Context, container string) error {
+	fmt.Fprintln(utils.Out, "stopping "+container)
+	return a.Client.ContainerStop(ctx, container, 600)
+}
+
+func (a *ApiRuntime) Remove(ctx context.Context, container string, force bool) error {
+	if !force {
+		fmt.Fprintln(utils.Out, "removing "+container)
+	}
+	return a.Client.ContainerRemove(ctx, container, force)
+}
+
+func (a *ApiRuntime) Enter(ctx context.Context, container string) error {
+	return errors.New("enter needs an interactive terminal, which requires the " + a.Name() + " cli. Rerun with --engine=cli")
+}
+
+func (a *ApiRuntime) Logs(ctx context.Context, container string) ([]byte, error) {
+	out := &bytes.Buffer{}
+	err := a.Client.ContainerLogs(ctx, container, out, out)
+	return out.Bytes(), err
+}
+
+func (a *ApiRuntime) Prune(ctx context.Context) error {
+	if err := a.Client.ContainersPrune(ctx, map[string][]string{"until": {"1h"}}); err != nil {
+		return err
+	}
+	// launcher's own tagged images are kept for rollback, and rotated out by rebuild instead
+	if err := a.Client.ImagesPrune(ctx, map[string][]string{"until": {"1h"}, "dangling": {"false"}, "label!": {utils.ConfigLabel}}); err != nil {
+		return err
+	}
+	return a.Client.ImagesPrune(ctx, map[string][]string{"until": {"1h"}, "dangling": {"true"}})
+}
+
+func (a *ApiRuntime) ContainerExists(container string) (bool, error) {
+	containers, err := a.Client.ContainerList(context.Background(), true, map[string][]string{"name": {nameFilter(container)}})
+	return len(containers) > 0, err
+}
+
+func (a *ApiRuntime) ContainerRunning(container string) (bool, error) {
+	containers, err := a.Client.ContainerList(context.Background(), false, map[string][]string{"name": {nameFilter(container)}})
+	return len(containers) > 0, err
+}
+
+func (a *ApiRuntime) InspectContainer(ctx context.Context, container string) (*ContainerStatus, error) {
+	info, err := a.Client.ContainerInspect(ctx, container)
+	if IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return info.status(), nil
+}
+
+func (a *ApiRuntime) InspectImage(ctx context.Context, image string) (*ImageStatus, error) {
+	info, err := a.Client.ImageInspect(ctx, image)
+	if IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return info.status(), nil
+}
+
+func (a *ApiRuntime) Rename(ctx context.Context, container string, name string) error {
+	fmt.Fprintln(utils.Out, "renaming "+container+" to "+name)
+	return a.Client.ContainerRename(ctx, container, name)
+}
+
+func (a *ApiRuntime) TagImage(ctx context.Context, image string, target string) error {
+	repo, tag := splitImageTag(target)
+	fmt.Fprintln(utils.Out, "tagging "+image+" as "+target)
+	return a.Client.ImageTag(ctx, image, repo, tag)
+}
+
+func (a *ApiRuntime) RemoveImage(ctx context.Context, image string) error {
+	fmt.Fprintln(utils.Out, "removing "+image)
+	return a.Client.ImageRemove(ctx, image)
+}
+
+func (a *ApiRuntime) Pull(ctx context.Context, image string) error {
+	return a.Client.ImagePull(ctx, image, os.Stdout)
+}
+
+func (a *ApiRuntime) Push(ctx context.Context, image string) error {
+	fmt.Fprintln(utils.Out, "pushing "+image)
+	return a.Client.ImagePush(ctx, image, os.Stdout)
+}
+
+func (a *ApiRuntime) ImageTags(ctx context.Context, repo string) ([]string, error) {
+	images, err := a.Client.ImageList(ctx, map[string][]string{"reference": {repo}})
+	if err != nil {
+		return nil, err
+	}
+	tags := []string{}
+	for _, image := range images {
+		for _, t := range image.RepoTags {
+			if tag, found := strings.CutPrefix(t, repo+":"); found {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return tags, nil
+}
+
+// Replaces or appends a KEY=value entry in an env list.
+// A bare KEY takes its value from the current environment, as the docker cli does.
+func setEnv(env []string, entry string) []string {
+	key, _, found := strings.Cut(entry, "=")
+	if !found {
+		value, ok := os.LookupEnv(key)
+		if !ok {
+			return env
+		}
+		entry = key + "=" + value
+	}
+	for i, e := range env {
+		if strings.HasPrefix(e, key+"=") {
+			env[i] = entry
+			return env
+		}
+	}
+	return append(env, entry)
+}
+
+// Adds a port spec, [ip:][hostPort:]containerPort[/protocol], to the exposed ports and optionally publishes it.
+func addPort(config *ContainerConfig, spec string, publish bool) error {
+	spec, protocol, found := strings.Cut(spec, "/")
+	if !found {
+		protocol = "tcp"
+	}
+	hostIp := ""
+	hostPort := ""
+	containerPort := spec
+	if i := strings.LastIndex(spec, ":"); i >= 0 {
+		containerPort = spec[i+1:]
+		hostPort = spec[:i]
+		if j := strings.LastIndex(hostPort, ":"); j >= 0 {
+			hostIp = strings.Trim(hostPort[:j], "[]")
+			hostPort = hostPort[j+1:]
+		}
+	}
+	if strings.Contains(containerPort, "-") || strings.Contains(hostPort, "-") {
+		return errors.New("port ranges are not supported by the engine api, use --engine=cli for " + spec)
+	}
+	if _, err := strconv.Atoi(containerPort); err != nil {
+		return errors.New("invalid port " + spec)
+	}
+	key := containerPort + "/" + protocol
+	config.ExposedPorts[key] = struct{}{}
+	if publish {
+		if config.HostConfig.PortBindings == nil {
+			config.HostConfig.PortBindings = map[string][]PortBinding{}
+		}
+		config.HostConfig.PortBindings[key] = append(config.HostConfig.PortBindings[key], PortBinding{HostIp: hostIp, HostPort: hostPort})
+	}
+	return nil
+}
+
+var supportedRunFlags = []string{
+	"-e", "--env",
+	"-l", "--label",
+	"-v", "--volume",
+	"--link",
+	"-p", "--publish",
+	"--expose",
+	"--add-host",
+	"--network", "--net",
+	"--restart",
+	"--shm-size",
+	"-h", "--hostname",
+}
+
+// Translates the subset of docker run flags commonly used in docker_args into engine api settings.
+func applyRunFlags(config *ContainerConfig, flags []string) error {
+	for i := 0; i < len(flags); i++ {
+		name, value, hasValue := strings.Cut(flags[i], "=")
+		switch name {
+		case "-i", "--interactive", "-d", "--detach":
+			// attaching and detaching is decided by the runner
+			continue
+		case "--rm":
+			config.HostConfig.AutoRemove = true
+			continue
+		}
+		if !strings.HasPrefix(name, "-") {
+			return errors.New("unexpected docker argument " + flags[i])
+		}
+		if !slices.Contains(supportedRunFlags, name) {
+			return fmt.Errorf("docker argument %s is not supported by the engine api, use --engine=cli", name)
+		}
+		if !hasValue {
+			if i+1 >= len(flags) {
+				return errors.New("docker argument " + name + " is missing a value")
+			}
+			i++
+			value = flags[i]
+		}
+		var err error
+		switch name {
+		case "-e", "--env":
+			config.Env = setEnv(config.Env, value)
+		case "-l", "--label":
+			k, v, _ := strings.Cut(value, "=")
+			config.Labels[k] = v
+		case "-v", "--volume":
+			config.HostConfig.Binds = append(config.HostConfig.Binds, value)
+		case "--link":
+			config.HostConfig.Links = append(config.HostConfig.Links, value)
+		case "-p", "--publish":
+			err = addPort(config, value, true)
+		case "--expose":
+			err = addPort(config, value, false)
+		case "--add-host":
+			config.HostConfig.ExtraHosts = append(config.HostConfig.ExtraHosts, value)
+		case "--network", "--net":
+			config.HostConfig.NetworkMode = value
+		case "--restart":
+			config.HostConfig.RestartPolicy.Name = value
+		case "--shm-size":
+			config.HostConfig.ShmSize, err = parseSize(value)
+		case "-h", "--hostname":
+			config.Hostname = value
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Parses docker style sizes: a number of bytes with an optional b, k, m, or g suffix.
+func parseSize(size string) (int64, error) {
+	multiplier := int64(1)
+	s := strings.TrimSuffix(strings.ToLower(size), "b")
+	switch {
+	case strings.HasSuffix(s, "k"):
+		multiplier = 1024
+	case strings.HasSuffix(s, "m"):
+		multiplier = 1024 * 1024
+	case strings.HasSuffix(s, "g"):
+		multiplier = 1024 * 1024 * 1024
+	}
+	value, err := strconv.ParseInt(strings.TrimRight(s, "kmg"), 10, 64)
+	if err != nil {
+		return 0, errors.New("invalid size " + size)
+	}
+	return value * multiplier, nil
+}
+
+// Splits an image reference into repository and tag. Tags come after the last colon following the last slash.
+func splitImageTag(image string) (string, string) {
+	i := strings.LastIndex(image, ":")
+	if i < 0 || strings.Contains(image[i:], "/") {
+		return image, ""
+	}
+	return image[:i], image[i+1:]
+}
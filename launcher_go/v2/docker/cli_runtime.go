@@ -0,0 +1,417 @@
+package docker
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Wing924/shellwords"
+	"github.com/discourse/discourse_docker/launcher_go/v2/utils"
+	"golang.org/x/sys/unix"
+	"os"
+	"os/exec"
+	"runtime"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Runs containers by shelling out to a docker compatible cli.
+type CliRuntime struct {
+	name string
+	// read on every call, so the binary can be swapped out after the runtime is created
+	path *string
+}
+
+func NewDockerRuntime() *CliRuntime {
+	return &CliRuntime{name: "docker", path: &utils.DockerPath}
+}
+
+func (c *CliRuntime) Name() string {
+	return c.name
+}
+
+// Platform builds go through buildx, which loads the multi-arch image into the local image store.
+// Several platforms need the containerd image store, so that is checked first.
+func (c *CliRuntime) Build(r *DockerBuilder) error {
+	if len(r.Platforms) > 1 {
+		containerd, err := c.containerdImageStore(*r.Ctx)
+		if err != nil {
+			return err
+		}
+		if !containerd {
+			return errors.New("docker's default image store can't hold multi-platform images, so " + strings.Join(r.Platforms, ",") + " can't be loaded into it. " +
+				"Enable the containerd image store (https://docs.docker.com/engine/storage/containerd/), or build and push one --platform at a time")
+		}
+	}
+	cmd := c.buildCmd(r)
+	if len(r.Platforms) > 0 {
+		cmd.Args = slices.Insert(cmd.Args, 1, "buildx")
+		cmd.Args = append(cmd.Args, "--platform", strings.Join(r.Platforms, ","), "--load")
+	}
+	cmd.Env = append(cmd.Env, "DOCKER_BUILDKIT=1", "BUILDKIT_PROGRESS=plain")
+	cmd.Args = append(cmd.Args, "-f")
+	cmd.Args = append(cmd.Args, "-")
+	cmd.Args = append(cmd.Args, ".")
+	cmd.Stdin = r.Stdin
+	return utils.CmdRunner(cmd).Run()
+}
+
+// Whether images are kept in the containerd image store, the only docker image store that holds multi-platform images.
+func (c *CliRuntime) containerdImageStore(ctx context.Context) (bool, error) {
+	cmd := exec.CommandContext(ctx, *c.path, "info", "--format", "{{json .DriverStatus}}")
+	output, err := utils.CmdRunner(cmd).Output()
+	if err != nil {
+		return false, err
+	}
+	return strings.Contains(string(output), "io.containerd.snapshotter"), nil
+}
+
+func (c *CliRuntime) BuildSecrets() bool {
+	return true
+}
+
+func (c *CliRuntime) buildCmd(r *DockerBuilder) *exec.Cmd {
+	cmd := exec.CommandContext(*r.Ctx, *c.path, "build")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return unix.Kill(-cmd.Process.Pid, unix.SIGINT)
+	}
+	cmd.Dir = r.Dir
+	// secrets are read from the cli's environment, and only mounted for the pups step
+	cmd.Env = r.Config.EnvArray(true)
+	for k, _ := range r.Config.Env {
+		if r.Config.IsSecret(k) {
+			continue
+		}
+		cmd.Args = append(cmd.Args, "--build-arg")
+		cmd.Args = append(cmd.Args, k)
+	}
+	for _, k := range r.Config.SecretKeys() {
+		cmd.Args = append(cmd.Args, "--secret")
+		cmd.Args = append(cmd.Args, "id="+k+",env="+k)
+	}
+	switch r.Cache {
+	case "", "none":
+		cmd.Args = append(cmd.Args, "--no-cache")
+	case "registry":
+		if c.name == "podman" {
+			// podman keeps cache as image layers in a repository
+			cmd.Args = append(cmd.Args, "--layers", "--cache-from", r.CacheRef, "--cache-to", r.CacheRef)
+		} else {
+			cmd.Args = append(cmd.Args, "--cache-from", "type=registry,ref="+r.CacheRef)
+			cmd.Args = append(cmd.Args, "--cache-to", "type=registry,ref="+r.CacheRef+",mode=max")
+		}
+	}
+	if !r.NoPull {
+		cmd.Args = append(cmd.Args, "--pull")
+	}
+	cmd.Args = append(cmd.Args, "--force-rm")
+	cmd.Args = append(cmd.Args, "-t")
+	cmd.Args = append(cmd.Args, r.imageName())
+	cmd.Args = append(cmd.Args, "--shm-size=512m")
+	for _, label := range r.labels() {
+		cmd.Args = append(cmd.Args, "--label")
+		cmd.Args = append(cmd.Args, label)
+	}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+func (c *CliRuntime) Run(r *DockerRunner) error {
+	linkArgs := []string{}
+	for _, v := range r.Config.Links {
+		linkArgs = append(linkArgs, "--link", v.Link.Name+":"+v.Link.Alias)
+	}
+	return c.run(r, linkArgs)
+}
+
+// Runs a container, with linkArgs in place of the config's links.
+func (c *CliRuntime) run(r *DockerRunner, linkArgs []string) error {
+	cmd := exec.CommandContext(*r.Ctx, *c.path, "run")
+
+	// Detatch signifies we do not want to supervise
+	if !r.Detatch {
+		c.superviseCmd(cmd, r.ContainerId)
+	}
+	cmd.Env = r.Config.EnvArray(true)
+
+	if r.DryRun {
+		// multi-line env doesn't work super great from CLI, but we can print out the rest.
+		// Secrets are never printed, they are passed by name instead.
+		for k, v := range r.Config.Env {
+			if r.Config.IsSecret(k) {
+				cmd.Args = append(cmd.Args, "--env")
+				cmd.Args = append(cmd.Args, k)
+			} else if !strings.Contains(v, "\n") {
+				cmd.Args = append(cmd.Args, "--env")
+				cmd.Args = append(cmd.Args, k+"="+shellwords.Escape(v))
+			}
+		}
+	} else {
+		for k, _ := range r.Config.Env {
+			cmd.Args = append(cmd.Args, "--env")
+			cmd.Args = append(cmd.Args, k)
+		}
+	}
+
+	// Order is important here, we add extra env after config's env to override anything set in env.
+	for _, e := range r.ExtraEnv {
+		cmd.Args = append(cmd.Args, "--env")
+		cmd.Args = append(cmd.Args, e)
+	}
+	for k, v := range r.Config.Labels {
+		cmd.Args = append(cmd.Args, "--label")
+		cmd.Args = append(cmd.Args, k+"="+v)
+	}
+	if !r.SkipPorts {
+		for _, v := range r.Config.Expose {
+			if strings.Contains(v, ":") {
+				cmd.Args = append(cmd.Args, "-p")
+				cmd.Args = append(cmd.Args, v)
+			} else {
+				cmd.Args = append(cmd.Args, "--expose")
+				cmd.Args = append(cmd.Args, v)
+			}
+		}
+	}
+	for _, v := range r.Config.Volumes {
+		cmd.Args = append(cmd.Args, "-v")
+		cmd.Args = append(cmd.Args, v.Volume.Host+":"+v.Volume.Guest)
+	}
+	cmd.Args = append(cmd.Args, linkArgs...)
+	cmd.Args = append(cmd.Args, "--shm-size=512m")
+	if r.Rm {
+		cmd.Args = append(cmd.Args, "--rm")
+	}
+	if r.Restart {
+		cmd.Args = append(cmd.Args, "--restart=always")
+	} else {
+		cmd.Args = append(cmd.Args, "--restart=no")
+	}
+	if r.Detatch {
+		cmd.Args = append(cmd.Args, "-d")
+	}
+	cmd.Args = append(cmd.Args, "-i")
+
+	// Docker args override settings above
+	for _, f := range r.Config.DockerArgs() {
+		cmd.Args = append(cmd.Args, f)
+	}
+	for _, f := range r.ExtraFlags {
+		cmd.Args = append(cmd.Args, f)
+	}
+	cmd.Args = append(cmd.Args, "-h")
+	cmd.Args = append(cmd.Args, r.Hostname)
+	cmd.Args = append(cmd.Args, "--name")
+	cmd.Args = append(cmd.Args, r.ContainerId)
+	cmd.Args = append(cmd.Args, r.image())
+
+	for _, c := range r.Cmd {
+		cmd.Args = append(cmd.Args, c)
+	}
+
+	if !r.Detatch {
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		cmd.Stdin = r.Stdin
+	}
+	runner := utils.CmdRunner(cmd)
+	if r.DryRun {
+		fmt.Fprintln(utils.Out, cmd)
+	} else {
+		if err := runner.Run(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Interrupts the whole process group when cmd's context is cancelled, so the attached container shuts down with it.
+func (c *CliRuntime) superviseCmd(cmd *exec.Cmd, container string) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		if runtime.GOOS == "darwin" {
+			runCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			stopCmd := exec.CommandContext(runCtx, *c.path, "stop", container)
+			utils.CmdRunner(stopCmd).Run()
+			cancel()
+		}
+		return unix.Kill(-cmd.Process.Pid, unix.SIGINT)
+	}
+}
+
+func (c *CliRuntime) Commit(ctx context.Context, container string, image string, changes []string) error {
+	cmd := exec.Command(*c.path, "commit")
+	for _, change := range changes {
+		cmd.Args = append(cmd.Args, "--change", change)
+	}
+	cmd.Args = append(cmd.Args, container, image)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	fmt.Fprintln(utils.Out, cmd)
+	return utils.CmdRunner(cmd).Run()
+}
+
+func (c *CliRuntime) Start(ctx context.Context, container string, supervised bool) error {
+	cmd := exec.CommandContext(ctx, *c.path, "start", container)
+	if supervised {
+		c.superviseCmd(cmd, container)
+		cmd.Args = append(cmd.Args, "--attach")
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+	}
+	fmt.Fprintln(utils.Out, cmd)
+	return utils.CmdRunner(cmd).Run()
+}
+
+func (c *CliRuntime) Stop(ctx context.Context, container string) error {
+	cmd := exec.CommandContext(ctx, *c.path, "stop", "-t", "600", container)
+	fmt.Fprintln(utils.Out, cmd)
+	return utils.CmdRunner(cmd).Run()
+}
+
+func (c *CliRuntime) Remove(ctx context.Context, container string, force bool) error {
+	if force {
+		cmd := exec.CommandContext(ctx, *c.path, "rm", "-f", container)
+		return utils.CmdRunner(cmd).Run()
+	}
+	cmd := exec.CommandContext(ctx, *c.path, "rm", container)
+	fmt.Fprintln(utils.Out, cmd)
+	return utils.CmdRunner(cmd).Run()
+}
+
+func (c *CliRuntime) Enter(ctx context.Context, container string) error {
+	cmd := exec.CommandContext(ctx, *c.path, "exec", "-it", container, "/bin/bash", "--login")
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return utils.CmdRunner(cmd).Run()
+}
+
+func (c *CliRuntime) Logs(ctx context.Context, container string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, *c.path, "logs", container)
+	return utils.CmdRunner(cmd).Output()
+}
+
+func (c *CliRuntime) Prune(ctx context.Context) error {
+	cmd := exec.CommandContext(ctx, *c.path, "container", "prune", "--filter", "until=1h")
+	if err := utils.CmdRunner(cmd).Run(); err != nil {
+		return err
+	}
+	// launcher's own tagged images are kept for rollback, and rotated out by rebuild instead
+	cmd = exec.CommandContext(ctx, *c.path, "image", "prune", "--all", "--filter", "until=1h", "--filter", "label!="+utils.ConfigLabel)
+	if err := utils.CmdRunner(cmd).Run(); err != nil {
+		return err
+	}
+	cmd = exec.CommandContext(ctx, *c.path, "image", "prune", "--filter", "until=1h")
+	return utils.CmdRunner(cmd).Run()
+}
+
+func (c *CliRuntime) Rename(ctx context.Context, container string, name string) error {
+	cmd := exec.CommandContext(ctx, *c.path, "rename", container, name)
+	fmt.Fprintln(utils.Out, cmd)
+	return utils.CmdRunner(cmd).Run()
+}
+
+func (c *CliRuntime) TagImage(ctx context.Context, image string, target string) error {
+	cmd := exec.CommandContext(ctx, *c.path, "tag", image, target)
+	fmt.Fprintln(utils.Out, cmd)
+	return utils.CmdRunner(cmd).Run()
+}
+
+func (c *CliRuntime) RemoveImage(ctx context.Context, image string) error {
+	cmd := exec.CommandContext(ctx, *c.path, "rmi", image)
+	fmt.Fprintln(utils.Out, cmd)
+	return utils.CmdRunner(cmd).Run()
+}
+
+func (c *CliRuntime) Pull(ctx context.Context, image string) error {
+	cmd := exec.CommandContext(ctx, *c.path, "pull", image)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	fmt.Fprintln(utils.Out, cmd)
+	return utils.CmdRunner(cmd).Run()
+}
+
+func (c *CliRuntime) Push(ctx context.Context, image string) error {
+	cmd := exec.CommandContext(ctx, *c.path, "push", image)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	fmt.Fprintln(utils.Out, cmd)
+	return utils.CmdRunner(cmd).Run()
+}
+
+func (c *CliRuntime) ImageTags(ctx context.Context, repo string) ([]string, error) {
+	cmd := exec.CommandContext(ctx, *c.path, "image", "ls", "--format", "{{.Tag}}", repo)
+	output, err := utils.CmdRunner(cmd).Output()
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(output)), nil
+}
+
+func (c *CliRuntime) ContainerExists(container string) (bool, error) {
+	return c.listContainers("ps", "-a", "-q", "--filter", "name="+nameFilter(container))
+}
+
+func (c *CliRuntime) ContainerRunning(container string) (bool, error) {
+	return c.listContainers("ps", "-q", "--filter", "name="+nameFilter(container))
+}
+
+func (c *CliRuntime) listContainers(args ...string) (bool, error) {
+	cmd := exec.Command(*c.path, args...)
+	result, err := utils.CmdRunner(cmd).Output()
+	if err != nil {
+		return false, err
+	}
+	return len(result) > 0, nil
+}
+
+func (c *CliRuntime) InspectContainer(ctx context.Context, container string) (*ContainerStatus, error) {
+	// podman reports the image reference as ImageName, docker as Config.Image
+	result := []struct {
+		ContainerInfo
+		ImageName string
+	}{}
+	if err := c.inspect(ctx, "container", container, &result); err != nil || len(result) == 0 {
+		return nil, err
+	}
+	status := result[0].status()
+	if status.ImageName == "" {
+		status.ImageName = result[0].ImageName
+	}
+	return status, nil
+}
+
+func (c *CliRuntime) InspectImage(ctx context.Context, image string) (*ImageStatus, error) {
+	result := []ImageInfo{}
+	if err := c.inspect(ctx, "image", image, &result); err != nil || len(result) == 0 {
+		return nil, err
+	}
+	return result[0].status(), nil
+}
+
+// Runs `inspect` for an object, decoding its json output into result. Leaves result empty when the object does not exist.
+func (c *CliRuntime) inspect(ctx context.Context, kind string, name string, result any) error {
+	cmd := exec.CommandContext(ctx, *c.path, kind, "inspect", name)
+	output, err := utils.CmdRunner(cmd).Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			stderr := strings.ToLower(string(exitErr.Stderr))
+			if strings.Contains(stderr, "no such") || strings.Contains(stderr, "not known") {
+				return nil
+			}
+			if len(exitErr.Stderr) > 0 {
+				return errors.New(strings.TrimSpace(string(exitErr.Stderr)))
+			}
+		}
+		return err
+	}
+	return json.Unmarshal(output, result)
+}
@@ -0,0 +1,602 @@
+package docker
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const ApiVersion = "v1.41"
+const DefaultDockerHost = "unix:///var/run/docker.sock"
+
+// Minimal Docker Engine API client, covering what launcher needs to build, run, and inspect containers
+// without shelling out to the docker cli.
+type Client struct {
+	network string
+	address string
+	http    *http.Client
+}
+
+// An error response from the engine.
+type ApiError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *ApiError) Error() string {
+	return "docker engine: " + e.Message
+}
+
+func IsNotFound(err error) bool {
+	var apiErr *ApiError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+// Returned when a container exits with a non-zero status.
+// Mirrors exec.ExitError so callers can check exit codes the same way for either engine.
+type ExitError struct {
+	Code int
+}
+
+func (e *ExitError) Error() string {
+	return "container exited with status " + strconv.Itoa(e.Code)
+}
+
+func (e *ExitError) ExitCode() int {
+	return e.Code
+}
+
+type PortBinding struct {
+	HostIp   string `json:",omitempty"`
+	HostPort string `json:",omitempty"`
+}
+
+type RestartPolicy struct {
+	Name string `json:",omitempty"`
+}
+
+type HostConfig struct {
+	Binds         []string                 `json:",omitempty"`
+	Links         []string                 `json:",omitempty"`
+	PortBindings  map[string][]PortBinding `json:",omitempty"`
+	ExtraHosts    []string                 `json:",omitempty"`
+	NetworkMode   string                   `json:",omitempty"`
+	ShmSize       int64                    `json:",omitempty"`
+	AutoRemove    bool                     `json:",omitempty"`
+	RestartPolicy RestartPolicy            `json:",omitempty"`
+}
+
+type ContainerConfig struct {
+	Hostname     string              `json:",omitempty"`
+	Env          []string            `json:",omitempty"`
+	Cmd          []string            `json:",omitempty"`
+	Image        string              `json:",omitempty"`
+	Labels       map[string]string   `json:",omitempty"`
+	ExposedPorts map[string]struct{} `json:",omitempty"`
+	AttachStdin  bool                `json:",omitempty"`
+	AttachStdout bool                `json:",omitempty"`
+	AttachStderr bool                `json:",omitempty"`
+	OpenStdin    bool                `json:",omitempty"`
+	StdinOnce    bool                `json:",omitempty"`
+	Tty          bool                `json:",omitempty"`
+	HostConfig   *HostConfig         `json:",omitempty"`
+}
+
+type ContainerSummary struct {
+	Id     string
+	Names  []string
+	Image  string
+	State  string
+	Status string
+}
+
+type ImageSummary struct {
+	Id       string
+	RepoTags []string
+	Created  int64
+}
+
+type ContainerState struct {
+	Status     string
+	Running    bool
+	Restarting bool
+	ExitCode   int
+	StartedAt  string
+	FinishedAt string
+}
+
+type ContainerInfo struct {
+	Id           string
+	Name         string
+	Created      string
+	Image        string
+	RestartCount int
+	State        ContainerState
+	Config       ContainerConfig
+}
+
+type ImageInfo struct {
+	Id      string
+	Created string
+	Config  ContainerConfig
+}
+
+// Creates a client for the engine at host, eg unix:///var/run/docker.sock or tcp://127.0.0.1:2375.
+// An empty host uses DOCKER_HOST, falling back to the default docker socket.
+func NewClient(host string) (*Client, error) {
+	if host == "" {
+		host = os.Getenv("DOCKER_HOST")
+	}
+	if host == "" {
+		host = DefaultDockerHost
+	}
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, fmt.Errorf("invalid docker host %s: %w", host, err)
+	}
+	client := &Client{}
+	switch u.Scheme {
+	case "unix":
+		client.network = "unix"
+		client.address = u.Path
+	case "tcp", "http":
+		client.network = "tcp"
+		client.address = u.Host
+	default:
+		return nil, errors.New("unsupported docker host " + host + ", only unix:// and tcp:// hosts are supported")
+	}
+	client.http = &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return client.dial(ctx)
+			},
+		},
+	}
+	return client, nil
+}
+
+func (c *Client) dial(ctx context.Context) (net.Conn, error) {
+	dialer := net.Dialer{}
+	return dialer.DialContext(ctx, c.network, c.address)
+}
+
+func (c *Client) url(path string, query url.Values) string {
+	u := "http://docker/" + ApiVersion + path
+	if len(query) > 0 {
+		u = u + "?" + query.Encode()
+	}
+	return u
+}
+
+func (c *Client) do(ctx context.Context, method string, path string, query url.Values, body io.Reader, contentType string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.url(path, query), body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	return c.send(req)
+}
+
+func (c *Client) send(req *http.Request) (*http.Response, error) {
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		defer resp.Body.Close()
+		return nil, decodeError(resp)
+	}
+	return resp, nil
+}
+
+func decodeError(resp *http.Response) error {
+	body, _ := io.ReadAll(resp.Body)
+	message := struct{ Message string }{}
+	if err := json.Unmarshal(body, &message); err != nil || message.Message == "" {
+		message.Message = strings.TrimSpace(string(body))
+	}
+	if message.Message == "" {
+		message.Message = resp.Status
+	}
+	return &ApiError{StatusCode: resp.StatusCode, Message: message.Message}
+}
+
+// Sends in as a json body when non-nil, and decodes the json response into out when non-nil.
+func (c *Client) doJson(ctx context.Context, method string, path string, query url.Values, in any, out any) error {
+	var body io.Reader
+	contentType := ""
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+		contentType = "application/json"
+	}
+	resp, err := c.do(ctx, method, path, query, body, contentType)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func filtersQuery(query url.Values, filters map[string][]string) {
+	if len(filters) == 0 {
+		return
+	}
+	b, _ := json.Marshal(filters)
+	query.Set("filters", string(b))
+}
+
+func (c *Client) Ping(ctx context.Context) error {
+	resp, err := c.do(ctx, http.MethodGet, "/_ping", nil, nil, "")
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (c *Client) ContainerList(ctx context.Context, all bool, filters map[string][]string) ([]ContainerSummary, error) {
+	query := url.Values{}
+	if all {
+		query.Set("all", "1")
+	}
+	filtersQuery(query, filters)
+	result := []ContainerSummary{}
+	err := c.doJson(ctx, http.MethodGet, "/containers/json", query, nil, &result)
+	return result, err
+}
+
+func (c *Client) ContainerInspect(ctx context.Context, id string) (*ContainerInfo, error) {
+	result := &ContainerInfo{}
+	if err := c.doJson(ctx, http.MethodGet, "/containers/"+id+"/json", nil, nil, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (c *Client) ImageInspect(ctx context.Context, image string) (*ImageInfo, error) {
+	result := &ImageInfo{}
+	if err := c.doJson(ctx, http.MethodGet, "/images/"+image+"/json", nil, nil, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Creates a container and returns its id. An empty name lets the engine pick one.
+func (c *Client) ContainerCreate(ctx context.Context, name string, config *ContainerConfig) (string, error) {
+	query := url.Values{}
+	if name != "" {
+		query.Set("name", name)
+	}
+	result := struct{ Id string }{}
+	if err := c.doJson(ctx, http.MethodPost, "/containers/create", query, config, &result); err != nil {
+		return "", err
+	}
+	return result.Id, nil
+}
+
+func (c *Client) ContainerRename(ctx context.Context, id string, name string) error {
+	query := url.Values{}
+	query.Set("name", name)
+	return c.doJson(ctx, http.MethodPost, "/containers/"+id+"/rename", query, nil, nil)
+}
+
+func (c *Client) ContainerStart(ctx context.Context, id string) error {
+	return c.doJson(ctx, http.MethodPost, "/containers/"+id+"/start", nil, nil, nil)
+}
+
+func (c *Client) ContainerStop(ctx context.Context, id string, timeout int) error {
+	query := url.Values{}
+	query.Set("t", strconv.Itoa(timeout))
+	return c.doJson(ctx, http.MethodPost, "/containers/"+id+"/stop", query, nil, nil)
+}
+
+func (c *Client) ContainerRemove(ctx context.Context, id string, force bool) error {
+	query := url.Values{}
+	if force {
+		query.Set("force", "1")
+	}
+	return c.doJson(ctx, http.MethodDelete, "/containers/"+id, query, nil, nil)
+}
+
+// Blocks until the container reaches condition (not-running, next-exit, or removed), returning its exit code.
+func (c *Client) ContainerWait(ctx context.Context, id string, condition string) (int, error) {
+	query := url.Values{}
+	if condition != "" {
+		query.Set("condition", condition)
+	}
+	result := struct {
+		StatusCode int
+		Error      *struct{ Message string }
+	}{}
+	if err := c.doJson(ctx, http.MethodPost, "/containers/"+id+"/wait", query, nil, &result); err != nil {
+		return -1, err
+	}
+	if result.Error != nil && result.Error.Message != "" {
+		return result.StatusCode, errors.New(result.Error.Message)
+	}
+	return result.StatusCode, nil
+}
+
+// Copies container logs to stdout and stderr.
+func (c *Client) ContainerLogs(ctx context.Context, id string, stdout io.Writer, stderr io.Writer) error {
+	info, err := c.ContainerInspect(ctx, id)
+	if err != nil {
+		return err
+	}
+	query := url.Values{}
+	query.Set("stdout", "1")
+	query.Set("stderr", "1")
+	resp, err := c.do(ctx, http.MethodGet, "/containers/"+id+"/logs", query, nil, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if info.Config.Tty {
+		_, err = io.Copy(stdout, resp.Body)
+		return err
+	}
+	return demuxStream(resp.Body, stdout, stderr)
+}
+
+// Commits a container to repo:tag, applying Dockerfile instructions in changes.
+func (c *Client) ContainerCommit(ctx context.Context, id string, repo string, tag string, changes []string) error {
+	query := url.Values{}
+	query.Set("container", id)
+	query.Set("repo", repo)
+	if tag != "" {
+		query.Set("tag", tag)
+	}
+	for _, change := range changes {
+		query.Add("changes", change)
+	}
+	return c.doJson(ctx, http.MethodPost, "/commit", query, nil, nil)
+}
+
+func (c *Client) ContainersPrune(ctx context.Context, filters map[string][]string) error {
+	query := url.Values{}
+	filtersQuery(query, filters)
+	return c.doJson(ctx, http.MethodPost, "/containers/prune", query, nil, nil)
+}
+
+func (c *Client) ImagesPrune(ctx context.Context, filters map[string][]string) error {
+	query := url.Values{}
+	filtersQuery(query, filters)
+	return c.doJson(ctx, http.MethodPost, "/images/prune", query, nil, nil)
+}
+
+func (c *Client) ImageList(ctx context.Context, filters map[string][]string) ([]ImageSummary, error) {
+	query := url.Values{}
+	filtersQuery(query, filters)
+	result := []ImageSummary{}
+	err := c.doJson(ctx, http.MethodGet, "/images/json", query, nil, &result)
+	return result, err
+}
+
+// Tags image as repo:tag.
+func (c *Client) ImageTag(ctx context.Context, image string, repo string, tag string) error {
+	query := url.Values{}
+	query.Set("repo", repo)
+	query.Set("tag", tag)
+	return c.doJson(ctx, http.MethodPost, "/images/"+image+"/tag", query, nil, nil)
+}
+
+// Removes an image reference, deleting the image once no tags are left.
+func (c *Client) ImageRemove(ctx context.Context, image string) error {
+	return c.doJson(ctx, http.MethodDelete, "/images/"+image, nil, nil, nil)
+}
+
+// Returns whether a network exists.
+func (c *Client) NetworkExists(ctx context.Context, name string) (bool, error) {
+	err := c.doJson(ctx, http.MethodGet, "/networks/"+name, nil, nil, nil)
+	if IsNotFound(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (c *Client) NetworkCreate(ctx context.Context, name string) error {
+	return c.doJson(ctx, http.MethodPost, "/networks/create", nil, map[string]string{"Name": name}, nil)
+}
+
+// Builds an image from a tar build context, streaming build output to out.
+func (c *Client) ImageBuild(ctx context.Context, buildContext io.Reader, query url.Values, out io.Writer) error {
+	resp, err := c.do(ctx, http.MethodPost, "/build", query, buildContext, "application/x-tar")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return decodeJsonMessages(resp.Body, out)
+}
+
+// Pulls an image, streaming progress to out. Images without a tag pull latest.
+// Uses the login docker or podman stored for the image's registry, if any.
+func (c *Client) ImagePull(ctx context.Context, image string, out io.Writer) error {
+	repo, tag := splitImageTag(image)
+	if name, digest, found := strings.Cut(image, "@"); found {
+		repo, tag = name, digest
+	}
+	if tag == "" {
+		tag = "latest"
+	}
+	query := url.Values{}
+	query.Set("fromImage", repo)
+	query.Set("tag", tag)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url("/images/create", query), nil)
+	if err != nil {
+		return err
+	}
+	auth, err := registryAuth(repo)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Registry-Auth", auth)
+	resp, err := c.send(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return decodeJsonMessages(resp.Body, out)
+}
+
+// Pushes an image to its registry, streaming progress to out.
+// Uses the login docker or podman stored for the image's registry, if any.
+func (c *Client) ImagePush(ctx context.Context, image string, out io.Writer) error {
+	repo, tag := splitImageTag(image)
+	if tag == "" {
+		tag = "latest"
+	}
+	query := url.Values{}
+	query.Set("tag", tag)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url("/images/"+repo+"/push", query), nil)
+	if err != nil {
+		return err
+	}
+	// the engine requires auth on every push, an empty auth config is anonymous
+	auth, err := registryAuth(repo)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Registry-Auth", auth)
+	resp, err := c.send(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return decodeJsonMessages(resp.Body, out)
+}
+
+// Builds, pulls, and pushes stream a series of json messages, with any failure reported in the stream itself.
+func decodeJsonMessages(r io.Reader, out io.Writer) error {
+	decoder := json.NewDecoder(r)
+	for {
+		message := struct {
+			Stream string
+			Status string
+			Error  string
+		}{}
+		if err := decoder.Decode(&message); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		if message.Error != "" {
+			return errors.New(strings.TrimSpace(message.Error))
+		}
+		if message.Stream != "" {
+			fmt.Fprint(out, message.Stream)
+		} else if message.Status != "" {
+			fmt.Fprintln(out, message.Status)
+		}
+	}
+}
+
+// A hijacked connection attached to a container's stdio.
+type Attachment struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	stdin  io.Reader
+}
+
+// Attaches to the container's stdio. Attach before starting the container so no output is lost.
+func (c *Client) ContainerAttach(ctx context.Context, id string, stdin io.Reader) (*Attachment, error) {
+	conn, err := c.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	query := url.Values{}
+	query.Set("stream", "1")
+	query.Set("stdout", "1")
+	query.Set("stderr", "1")
+	if stdin != nil {
+		query.Set("stdin", "1")
+	}
+	req, err := http.NewRequest(http.MethodPost, c.url("/containers/"+id+"/attach", query), nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "tcp")
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols && resp.StatusCode != http.StatusOK {
+		defer conn.Close()
+		return nil, decodeError(resp)
+	}
+	return &Attachment{conn: conn, reader: reader, stdin: stdin}, nil
+}
+
+// Sends stdin to the container, and copies container output until the container closes the stream.
+func (a *Attachment) Stream(stdout io.Writer, stderr io.Writer, tty bool) error {
+	if a.stdin != nil {
+		go func() {
+			io.Copy(a.conn, a.stdin)
+			if closer, ok := a.conn.(interface{ CloseWrite() error }); ok {
+				closer.CloseWrite()
+			}
+		}()
+	}
+	if tty {
+		_, err := io.Copy(stdout, a.reader)
+		return err
+	}
+	return demuxStream(a.reader, stdout, stderr)
+}
+
+func (a *Attachment) Close() error {
+	return a.conn.Close()
+}
+
+// Splits the multiplexed stream docker uses for non-tty containers: each frame is an 8 byte header
+// holding the stream type and payload size, followed by the payload.
+func demuxStream(r io.Reader, stdout io.Writer, stderr io.Writer) error {
+	header := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, header); err != nil {
+			if err == io.EOF || errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		w := stdout
+		if header[0] == 2 {
+			w = stderr
+		}
+		if w == nil {
+			w = io.Discard
+		}
+		size := binary.BigEndian.Uint32(header[4:])
+		if _, err := io.CopyN(w, r, int64(size)); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package docker_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/discourse/discourse_docker/launcher_go/v2/config"
+	"github.com/discourse/discourse_docker/launcher_go/v2/docker"
+	. "github.com/discourse/discourse_docker/launcher_go/v2/test_utils"
+	"github.com/discourse/discourse_docker/launcher_go/v2/utils"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+var _ = Describe("Engine API", func() {
+	var api *FakeDockerApi
+	var conf *config.Config
+	var ctx context.Context
+	var testDir string
+
+	BeforeEach(func() {
+		utils.Out = &bytes.Buffer{}
+		utils.CommitWait = 0
+		utils.CmdRunner = CreateNewFakeCmdRunner()
+		api = NewFakeDockerApi()
+		client, err := docker.NewClient(api.Host())
+		Expect(err).To(BeNil())
+		docker.ActiveRuntime = &docker.ApiRuntime{Client: client}
+		conf, _ = config.LoadConfig("../test/containers", "test", true, "../test")
+		ctx = context.Background()
+		testDir, _ = os.MkdirTemp("", "ddocker-test")
+	})
+	AfterEach(func() {
+		docker.ActiveRuntime = docker.NewDockerRuntime()
+		api.Close()
+		os.RemoveAll(testDir)
+		// nothing should have shelled out to the docker cli
+		Expect(RanCmds).To(BeEmpty())
+	})
+
+	It("rejects unsupported docker hosts", func() {
+		_, err := docker.NewClient("ssh://user@host")
+		Expect(err).To(MatchError(ContainSubstring("unsupported docker host")))
+	})
+
+	It("builds images with a tarred build context", func() {
+		conf.WriteYamlConfig(testDir)
+		builder := docker.DockerBuilder{
+			Config: conf,
+			Ctx:    &ctx,
+			Stdin:  strings.NewReader("FROM discourse/base\n"),
+			Dir:    testDir,
+		}
+		Expect(builder.Run()).To(Succeed())
+		request := api.LastRequest("POST", "/build")
+		Expect(request).ToNot(BeNil())
+		Expect(request.Query.Get("t")).To(Equal("local_discourse/test:latest"))
+		Expect(request.Query.Get("nocache")).To(Equal("1"))
+		Expect(request.Query.Get("pull")).To(Equal("1"))
+		buildArgs := map[string]string{}
+		json.Unmarshal([]byte(request.Query.Get("buildargs")), &buildArgs)
+		Expect(buildArgs).To(HaveKeyWithValue("LANG", "en_US.UTF-8"))
+		// secrets are excluded from the build
+		Expect(buildArgs).ToNot(HaveKey("DISCOURSE_DB_PASSWORD"))
+
+		files := map[string]string{}
+		tr := tar.NewReader(bytes.NewReader(request.Body))
+		for header, err := tr.Next(); err == nil; header, err = tr.Next() {
+			content, _ := io.ReadAll(tr)
+			files[header.Name] = string(content)
+		}
+		Expect(files).To(HaveKeyWithValue("Dockerfile", "FROM discourse/base\n"))
+		Expect(files["config.yaml"]).To(ContainSubstring("LANG: en_US.UTF-8"))
+		Expect(files["config.yaml"]).ToNot(ContainSubstring("DISCOURSE_DB_PASSWORD"))
+	})
+
+	It("builds a single platform", func() {
+		builder := docker.DockerBuilder{Config: conf, Ctx: &ctx, Stdin: strings.NewReader("FROM discourse/base:aarch64\n"), Dir: testDir, Platforms: []string{"linux/arm64"}}
+		Expect(builder.Run()).To(Succeed())
+		Expect(api.LastRequest("POST", "/build").Query.Get("platform")).To(Equal("linux/arm64"))
+
+		builder = docker.DockerBuilder{Config: conf, Ctx: &ctx, Stdin: strings.NewReader("FROM discourse/base\n"), Dir: testDir, Platforms: []string{"linux/amd64", "linux/arm64"}}
+		Expect(builder.Run()).To(MatchError(ContainSubstring("the engine api can only build one platform at a time")))
+		Expect(api.Calls()).To(HaveLen(1))
+	})
+
+	It("builds with a cache, reading registry cache without writing it", func() {
+		conf.WriteYamlConfig(testDir)
+		builder := docker.DockerBuilder{
+			Config:   conf,
+			Ctx:      &ctx,
+			Stdin:    strings.NewReader("FROM discourse/base\n"),
+			Dir:      testDir,
+			Cache:    "registry",
+			CacheRef: "ghcr.io/example/cache",
+			NoPull:   true,
+		}
+		Expect(builder.Run()).To(Succeed())
+		request := api.LastRequest("POST", "/build")
+		Expect(request.Query.Has("nocache")).To(BeFalse())
+		Expect(request.Query.Has("pull")).To(BeFalse())
+		Expect(request.Query.Get("cachefrom")).To(Equal(`["ghcr.io/example/cache"]`))
+	})
+
+	It("returns build failures reported in the build stream", func() {
+		api.Handle("POST", "/build", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"stream":"Step 1/2\n"}` + "\n" + `{"errorDetail":{"message":"pups failed"},"error":"pups failed"}`))
+		})
+		builder := docker.DockerBuilder{Config: conf, Ctx: &ctx, Stdin: strings.NewReader(""), Dir: testDir}
+		Expect(builder.Run()).To(MatchError("pups failed"))
+	})
+
+	It("runs pups through an attached container, then commits and removes it", func() {
+		runner := docker.DockerPupsRunner{
+			Config:         conf,
+			PupsArgs:       "--tags=db,precompile",
+			SavedImageName: "local_discourse/test:latest",
+			ExtraEnv:       []string{"SKIP_EMBER_CLI_COMPILE=1", "LANG=C"},
+			Ctx:            &ctx,
+			ContainerId:    "discourse-build-123",
+		}
+		Expect(runner.Run()).To(Succeed())
+		Expect(api.Calls()).To(Equal([]string{
+			"POST /containers/create",
+			"POST /containers/fake-container-id/attach",
+			"POST /containers/fake-container-id/start",
+			"POST /containers/fake-container-id/wait",
+			"POST /commit",
+			"DELETE /containers/discourse-build-123",
+		}))
+
+		create := api.LastRequest("POST", "/containers/create")
+		Expect(create.Query.Get("name")).To(Equal("discourse-build-123"))
+		containerConfig := docker.ContainerConfig{}
+		Expect(json.Unmarshal(create.Body, &containerConfig)).To(Succeed())
+		Expect(containerConfig.Image).To(Equal("local_discourse/test"))
+		Expect(containerConfig.Cmd).To(Equal([]string{"/bin/bash", "-c", "/usr/local/bin/pups --stdin --tags=db,precompile"}))
+		Expect(containerConfig.OpenStdin).To(BeTrue())
+		// the run gets secrets, and extra env overrides config env
+		Expect(containerConfig.Env).To(ContainElements("DISCOURSE_DB_PASSWORD=SOME_SECRET", "SKIP_EMBER_CLI_COMPILE=1", "LANG=C"))
+		Expect(containerConfig.Env).ToNot(ContainElement("LANG=en_US.UTF-8"))
+		// pups runs don't need to expose ports
+		Expect(containerConfig.HostConfig.PortBindings).To(BeEmpty())
+		Expect(containerConfig.HostConfig.Links).To(Equal([]string{"data:data"}))
+		Expect(containerConfig.HostConfig.ShmSize).To(Equal(int64(512 * 1024 * 1024)))
+
+		// the pups config is sent over stdin
+		Expect(string(api.Stdin)).To(ContainSubstring("path: /etc/service/nginx/run"))
+
+		commit := api.LastRequest("POST", "/commit")
+		Expect(commit.Query.Get("container")).To(Equal("discourse-build-123"))
+		Expect(commit.Query.Get("repo")).To(Equal("local_discourse/test"))
+		Expect(commit.Query.Get("tag")).To(Equal("latest"))
+		Expect(commit.Query["changes"]).To(ContainElement("CMD [\"/sbin/boot\"]"))
+		Expect(api.LastRequest("DELETE", "/containers/discourse-build-123").Query.Get("force")).To(Equal("1"))
+	})
+
+	It("starts detached containers with published ports and docker args", func() {
+		runner := docker.DockerRunner{
+			Config:      conf,
+			Ctx:         &ctx,
+			ContainerId: "test",
+			Restart:     true,
+			Detatch:     true,
+			Hostname:    "test-host",
+			Cmd:         []string{"/sbin/boot"},
+		}
+		Expect(runner.Run()).To(Succeed())
+		Expect(api.Calls()).To(Equal([]string{"POST /containers/create", "POST /containers/fake-container-id/start"}))
+		containerConfig := docker.ContainerConfig{}
+		json.Unmarshal(api.LastRequest("POST", "/containers/create").Body, &containerConfig)
+		Expect(containerConfig.Hostname).To(Equal("test-host"))
+		Expect(containerConfig.HostConfig.RestartPolicy.Name).To(Equal("always"))
+		Expect(containerConfig.HostConfig.PortBindings).To(HaveKeyWithValue("80/tcp", []docker.PortBinding{{HostPort: "80"}}))
+		// expose-only ports, including the config's --expose docker arg
+		Expect(containerConfig.ExposedPorts).To(HaveKey("90/tcp"))
+		Expect(containerConfig.ExposedPorts).To(HaveKey("100/tcp"))
+		Expect(containerConfig.HostConfig.PortBindings).ToNot(HaveKey("90/tcp"))
+	})
+
+	It("fails clearly on docker args the engine api can't translate", func() {
+		runner := docker.DockerRunner{Config: conf, Ctx: &ctx, Detatch: true, ExtraFlags: []string{"--privileged"}}
+		Expect(runner.Run()).To(MatchError(ContainSubstring("docker argument --privileged is not supported by the engine api")))
+		Expect(api.Calls()).To(BeEmpty())
+	})
+
+	It("returns the container's exit code", func() {
+		api.ExitCode = 77
+		runner := docker.DockerRunner{Config: conf, Ctx: &ctx, Rm: true, Cmd: []string{"false"}}
+		err := runner.Run()
+		var exitErr interface{ ExitCode() int }
+		Expect(errors.As(err, &exitErr)).To(BeTrue())
+		Expect(exitErr.ExitCode()).To(Equal(77))
+		// --rm containers are still cleaned up
+		Expect(api.Calls()).To(ContainElement("DELETE /containers/fake-container-id"))
+	})
+
+	It("returns engine error messages", func() {
+		api.Handle("POST", "/containers/create", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(`{"message":"Conflict. The container name \"/test\" is already in use"}`))
+		})
+		runner := docker.DockerRunner{Config: conf, Ctx: &ctx, ContainerId: "test", Detatch: true}
+		Expect(runner.Run()).To(MatchError("docker engine: Conflict. The container name \"/test\" is already in use"))
+	})
+
+	It("pulls missing images before creating containers", func() {
+		created := false
+		api.Handle("POST", "/containers/create", func(w http.ResponseWriter, r *http.Request) {
+			if !created {
+				created = true
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"message":"No such image: discourse/base:2.0"}`))
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"Id":"fake-container-id"}`))
+		})
+		runner := docker.DockerRunner{Config: conf, Ctx: &ctx, Detatch: true, CustomImage: "discourse/base:2.0"}
+		Expect(runner.Run()).To(Succeed())
+		pull := api.LastRequest("POST", "/images/create")
+		Expect(pull.Query.Get("fromImage")).To(Equal("discourse/base"))
+		Expect(pull.Query.Get("tag")).To(Equal("2.0"))
+	})
+
+	It("checks container existence with a name filter", func() {
+		exists, err := docker.ContainerExists("test")
+		Expect(err).To(BeNil())
+		Expect(exists).To(BeFalse())
+		request := api.LastRequest("GET", "/containers/json")
+		Expect(request.Query.Get("all")).To(Equal("1"))
+		Expect(request.Query.Get("filters")).To(Equal(`{"name":["^/?test$"]}`))
+
+		api.Containers = []map[string]any{{"Id": "abc", "Names": []string{"/test"}}}
+		running, err := docker.ContainerRunning("test")
+		Expect(err).To(BeNil())
+		Expect(running).To(BeTrue())
+		Expect(api.LastRequest("GET", "/containers/json").Query.Get("all")).To(Equal(""))
+	})
+
+	It("demultiplexes container logs", func() {
+		api.Output = "started unicorn\n"
+		logs, err := docker.ContainerLogs(ctx, "test")
+		Expect(err).To(BeNil())
+		Expect(string(logs)).To(Equal("started unicorn\n"))
+	})
+
+	It("stops and removes containers", func() {
+		Expect(docker.StopContainer(ctx, "test")).To(Succeed())
+		Expect(docker.RemoveContainer(ctx, "test")).To(Succeed())
+		Expect(api.Calls()).To(Equal([]string{"POST /containers/test/stop", "DELETE /containers/test"}))
+		Expect(api.LastRequest("POST", "/containers/test/stop").Query.Get("t")).To(Equal("600"))
+	})
+})
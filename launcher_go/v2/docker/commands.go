@@ -2,60 +2,58 @@ package docker
 
 import (
 	"context"
-	"fmt"
-	"github.com/Wing924/shellwords"
 	"github.com/discourse/discourse_docker/launcher_go/v2/config"
 	"github.com/discourse/discourse_docker/launcher_go/v2/utils"
-	"golang.org/x/sys/unix"
 	"io"
-	"os"
-	"os/exec"
-	"runtime"
+	"slices"
 	"strings"
-	"syscall"
 	"time"
 )
 
+// docker run and build use a 512m shm, which discourse needs for chrome during asset precompile
+const shmSize = 512 * 1024 * 1024
+
 type DockerBuilder struct {
 	Config   *config.Config
 	Ctx      *context.Context
 	Stdin    io.Reader
 	Dir      string
 	ImageTag string
+	// Labels set on the image, in addition to the config label
+	Labels map[string]string
+	// One of config.BuildCacheModes, none when empty. registry mode keeps the cache at CacheRef.
+	Cache    string
+	CacheRef string
+	// Build from the local base image instead of pulling it
+	NoPull bool
+	// Platforms to build for, eg. linux/arm64. Builds for the host's platform when empty.
+	// Multiple platforms produce a multi-arch manifest under the image name.
+	Platforms []string
+}
+
+// The config label, and any extra labels, sorted by key.
+func (r *DockerBuilder) labels() []string {
+	labels := []string{utils.ConfigLabel + "=" + r.Config.Name}
+	keys := []string{}
+	for k := range r.Labels {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		labels = append(labels, k+"="+r.Labels[k])
+	}
+	return labels
+}
+
+func (r *DockerBuilder) imageName() string {
+	return utils.BaseImageName + r.Config.Name + ":" + r.ImageTag
 }
 
 func (r *DockerBuilder) Run() error {
 	if r.ImageTag == "" {
 		r.ImageTag = "latest"
 	}
-	cmd := exec.CommandContext(*r.Ctx, utils.DockerPath, "build")
-	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
-	cmd.Cancel = func() error {
-		return unix.Kill(-cmd.Process.Pid, unix.SIGINT)
-	}
-	cmd.Dir = r.Dir
-	cmd.Env = r.Config.EnvArray(false)
-	cmd.Env = append(cmd.Env, "BUILDKIT_PROGRESS=plain")
-	for k, _ := range r.Config.Env {
-		cmd.Args = append(cmd.Args, "--build-arg")
-		cmd.Args = append(cmd.Args, k)
-	}
-	cmd.Args = append(cmd.Args, "--no-cache")
-	cmd.Args = append(cmd.Args, "--pull")
-	cmd.Args = append(cmd.Args, "--force-rm")
-	cmd.Args = append(cmd.Args, "-t")
-	cmd.Args = append(cmd.Args, utils.BaseImageName+r.Config.Name+":"+r.ImageTag)
-	cmd.Args = append(cmd.Args, "--shm-size=512m")
-	cmd.Args = append(cmd.Args, "-f")
-	cmd.Args = append(cmd.Args, "-")
-	cmd.Args = append(cmd.Args, ".")
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Stdin = r.Stdin
-	if err := utils.CmdRunner(cmd).Run(); err != nil {
-		return err
-	}
-	return nil
+	return ActiveRuntime.Build(r)
 }
 
 type DockerRunner struct {
@@ -75,125 +73,28 @@ type DockerRunner struct {
 	Hostname    string
 }
 
-func (r *DockerRunner) Run() error {
-	cmd := exec.CommandContext(*r.Ctx, utils.DockerPath, "run")
-
-	// Detatch signifies we do not want to supervise
-	if !r.Detatch {
-		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
-		cmd.Cancel = func() error {
-			if runtime.GOOS == "darwin" {
-				runCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-				stopCmd := exec.CommandContext(runCtx, utils.DockerPath, "stop", r.ContainerId)
-				utils.CmdRunner(stopCmd).Run()
-				cancel()
-			}
-			return unix.Kill(-cmd.Process.Pid, unix.SIGINT)
-		}
-	}
-	cmd.Env = r.Config.EnvArray(true)
-
-	if r.DryRun {
-		// multi-line env doesn't work super great from CLI, but we can print out the rest.
-		for k, v := range r.Config.Env {
-			if !strings.Contains(v, "\n") {
-				cmd.Args = append(cmd.Args, "--env")
-				cmd.Args = append(cmd.Args, k+"="+shellwords.Escape(v))
-			}
-		}
-	} else {
-		for k, _ := range r.Config.Env {
-			cmd.Args = append(cmd.Args, "--env")
-			cmd.Args = append(cmd.Args, k)
-		}
-	}
-
-	// Order is important here, we add extra env after config's env to override anything set in env.
-	for _, e := range r.ExtraEnv {
-		cmd.Args = append(cmd.Args, "--env")
-		cmd.Args = append(cmd.Args, e)
-	}
-	for k, v := range r.Config.Labels {
-		cmd.Args = append(cmd.Args, "--label")
-		cmd.Args = append(cmd.Args, k+"="+v)
-	}
-	if !r.SkipPorts {
-		for _, v := range r.Config.Expose {
-			if strings.Contains(v, ":") {
-				cmd.Args = append(cmd.Args, "-p")
-				cmd.Args = append(cmd.Args, v)
-			} else {
-				cmd.Args = append(cmd.Args, "--expose")
-				cmd.Args = append(cmd.Args, v)
-			}
-		}
-	}
-	for _, v := range r.Config.Volumes {
-		cmd.Args = append(cmd.Args, "-v")
-		cmd.Args = append(cmd.Args, v.Volume.Host+":"+v.Volume.Guest)
-	}
-	for _, v := range r.Config.Links {
-		cmd.Args = append(cmd.Args, "--link")
-		cmd.Args = append(cmd.Args, v.Link.Name+":"+v.Link.Alias)
-	}
-	cmd.Args = append(cmd.Args, "--shm-size=512m")
-	if r.Rm {
-		cmd.Args = append(cmd.Args, "--rm")
-	}
-	if r.Restart {
-		cmd.Args = append(cmd.Args, "--restart=always")
-	} else {
-		cmd.Args = append(cmd.Args, "--restart=no")
-	}
-	if r.Detatch {
-		cmd.Args = append(cmd.Args, "-d")
-	}
-	cmd.Args = append(cmd.Args, "-i")
-
-	// Docker args override settings above
-	for _, f := range r.Config.DockerArgs() {
-		cmd.Args = append(cmd.Args, f)
-	}
-	for _, f := range r.ExtraFlags {
-		cmd.Args = append(cmd.Args, f)
-	}
-	cmd.Args = append(cmd.Args, "-h")
-	cmd.Args = append(cmd.Args, r.Hostname)
-	cmd.Args = append(cmd.Args, "--name")
-	cmd.Args = append(cmd.Args, r.ContainerId)
+func (r *DockerRunner) image() string {
 	if len(r.CustomImage) > 0 {
-		cmd.Args = append(cmd.Args, r.CustomImage)
-	} else {
-		cmd.Args = append(cmd.Args, r.Config.RunImage())
-	}
-
-	for _, c := range r.Cmd {
-		cmd.Args = append(cmd.Args, c)
+		return r.CustomImage
 	}
+	return r.Config.RunImage()
+}
 
-	if !r.Detatch {
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		cmd.Stdin = r.Stdin
-	}
-	runner := utils.CmdRunner(cmd)
-	if r.DryRun {
-		fmt.Println(cmd)
-	} else {
-		if err := runner.Run(); err != nil {
-			return err
-		}
-	}
-	return nil
+func (r *DockerRunner) Run() error {
+	return ActiveRuntime.Run(r)
 }
 
 type DockerPupsRunner struct {
-	Config         *config.Config
-	PupsArgs       string
+	Config   *config.Config
+	PupsArgs string
+	// Image pups runs in, eg. one built for another config. Defaults to the config's run image.
+	Image          string
 	SavedImageName string
 	ExtraEnv       []string
-	Ctx            *context.Context
-	ContainerId    string
+	// extra labels set on the saved image
+	Labels      map[string]string
+	Ctx         *context.Context
+	ContainerId string
 }
 
 func (r *DockerPupsRunner) Run() error {
@@ -207,8 +108,7 @@ func (r *DockerPupsRunner) Run() error {
 		if !rm {
 			time.Sleep(utils.CommitWait)
 			runCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-			cmd := exec.CommandContext(runCtx, utils.DockerPath, "rm", "-f", r.ContainerId)
-			utils.CmdRunner(cmd).Run()
+			ActiveRuntime.Remove(runCtx, r.ContainerId, true)
 			cancel()
 		}
 	}(rm)
@@ -221,8 +121,9 @@ func (r *DockerPupsRunner) Run() error {
 		ExtraEnv:    r.ExtraEnv,
 		Rm:          rm,
 		ContainerId: r.ContainerId,
+		CustomImage: r.Image,
 		Cmd:         commands,
-		Stdin:       strings.NewReader(r.Config.Yaml()),
+		Stdin:       strings.NewReader(r.Config.Yaml(true)),
 		SkipPorts:   true, //pups runs don't need to expose ports
 	}
 
@@ -232,20 +133,21 @@ func (r *DockerPupsRunner) Run() error {
 
 	if len(r.SavedImageName) > 0 {
 		time.Sleep(utils.CommitWait)
-		cmd := exec.Command("docker",
-			"commit",
-			"--change",
-			"LABEL org.opencontainers.image.created=\""+time.Now().Format(time.RFC3339)+"\"",
-			"--change",
-			"CMD [\""+r.Config.BootCommand()+"\"]",
-			r.ContainerId,
-			r.SavedImageName,
-		)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-
-		fmt.Fprintln(utils.Out, cmd)
-		if err := utils.CmdRunner(cmd).Run(); err != nil {
+		// images from other configs are relabeled for this one
+		changes := []string{
+			"LABEL org.opencontainers.image.created=\"" + time.Now().Format(time.RFC3339) + "\"",
+			"LABEL " + utils.ConfigLabel + "=" + r.Config.Name,
+			"CMD [\"" + r.Config.BootCommand() + "\"]",
+		}
+		keys := []string{}
+		for k := range r.Labels {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		for _, k := range keys {
+			changes = append(changes, "LABEL "+k+"="+r.Labels[k])
+		}
+		if err := ActiveRuntime.Commit(*r.Ctx, r.ContainerId, r.SavedImageName, changes); err != nil {
 			return err
 		}
 	}
@@ -253,25 +155,36 @@ func (r *DockerPupsRunner) Run() error {
 }
 
 func ContainerExists(container string) (bool, error) {
-	cmd := exec.Command(utils.DockerPath, "ps", "-a", "-q", "--filter", "name="+container)
-	result, err := utils.CmdRunner(cmd).Output()
-	if err != nil {
-		return false, err
-	}
-	if len(result) > 0 {
-		return true, nil
-	}
-	return false, nil
+	return ActiveRuntime.ContainerExists(container)
 }
 
 func ContainerRunning(container string) (bool, error) {
-	cmd := exec.Command(utils.DockerPath, "ps", "-q", "--filter", "name="+container)
-	result, err := utils.CmdRunner(cmd).Output()
-	if err != nil {
-		return false, err
-	}
-	if len(result) > 0 {
-		return true, nil
-	}
-	return false, nil
+	return ActiveRuntime.ContainerRunning(container)
+}
+
+// Starts an existing container. When supervised, stays attached to the container until it exits.
+func StartContainer(ctx context.Context, container string, supervised bool) error {
+	return ActiveRuntime.Start(ctx, container, supervised)
+}
+
+// Stops a container, giving it up to 10 minutes to shut down cleanly.
+func StopContainer(ctx context.Context, container string) error {
+	return ActiveRuntime.Stop(ctx, container)
+}
+
+func RemoveContainer(ctx context.Context, container string) error {
+	return ActiveRuntime.Remove(ctx, container, false)
+}
+
+func EnterContainer(ctx context.Context, container string) error {
+	return ActiveRuntime.Enter(ctx, container)
+}
+
+func ContainerLogs(ctx context.Context, container string) ([]byte, error) {
+	return ActiveRuntime.Logs(ctx, container)
+}
+
+// Removes stopped containers and unused images that are more than an hour old.
+func Prune(ctx context.Context) error {
+	return ActiveRuntime.Prune(ctx)
 }
@@ -39,5 +39,16 @@ var _ = Describe("Commands", func() {
 			cmd = GetLastCommand()
 			Expect(cmd.String()).To(ContainSubstring("docker rm"))
 		})
+		It("Never prints secrets on dry runs", func() {
+			conf.Env = map[string]string{"LANG": "en_US.UTF-8", "DISCOURSE_DB_PASSWORD": "hunter2", "PLUGIN_TOKEN": "abc"}
+			conf.Secrets = []string{"*_TOKEN"}
+			runner := docker.DockerRunner{Config: conf, Ctx: &ctx, ContainerId: "test", DryRun: true}
+			Expect(runner.Run()).To(Succeed())
+			Expect(out.String()).To(ContainSubstring("--env LANG=en_US.UTF-8"))
+			Expect(out.String()).To(ContainSubstring("--env DISCOURSE_DB_PASSWORD "))
+			Expect(out.String()).To(ContainSubstring("--env PLUGIN_TOKEN "))
+			Expect(out.String()).ToNot(ContainSubstring("hunter2"))
+			Expect(out.String()).ToNot(ContainSubstring("abc"))
+		})
 	})
 })
@@ -0,0 +1,127 @@
+package docker
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"github.com/discourse/discourse_docker/launcher_go/v2/utils"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Number of log lines reported when a container does not become healthy.
+const healthLogLines = 50
+
+// Returned when a started container does not become healthy. Carries the tail of the container's logs.
+type UnhealthyError struct {
+	Container string
+	Reason    string
+	Logs      string
+}
+
+func (e *UnhealthyError) Error() string {
+	message := e.Container + " did not become healthy: " + e.Reason
+	if e.Logs != "" {
+		message = message + "\nlast " + fmt.Sprint(healthLogLines) + " lines of container logs:\n" + e.Logs
+	}
+	return message
+}
+
+type HealthCheck struct {
+	Container string
+	// Polled until it responds with a 200. When empty, the container only needs to stay up.
+	Url string
+	// Host header sent with requests to Url
+	Host    string
+	Timeout time.Duration
+}
+
+// Waits for a started container to become healthy: running without restarting, and answering on the check's url.
+func WaitHealthy(ctx context.Context, check HealthCheck) error {
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			// the container's certificate is for its public hostname, not the local address probed here
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true, ServerName: check.Host},
+		},
+		// redirects are answered by nginx, not the app
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	deadline := time.Now().Add(check.Timeout)
+	restarts := -1
+	runningPolls := 0
+	reason := "container is not running"
+	for {
+		status, err := InspectContainer(ctx, check.Container)
+		if err != nil {
+			return err
+		}
+		if status == nil {
+			return &UnhealthyError{Container: check.Container, Reason: "container no longer exists"}
+		}
+		if status.State == "exited" || status.State == "dead" {
+			return unhealthy(ctx, check.Container, "container "+status.State)
+		}
+		if restarts >= 0 && status.RestartCount > restarts {
+			return unhealthy(ctx, check.Container, fmt.Sprintf("container restarted %d time(s) while starting", status.RestartCount-restarts))
+		}
+		restarts = status.RestartCount
+
+		if status.State == "running" {
+			runningPolls++
+			if check.Url == "" {
+				// without a url to poll, staying up across two polls is as healthy as it gets
+				if runningPolls >= 2 {
+					return nil
+				}
+				reason = "container is not running"
+			} else if reason = probe(ctx, client, check); reason == "" {
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return unhealthy(ctx, check.Container, "timed out after "+check.Timeout.String()+": "+reason)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(utils.HealthPollInterval):
+		}
+	}
+}
+
+// Requests the check's url, returning why the container isn't healthy, or empty when it is.
+func probe(ctx context.Context, client *http.Client, check HealthCheck) string {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, check.Url, nil)
+	if err != nil {
+		return err.Error()
+	}
+	if check.Host != "" {
+		req.Host = check.Host
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err.Error()
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return check.Url + " responded with " + resp.Status
+	}
+	return ""
+}
+
+func unhealthy(ctx context.Context, container string, reason string) error {
+	err := &UnhealthyError{Container: container, Reason: reason}
+	logs, _ := ContainerLogs(ctx, container)
+	lines := strings.Split(strings.TrimRight(string(logs), "\n"), "\n")
+	if len(lines) > healthLogLines {
+		lines = lines[len(lines)-healthLogLines:]
+	}
+	err.Logs = strings.Join(lines, "\n")
+	return err
+}
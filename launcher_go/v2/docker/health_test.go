@@ -0,0 +1,91 @@
+package docker_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"context"
+	"errors"
+	"github.com/discourse/discourse_docker/launcher_go/v2/docker"
+	. "github.com/discourse/discourse_docker/launcher_go/v2/test_utils"
+	"github.com/discourse/discourse_docker/launcher_go/v2/utils"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var _ = Describe("Health", func() {
+	var api *FakeDockerApi
+	var ctx context.Context
+	var state string
+	var restartCount int
+	var appStatus int
+	var app *httptest.Server
+	var check docker.HealthCheck
+
+	BeforeEach(func() {
+		utils.HealthPollInterval = time.Millisecond
+		api = NewFakeDockerApi()
+		client, _ := docker.NewClient(api.Host())
+		docker.ActiveRuntime = &docker.ApiRuntime{Client: client}
+		ctx = context.Background()
+		state = "running"
+		restartCount = 0
+		appStatus = http.StatusOK
+		api.Handle("GET", "/containers/app/json", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{"Id":"abc","State":{"Status":"` + state + `"},"RestartCount":` + strconv.Itoa(restartCount) + `}`))
+		})
+		api.Output = strings.Repeat("booting\n", 60) + "unicorn worker crashed\n"
+		app = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			Expect(r.URL.Path).To(Equal("/srv/status"))
+			Expect(r.Host).To(Equal("discourse.example.com"))
+			w.WriteHeader(appStatus)
+		}))
+		check = docker.HealthCheck{Container: "app", Url: app.URL + "/srv/status", Host: "discourse.example.com", Timeout: time.Second}
+	})
+	AfterEach(func() {
+		docker.ActiveRuntime = docker.NewDockerRuntime()
+		utils.HealthPollInterval = 2 * time.Second
+		api.Close()
+		app.Close()
+	})
+
+	It("succeeds once the app responds", func() {
+		Expect(docker.WaitHealthy(ctx, check)).To(Succeed())
+	})
+
+	It("succeeds when a container without a url stays up", func() {
+		check.Url = ""
+		Expect(docker.WaitHealthy(ctx, check)).To(Succeed())
+	})
+
+	It("times out with the tail of the logs while the app isn't ready", func() {
+		appStatus = http.StatusServiceUnavailable
+		check.Timeout = 20 * time.Millisecond
+		err := docker.WaitHealthy(ctx, check)
+		var unhealthy *docker.UnhealthyError
+		Expect(errors.As(err, &unhealthy)).To(BeTrue())
+		Expect(unhealthy.Reason).To(ContainSubstring("timed out after 20ms"))
+		Expect(unhealthy.Reason).To(ContainSubstring("responded with 503 Service Unavailable"))
+		Expect(strings.Split(unhealthy.Logs, "\n")).To(HaveLen(50))
+		Expect(unhealthy.Logs).To(HaveSuffix("unicorn worker crashed"))
+	})
+
+	It("fails when the container exits", func() {
+		state = "exited"
+		err := docker.WaitHealthy(ctx, check)
+		Expect(err).To(MatchError(HavePrefix("app did not become healthy: container exited")))
+	})
+
+	It("fails when the container crash loops", func() {
+		appStatus = http.StatusBadGateway
+		api.Handle("GET", "/containers/app/json", func(w http.ResponseWriter, r *http.Request) {
+			restartCount++
+			w.Write([]byte(`{"Id":"abc","State":{"Status":"running"},"RestartCount":` + strconv.Itoa(restartCount) + `}`))
+		})
+		err := docker.WaitHealthy(ctx, check)
+		Expect(err).To(MatchError(HavePrefix("app did not become healthy: container restarted 1 time(s) while starting")))
+	})
+})
@@ -0,0 +1,94 @@
+package docker
+
+import (
+	"context"
+	"fmt"
+	"github.com/discourse/discourse_docker/launcher_go/v2/utils"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// Podman has no container links. Launcher containers instead join this network,
+// where they reach each other by container name.
+const PodmanNetwork = "discourse"
+
+// Runs containers through the podman cli.
+type PodmanRuntime struct {
+	CliRuntime
+}
+
+func NewPodmanRuntime() *PodmanRuntime {
+	return &PodmanRuntime{CliRuntime{name: "podman", path: &utils.PodmanPath}}
+}
+
+// Podman builds don't read BUILDKIT_PROGRESS, and older versions can't read a dockerfile from stdin,
+// so the dockerfile is written into the build dir instead.
+func (p *PodmanRuntime) Build(r *DockerBuilder) error {
+	dockerfile, err := io.ReadAll(r.Stdin)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(r.Dir, "Dockerfile"), dockerfile, 0644); err != nil {
+		return err
+	}
+	cmd := p.buildCmd(r)
+	if len(r.Platforms) > 0 {
+		// each platform's image is added to a manifest list, which can't share its name with a previous build
+		rm := exec.CommandContext(*r.Ctx, *p.path, "manifest", "rm", r.imageName())
+		utils.CmdRunner(rm).Run()
+		i := slices.Index(cmd.Args, "-t")
+		cmd.Args[i] = "--manifest"
+		cmd.Args = append(cmd.Args, "--platform", strings.Join(r.Platforms, ","))
+	}
+	cmd.Args = append(cmd.Args, "-f")
+	cmd.Args = append(cmd.Args, "Dockerfile")
+	cmd.Args = append(cmd.Args, ".")
+	return utils.CmdRunner(cmd).Run()
+}
+
+func (p *PodmanRuntime) Run(r *DockerRunner) error {
+	network, err := podmanNetwork(r)
+	if err != nil {
+		return err
+	}
+	if network == "" {
+		return p.run(r, []string{})
+	}
+	if !r.DryRun {
+		if err := p.ensureNetwork(*r.Ctx); err != nil {
+			return err
+		}
+	}
+	return p.run(r, []string{"--network", network})
+}
+
+func (p *PodmanRuntime) ensureNetwork(ctx context.Context) error {
+	cmd := exec.CommandContext(ctx, *p.path, "network", "exists", PodmanNetwork)
+	if err := utils.CmdRunner(cmd).Run(); err == nil {
+		return nil
+	}
+	cmd = exec.CommandContext(ctx, *p.path, "network", "create", PodmanNetwork)
+	fmt.Fprintln(utils.Out, cmd)
+	return utils.CmdRunner(cmd).Run()
+}
+
+// Returns the network a podman container should join in place of links.
+// Empty when docker_args already choose a network or pod, in which case reaching linked containers is left to them.
+func podmanNetwork(r *DockerRunner) (string, error) {
+	for _, f := range append(r.Config.DockerArgs(), r.ExtraFlags...) {
+		name, _, _ := strings.Cut(f, "=")
+		if name == "--network" || name == "--net" || name == "--pod" {
+			return "", nil
+		}
+	}
+	for _, v := range r.Config.Links {
+		if v.Link.Name != v.Link.Alias {
+			return "", fmt.Errorf("podman does not support link aliases: link %s:%s must use the container name as its alias, or set --network or --pod in docker_args", v.Link.Name, v.Link.Alias)
+		}
+	}
+	return PodmanNetwork, nil
+}
@@ -0,0 +1,153 @@
+package docker
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/discourse/discourse_docker/launcher_go/v2/utils"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// The key docker logins to docker hub are stored under.
+const dockerHubServer = "https://index.docker.io/v1/"
+
+// The logins docker and podman store, in docker's config.json format.
+type authFile struct {
+	Auths map[string]struct {
+		Auth          string
+		IdentityToken string
+	}
+	CredsStore  string
+	CredHelpers map[string]string
+}
+
+// Credentials sent to the engine for pushes and pulls.
+type registryAuthConfig struct {
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+	ServerAddress string `json:"serveraddress,omitempty"`
+}
+
+// The X-Registry-Auth header for pushing or pulling repo, with the login docker or podman stored for its registry.
+// Registries with no stored login get an empty auth config, which is anonymous.
+func registryAuth(repo string) (string, error) {
+	server := registryServer(repo)
+	auth := registryAuthConfig{}
+	for _, file := range authFiles() {
+		found, err := readRegistryAuth(file, server)
+		if err != nil {
+			return "", err
+		}
+		if found != nil {
+			auth = *found
+			break
+		}
+	}
+	encoded, err := json.Marshal(auth)
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(encoded), nil
+}
+
+// The registry an image is pushed to or pulled from. Images without one are on docker hub.
+func registryServer(repo string) string {
+	host, _, found := strings.Cut(repo, "/")
+	if !found || (!strings.ContainsAny(host, ".:") && host != "localhost") || host == "docker.io" || host == "index.docker.io" {
+		return dockerHubServer
+	}
+	return host
+}
+
+// docker's config.json, then podman's auth.json.
+func authFiles() []string {
+	files := []string{}
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		files = append(files, filepath.Join(dir, "config.json"))
+	} else if home, err := os.UserHomeDir(); err == nil {
+		files = append(files, filepath.Join(home, ".docker", "config.json"))
+	}
+	if file := os.Getenv("REGISTRY_AUTH_FILE"); file != "" {
+		files = append(files, file)
+	}
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		files = append(files, filepath.Join(dir, "containers", "auth.json"))
+	}
+	return files
+}
+
+// Reads the login for server from an auth file. Returns nil when the file has none.
+func readRegistryAuth(file string, server string) (*registryAuthConfig, error) {
+	content, err := os.ReadFile(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	auths := authFile{}
+	if err := json.Unmarshal(content, &auths); err != nil {
+		return nil, errors.New("could not read registry logins from " + file + ": " + err.Error())
+	}
+	if helper, ok := auths.CredHelpers[server]; ok {
+		return credentialHelperAuth(helper, server)
+	}
+	for key, entry := range auths.Auths {
+		if authServer(key) != authServer(server) {
+			continue
+		}
+		if entry.IdentityToken != "" {
+			return &registryAuthConfig{IdentityToken: entry.IdentityToken, ServerAddress: server}, nil
+		}
+		if entry.Auth == "" {
+			// logins kept in a credentials store leave an empty entry
+			break
+		}
+		decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+		if err != nil {
+			return nil, errors.New("could not read the login for " + server + " from " + file + ": " + err.Error())
+		}
+		username, password, _ := strings.Cut(string(decoded), ":")
+		return &registryAuthConfig{Username: username, Password: password, ServerAddress: server}, nil
+	}
+	if auths.CredsStore != "" {
+		return credentialHelperAuth(auths.CredsStore, server)
+	}
+	return nil, nil
+}
+
+// Auth file keys may be urls, eg. https://ghcr.io or https://index.docker.io/v1/.
+func authServer(key string) string {
+	key = strings.TrimPrefix(strings.TrimPrefix(key, "https://"), "http://")
+	host, _, _ := strings.Cut(key, "/")
+	return host
+}
+
+// Asks a docker credential helper, eg. docker-credential-desktop, for the login for server.
+func credentialHelperAuth(helper string, server string) (*registryAuthConfig, error) {
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(server)
+	output, err := utils.CmdRunner(cmd).Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && strings.Contains(string(output)+string(exitErr.Stderr), "credentials not found") {
+			return nil, nil
+		}
+		return nil, errors.New("could not get the login for " + server + " from docker-credential-" + helper + ": " + err.Error())
+	}
+	credentials := struct {
+		Username string
+		Secret   string
+	}{}
+	if err := json.Unmarshal(output, &credentials); err != nil {
+		return nil, errors.New("could not read the login for " + server + " from docker-credential-" + helper + ": " + err.Error())
+	}
+	// helpers return identity tokens under a <token> username
+	if credentials.Username == "<token>" {
+		return &registryAuthConfig{IdentityToken: credentials.Secret, ServerAddress: server}, nil
+	}
+	return &registryAuthConfig{Username: credentials.Username, Password: credentials.Secret, ServerAddress: server}, nil
+}
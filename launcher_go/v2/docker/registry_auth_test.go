@@ -0,0 +1,90 @@
+package docker_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/discourse/discourse_docker/launcher_go/v2/docker"
+	. "github.com/discourse/discourse_docker/launcher_go/v2/test_utils"
+	"github.com/discourse/discourse_docker/launcher_go/v2/utils"
+	"io"
+	"os"
+)
+
+var _ = Describe("Registry auth", func() {
+	var api *FakeDockerApi
+	var client *docker.Client
+	var ctx context.Context
+	var testDir string
+	var env map[string]string
+
+	var sentAuth = func(method string, path string) map[string]string {
+		request := api.LastRequest(method, path)
+		Expect(request).ToNot(BeNil())
+		decoded, err := base64.URLEncoding.DecodeString(request.Header.Get("X-Registry-Auth"))
+		Expect(err).To(BeNil())
+		auth := map[string]string{}
+		Expect(json.Unmarshal(decoded, &auth)).To(Succeed())
+		return auth
+	}
+
+	BeforeEach(func() {
+		utils.Out = &bytes.Buffer{}
+		utils.CmdRunner = CreateNewFakeCmdRunner()
+		api = NewFakeDockerApi()
+		client, _ = docker.NewClient(api.Host())
+		ctx = context.Background()
+		testDir, _ = os.MkdirTemp("", "ddocker-test")
+		env = map[string]string{}
+		for _, k := range []string{"DOCKER_CONFIG", "REGISTRY_AUTH_FILE", "XDG_RUNTIME_DIR"} {
+			env[k] = os.Getenv(k)
+			os.Unsetenv(k)
+		}
+		os.Setenv("DOCKER_CONFIG", testDir)
+	})
+	AfterEach(func() {
+		for k, v := range env {
+			os.Setenv(k, v)
+		}
+		api.Close()
+		os.RemoveAll(testDir)
+	})
+
+	It("pushes anonymously without a stored login", func() {
+		Expect(client.ImagePush(ctx, "localhost:5000/discourse/app:v1", io.Discard)).To(Succeed())
+		Expect(sentAuth("POST", "/images/localhost:5000/discourse/app/push")).To(BeEmpty())
+	})
+
+	It("sends the login stored for the image's registry", func() {
+		os.WriteFile(testDir+"/config.json", []byte(`{"auths":{"https://ghcr.io":{"auth":"`+base64.StdEncoding.EncodeToString([]byte("bot:s3cr3t"))+`"}}}`), 0600)
+		Expect(client.ImagePush(ctx, "ghcr.io/example/discourse:v1", io.Discard)).To(Succeed())
+		Expect(sentAuth("POST", "/images/ghcr.io/example/discourse/push")).To(Equal(map[string]string{"username": "bot", "password": "s3cr3t", "serveraddress": "ghcr.io"}))
+	})
+
+	It("sends the docker hub login for images without a registry", func() {
+		os.WriteFile(testDir+"/config.json", []byte(`{"auths":{"https://index.docker.io/v1/":{"auth":"`+base64.StdEncoding.EncodeToString([]byte("bot:s3cr3t"))+`"}}}`), 0600)
+		Expect(client.ImagePull(ctx, "discourse/base:2.0", io.Discard)).To(Succeed())
+		Expect(sentAuth("POST", "/images/create")).To(HaveKeyWithValue("username", "bot"))
+	})
+
+	It("reads logins kept in a credentials store", func() {
+		os.WriteFile(testDir+"/config.json", []byte(`{"auths":{"ghcr.io":{}},"credsStore":"desktop"}`), 0600)
+		CmdOutputResponse = []byte(`{"ServerURL":"ghcr.io","Username":"<token>","Secret":"t0ken"}`)
+		Expect(client.ImagePull(ctx, "ghcr.io/example/discourse:v1", io.Discard)).To(Succeed())
+		cmd := GetLastCommand()
+		Expect(cmd.String()).To(ContainSubstring("docker-credential-desktop get"))
+		Expect(sentAuth("POST", "/images/create")).To(Equal(map[string]string{"identitytoken": "t0ken", "serveraddress": "ghcr.io"}))
+	})
+
+	It("fails when the credentials store can't be read", func() {
+		os.WriteFile(testDir+"/config.json", []byte(`{"credHelpers":{"ghcr.io":"ecr-login"}}`), 0600)
+		CmdOutputError = errors.New("executable file not found in $PATH")
+		Expect(client.ImagePush(ctx, "ghcr.io/example/discourse:v1", io.Discard)).To(MatchError("could not get the login for ghcr.io from docker-credential-ecr-login: executable file not found in $PATH"))
+		Expect(api.Calls()).To(BeEmpty())
+	})
+})
@@ -0,0 +1,172 @@
+package docker
+
+import (
+	"context"
+	"errors"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/discourse/discourse_docker/launcher_go/v2/utils"
+)
+
+// A container runtime that images are built and containers are run with.
+type Runtime interface {
+	// The runtime's name, as given to --runtime
+	Name() string
+	Build(r *DockerBuilder) error
+	// Whether builds can mount BuildKit secrets. Without them, secrets are left out of builds.
+	BuildSecrets() bool
+	Run(r *DockerRunner) error
+	Commit(ctx context.Context, container string, image string, changes []string) error
+	// Starts an existing container. When supervised, stays attached to the container until it exits.
+	Start(ctx context.Context, container string, supervised bool) error
+	Stop(ctx context.Context, container string) error
+	Remove(ctx context.Context, container string, force bool) error
+	// Opens an interactive login shell in a running container.
+	Enter(ctx context.Context, container string) error
+	Logs(ctx context.Context, container string) ([]byte, error)
+	Prune(ctx context.Context) error
+	ContainerExists(container string) (bool, error)
+	ContainerRunning(container string) (bool, error)
+	// Returns nil when the container does not exist.
+	InspectContainer(ctx context.Context, container string) (*ContainerStatus, error)
+	// Returns nil when the image does not exist.
+	InspectImage(ctx context.Context, image string) (*ImageStatus, error)
+	Rename(ctx context.Context, container string, name string) error
+	TagImage(ctx context.Context, image string, target string) error
+	RemoveImage(ctx context.Context, image string) error
+	Pull(ctx context.Context, image string) error
+	Push(ctx context.Context, image string) error
+	// Lists the tags of a repository's local images, eg local_discourse/app.
+	ImageTags(ctx context.Context, repo string) ([]string, error)
+}
+
+// A container's state, as reported by the runtime.
+type ContainerStatus struct {
+	Id   string
+	Name string
+	// created, running, paused, restarting, exited, or dead
+	State string
+	// Id of the image the container runs
+	Image string
+	// Image reference the container was created from, eg local_discourse/app
+	ImageName    string
+	Created      time.Time
+	StartedAt    time.Time
+	RestartCount int
+}
+
+type ImageStatus struct {
+	Id      string
+	Created time.Time
+	Labels  map[string]string
+	Env     []string
+}
+
+// The info the cli and engine api both report for containers and images, converted to statuses.
+func (c *ContainerInfo) status() *ContainerStatus {
+	created, _ := time.Parse(time.RFC3339Nano, c.Created)
+	started, _ := time.Parse(time.RFC3339Nano, c.State.StartedAt)
+	return &ContainerStatus{
+		Id:           c.Id,
+		Name:         strings.TrimPrefix(c.Name, "/"),
+		State:        c.State.Status,
+		Image:        c.Image,
+		ImageName:    c.Config.Image,
+		Created:      created,
+		StartedAt:    started,
+		RestartCount: c.RestartCount,
+	}
+}
+
+func (i *ImageInfo) status() *ImageStatus {
+	created, _ := time.Parse(time.RFC3339Nano, i.Created)
+	return &ImageStatus{Id: i.Id, Created: created, Labels: i.Config.Labels, Env: i.Config.Env}
+}
+
+// The runtime all container commands go through. Defaults to the docker cli.
+var ActiveRuntime Runtime = NewDockerRuntime()
+
+// Picks a runtime by name (auto, docker, or podman) and engine (auto, cli, or api).
+// auto prefers docker when it is installed, then podman. The api engine connects to
+// DOCKER_HOST, or for podman, CONTAINER_HOST or the podman service socket.
+func NewRuntime(name string, engine string) (Runtime, error) {
+	if name == "auto" {
+		name = "docker"
+		if utils.DockerPath == "" && utils.PodmanPath != "" {
+			name = "podman"
+		}
+	}
+	if name != "docker" && name != "podman" {
+		return nil, errors.New("unknown container runtime " + name)
+	}
+	path := utils.DockerPath
+	if name == "podman" {
+		path = utils.PodmanPath
+	}
+	if engine == "cli" || (engine == "auto" && path != "") {
+		if name == "podman" {
+			return NewPodmanRuntime(), nil
+		}
+		return NewDockerRuntime(), nil
+	}
+
+	host := os.Getenv("DOCKER_HOST")
+	if host == "" && name == "podman" {
+		host = podmanHost()
+	}
+	client, err := NewClient(host)
+	if err != nil {
+		return nil, err
+	}
+	return &ApiRuntime{Client: client, Podman: name == "podman"}, nil
+}
+
+func InspectContainer(ctx context.Context, container string) (*ContainerStatus, error) {
+	return ActiveRuntime.InspectContainer(ctx, container)
+}
+
+func InspectImage(ctx context.Context, image string) (*ImageStatus, error) {
+	return ActiveRuntime.InspectImage(ctx, image)
+}
+
+func RenameContainer(ctx context.Context, container string, name string) error {
+	return ActiveRuntime.Rename(ctx, container, name)
+}
+
+// A name filter matching only the container called name, rather than every container with name in its name.
+func nameFilter(name string) string {
+	return "^/?" + regexp.QuoteMeta(name) + "$"
+}
+
+func TagImage(ctx context.Context, image string, target string) error {
+	return ActiveRuntime.TagImage(ctx, image, target)
+}
+
+func RemoveImage(ctx context.Context, image string) error {
+	return ActiveRuntime.RemoveImage(ctx, image)
+}
+
+func PullImage(ctx context.Context, image string) error {
+	return ActiveRuntime.Pull(ctx, image)
+}
+
+func PushImage(ctx context.Context, image string) error {
+	return ActiveRuntime.Push(ctx, image)
+}
+
+func ImageTags(ctx context.Context, repo string) ([]string, error) {
+	return ActiveRuntime.ImageTags(ctx, repo)
+}
+
+func podmanHost() string {
+	if host := os.Getenv("CONTAINER_HOST"); host != "" {
+		return host
+	}
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" && os.Geteuid() != 0 {
+		return "unix://" + dir + "/podman/podman.sock"
+	}
+	return "unix:///run/podman/podman.sock"
+}
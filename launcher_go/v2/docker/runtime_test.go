@@ -0,0 +1,213 @@
+package docker_test
+
+import (
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"bytes"
+	"context"
+	"github.com/discourse/discourse_docker/launcher_go/v2/config"
+	"github.com/discourse/discourse_docker/launcher_go/v2/docker"
+	. "github.com/discourse/discourse_docker/launcher_go/v2/test_utils"
+	"github.com/discourse/discourse_docker/launcher_go/v2/utils"
+	"os"
+	"strings"
+)
+
+var _ = Describe("Runtime", func() {
+	var conf *config.Config
+	var ctx context.Context
+	var dockerPath, podmanPath string
+
+	BeforeEach(func() {
+		dockerPath = utils.DockerPath
+		podmanPath = utils.PodmanPath
+		utils.DockerPath = "docker"
+		utils.PodmanPath = "podman"
+		utils.Out = &bytes.Buffer{}
+		utils.CommitWait = 0
+		utils.CmdRunner = CreateNewFakeCmdRunner()
+		conf, _ = config.LoadConfig("../test/containers", "test", true, "../test")
+		ctx = context.Background()
+	})
+	AfterEach(func() {
+		utils.DockerPath = dockerPath
+		utils.PodmanPath = podmanPath
+		docker.ActiveRuntime = docker.NewDockerRuntime()
+	})
+
+	Context("selection", func() {
+		It("prefers docker when it is installed", func() {
+			runtime, err := docker.NewRuntime("auto", "auto")
+			Expect(err).To(BeNil())
+			Expect(runtime.Name()).To(Equal("docker"))
+			Expect(runtime).To(BeAssignableToTypeOf(&docker.CliRuntime{}))
+		})
+
+		It("falls back to podman", func() {
+			utils.DockerPath = ""
+			runtime, err := docker.NewRuntime("auto", "auto")
+			Expect(err).To(BeNil())
+			Expect(runtime).To(BeAssignableToTypeOf(&docker.PodmanRuntime{}))
+		})
+
+		It("can be overridden", func() {
+			runtime, err := docker.NewRuntime("podman", "cli")
+			Expect(err).To(BeNil())
+			Expect(runtime.Name()).To(Equal("podman"))
+		})
+
+		It("uses the podman api when podman is not installed", func() {
+			utils.PodmanPath = ""
+			os.Setenv("DOCKER_HOST", "tcp://127.0.0.1:2375")
+			defer os.Unsetenv("DOCKER_HOST")
+			runtime, err := docker.NewRuntime("podman", "auto")
+			Expect(err).To(BeNil())
+			Expect(runtime).To(BeAssignableToTypeOf(&docker.ApiRuntime{}))
+			Expect(runtime.Name()).To(Equal("podman"))
+		})
+	})
+
+	Context("build cache", func() {
+		var build = func(builder docker.DockerBuilder) string {
+			builder.Config = conf
+			builder.Ctx = &ctx
+			builder.Stdin = strings.NewReader("FROM discourse/base\n")
+			Expect(builder.Run()).To(Succeed())
+			cmd := GetLastCommand()
+			return cmd.String()
+		}
+
+		It("rebuilds every layer by default", func() {
+			cmd := build(docker.DockerBuilder{})
+			Expect(cmd).To(ContainSubstring(" --no-cache --pull --force-rm "))
+		})
+
+		It("reuses local layers, and can skip pulling", func() {
+			cmd := build(docker.DockerBuilder{Cache: "local", NoPull: true})
+			Expect(cmd).ToNot(ContainSubstring("--no-cache"))
+			Expect(cmd).ToNot(ContainSubstring("--pull"))
+		})
+
+		It("reads and writes the cache in a registry", func() {
+			cmd := build(docker.DockerBuilder{Cache: "registry", CacheRef: "ghcr.io/example/cache"})
+			Expect(cmd).To(ContainSubstring(" --cache-from type=registry,ref=ghcr.io/example/cache --cache-to type=registry,ref=ghcr.io/example/cache,mode=max --pull "))
+
+			docker.ActiveRuntime = docker.NewPodmanRuntime()
+			dir, _ := os.MkdirTemp("", "ddocker-test")
+			defer os.RemoveAll(dir)
+			cmd = build(docker.DockerBuilder{Cache: "registry", CacheRef: "ghcr.io/example/cache", Dir: dir})
+			Expect(cmd).To(ContainSubstring(" --layers --cache-from ghcr.io/example/cache --cache-to ghcr.io/example/cache "))
+		})
+	})
+
+	It("builds multi-arch images with buildx", func() {
+		CmdOutputResponse = []byte(`[["driver-type","io.containerd.snapshotter.v1"]]`)
+		builder := docker.DockerBuilder{Config: conf, Ctx: &ctx, Stdin: strings.NewReader("FROM discourse/base\n"), Platforms: []string{"linux/amd64", "linux/arm64"}}
+		Expect(builder.Run()).To(Succeed())
+		cmd := GetLastCommand()
+		Expect(cmd.String()).To(Equal("docker info --format {{json .DriverStatus}}"))
+		cmd = GetLastCommand()
+		Expect(cmd.String()).To(HavePrefix("docker buildx build "))
+		Expect(cmd.String()).To(ContainSubstring(" -t local_discourse/test:latest "))
+		Expect(cmd.String()).To(HaveSuffix(" --platform linux/amd64,linux/arm64 --load -f - ."))
+	})
+
+	It("fails multi-arch builds without the containerd image store", func() {
+		CmdOutputResponse = []byte(`[["Backing Filesystem","extfs"]]`)
+		builder := docker.DockerBuilder{Config: conf, Ctx: &ctx, Stdin: strings.NewReader("FROM discourse/base\n"), Platforms: []string{"linux/amd64", "linux/arm64"}}
+		Expect(builder.Run()).To(MatchError(HavePrefix("docker's default image store can't hold multi-platform images, so linux/amd64,linux/arm64 can't be loaded into it.")))
+		cmd := GetLastCommand()
+		Expect(cmd.String()).To(HavePrefix("docker info "))
+
+		// a single platform loads into either store
+		builder = docker.DockerBuilder{Config: conf, Ctx: &ctx, Stdin: strings.NewReader("FROM discourse/base\n"), Platforms: []string{"linux/arm64"}}
+		Expect(builder.Run()).To(Succeed())
+		Expect(RanCmds).To(HaveLen(1))
+		cmd = GetLastCommand()
+		Expect(cmd.String()).To(HavePrefix("docker buildx build "))
+	})
+
+	It("keeps launcher's own images when pruning", func() {
+		Expect(docker.Prune(ctx)).To(Succeed())
+		Expect(RanCmds).To(HaveLen(3))
+		GetLastCommand()
+		cmd := GetLastCommand()
+		Expect(cmd.String()).To(Equal("docker image prune --all --filter until=1h --filter label!=org.discourse.launcher.config"))
+		cmd = GetLastCommand()
+		Expect(cmd.String()).To(Equal("docker image prune --filter until=1h"))
+	})
+
+	Context("podman", func() {
+		BeforeEach(func() {
+			docker.ActiveRuntime = docker.NewPodmanRuntime()
+		})
+
+		It("runs containers on a shared network instead of links", func() {
+			runner := docker.DockerRunner{Config: conf, Ctx: &ctx, ContainerId: "test", Detatch: true}
+			Expect(runner.Run()).To(Succeed())
+			cmd := GetLastCommand()
+			Expect(cmd.String()).To(Equal("podman network exists discourse"))
+			cmd = GetLastCommand()
+			Expect(cmd.String()).To(ContainSubstring("podman run"))
+			Expect(cmd.String()).To(ContainSubstring("--network discourse"))
+			Expect(cmd.String()).ToNot(ContainSubstring("--link"))
+		})
+
+		It("leaves networking to docker_args that pick a network", func() {
+			runner := docker.DockerRunner{Config: conf, Ctx: &ctx, ContainerId: "test", Detatch: true, ExtraFlags: []string{"--pod=discourse"}}
+			Expect(runner.Run()).To(Succeed())
+			Expect(RanCmds).To(HaveLen(1))
+			cmd := GetLastCommand()
+			Expect(cmd.String()).ToNot(ContainSubstring("--network"))
+			Expect(cmd.String()).ToNot(ContainSubstring("--link"))
+		})
+
+		It("fails clearly on link aliases", func() {
+			conf.Links[0].Link.Alias = "db"
+			runner := docker.DockerRunner{Config: conf, Ctx: &ctx, ContainerId: "test", Detatch: true}
+			Expect(runner.Run()).To(MatchError(ContainSubstring("podman does not support link aliases: link data:db")))
+			Expect(RanCmds).To(BeEmpty())
+		})
+
+		It("builds from a dockerfile written to the build dir", func() {
+			dir, _ := os.MkdirTemp("", "ddocker-test")
+			defer os.RemoveAll(dir)
+			builder := docker.DockerBuilder{Config: conf, Ctx: &ctx, Stdin: strings.NewReader("FROM discourse/base\n"), Dir: dir}
+			Expect(builder.Run()).To(Succeed())
+			cmd := GetLastCommand()
+			Expect(cmd.String()).To(ContainSubstring("podman build"))
+			Expect(cmd.String()).To(HaveSuffix("-f Dockerfile ."))
+			Expect(cmd.String()).To(ContainSubstring("--secret id=DISCOURSE_DB_PASSWORD,env=DISCOURSE_DB_PASSWORD"))
+			Expect(cmd.Dir).To(Equal(dir))
+			dockerfile, _ := os.ReadFile(dir + "/Dockerfile")
+			Expect(string(dockerfile)).To(Equal("FROM discourse/base\n"))
+		})
+
+		It("builds multi-arch images into a manifest list", func() {
+			dir, _ := os.MkdirTemp("", "ddocker-test")
+			defer os.RemoveAll(dir)
+			builder := docker.DockerBuilder{Config: conf, Ctx: &ctx, Stdin: strings.NewReader("FROM discourse/base\n"), Dir: dir, Platforms: []string{"linux/amd64", "linux/arm64"}}
+			Expect(builder.Run()).To(Succeed())
+			Expect(RanCmds).To(HaveLen(2))
+			cmd := GetLastCommand()
+			Expect(cmd.String()).To(Equal("podman manifest rm local_discourse/test:latest"))
+			cmd = GetLastCommand()
+			Expect(cmd.String()).To(ContainSubstring(" --manifest local_discourse/test:latest "))
+			Expect(cmd.String()).ToNot(ContainSubstring(" -t "))
+			Expect(cmd.String()).To(HaveSuffix(" --platform linux/amd64,linux/arm64 -f Dockerfile ."))
+		})
+
+		It("commits with podman", func() {
+			runner := docker.DockerPupsRunner{Config: conf, ContainerId: "123", Ctx: &ctx, SavedImageName: "local_discourse/test"}
+			Expect(runner.Run()).To(Succeed())
+			GetLastCommand()
+			cmd := GetLastCommand()
+			Expect(cmd.String()).To(ContainSubstring("podman run"))
+			cmd = GetLastCommand()
+			Expect(cmd.String()).To(ContainSubstring("podman commit"))
+			cmd = GetLastCommand()
+			Expect(cmd.String()).To(Equal("podman rm -f 123"))
+		})
+	})
+})
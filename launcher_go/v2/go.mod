@@ -3,7 +3,6 @@ module github.com/discourse/discourse_docker/launcher_go/v2
 go 1.21
 
 require (
-	dario.cat/mergo v1.0.0
 	github.com/Wing924/shellwords v1.1.0
 	github.com/alecthomas/kong v0.8.1
 	github.com/google/uuid v1.3.1
@@ -2,43 +2,79 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/alecthomas/kong"
+	"github.com/discourse/discourse_docker/launcher_go/v2/config"
+	"github.com/discourse/discourse_docker/launcher_go/v2/docker"
 	"github.com/discourse/discourse_docker/launcher_go/v2/utils"
 	"github.com/posener/complete"
 	"github.com/willabides/kongplete"
 	"golang.org/x/sys/unix"
 	"os"
-	"os/exec"
 	"os/signal"
 )
 
 type Cli struct {
-	Version      kong.VersionFlag   `help:"Show version."`
-	ConfDir      string             `default:"./containers" help:"Discourse pups config directory." predictor:"dir"`
-	TemplatesDir string             `default:"." help:"Home project directory containing a templates/ directory which in turn contains pups yaml templates." predictor:"dir"`
-	BuildDir     string             `default:"./tmp" help:"Temporary build folder for building images." predictor:"dir"`
-	ForceMkdir   bool               `short:"p" name:"parent-dirs" help:"Create intermediate output directories as required.  If this option is not specified, the full path prefix of each operand must already exist."`
-	Upgrade      CliUpgrade         `cmd:"" help:"Upgrade launcher"`
-	CliGenerate  CliGenerate        `cmd:"" name:"generate" help:"Generate commands, used to generate Discourse pups, and other Discourse configuration for external tools."`
-	BuildCmd     DockerBuildCmd     `cmd:"" name:"build" help:"Build a base image. This command does not need a running database. Saves resulting container."`
-	ConfigureCmd DockerConfigureCmd `cmd:"" name:"configure" help:"Configure and save an image with all dependencies and environment baked in. Updates themes and precompiles all assets. Saves resulting container."`
-	MigrateCmd   DockerMigrateCmd   `cmd:"" name:"migrate" help:"Run migration tasks for a site. Running container is temporary and is not saved."`
-	BootstrapCmd DockerBootstrapCmd `cmd:"" name:"bootstrap" help:"Builds, migrates, and configures an image. Resulting image is a fully built and configured Discourse image."`
+	Version       kong.VersionFlag   `help:"Show version."`
+	ConfDir       string             `default:"./containers" help:"Discourse pups config directory." predictor:"dir"`
+	TemplatesDirs []string           `name:"templates-dir" default:"." sep:"none" help:"Home project directory containing a templates/ directory which in turn contains pups yaml templates. May be repeated, templates are taken from the first directory containing them." predictor:"dir"`
+	Overlays      []string           `name:"overlay" help:"Config file to merge over the container config, after its templates. May be repeated, later overlays take precedence." predictor:"file"`
+	EnvName       string             `name:"env-name" help:"Environment the config is for. Merges {conf-dir}/{config}.{env-name}.yml over the container config, before any --overlay files. The file must exist."`
+	EnvFile       string             `name:"env-file" help:"File of KEY=VALUE lines to interpolate into configs, for variables the process environment does not set." predictor:"file"`
+	BuildDir      string             `default:"./tmp" help:"Temporary build folder for building images." predictor:"dir"`
+	ForceMkdir    bool               `short:"p" name:"parent-dirs" help:"Create intermediate output directories as required.  If this option is not specified, the full path prefix of each operand must already exist."`
+	Runtime       string             `default:"auto" enum:"auto,docker,podman" help:"Container runtime to build and run with. auto uses docker when it is installed, then podman."`
+	Engine        string             `default:"auto" enum:"auto,cli,api" help:"How to talk to the runtime: cli runs the docker or podman cli, api talks to the Engine API at DOCKER_HOST (default unix:///var/run/docker.sock, or the podman socket). auto uses the cli when it is installed."`
+	Upgrade       CliUpgrade         `cmd:"" help:"Upgrade launcher"`
+	CliGenerate   CliGenerate        `cmd:"" name:"generate" help:"Generate commands, used to generate Discourse pups, and other Discourse configuration for external tools."`
+	ValidateCmd   ValidateCmd        `cmd:"" name:"validate" help:"Check a config and its templates for errors. Exits non-zero when problems are found."`
+	LintCmd       LintCmd            `cmd:"" name:"lint" help:"Check a config for settings known to break Discourse, like placeholder hostnames or ports bound twice. Runs before every build."`
+	ConfigCmd     CliConfig          `cmd:"" name:"config" help:"Get and edit a container config, keeping its comments and formatting. Edits are validated before they are written."`
+	SetupCmd      SetupCmd           `cmd:"" name:"setup" help:"Create a new config from the standalone sample, asking for its hostname, admin emails, and SMTP settings, and sizing it for this host."`
+	BuildCmd      DockerBuildCmd     `cmd:"" name:"build" help:"Build a base image. This command does not need a running database. Saves resulting container."`
+	ConfigureCmd  DockerConfigureCmd `cmd:"" name:"configure" help:"Configure and save an image with all dependencies and environment baked in. Updates themes and precompiles all assets. Saves resulting container."`
+	PromoteCmd    PromoteCmd         `cmd:"" name:"promote" help:"Configure the image built for one config with another config's settings, tagging the result for that config. Lets one build serve several sites, eg. staging and production."`
+	MigrateCmd    DockerMigrateCmd   `cmd:"" name:"migrate" help:"Run migration tasks for a site. Running container is temporary and is not saved."`
+	BootstrapCmd  DockerBootstrapCmd `cmd:"" name:"bootstrap" help:"Builds, migrates, and configures an image. Resulting image is a fully built and configured Discourse image."`
+	PushCmd       PushCmd            `cmd:"" name:"push" help:"Push a built image to the config's registry."`
+	PullCmd       PullCmd            `cmd:"" name:"pull" help:"Pull the config's image from its registry, so the container starts from it."`
 
-	DestroyCmd DestroyCmd `cmd:"" alias:"rm" name:"destroy" help:"Shutdown and destroy container."`
-	LogsCmd    LogsCmd    `cmd:"" name:"logs" help:"Print logs for container."`
-	CleanupCmd CleanupCmd `cmd:"" name:"cleanup" help:"Cleanup unused containers."`
-	EnterCmd   EnterCmd   `cmd:"" name:"enter" help:"Connects to a shell running in the container."`
-	RunCmd     RunCmd     `cmd:"" name:"run" help:"Runs the specified command in context of a docker container."`
-	StartCmd   StartCmd   `cmd:"" name:"start" help:"Starts container."`
-	StopCmd    StopCmd    `cmd:"" name:"stop" help:"Stops container."`
-	RestartCmd RestartCmd `cmd:"" name:"restart" help:"Stops then starts container."`
-	RebuildCmd RebuildCmd `cmd:"" name:"rebuild" help:"Builds new image, then destroys old container, and starts new container."`
+	DestroyCmd  DestroyCmd  `cmd:"" alias:"rm" name:"destroy" help:"Shutdown and destroy container."`
+	LogsCmd     LogsCmd     `cmd:"" name:"logs" help:"Print logs for container."`
+	CleanupCmd  CleanupCmd  `cmd:"" name:"cleanup" help:"Cleanup unused containers."`
+	EnterCmd    EnterCmd    `cmd:"" name:"enter" help:"Connects to a shell running in the container."`
+	RunCmd      RunCmd      `cmd:"" name:"run" help:"Runs the specified command in context of a docker container."`
+	StartCmd    StartCmd    `cmd:"" name:"start" help:"Starts container."`
+	StopCmd     StopCmd     `cmd:"" name:"stop" help:"Stops container."`
+	RestartCmd  RestartCmd  `cmd:"" name:"restart" help:"Stops then starts container."`
+	StatusCmd   StatusCmd   `cmd:"" name:"status" help:"Shows the container state, uptime, and image of every config."`
+	RebuildCmd  RebuildCmd  `cmd:"" name:"rebuild" help:"Builds new image, then destroys old container, and starts new container."`
+	RollbackCmd RollbackCmd `cmd:"" name:"rollback" help:"Destroys the container and starts it again from the previously built image."`
 
 	InstallCompletions kongplete.InstallCompletions `cmd:"" aliases:"sh" help:"Print shell autocompletions. Add output to dotfiles, or 'source <(./launcher2 sh)'."`
 }
 
+// Loads a config with its templates and overlays.
+func (cli *Cli) loadConfig(name string) (*config.Config, error) {
+	return config.Load(cli.ConfDir, name, config.LoadOptions{
+		IncludeTemplates: true,
+		TemplatesDirs:    cli.TemplatesDirs,
+		Overlays:         cli.Overlays,
+		EnvName:          cli.EnvName,
+		EnvFile:          cli.EnvFile,
+	})
+}
+
+func (cli *Cli) setupRuntime() error {
+	runtime, err := docker.NewRuntime(cli.Runtime, cli.Engine)
+	if err != nil {
+		return err
+	}
+	docker.ActiveRuntime = runtime
+	return nil
+}
+
 func main() {
 	cli := Cli{}
 	runCtx, cancel := context.WithCancel(context.Background())
@@ -57,6 +93,7 @@ func main() {
 
 	ctx, err := parser.Parse(os.Args[1:])
 	parser.FatalIfErrorf(err)
+	ctx.FatalIfErrorf(cli.setupRuntime())
 
 	defer cancel()
 	sigChan := make(chan os.Signal, 1)
@@ -76,7 +113,14 @@ func main() {
 	if err == nil {
 		return
 	}
-	if exiterr, ok := err.(*exec.ExitError); ok {
+	var unhealthy *docker.UnhealthyError
+	if errors.As(err, &unhealthy) {
+		fmt.Fprintln(os.Stderr, unhealthy.Error())
+		os.Exit(utils.UnhealthyExitCode)
+	}
+	// exit errors from either the docker cli or the engine api
+	var exiterr interface{ ExitCode() int }
+	if errors.As(err, &exiterr) {
 		// Magic exit code that indicates a retry
 		if exiterr.ExitCode() == 77 {
 			os.Exit(77)
@@ -0,0 +1,163 @@
+package test_utils
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+type FakeApiRequest struct {
+	Method string
+	Path   string
+	Query  url.Values
+	Header http.Header
+	Body   []byte
+}
+
+// A stand-in for the docker engine api. Records requests so tests can inspect them,
+// and answers with canned responses that can be overridden per endpoint.
+type FakeDockerApi struct {
+	Server *httptest.Server
+	// Output written to the stdout of attached containers, and returned from logs
+	Output string
+	// Exit code returned when waiting on containers
+	ExitCode int
+	// Containers returned when listing containers
+	Containers []map[string]any
+	// Stdin received by the last attached container
+	Stdin []byte
+
+	mu       sync.Mutex
+	requests []FakeApiRequest
+	handlers map[string]http.HandlerFunc
+}
+
+func NewFakeDockerApi() *FakeDockerApi {
+	api := &FakeDockerApi{
+		Containers: []map[string]any{},
+		handlers:   map[string]http.HandlerFunc{},
+	}
+	api.Server = httptest.NewServer(http.HandlerFunc(api.serve))
+	return api
+}
+
+// A DOCKER_HOST value pointing at the fake api.
+func (f *FakeDockerApi) Host() string {
+	return "tcp://" + f.Server.Listener.Addr().String()
+}
+
+func (f *FakeDockerApi) Close() {
+	f.Server.Close()
+}
+
+// Overrides the response for requests matching method and path, eg "POST", "/build".
+func (f *FakeDockerApi) Handle(method string, path string, handler http.HandlerFunc) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.handlers[method+" "+path] = handler
+}
+
+func (f *FakeDockerApi) Requests() []FakeApiRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]FakeApiRequest{}, f.requests...)
+}
+
+// Returns the requests made, as "METHOD /path" strings.
+func (f *FakeDockerApi) Calls() []string {
+	calls := []string{}
+	for _, r := range f.Requests() {
+		calls = append(calls, r.Method+" "+r.Path)
+	}
+	return calls
+}
+
+// Returns the last request made matching method and path.
+func (f *FakeDockerApi) LastRequest(method string, path string) *FakeApiRequest {
+	requests := f.Requests()
+	for i := len(requests) - 1; i >= 0; i-- {
+		if requests[i].Method == method && requests[i].Path == path {
+			return &requests[i]
+		}
+	}
+	return nil
+}
+
+func (f *FakeDockerApi) serve(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	if strings.HasPrefix(path, "/v1.") {
+		_, path, _ = strings.Cut(strings.TrimPrefix(path, "/"), "/")
+		path = "/" + path
+	}
+	request := FakeApiRequest{Method: r.Method, Path: path, Query: r.URL.Query(), Header: r.Header}
+	if !strings.HasSuffix(path, "/attach") {
+		request.Body, _ = io.ReadAll(r.Body)
+	}
+	f.mu.Lock()
+	f.requests = append(f.requests, request)
+	handler := f.handlers[r.Method+" "+path]
+	f.mu.Unlock()
+
+	if handler != nil {
+		handler(w, r)
+		return
+	}
+	switch {
+	case r.Method == "POST" && path == "/containers/create":
+		writeJson(w, http.StatusCreated, map[string]any{"Id": "fake-container-id"})
+	case r.Method == "GET" && path == "/containers/json":
+		writeJson(w, http.StatusOK, f.Containers)
+	case r.Method == "POST" && strings.HasSuffix(path, "/attach"):
+		f.attach(w, r)
+	case r.Method == "POST" && strings.HasSuffix(path, "/wait"):
+		writeJson(w, http.StatusOK, map[string]any{"StatusCode": f.ExitCode})
+	case r.Method == "GET" && strings.HasSuffix(path, "/logs"):
+		w.WriteHeader(http.StatusOK)
+		w.Write(MultiplexedFrame(1, f.Output))
+	case r.Method == "GET" && strings.HasPrefix(path, "/containers/") && strings.HasSuffix(path, "/json"):
+		writeJson(w, http.StatusOK, map[string]any{"Id": "fake-container-id", "Config": map[string]any{"Tty": false}})
+	case r.Method == "POST" && path == "/build":
+		writeJson(w, http.StatusOK, map[string]any{"stream": "Successfully built fake-image-id\n"})
+	case r.Method == "POST" && path == "/commit":
+		writeJson(w, http.StatusCreated, map[string]any{"Id": "fake-image-id"})
+	default:
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Hijacks the connection, reads stdin until the client closes its side, then writes Output and hangs up.
+func (f *FakeDockerApi) attach(w http.ResponseWriter, r *http.Request) {
+	conn, buf, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	buf.WriteString("HTTP/1.1 101 UPGRADED\r\nContent-Type: application/vnd.docker.raw-stream\r\nConnection: Upgrade\r\nUpgrade: tcp\r\n\r\n")
+	buf.Flush()
+	if r.URL.Query().Get("stdin") == "1" {
+		stdin, _ := io.ReadAll(buf)
+		f.mu.Lock()
+		f.Stdin = stdin
+		f.mu.Unlock()
+	}
+	conn.Write(MultiplexedFrame(1, f.Output))
+}
+
+// Encodes output in docker's multiplexed stream format, stream 1 being stdout and 2 stderr.
+func MultiplexedFrame(stream byte, output string) []byte {
+	frame := make([]byte, 8, 8+len(output))
+	frame[0] = stream
+	binary.BigEndian.PutUint32(frame[4:], uint32(len(output)))
+	return append(frame, output...)
+}
+
+func writeJson(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
@@ -11,6 +11,21 @@ const Version = "v2.0.0"
 
 const BaseImageName = "local_discourse/"
 
+// Label set on every image launcher builds, naming the config it was built for
+const ConfigLabel = "org.discourse.launcher.config"
+
+// Label set on images rebuild builds, holding the fingerprint of the config and base image they were built from
+const FingerprintLabel = "org.discourse.launcher.fingerprint"
+
+// Format of the tags that record each rebuild's image, so previous images can be rolled back to
+const BuildTagFormat = "20060102-150405"
+
+// Env keys matching these glob patterns are secrets, in addition to known secrets and a config's own secrets patterns
+var SecretPatterns = []string{
+	"*_PASSWORD",
+	"*_SECRET*",
+}
+
 // Known secrets, or otherwise not public info from config so we can build public images
 var KnownSecrets = []string{
 	"DISCOURSE_DB_HOST",
@@ -44,6 +59,16 @@ func findDockerPath() string {
 
 var DockerPath = findDockerPath()
 
+var PodmanPath, _ = exec.LookPath("podman")
+
 var Out io.Writer = os.Stdout
 
+var In io.Reader = os.Stdin
+
 var CommitWait = 2 * time.Second
+
+// How often a starting container is checked while waiting for it to become healthy
+var HealthPollInterval = 2 * time.Second
+
+// Exit code for containers that never become healthy after start, distinct from build and run failures
+const UnhealthyExitCode = 69
@@ -5,6 +5,7 @@ import (
 	"flag"
 	"io/ioutil"
 	"os"
+	"slices"
 	"strings"
 )
 
@@ -30,8 +31,12 @@ func FindConfigNames() []string {
 	confDirArg := flags.String("conf-dir", "./containers", "conf dir")
 	flags.Parse(flagLine)
 
-	// search in the current conf dir for any files
-	confDir := strings.TrimRight(*confDirArg, "/") + "/"
+	return FindConfigNamesIn(*confDirArg)
+}
+
+// Find the names of all configs in confDir.
+func FindConfigNamesIn(confDir string) []string {
+	confDir = strings.TrimRight(confDir, "/") + "/"
 	confFiles := []string{}
 	files, err := ioutil.ReadDir(confDir)
 	if err == nil {
@@ -47,5 +52,13 @@ func FindConfigNames() []string {
 			}
 		}
 	}
-	return confFiles
+	// {config}.{env}.yml files are overlays for an environment, not configs of their own
+	configs := []string{}
+	for _, name := range confFiles {
+		if base, _, found := strings.Cut(name, "."); found && slices.Contains(confFiles, base) {
+			continue
+		}
+		configs = append(configs, name)
+	}
+	return configs
 }
@@ -36,4 +36,8 @@ var _ = Describe("FindConfig", func() {
 		os.Setenv("COMP_LINE", "launcher2")
 		Expect(utils.FindConfigNames()).To(BeEmpty())
 	})
+
+	It("finds configs in a given dir", func() {
+		Expect(utils.FindConfigNamesIn("../test/containers")).To(Equal([]string{"standalone", "test", "test2", "web_only"}))
+	})
 })